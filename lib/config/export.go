@@ -70,6 +70,7 @@ var whitelist = map[string]bool{
 	"API.LogCreateRequestFraction":             false,
 	"API.MaxConcurrentRailsRequests":           false,
 	"API.MaxConcurrentRequests":                false,
+	"API.MaxFederationHops":                    false,
 	"API.MaxGatewayTunnels":                    false,
 	"API.MaxIndexDatabaseRead":                 false,
 	"API.MaxItemsPerResponse":                  true,
@@ -117,6 +118,8 @@ var whitelist = map[string]bool{
 	"Collections.ManagedProperties.*":          true,
 	"Collections.ManagedProperties.*.*":        true,
 	"Collections.PreserveVersionIfIdle":        true,
+	"Collections.RemotePDHCacheTTL":            false,
+	"Collections.RemotePDHSelection":           false,
 	"Collections.S3FolderObjects":              true,
 	"Collections.TrashSweepInterval":           false,
 	"Collections.TrustAllContent":              true,
@@ -216,10 +219,14 @@ var whitelist = map[string]bool{
 	"RemoteClusters":                                      true,
 	"RemoteClusters.*":                                    true,
 	"RemoteClusters.*.ActivateUsers":                      true,
+	"RemoteClusters.*.AttemptTimeout":                     false,
 	"RemoteClusters.*.Host":                               true,
 	"RemoteClusters.*.Insecure":                           true,
 	"RemoteClusters.*.Proxy":                              true,
+	"RemoteClusters.*.RequestTimeout":                     false,
+	"RemoteClusters.*.Retries":                            false,
 	"RemoteClusters.*.Scheme":                             true,
+	"RemoteClusters.*.Weight":                             false,
 	"Services":                                            true,
 	"Services.*":                                          true,
 	"Services.*.ExternalURL":                              true,
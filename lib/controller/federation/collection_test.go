@@ -6,9 +6,15 @@ package federation
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"sync"
+	"time"
 
+	"git.arvados.org/arvados.git/lib/controller/rpc"
 	"git.arvados.org/arvados.git/lib/ctrlctx"
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/arvadostest"
@@ -24,6 +30,31 @@ type collectionSuite struct {
 	FederationSuite
 }
 
+func (s *collectionSuite) TestRemoteErrorIdentifiesCluster(c *check.C) {
+	// zbbbb forwards to zcccc, which rejects the request.
+	s.addHTTPRemote(c, "zcccc", &arvadostest.APIStub{Error: httpserver.ErrorWithStatus(errors.New("not found"), http.StatusNotFound)})
+	zbbbbToZcccc := rpc.NewConn("zcccc", &url.URL{Scheme: "http", Host: s.cluster.RemoteClusters["zcccc"].Host}, true, rpc.PassthroughTokenProvider)
+	zbbbbToZcccc.LocalClusterID = "zbbbb"
+	s.addHTTPRemote(c, "zbbbb", zbbbbToZcccc)
+
+	for _, trial := range []struct {
+		remoteID string
+		origin   string
+		via      []string
+	}{
+		{"zcccc", "zcccc", []string{"aaaaa", "zcccc"}},
+		{"zbbbb", "zcccc", []string{"aaaaa", "zbbbb", "zcccc"}},
+	} {
+		_, err := s.fed.remotes[trial.remoteID].CollectionGet(s.ctx, arvados.GetOptions{UUID: "zcccc-4zz18-aaaaaaaaaaaaaaa"})
+		c.Check(errStatus(err), check.Equals, http.StatusNotFound)
+		var terr *arvados.TransactionError
+		if c.Check(errors.As(err, &terr), check.Equals, true, check.Commentf("%T %v", err, err)) {
+			c.Check(terr.ClusterID, check.Equals, trial.origin, check.Commentf("via %s", trial.remoteID))
+			c.Check(terr.Via, check.DeepEquals, trial.via, check.Commentf("via %s", trial.remoteID))
+		}
+	}
+}
+
 func (s *collectionSuite) TestMultipleBackendFailureStatus(c *check.C) {
 	nxPDH := "a4f995dd0c08216f37cb1bdec990f0cd+1234"
 	s.cluster.ClusterID = "local"
@@ -104,3 +135,336 @@ func (s *collectionSuite) TestMultipleBackendFailureStatus(c *check.C) {
 		c.Check(err.(httpserver.HTTPStatusError).HTTPStatus(), check.Equals, trial.expectStatus)
 	}
 }
+
+func (s *collectionSuite) TestRemotePDHCache(c *check.C) {
+	// The empty collection's PDH, because that's what
+	// APIStub.CollectionGet returns.
+	pdh := "d41d8cd98f00b204e9800998ecf8427e+0"
+	s.cluster.ClusterID = "local"
+	s.cluster.Collections.RemotePDHCacheTTL = arvados.Duration(time.Minute)
+	s.fed = New(s.ctx, s.cluster, nil, (&ctrlctx.DBConnector{PostgreSQL: s.cluster.PostgreSQL}).GetDB)
+	s.fed.local = &arvadostest.APIStub{Error: httpserver.ErrorWithStatus(fmt.Errorf("stub error 404"), http.StatusNotFound)}
+	stub := &arvadostest.APIStub{}
+	s.addDirectRemote(c, "z2222", stub)
+
+	for i := 0; i < 3; i++ {
+		_, err := s.fed.CollectionGet(s.ctx, arvados.GetOptions{UUID: pdh})
+		c.Check(err, check.IsNil)
+	}
+	c.Check(stub.Calls(stub.CollectionGet), check.HasLen, 1)
+
+	// A different token doesn't get the cached record.
+	ctx := auth.NewContext(s.ctx, &auth.Credentials{Tokens: []string{arvadostest.SpectatorToken}})
+	_, err := s.fed.CollectionGet(ctx, arvados.GetOptions{UUID: pdh})
+	c.Check(err, check.IsNil)
+	c.Check(stub.Calls(stub.CollectionGet), check.HasLen, 2)
+
+	// Mutable UUIDs are never cached.
+	for i := 0; i < 2; i++ {
+		_, err = s.fed.CollectionGet(s.ctx, arvados.GetOptions{UUID: "z2222-4zz18-aaaaaaaaaaaaaaa"})
+		c.Check(err, check.IsNil)
+	}
+	c.Check(stub.Calls(stub.CollectionGet), check.HasLen, 4)
+
+	// Cache entries expire before the signatures in the manifest
+	// get close to expiring.
+	exp := time.Now().Add(pdhCacheSignatureMargin + 2*time.Second).Truncate(time.Second)
+	mt := fmt.Sprintf(". d41d8cd98f00b204e9800998ecf8427e+0+Rz2222-%040x@%x 0:0:foo\n", 0, exp.Add(time.Hour).Unix()) +
+		fmt.Sprintf(". d41d8cd98f00b204e9800998ecf8427e+0+A%040x@%x 0:0:bar\n", 0, exp.Unix())
+	t, ok := earliestSignatureExpiry(mt)
+	c.Check(ok, check.Equals, true)
+	c.Check(t.Equal(exp), check.Equals, true)
+	var pc pdhCache
+	key := makePDHCacheKey(arvados.GetOptions{UUID: pdh}, nil)
+	pc.add(key, arvados.Collection{ManifestText: mt}, time.Minute)
+	_, ok = pc.get(key)
+	c.Check(ok, check.Equals, true)
+	time.Sleep(time.Until(exp.Add(-pdhCacheSignatureMargin)) + 10*time.Millisecond)
+	_, ok = pc.get(key)
+	c.Check(ok, check.Equals, false)
+
+	// A collection whose signatures are already too close to
+	// expiring is not cached at all.
+	mt = fmt.Sprintf(". d41d8cd98f00b204e9800998ecf8427e+0+A%040x@%x 0:0:bar\n", 0, time.Now().Add(pdhCacheSignatureMargin/2).Unix())
+	pc.add(key, arvados.Collection{ManifestText: mt}, time.Minute)
+	_, ok = pc.get(key)
+	c.Check(ok, check.Equals, false)
+}
+
+func (s *collectionSuite) TestRemotePDHCacheLocalFirst(c *check.C) {
+	pdh := "d41d8cd98f00b204e9800998ecf8427e+0"
+	s.cluster.ClusterID = "local"
+	s.cluster.Collections.RemotePDHCacheTTL = arvados.Duration(time.Minute)
+	s.fed = New(s.ctx, s.cluster, nil, (&ctrlctx.DBConnector{PostgreSQL: s.cluster.PostgreSQL}).GetDB)
+	local := &collectionTrashStub{APIStub: &arvadostest.APIStub{}}
+	s.fed.local = local
+	remote := &collectionTrashStub{APIStub: &arvadostest.APIStub{}, collections: []arvados.Collection{
+		{UUID: pdh, Name: "remote", Properties: map[string]interface{}{"foo": []interface{}{"bar"}}},
+	}}
+	s.addDirectRemote(c, "z2222", remote)
+
+	for i := 0; i < 3; i++ {
+		coll, err := s.fed.CollectionGet(s.ctx, arvados.GetOptions{UUID: pdh})
+		c.Assert(err, check.IsNil)
+		c.Check(coll.Name, check.Equals, "remote")
+		c.Check(coll.Properties, check.DeepEquals, map[string]interface{}{"foo": []interface{}{"bar"}})
+		// Modifying the returned record doesn't affect
+		// the cached one.
+		coll.Properties["foo"].([]interface{})[0] = "baz"
+		coll.Properties["new"] = "value"
+	}
+	c.Check(remote.Calls(remote.APIStub.CollectionGet), check.HasLen, 1)
+	// The local cluster is checked every time, before the cache.
+	c.Check(local.Calls(local.APIStub.CollectionGet), check.HasLen, 3)
+
+	// Once the collection is on the local cluster, the local
+	// record is returned instead of the cached remote one.
+	local.collections = []arvados.Collection{{UUID: pdh, Name: "local"}}
+	coll, err := s.fed.CollectionGet(s.ctx, arvados.GetOptions{UUID: pdh})
+	c.Assert(err, check.IsNil)
+	c.Check(coll.Name, check.Equals, "local")
+	c.Check(remote.Calls(remote.APIStub.CollectionGet), check.HasLen, 1)
+}
+
+func (s *collectionSuite) TestPDHCacheEviction(c *check.C) {
+	var pc pdhCache
+	keys := make([]pdhCacheKey, pdhCacheMaxEntries+1)
+	for i := range keys {
+		keys[i] = makePDHCacheKey(arvados.GetOptions{UUID: fmt.Sprintf("%032x+%d", i, i)}, nil)
+	}
+	for _, key := range keys[:pdhCacheMaxEntries] {
+		pc.add(key, arvados.Collection{}, time.Minute)
+	}
+	// Use the oldest entry, then add one more: the least
+	// recently used entry is evicted, and the rest remain.
+	_, ok := pc.get(keys[0])
+	c.Check(ok, check.Equals, true)
+	pc.add(keys[pdhCacheMaxEntries], arvados.Collection{}, time.Minute)
+	_, ok = pc.get(keys[1])
+	c.Check(ok, check.Equals, false)
+	for _, key := range append([]pdhCacheKey{keys[0]}, keys[2:]...) {
+		_, ok = pc.get(key)
+		c.Check(ok, check.Equals, true)
+	}
+}
+
+func (s *collectionSuite) TestRemotePDHSelection(c *check.C) {
+	// The empty collection's PDH, because that's what
+	// APIStub.CollectionGet returns.
+	pdh := "d41d8cd98f00b204e9800998ecf8427e+0"
+	s.cluster.ClusterID = "local"
+	notFound := httpserver.ErrorWithStatus(fmt.Errorf("stub error 404"), http.StatusNotFound)
+
+	for _, mode := range []string{"weighted", "roundrobin"} {
+		c.Logf("mode: %s", mode)
+		s.cluster.Collections.RemotePDHSelection = mode
+		s.fed = New(s.ctx, s.cluster, nil, (&ctrlctx.DBConnector{PostgreSQL: s.cluster.PostgreSQL}).GetDB)
+		s.fed.local = &arvadostest.APIStub{Error: notFound}
+		// z1111 doesn't have the PDH, z2222 and z3333 do.
+		stubs := map[string]*arvadostest.APIStub{
+			"z1111": {Error: notFound},
+			"z2222": {},
+			"z3333": {},
+		}
+		for id, stub := range stubs {
+			s.addDirectRemote(c, id, stub)
+		}
+		s.cluster.RemoteClusters["z1111"] = arvados.RemoteCluster{Weight: 1}
+		s.cluster.RemoteClusters["z2222"] = arvados.RemoteCluster{Weight: 3}
+		s.cluster.RemoteClusters["z3333"] = arvados.RemoteCluster{Weight: 1}
+
+		for i := 0; i < 60; i++ {
+			_, err := s.fed.CollectionGet(s.ctx, arvados.GetOptions{UUID: pdh})
+			c.Assert(err, check.IsNil)
+		}
+		// Each request stops at the first remote that has
+		// the PDH, and both of them get a share of the load.
+		n2 := len(stubs["z2222"].Calls(stubs["z2222"].CollectionGet))
+		n3 := len(stubs["z3333"].Calls(stubs["z3333"].CollectionGet))
+		c.Check(n2+n3, check.Equals, 60)
+		c.Check(n2 > 0, check.Equals, true)
+		c.Check(n3 > 0, check.Equals, true)
+		if mode == "roundrobin" {
+			// z1111 is tried first, then falls back to
+			// z2222, in 1/3 of requests.
+			c.Check(len(stubs["z1111"].Calls(nil)), check.Equals, 20)
+			c.Check(n2, check.Equals, 40)
+			c.Check(n3, check.Equals, 20)
+		} else {
+			c.Check(n2 > n3, check.Equals, true)
+		}
+
+		// A request forwarded from another cluster must not
+		// be forwarded again.
+		_, err := s.fed.CollectionGet(s.ctx, arvados.GetOptions{UUID: pdh, ForwardedFor: "z1111-"})
+		c.Check(err.(httpserver.HTTPStatusError).HTTPStatus(), check.Equals, http.StatusNotFound)
+		c.Check(len(stubs["z2222"].Calls(nil))+len(stubs["z3333"].Calls(nil)), check.Equals, 60)
+	}
+
+	// When no remote has the PDH, all of them are tried and the
+	// result is 404.
+	s.cluster.Collections.RemotePDHSelection = "weighted"
+	s.fed = New(s.ctx, s.cluster, nil, (&ctrlctx.DBConnector{PostgreSQL: s.cluster.PostgreSQL}).GetDB)
+	s.fed.local = &arvadostest.APIStub{Error: notFound}
+	var stubs []*arvadostest.APIStub
+	for _, id := range []string{"z1111", "z2222", "z3333"} {
+		stub := &arvadostest.APIStub{Error: notFound}
+		stubs = append(stubs, stub)
+		s.addDirectRemote(c, id, stub)
+	}
+	_, err := s.fed.CollectionGet(s.ctx, arvados.GetOptions{UUID: pdh})
+	c.Check(err.(httpserver.HTTPStatusError).HTTPStatus(), check.Equals, http.StatusNotFound)
+	for _, stub := range stubs {
+		c.Check(stub.Calls(nil), check.HasLen, 1)
+	}
+}
+
+// collectionTrashStub is an APIStub that holds some collections,
+// for testing CollectionTrashFederated.
+type collectionTrashStub struct {
+	*arvadostest.APIStub
+	mtx         sync.Mutex
+	collections []arvados.Collection
+}
+
+func (stub *collectionTrashStub) UserGetCurrent(ctx context.Context, options arvados.GetOptions) (arvados.User, error) {
+	_, err := stub.APIStub.UserGetCurrent(ctx, options)
+	if err != nil {
+		return arvados.User{}, err
+	}
+	return arvados.User{UUID: arvadostest.ActiveUserUUID}, nil
+}
+
+func (stub *collectionTrashStub) CollectionGet(ctx context.Context, options arvados.GetOptions) (arvados.Collection, error) {
+	stub.APIStub.CollectionGet(ctx, options)
+	stub.mtx.Lock()
+	defer stub.mtx.Unlock()
+	for _, coll := range stub.collections {
+		if coll.UUID == options.UUID && (options.IncludeTrash || !coll.IsTrashed) {
+			return coll, nil
+		}
+	}
+	return arvados.Collection{}, httpserver.ErrorWithStatus(fmt.Errorf("not found"), http.StatusNotFound)
+}
+
+func (stub *collectionTrashStub) CollectionList(ctx context.Context, options arvados.ListOptions) (arvados.CollectionList, error) {
+	_, err := stub.APIStub.CollectionList(ctx, options)
+	if err != nil {
+		return arvados.CollectionList{}, err
+	}
+	stub.mtx.Lock()
+	defer stub.mtx.Unlock()
+	var resp arvados.CollectionList
+	for _, coll := range stub.collections {
+		if !coll.IsTrashed &&
+			coll.PortableDataHash == options.Filters[0].Operand &&
+			coll.UUID > options.Filters[1].Operand.(string) {
+			resp.Items = append(resp.Items, coll)
+		}
+	}
+	return resp, nil
+}
+
+func (stub *collectionTrashStub) CollectionTrash(ctx context.Context, options arvados.DeleteOptions) (arvados.Collection, error) {
+	_, err := stub.APIStub.CollectionTrash(ctx, options)
+	if err != nil {
+		return arvados.Collection{}, err
+	}
+	stub.mtx.Lock()
+	defer stub.mtx.Unlock()
+	for i, coll := range stub.collections {
+		if coll.UUID == options.UUID {
+			stub.collections[i].IsTrashed = true
+			return stub.collections[i], nil
+		}
+	}
+	return arvados.Collection{}, httpserver.ErrorWithStatus(fmt.Errorf("not found"), http.StatusNotFound)
+}
+
+func (s *collectionSuite) TestCollectionTrashFederated(c *check.C) {
+	pdh := "fa7aeb5140e2848d39b416daeef4ffc5+45"
+	otherPDH := "d41d8cd98f00b204e9800998ecf8427e+0"
+	s.cluster.ClusterID = "local"
+	s.fed = New(s.ctx, s.cluster, nil, (&ctrlctx.DBConnector{PostgreSQL: s.cluster.PostgreSQL}).GetDB)
+	local := &collectionTrashStub{APIStub: &arvadostest.APIStub{}, collections: []arvados.Collection{
+		{UUID: "local-4zz18-000000000000001", PortableDataHash: pdh},
+		{UUID: "local-4zz18-000000000000002", PortableDataHash: pdh},
+	}}
+	s.fed.local = local
+	writable := []string{"zzzzz-j7d0g-000000000000000", arvadostest.ActiveUserUUID}
+	z1111 := &collectionTrashStub{APIStub: &arvadostest.APIStub{}, collections: []arvados.Collection{
+		{UUID: "z1111-4zz18-000000000000001", PortableDataHash: pdh, WritableBy: writable},
+		{UUID: "z1111-4zz18-000000000000002", PortableDataHash: otherPDH, WritableBy: writable},
+		{UUID: "z1111-4zz18-000000000000003", PortableDataHash: pdh, WritableBy: writable},
+		// Cached copy of a z2222 collection: z1111
+		// won't trash it, and we don't ask it to.
+		{UUID: "z2222-4zz18-000000000000001", PortableDataHash: pdh, WritableBy: writable},
+		// Shared with the caller, but read-only: left
+		// alone.
+		{UUID: "z1111-4zz18-000000000000004", PortableDataHash: pdh, WritableBy: []string{"zzzzz-j7d0g-000000000000000"}},
+	}}
+	s.addDirectRemote(c, "z1111", z1111)
+	// Caller doesn't have permission to list collections on z2222
+	z2222 := &collectionTrashStub{APIStub: &arvadostest.APIStub{Error: httpserver.ErrorWithStatus(fmt.Errorf("stub error 403"), http.StatusForbidden)}}
+	s.addDirectRemote(c, "z2222", z2222)
+
+	resp, err := s.fed.CollectionTrashFederated(s.ctx, arvados.DeleteOptions{UUID: "local-4zz18-000000000000001"})
+	c.Assert(err, check.IsNil)
+	c.Check(resp.Clusters["local"].UUIDs, check.DeepEquals, []string{"local-4zz18-000000000000001"})
+	c.Check(resp.Clusters["local"].Error, check.Equals, "")
+	c.Check(resp.Clusters["z1111"].UUIDs, check.DeepEquals, []string{"z1111-4zz18-000000000000001", "z1111-4zz18-000000000000003"})
+	c.Check(resp.Clusters["z1111"].Error, check.Equals, "")
+	c.Check(resp.Clusters["z2222"].UUIDs, check.HasLen, 0)
+	c.Check(resp.Clusters["z2222"].Error, check.Matches, `.*stub error 403.*`)
+	// Only the requested collection is trashed on the home
+	// cluster.
+	c.Check(local.collections[1].IsTrashed, check.Equals, false)
+	c.Check(z1111.collections[1].IsTrashed, check.Equals, false)
+	c.Check(z1111.collections[3].IsTrashed, check.Equals, false)
+	c.Check(z1111.collections[4].IsTrashed, check.Equals, false)
+	for _, call := range z1111.Calls(z1111.APIStub.CollectionList) {
+		c.Check(call.Options.(arvados.ListOptions).ForwardedFor, check.Equals, "local-")
+	}
+
+	// Running again is harmless.
+	resp, err = s.fed.CollectionTrashFederated(s.ctx, arvados.DeleteOptions{UUID: "local-4zz18-000000000000001"})
+	c.Assert(err, check.IsNil)
+	c.Check(resp.Clusters["local"].UUIDs, check.DeepEquals, []string{"local-4zz18-000000000000001"})
+	c.Check(resp.Clusters["z1111"].UUIDs, check.HasLen, 0)
+	c.Check(resp.Clusters["z1111"].Error, check.Equals, "")
+	c.Check(z1111.Calls(z1111.APIStub.CollectionTrash), check.HasLen, 2)
+}
+
+func (s *collectionSuite) TestCollectionTrashFederatedPartialFailure(c *check.C) {
+	pdh := "fa7aeb5140e2848d39b416daeef4ffc5+45"
+	s.cluster.ClusterID = "local"
+	s.fed = New(s.ctx, s.cluster, nil, (&ctrlctx.DBConnector{PostgreSQL: s.cluster.PostgreSQL}).GetDB)
+	s.fed.local = &collectionTrashStub{APIStub: &arvadostest.APIStub{}, collections: []arvados.Collection{
+		{UUID: "local-4zz18-000000000000001", PortableDataHash: pdh},
+	}}
+	z2222 := &collectionTrashStub{APIStub: &arvadostest.APIStub{Error: httpserver.ErrorWithStatus(fmt.Errorf("stub error 502"), http.StatusBadGateway)}}
+	s.addDirectRemote(c, "z2222", z2222)
+	z3333 := &collectionTrashStub{APIStub: &arvadostest.APIStub{}, collections: []arvados.Collection{
+		{UUID: "z3333-4zz18-000000000000001", PortableDataHash: pdh, WritableBy: []string{arvadostest.ActiveUserUUID}},
+	}}
+	s.addDirectRemote(c, "z3333", z3333)
+
+	resp, err := s.fed.CollectionTrashFederated(s.ctx, arvados.DeleteOptions{UUID: "local-4zz18-000000000000001"})
+	c.Assert(err, check.IsNil)
+	c.Check(resp.Failed(), check.DeepEquals, []string{"z2222"})
+	c.Check(resp.Clusters["z2222"].UUIDs, check.HasLen, 0)
+	c.Check(resp.Clusters["z2222"].Error, check.Matches, `.*stub error 502.*`)
+	c.Check(resp.Clusters["z2222"].HTTPStatus, check.Equals, http.StatusBadGateway)
+	c.Check(resp.Clusters["z3333"].UUIDs, check.DeepEquals, []string{"z3333-4zz18-000000000000001"})
+	c.Check(resp.Clusters["z3333"].Error, check.Equals, "")
+	c.Check(z3333.collections[0].IsTrashed, check.Equals, true)
+
+	// The response survives a round trip through JSON, so
+	// callers of the API see the same per-cluster outcomes.
+	buf, err := json.Marshal(resp)
+	c.Assert(err, check.IsNil)
+	var decoded arvados.MultiClusterResponse
+	c.Assert(json.Unmarshal(buf, &decoded), check.IsNil)
+	c.Check(decoded, check.DeepEquals, resp)
+	c.Check(string(buf), check.Matches, `.*"z2222":\{"uuids":\[\],"error":"[^"]*stub error 502[^"]*","http_status":502\}.*`)
+}
@@ -10,11 +10,15 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"git.arvados.org/arvados.git/lib/config"
@@ -25,6 +29,7 @@ import (
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
 	"git.arvados.org/arvados.git/sdk/go/health"
 	"github.com/jmoiron/sqlx"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type Conn struct {
@@ -32,6 +37,12 @@ type Conn struct {
 	cluster *arvados.Cluster
 	local   backend
 	remotes map[string]backend
+
+	// next starting position for RemotePDHSelection=roundrobin
+	roundrobin uint64
+
+	// collections recently retrieved by PDH from remotes
+	pdhCache pdhCache
 }
 
 func New(bgCtx context.Context, cluster *arvados.Cluster, healthFuncs *map[string]health.Func, getdb func(context.Context) (*sqlx.DB, error)) *Conn {
@@ -41,10 +52,16 @@ func New(bgCtx context.Context, cluster *arvados.Cluster, healthFuncs *map[strin
 		if !remote.Proxy || id == cluster.ClusterID {
 			continue
 		}
-		conn := rpc.NewConn(id, &url.URL{Scheme: remote.Scheme, Host: remote.Host}, remote.Insecure, saltedTokenProvider(cluster, local, id))
+		conn := rpc.NewConn(id, &url.URL{Scheme: remote.Scheme, Host: remote.Host}, remote.Insecure, saltedTokenProvider(cluster, local, id, false))
+		conn.RefreshTokens = saltedTokenProvider(cluster, local, id, true)
 		// Older versions of controller rely on the Via header
 		// to detect loops.
 		conn.SendHeader = http.Header{"Via": {"HTTP/1.1 arvados-controller"}}
+		conn.LocalClusterID = cluster.ClusterID
+		conn.MaxHops = cluster.API.MaxFederationHops
+		conn.Retries = remote.Retries
+		conn.AttemptTimeout = remote.AttemptTimeout.Duration()
+		conn.Timeout = remote.RequestTimeout.Duration()
 		remotes[id] = conn
 	}
 
@@ -61,11 +78,29 @@ func New(bgCtx context.Context, cluster *arvados.Cluster, healthFuncs *map[strin
 	}
 }
 
+// RegisterMetrics records requests sent to remote clusters in
+// metrics registered with reg.
+func (conn *Conn) RegisterMetrics(reg *prometheus.Registry) {
+	m := rpc.NewMetrics(reg)
+	for _, be := range conn.remotes {
+		if be, ok := be.(*rpc.Conn); ok {
+			be.Metrics = m
+		}
+	}
+}
+
 // Return a new rpc.TokenProvider that takes the client-provided
 // tokens from an incoming request context, determines whether they
 // should (and can) be salted for the given remoteID, and returns the
 // resulting tokens.
-func saltedTokenProvider(cluster *arvados.Cluster, local backend, remoteID string) rpc.TokenProvider {
+//
+// If refresh is true, every token that isn't already salted is
+// re-derived by looking up its current record on the local cluster
+// (which, in a LoginCluster federation, asks the login cluster), as
+// is otherwise done only for obsolete tokens. This is used to retry a
+// request after the remote reports that the token it was sent has
+// expired (see rpc.Conn.RefreshTokens).
+func saltedTokenProvider(cluster *arvados.Cluster, local backend, remoteID string, refresh bool) rpc.TokenProvider {
 	return func(ctx context.Context) ([]string, error) {
 		var tokens []string
 		incoming, ok := auth.FromContext(ctx)
@@ -87,6 +122,9 @@ func saltedTokenProvider(cluster *arvados.Cluster, local backend, remoteID strin
 				return nil, httpErrorf(http.StatusUnauthorized, "cannot use a locally issued token to forward a request to our login cluster (%s)", remoteID)
 			}
 			salted, err := auth.SaltToken(token, remoteID)
+			if refresh && ((err == nil && salted != token) || err == auth.ErrTokenFormat) {
+				err = auth.ErrObsoleteToken
+			}
 			switch err {
 			case nil:
 				tokens = append(tokens, salted)
@@ -98,7 +136,7 @@ func saltedTokenProvider(cluster *arvados.Cluster, local backend, remoteID strin
 			case auth.ErrObsoleteToken:
 				ctx := auth.NewContext(ctx, &auth.Credentials{Tokens: []string{token}})
 				aca, err := local.APIClientAuthorizationCurrent(ctx, arvados.GetOptions{})
-				if errStatus(err) == http.StatusUnauthorized {
+				if errStatus(err) == http.StatusUnauthorized && !refresh {
 					// pass through unmodified
 					tokens = append(tokens, token)
 					continue
@@ -179,7 +217,6 @@ func (conn *Conn) tryLocalThenRemotes(ctx context.Context, forwardedFor string,
 			errchan <- fn(ctx, remoteID, be)
 		}()
 	}
-	returncode := http.StatusNotFound
 	var errs []error
 	for i := 0; i < cap(errchan); i++ {
 		err := <-errchan
@@ -187,6 +224,70 @@ func (conn *Conn) tryLocalThenRemotes(ctx context.Context, forwardedFor string,
 			return nil
 		}
 		errs = append(errs, err)
+	}
+	return remoteErrors(errs)
+}
+
+// Call fn with the local backend; then, if fn returned 404, call fn
+// on the available remote backends one at a time, in the order
+// determined by Collections.RemotePDHSelection, until one succeeds.
+//
+// Arguments and return value are the same as tryLocalThenRemotes.
+func (conn *Conn) tryLocalThenRemotesInOrder(ctx context.Context, forwardedFor string, fn func(context.Context, string, backend) error) error {
+	if err := fn(ctx, "", conn.local); err == nil || errStatus(err) != http.StatusNotFound || forwardedFor != "" {
+		// See tryLocalThenRemotes
+		return err
+	}
+	var errs []error
+	for _, remoteID := range conn.remoteOrder() {
+		err := fn(ctx, remoteID, conn.remotes[remoteID])
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	return remoteErrors(errs)
+}
+
+// remoteOrder returns the IDs of the remote backends, in the order
+// they should be tried according to
+// Collections.RemotePDHSelection.
+func (conn *Conn) remoteOrder() []string {
+	ids := make([]string, 0, len(conn.remotes))
+	for id := range conn.remotes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if len(ids) == 0 {
+		return ids
+	}
+	switch conn.cluster.Collections.RemotePDHSelection {
+	case "roundrobin":
+		start := int((atomic.AddUint64(&conn.roundrobin, 1) - 1) % uint64(len(ids)))
+		return append(ids[start:], ids[:start]...)
+	default:
+		// Weighted random order: sort by r^(1/weight) for
+		// uniform random r, descending. Weight 0 sorts last.
+		keys := make(map[string]float64, len(ids))
+		for _, id := range ids {
+			if w := conn.cluster.RemoteClusters[id].Weight; w > 0 {
+				keys[id] = math.Pow(rand.Float64(), 1/float64(w))
+			} else {
+				keys[id] = -1
+			}
+		}
+		sort.SliceStable(ids, func(i, j int) bool {
+			return keys[ids[i]] > keys[ids[j]]
+		})
+		return ids
+	}
+}
+
+// remoteErrors returns a suitable error for a request that failed
+// on all remote backends, with the given errors.
+func remoteErrors(errs []error) error {
+	returncode := http.StatusNotFound
+	for _, err := range errs {
 		if code := errStatus(err); code >= 500 || code == http.StatusTooManyRequests {
 			// If any of the remotes have a retryable
 			// error (and none succeed) we'll return 502.
@@ -338,11 +439,35 @@ func (conn *Conn) CollectionGet(ctx context.Context, options arvados.GetOptions)
 		return arvados.Collection{}, httpErrorf(http.StatusNotFound, "invalid UUID or PDH %q", options.UUID)
 	}
 	// UUID is a PDH
+	var cacheKey pdhCacheKey
+	cacheTTL := conn.cluster.Collections.RemotePDHCacheTTL.Duration()
+	useCache := cacheTTL > 0 && options.ForwardedFor == ""
+	if useCache {
+		var tokens []string
+		if creds, ok := auth.FromContext(ctx); ok {
+			tokens = creds.Tokens
+		}
+		cacheKey = makePDHCacheKey(options, tokens)
+	}
+	try := conn.tryLocalThenRemotes
+	if conn.cluster.Collections.RemotePDHSelection != "" {
+		try = conn.tryLocalThenRemotesInOrder
+	}
 	first := make(chan arvados.Collection, 1)
-	err := conn.tryLocalThenRemotes(ctx, options.ForwardedFor, func(ctx context.Context, remoteID string, be backend) error {
+	err := try(ctx, options.ForwardedFor, func(ctx context.Context, remoteID string, be backend) error {
 		remoteOpts := options
 		remoteOpts.ForwardedFor = conn.cluster.ClusterID + "-" + options.ForwardedFor
 		c, err := be.CollectionGet(ctx, remoteOpts)
+		if remoteID == "" && useCache && errStatus(err) == http.StatusNotFound {
+			// Not found locally. The cache only holds
+			// remote responses, so it is consulted
+			// after the local cluster but before the
+			// remotes.
+			if c, ok := conn.pdhCache.get(cacheKey); ok {
+				first <- c
+				return nil
+			}
+		}
 		if err != nil {
 			return err
 		}
@@ -372,6 +497,9 @@ func (conn *Conn) CollectionGet(ctx context.Context, options arvados.GetOptions)
 		}
 		select {
 		case first <- c:
+			if remoteID != "" && useCache {
+				conn.pdhCache.add(cacheKey, c, cacheTTL)
+			}
 			return nil
 		default:
 			// lost race, return value doesn't matter
@@ -408,6 +536,136 @@ func (conn *Conn) CollectionUntrash(ctx context.Context, options arvados.Untrash
 	return conn.chooseBackend(options.UUID).CollectionUntrash(ctx, options)
 }
 
+// CollectionTrashFederated trashes the given collection on its home
+// cluster, then trashes the collections on the other clusters in the
+// federation that have the same portable data hash, using the
+// caller's (salted) token on each cluster. Collections the caller
+// cannot modify on a given cluster (according to the remote
+// cluster's writable_by response) are left alone. Errors are
+// reported in that cluster's outcome; a failure on one cluster does
+// not affect the others.
+//
+// Collections that are already trashed or deleted are skipped, so
+// it is safe to call CollectionTrashFederated again after a partial
+// failure.
+func (conn *Conn) CollectionTrashFederated(ctx context.Context, options arvados.DeleteOptions) (arvados.MultiClusterResponse, error) {
+	resp := arvados.MultiClusterResponse{Clusters: map[string]arvados.ClusterOutcome{}}
+	if len(options.UUID) != 27 {
+		return resp, httpErrorf(http.StatusBadRequest, "invalid collection UUID %q", options.UUID)
+	}
+	homeID := options.UUID[:5]
+	home := conn.chooseBackend(homeID)
+	coll, err := home.CollectionGet(ctx, arvados.GetOptions{
+		UUID:         options.UUID,
+		Select:       []string{"uuid", "portable_data_hash"},
+		IncludeTrash: true,
+	})
+	if err != nil {
+		return resp, err
+	}
+	_, err = home.CollectionTrash(ctx, options)
+	if err != nil {
+		return resp, err
+	}
+	resp.Clusters[homeID] = arvados.ClusterOutcome{UUIDs: []string{coll.UUID}}
+
+	backends := map[string]backend{conn.cluster.ClusterID: conn.local}
+	for id, be := range conn.remotes {
+		backends[id] = be
+	}
+	delete(backends, homeID)
+
+	var mtx sync.Mutex
+	var wg sync.WaitGroup
+	for id, be := range backends {
+		id, be := id, be
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			outcome := conn.trashCopies(ctx, id, be, coll)
+			mtx.Lock()
+			defer mtx.Unlock()
+			resp.Clusters[id] = outcome
+		}()
+	}
+	wg.Wait()
+	return resp, nil
+}
+
+// trashCopies trashes the collections on the given cluster that have
+// the same portable data hash as orig and are writable by the caller.
+func (conn *Conn) trashCopies(ctx context.Context, clusterID string, be backend, orig arvados.Collection) arvados.ClusterOutcome {
+	outcome := arvados.ClusterOutcome{UUIDs: []string{}}
+	user, err := be.UserGetCurrent(ctx, arvados.GetOptions{})
+	if err != nil {
+		outcome.Error = err.Error()
+		outcome.HTTPStatus = errStatus(err)
+		return outcome
+	}
+	var uuids []string
+	last := ""
+	for {
+		list, err := be.CollectionList(ctx, arvados.ListOptions{
+			Filters: []arvados.Filter{
+				{"portable_data_hash", "=", orig.PortableDataHash},
+				{"uuid", ">", last},
+			},
+			Select:       []string{"uuid", "writable_by"},
+			Order:        []string{"uuid"},
+			Count:        "none",
+			Limit:        1000,
+			ForwardedFor: conn.cluster.ClusterID + "-",
+		})
+		if err != nil {
+			outcome.Error = err.Error()
+			outcome.HTTPStatus = errStatus(err)
+			return outcome
+		}
+		if len(list.Items) == 0 {
+			break
+		}
+		for _, c := range list.Items {
+			// A collection whose UUID belongs to a third
+			// cluster is handled when we visit that
+			// cluster.
+			if !strings.HasPrefix(c.UUID, clusterID+"-") {
+				continue
+			}
+			// Don't trash collections that are merely
+			// shared with the caller (e.g., a read-only
+			// collection in someone else's project).
+			writable := user.IsAdmin
+			for _, uuid := range c.WritableBy {
+				if uuid == user.UUID {
+					writable = true
+				}
+			}
+			if !writable {
+				continue
+			}
+			uuids = append(uuids, c.UUID)
+		}
+		last = list.Items[len(list.Items)-1].UUID
+	}
+	var errs []string
+	for _, uuid := range uuids {
+		_, err := be.CollectionTrash(ctx, arvados.DeleteOptions{UUID: uuid})
+		if errStatus(err) == http.StatusNotFound {
+			// Deleted since we listed it
+			continue
+		} else if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", uuid, err))
+			if outcome.HTTPStatus == 0 {
+				outcome.HTTPStatus = errStatus(err)
+			}
+			continue
+		}
+		outcome.UUIDs = append(outcome.UUIDs, uuid)
+	}
+	outcome.Error = strings.Join(errs, "; ")
+	return outcome
+}
+
 func (conn *Conn) ContainerList(ctx context.Context, options arvados.ListOptions) (arvados.ContainerList, error) {
 	return conn.generated_ContainerList(ctx, options)
 }
@@ -0,0 +1,59 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package federation
+
+import (
+	"net/http"
+
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	"git.arvados.org/arvados.git/sdk/go/auth"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&TokenProviderSuite{})
+
+type TokenProviderSuite struct {
+	FederationSuite
+}
+
+func (s *TokenProviderSuite) TestSaltedTokenProvider(c *check.C) {
+	saltedActive, err := auth.SaltToken(arvadostest.ActiveTokenV2, "zmock")
+	c.Assert(err, check.IsNil)
+	bogus := "v2/zzzzz-gj3su-000000000000000/bogussecretbogussecretbogussecret"
+	saltedBogus, err := auth.SaltToken(bogus, "zmock")
+	c.Assert(err, check.IsNil)
+
+	for _, trial := range []struct {
+		token         string
+		expect        string // salted with refresh=false
+		expectRefresh string // salted with refresh=true, or "" if an error is expected
+	}{
+		{arvadostest.ActiveTokenV2, saltedActive, saltedActive},
+		{arvadostest.ActiveToken, saltedActive, saltedActive},
+		{saltedActive, saltedActive, saltedActive},
+		// A token that the local cluster doesn't accept is
+		// salted without a lookup, but can't be refreshed.
+		{bogus, saltedBogus, ""},
+		// An unrecognized token (e.g., an OIDC access token)
+		// is passed through, but can't be refreshed unless
+		// the local cluster accepts it.
+		{"bogus.oidc.token", "bogus.oidc.token", ""},
+	} {
+		comment := check.Commentf("token %q", trial.token)
+		ctx := auth.NewContext(s.ctx, &auth.Credentials{Tokens: []string{trial.token}})
+
+		tokens, err := saltedTokenProvider(s.cluster, s.fed.local, "zmock", false)(ctx)
+		c.Check(err, check.IsNil, comment)
+		c.Check(tokens, check.DeepEquals, []string{trial.expect}, comment)
+
+		tokens, err = saltedTokenProvider(s.cluster, s.fed.local, "zmock", true)(ctx)
+		if trial.expectRefresh == "" {
+			c.Check(errStatus(err), check.Equals, http.StatusUnauthorized, comment)
+		} else {
+			c.Check(err, check.IsNil, comment)
+			c.Check(tokens, check.DeepEquals, []string{trial.expectRefresh}, comment)
+		}
+	}
+}
@@ -86,12 +86,14 @@ func (s *FederationSuite) addDirectRemote(c *check.C, id string, backend backend
 
 func (s *FederationSuite) addHTTPRemote(c *check.C, id string, backend backend) {
 	srv := httpserver.Server{Addr: ":"}
-	srv.Handler = router.New(backend, router.Config{})
+	srv.Handler = router.New(backend, router.Config{ClusterID: id})
 	c.Check(srv.Start(), check.IsNil)
 	s.cluster.RemoteClusters[id] = arvados.RemoteCluster{
 		Scheme: "http",
 		Host:   srv.Addr,
 		Proxy:  true,
 	}
-	s.fed.remotes[id] = rpc.NewConn(id, &url.URL{Scheme: "http", Host: srv.Addr}, true, saltedTokenProvider(s.cluster, s.fed.local, id))
+	conn := rpc.NewConn(id, &url.URL{Scheme: "http", Host: srv.Addr}, true, saltedTokenProvider(s.cluster, s.fed.local, id, false))
+	conn.LocalClusterID = s.cluster.ClusterID
+	s.fed.remotes[id] = conn
 }
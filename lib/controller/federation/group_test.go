@@ -22,7 +22,12 @@ type GroupSuite struct {
 func makeConn() (*Conn, *arvadostest.APIStub, *arvadostest.APIStub) {
 	localAPIstub := &arvadostest.APIStub{Error: errors.New("No result")}
 	remoteAPIstub := &arvadostest.APIStub{Error: errors.New("No result")}
-	return &Conn{context.Background(), &arvados.Cluster{ClusterID: "local"}, localAPIstub, map[string]backend{"zzzzz": remoteAPIstub}}, localAPIstub, remoteAPIstub
+	return &Conn{
+		bgCtx:   context.Background(),
+		cluster: &arvados.Cluster{ClusterID: "local"},
+		local:   localAPIstub,
+		remotes: map[string]backend{"zzzzz": remoteAPIstub},
+	}, localAPIstub, remoteAPIstub
 }
 
 func (s *UserSuite) TestGroupContents(c *check.C) {
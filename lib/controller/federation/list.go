@@ -76,8 +76,13 @@ func (conn *Conn) generated_CollectionList(ctx context.Context, options arvados.
 // (If opts doesn't indicate a federation-wide list query, fn is just
 // called once with the local backend.)
 //
-// fn is called more than once only if the query meets the following
-// restrictions:
+// If all of the supplied UUIDs belong to a single cluster, fn is
+// called once with that cluster's backend and the unmodified opts, so
+// all filters, order, count, etc. are honored just as they would be
+// in a query sent directly to that cluster.
+//
+// Otherwise, fn is called more than once only if the query meets the
+// following restrictions:
 //
 //   - Count=="none"
 //
@@ -197,12 +202,22 @@ func (conn *Conn) splitListRequest(ctx context.Context, opts arvados.ListOptions
 	if len(todoByRemote) == 0 {
 		return nil
 	}
-	if len(todoByRemote) == 1 && todoByRemote[conn.cluster.ClusterID] != nil {
-		// All UUIDs are local, so proxy a single request. The
-		// generic case has some limitations (see below) which
-		// we don't want to impose on local requests.
-		_, err := fn(ctx, conn.cluster.ClusterID, conn.local, opts)
-		return err
+	if len(todoByRemote) == 1 {
+		// All UUIDs are on a single cluster, so proxy a
+		// single request with the caller's options intact.
+		// The generic case has some limitations (see below)
+		// which we don't want to impose on single-cluster
+		// requests.
+		for clusterID := range todoByRemote {
+			backend := conn.local
+			if clusterID != conn.cluster.ClusterID {
+				if backend = conn.remotes[clusterID]; backend == nil {
+					return httpErrorf(http.StatusNotFound, "cannot execute federated list query: no proxy available for cluster %q", clusterID)
+				}
+			}
+			_, err := fn(ctx, clusterID, backend, opts)
+			return err
+		}
 	}
 	if cannotSplit {
 		return httpErrorf(http.StatusBadRequest, "cannot execute federated list query: each filter must be either 'uuid = ...' or 'uuid in [...]'")
@@ -237,7 +252,7 @@ func (conn *Conn) splitListRequest(ctx context.Context, opts arvados.ListOptions
 				return
 			}
 			remoteOpts := opts
-			if remoteOpts.Select != nil {
+			if remoteOpts.Select != nil && !selectsUUID(remoteOpts.Select) {
 				// We always need to select UUIDs to
 				// use the response, even if our
 				// caller doesn't.
@@ -293,6 +308,15 @@ func (conn *Conn) splitListRequest(ctx context.Context, opts arvados.ListOptions
 	return firstErr
 }
 
+func selectsUUID(sel []string) bool {
+	for _, attr := range sel {
+		if attr == "uuid" {
+			return true
+		}
+	}
+	return false
+}
+
 func httpErrorf(code int, format string, args ...interface{}) error {
 	return httpserver.ErrorWithStatus(fmt.Errorf(format, args...), code)
 }
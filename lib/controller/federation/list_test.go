@@ -54,7 +54,17 @@ nextfilter:
 
 func (cl *collectionLister) CollectionList(ctx context.Context, options arvados.ListOptions) (resp arvados.CollectionList, _ error) {
 	cl.APIStub.CollectionList(ctx, options)
-	for _, c := range cl.ItemsToReturn {
+	items := cl.ItemsToReturn
+	if reflect.DeepEqual(options.Order, []string{"uuid desc"}) {
+		items = nil
+		for i := len(cl.ItemsToReturn) - 1; i >= 0; i-- {
+			items = append(items, cl.ItemsToReturn[i])
+		}
+	} else if len(options.Order) > 0 {
+		panic(fmt.Sprintf("not implemented: options=%#v", options))
+	}
+	skip := options.Offset
+	for _, c := range items {
 		if cl.MaxPageSize > 0 && len(resp.Items) >= cl.MaxPageSize {
 			break
 		}
@@ -62,6 +72,10 @@ func (cl *collectionLister) CollectionList(ctx context.Context, options arvados.
 			break
 		}
 		if cl.matchFilters(c, options.Filters) {
+			if skip > 0 {
+				skip--
+				continue
+			}
 			if reflect.DeepEqual(options.Select, []string{"uuid", "name"}) {
 				c = arvados.Collection{UUID: c.UUID, Name: c.Name}
 			} else if reflect.DeepEqual(options.Select, []string{"name"}) {
@@ -191,11 +205,35 @@ func (s *CollectionListSuite) TestCollectionListOneRemoteDeselectingUUID(c *chec
 		limit:        -1,
 		filters:      []arvados.Filter{{"uuid", "=", s.uuids[1][0]}},
 		selectfields: []string{"name"},
-		expectUUIDs:  []string{s.uuids[1][0]}, // uuid is returned, despite not being selected
+		expectUUIDs:  []string{""}, // select=name is honored
 		expectCalls:  []int{0, 1, 0},
 	})
 }
 
+func (s *CollectionListSuite) TestCollectionListOneRemoteExtraFilters(c *check.C) {
+	// The request is proxied to the remote cluster intact, so
+	// the usual restrictions on federated queries don't apply.
+	s.test(c, listTrial{
+		count:  "exact",
+		limit:  1,
+		offset: 1,
+		order:  []string{"uuid desc"},
+		filters: []arvados.Filter{
+			{"uuid", "in", []string{s.uuids[1][0], s.uuids[1][1], s.uuids[1][2]}},
+			{"uuid", "in", []string{s.uuids[1][0], s.uuids[1][1]}},
+		},
+		// Two collections match; with uuid desc order, offset 1
+		// skips [1][1] and limit 1 stops after [1][0].
+		expectUUIDs: []string{s.uuids[1][0]},
+		expectCalls: []int{0, 1, 0},
+	})
+	opts := s.backends[1].Calls(nil)[0].Options.(arvados.ListOptions)
+	c.Check(opts.Count, check.Equals, "exact")
+	c.Check(opts.Offset, check.Equals, int64(1))
+	c.Check(opts.Order, check.DeepEquals, []string{"uuid desc"})
+	c.Check(opts.Filters, check.HasLen, 2)
+}
+
 func (s *CollectionListSuite) TestCollectionListOneLocalOneRemote(c *check.C) {
 	s.test(c, listTrial{
 		count:       "none",
@@ -0,0 +1,166 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package federation
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+const (
+	// Maximum number of entries in a pdhCache. When the cache
+	// is full, the least recently used entry is evicted.
+	pdhCacheMaxEntries = 1000
+
+	// A cached collection is only returned while all of the
+	// blob signatures in its manifest remain valid for at least
+	// this long, so the caller has time to use them. (See
+	// pdhCache for why they can't be refreshed.)
+	pdhCacheSignatureMargin = time.Hour
+)
+
+// pdhCache remembers collections retrieved by PDH from remote
+// clusters. Entries are keyed by the request options and the
+// caller's tokens, so a cached record (and its blob signatures) is
+// only returned to a caller who would get the same response from the
+// remote.
+//
+// Cached manifests are returned as-is rather than re-signed for each
+// request. Their blocks are stored on the remote cluster, and their
+// +R signatures are made by the remote cluster with its own
+// BlobSigningKey and the caller's (salted) token. The local cluster
+// can't produce signatures the remote's keepstore would accept, so
+// the only way to get fresh ones is to ask the remote again, which
+// is what happens when an entry expires. Because the key includes the
+// caller's tokens, a cached signature is only ever handed back to the
+// caller it was issued for.
+type pdhCache struct {
+	setupOnce sync.Once
+	entries   *lru.Cache
+}
+
+type pdhCacheKey [sha256.Size]byte
+
+type pdhCacheEntry struct {
+	coll    arvados.Collection
+	expires time.Time
+}
+
+func makePDHCacheKey(options arvados.GetOptions, tokens []string) pdhCacheKey {
+	options.ForwardedFor = ""
+	buf, _ := json.Marshal(struct {
+		Options arvados.GetOptions
+		Tokens  []string
+	}{options, tokens})
+	return sha256.Sum256(buf)
+}
+
+func (pc *pdhCache) setup() {
+	var err error
+	pc.entries, err = lru.New(pdhCacheMaxEntries)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (pc *pdhCache) get(key pdhCacheKey) (arvados.Collection, bool) {
+	pc.setupOnce.Do(pc.setup)
+	v, ok := pc.entries.Get(key)
+	if !ok {
+		return arvados.Collection{}, false
+	}
+	ent := v.(pdhCacheEntry)
+	if time.Now().After(ent.expires) {
+		pc.entries.Remove(key)
+		return arvados.Collection{}, false
+	}
+	return copyCollection(ent.coll), true
+}
+
+// add stores coll until ttl elapses or the earliest signature in its
+// manifest is within pdhCacheSignatureMargin of expiring, whichever
+// comes first.
+func (pc *pdhCache) add(key pdhCacheKey, coll arvados.Collection, ttl time.Duration) {
+	expires := time.Now().Add(ttl)
+	if sigExpiry, ok := earliestSignatureExpiry(coll.ManifestText); ok {
+		if t := sigExpiry.Add(-pdhCacheSignatureMargin); t.Before(expires) {
+			expires = t
+		}
+	}
+	if !expires.After(time.Now()) {
+		return
+	}
+	pc.setupOnce.Do(pc.setup)
+	pc.entries.Add(key, pdhCacheEntry{coll: copyCollection(coll), expires: expires})
+}
+
+// copyCollection returns a copy of coll that doesn't share any maps
+// or slices with it, so callers can't modify a cached entry.
+func copyCollection(coll arvados.Collection) arvados.Collection {
+	coll.Properties, _ = copyJSONValue(coll.Properties).(map[string]interface{})
+	coll.StorageClassesDesired = copyStrings(coll.StorageClassesDesired)
+	coll.StorageClassesConfirmed = copyStrings(coll.StorageClassesConfirmed)
+	coll.WritableBy = copyStrings(coll.WritableBy)
+	return coll
+}
+
+func copyStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append([]string{}, s...)
+}
+
+// copyJSONValue returns a deep copy of a value decoded from JSON into
+// an interface{}.
+func copyJSONValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if v == nil {
+			return v
+		}
+		cp := make(map[string]interface{}, len(v))
+		for k, elem := range v {
+			cp[k] = copyJSONValue(elem)
+		}
+		return cp
+	case []interface{}:
+		if v == nil {
+			return v
+		}
+		cp := make([]interface{}, len(v))
+		for i, elem := range v {
+			cp[i] = copyJSONValue(elem)
+		}
+		return cp
+	default:
+		return v
+	}
+}
+
+// Matches the expiry timestamp of a local (+A) or remote (+R)
+// signature hint.
+var signatureExpiryRe = regexp.MustCompile(`\+[AR][^ +@]*@([0-9a-f]{8,})`)
+
+func earliestSignatureExpiry(mt string) (time.Time, bool) {
+	var earliest time.Time
+	for _, m := range signatureExpiryRe.FindAllStringSubmatch(mt, -1) {
+		ts, err := strconv.ParseInt(m[1], 16, 64)
+		if err != nil {
+			continue
+		}
+		if t := time.Unix(ts, 0); earliest.IsZero() || t.Before(earliest) {
+			earliest = t
+		}
+	}
+	return earliest, !earliest.IsZero()
+}
@@ -28,6 +28,7 @@ import (
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
 	"git.arvados.org/arvados.git/sdk/go/health"
 	"git.arvados.org/arvados.git/sdk/go/httpserver"
+	"github.com/prometheus/client_golang/prometheus"
 
 	// sqlx needs lib/pq to talk to PostgreSQL
 	_ "github.com/lib/pq"
@@ -36,6 +37,7 @@ import (
 type Handler struct {
 	Cluster           *arvados.Cluster
 	BackgroundContext context.Context
+	Registry          *prometheus.Registry // if nil, metrics are not recorded
 
 	setupOnce      sync.Once
 	federation     *federation.Conn
@@ -109,7 +111,11 @@ func (h *Handler) setup() {
 	}()
 	oidcAuthorizer := localdb.OIDCAccessTokenAuthorizer(h.Cluster, h.dbConnector.GetDB)
 	h.federation = federation.New(h.BackgroundContext, h.Cluster, &healthFuncs, h.dbConnector.GetDB)
+	if h.Registry != nil {
+		h.federation.RegisterMetrics(h.Registry)
+	}
 	rtr := router.New(h.federation, router.Config{
+		ClusterID:      h.Cluster.ClusterID,
 		MaxRequestSize: h.Cluster.API.MaxRequestSize,
 		WrapCalls: api.ComposeWrappers(
 			ctrlctx.WrapCallsInTransactions(h.dbConnector.GetDB),
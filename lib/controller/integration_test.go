@@ -7,8 +7,10 @@ package controller
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -16,6 +18,9 @@ import (
 	"math"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
 	"os"
 	"os/exec"
 	"strconv"
@@ -24,6 +29,7 @@ import (
 	"time"
 
 	"git.arvados.org/arvados.git/lib/boot"
+	"git.arvados.org/arvados.git/lib/controller/rpc"
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/arvadostest"
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
@@ -36,6 +42,72 @@ var _ = check.Suite(&IntegrationSuite{})
 type IntegrationSuite struct {
 	super        *boot.Supervisor
 	oidcprovider *arvadostest.OIDCProvider
+
+	// z1111 reaches z3333 through this proxy, so tests can make
+	// z3333 appear unavailable to z1111.
+	z3333proxy *unavailableProxy
+}
+
+// unavailableProxy forwards requests to a controller, except that it
+// responds 503 to the next failures requests whose path contains
+// failPath, like a load balancer in front of a controller that is
+// restarting.
+type unavailableProxy struct {
+	*httptest.Server
+	mtx        sync.Mutex
+	failPath   string
+	failures   int
+	requests   int
+	lastHeader http.Header
+}
+
+func newUnavailableProxy(target string) *unavailableProxy {
+	p := &unavailableProxy{}
+	rp := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "https", Host: target})
+	rp.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	p.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		p.mtx.Lock()
+		fail := false
+		if p.failPath != "" && strings.Contains(req.URL.Path, p.failPath) {
+			p.requests++
+			p.lastHeader = req.Header.Clone()
+			if p.failures > 0 {
+				p.failures--
+				fail = true
+			}
+		}
+		p.mtx.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rp.ServeHTTP(w, req)
+	}))
+	return p
+}
+
+// fail makes the proxy respond 503 to the next n requests whose path
+// contains path, and resets the request count.
+func (p *unavailableProxy) fail(path string, n int) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.failPath, p.failures, p.requests, p.lastHeader = path, n, 0, nil
+}
+
+// requestCount returns the number of requests received whose path
+// contains the path given to the last fail call.
+func (p *unavailableProxy) requestCount() int {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.requests
+}
+
+// lastRequestHeader returns the headers of the last request received
+// whose path contains the path given to the last fail call.
+func (p *unavailableProxy) lastRequestHeader() http.Header {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.lastHeader
 }
 
 func (s *IntegrationSuite) SetUpSuite(c *check.C) {
@@ -61,6 +133,8 @@ func (s *IntegrationSuite) SetUpSuite(c *check.C) {
 			return "127.0.0." + id[3:] + ":" + port
 		}()
 	}
+	s.z3333proxy = newUnavailableProxy(hostport["z3333"])
+	z3333proxyHost := strings.TrimPrefix(s.z3333proxy.URL, "https://")
 	yaml := "Clusters:\n"
 	for id := range hostport {
 		yaml += `
@@ -74,6 +148,7 @@ func (s *IntegrationSuite) SetUpSuite(c *check.C) {
       Format: text
     API:
       MaxConcurrentRequests: 128
+      MaxFederationHops: 3
     Containers:
       CloudVMs:
         Enable: true
@@ -103,7 +178,15 @@ func (s *IntegrationSuite) SetUpSuite(c *check.C) {
         ActivateUsers: true
 `
 		}
-		if id != "z3333" {
+		if id == "z1111" {
+			yaml += `      z3333:
+        Host: ` + z3333proxyHost + `
+        Scheme: https
+        Insecure: true
+        Proxy: true
+        ActivateUsers: true
+`
+		} else if id != "z3333" {
 			yaml += `      z3333:
         Host: ` + hostport["z3333"] + `
         Scheme: https
@@ -155,6 +238,9 @@ func (s *IntegrationSuite) TearDownSuite(c *check.C) {
 		s.super.Stop()
 		s.super.Wait()
 	}
+	if s.z3333proxy != nil {
+		s.z3333proxy.Close()
+	}
 }
 
 func (s *IntegrationSuite) TestDefaultStorageClassesOnCollections(c *check.C) {
@@ -205,6 +291,253 @@ func (s *IntegrationSuite) TestGetCollectionByPDH(c *check.C) {
 	c.Check(coll.PortableDataHash, check.Equals, pdh)
 }
 
+func (s *IntegrationSuite) TestCollectionTrashFederated(c *check.C) {
+	testText := "IntegrationSuite.TestCollectionTrashFederated"
+
+	conn1 := s.super.Conn("z1111")
+	rootctx1, _, _ := s.super.RootClients("z1111")
+	userctx1, ac1, _, _ := s.super.UserClients("z1111", rootctx1, c, conn1, s.oidcprovider.AuthEmail, true)
+	user, err := conn1.UserGetCurrent(userctx1, arvados.GetOptions{})
+	c.Assert(err, check.IsNil)
+
+	createColl := func(ctx context.Context, clusterID string) arvados.Collection {
+		_, ac, kc := s.super.ClientsWithToken(clusterID, ac1.AuthToken)
+		var coll arvados.Collection
+		fs, err := coll.FileSystem(ac, kc)
+		c.Assert(err, check.IsNil)
+		f, err := fs.OpenFile("test.txt", os.O_CREATE|os.O_RDWR, 0777)
+		c.Assert(err, check.IsNil)
+		_, err = io.WriteString(f, testText)
+		c.Assert(err, check.IsNil)
+		err = f.Close()
+		c.Assert(err, check.IsNil)
+		mtxt, err := fs.MarshalManifest(".")
+		c.Assert(err, check.IsNil)
+		coll, err = s.super.Conn(clusterID).CollectionCreate(ctx, arvados.CreateOptions{Attrs: map[string]interface{}{
+			"manifest_text": mtxt,
+		}})
+		c.Assert(err, check.IsNil)
+		return coll
+	}
+	orig := createColl(userctx1, "z1111")
+
+	// The caller's collections with the same content on z2222
+	// and z3333.
+	copies := map[string]string{}
+	for _, id := range []string{"z2222", "z3333"} {
+		coll := createColl(userctx1, id)
+		c.Assert(coll.PortableDataHash, check.Equals, orig.PortableDataHash)
+		copies[id] = coll.UUID
+	}
+
+	// Same content on z2222, owned by root and shared read-only
+	// with the caller: must be left alone.
+	rootctx2, _, _ := s.super.RootClients("z2222")
+	conn2 := s.super.Conn("z2222")
+	other := createColl(rootctx2, "z2222")
+	c.Assert(other.PortableDataHash, check.Equals, orig.PortableDataHash)
+	_, err = conn2.LinkCreate(rootctx2, arvados.CreateOptions{Attrs: map[string]interface{}{
+		"link_class": "permission",
+		"name":       "can_read",
+		"tail_uuid":  user.UUID,
+		"head_uuid":  other.UUID,
+	}})
+	c.Assert(err, check.IsNil)
+	_, err = conn2.CollectionGet(userctx1, arvados.GetOptions{UUID: other.UUID})
+	c.Assert(err, check.IsNil)
+
+	resp, err := conn1.CollectionTrashFederated(userctx1, arvados.DeleteOptions{UUID: orig.UUID})
+	c.Assert(err, check.IsNil)
+	c.Check(resp.Clusters["z1111"].UUIDs, check.DeepEquals, []string{orig.UUID})
+	for id, uuid := range copies {
+		c.Check(resp.Clusters[id].Error, check.Equals, "")
+		c.Check(resp.Clusters[id].UUIDs, check.DeepEquals, []string{uuid})
+		coll, err := s.super.Conn(id).CollectionGet(userctx1, arvados.GetOptions{UUID: uuid, IncludeTrash: true})
+		c.Check(err, check.IsNil)
+		c.Check(coll.IsTrashed, check.Equals, true)
+	}
+	coll, err := conn2.CollectionGet(rootctx2, arvados.GetOptions{UUID: other.UUID})
+	c.Check(err, check.IsNil)
+	c.Check(coll.IsTrashed, check.Equals, false)
+
+	// Trashing again is safe, and finds nothing more to trash.
+	resp, err = conn1.CollectionTrashFederated(userctx1, arvados.DeleteOptions{UUID: orig.UUID})
+	c.Assert(err, check.IsNil)
+	for id := range copies {
+		c.Check(resp.Clusters[id].Error, check.Equals, "")
+		c.Check(resp.Clusters[id].UUIDs, check.HasLen, 0)
+	}
+}
+
+func (s *IntegrationSuite) TestMaxFederationHops(c *check.C) {
+	conn1 := s.super.Conn("z1111")
+	rootctx1, _, _ := s.super.RootClients("z1111")
+	conn3 := s.super.Conn("z3333")
+	userctx1, _, _, _ := s.super.UserClients("z1111", rootctx1, c, conn1, s.oidcprovider.AuthEmail, true)
+
+	coll3, err := conn3.CollectionCreate(userctx1, arvados.CreateOptions{})
+	c.Assert(err, check.IsNil)
+
+	get := func(ctx context.Context) (string, error) {
+		s.z3333proxy.fail(coll3.UUID, 0)
+		coll, err := conn1.CollectionGet(ctx, arvados.GetOptions{UUID: coll3.UUID})
+		if err == nil {
+			c.Check(coll.UUID, check.Equals, coll3.UUID)
+		}
+		return s.z3333proxy.lastRequestHeader().Get(rpc.HeaderMaxHops), err
+	}
+
+	// z1111 is configured with MaxFederationHops: 3, so when it
+	// forwards our request to z3333, it tells z3333 that 2 more
+	// hops are allowed.
+	hops, err := get(userctx1)
+	c.Check(err, check.IsNil)
+	c.Check(hops, check.Equals, "2")
+
+	// A higher limit sent by the client doesn't override the
+	// configured limit.
+	hops, err = get(rpc.ContextWithMaxHops(userctx1, 6))
+	c.Check(err, check.IsNil)
+	c.Check(hops, check.Equals, "2")
+
+	// A lower limit sent by the client applies. Our request to
+	// z1111 is the first hop, so with a limit of 2, z1111 can
+	// forward it to z3333 but z3333 can't forward it any
+	// further.
+	hops, err = get(rpc.ContextWithMaxHops(userctx1, 2))
+	c.Check(err, check.IsNil)
+	c.Check(hops, check.Equals, "0")
+
+	// With a limit of 1, z1111 is not allowed to forward it to
+	// z3333.
+	_, err = get(rpc.ContextWithMaxHops(userctx1, 1))
+	c.Assert(err, check.ErrorMatches, `.*maximum number of federation hops exceeded.*`)
+	c.Check(err.(*arvados.TransactionError).StatusCode, check.Equals, http.StatusLoopDetected)
+	c.Check(s.z3333proxy.requestCount(), check.Equals, 0)
+}
+
+func (s *IntegrationSuite) TestRemoteErrorVia(c *check.C) {
+	conn1 := s.super.Conn("z1111")
+	rootctx1, _, _ := s.super.RootClients("z1111")
+	userctx1, _, _, _ := s.super.UserClients("z1111", rootctx1, c, conn1, s.oidcprovider.AuthEmail, true)
+
+	for _, trial := range []struct {
+		clusterID string // cluster that receives our request
+		uuid      string // object it looks up
+		origin    string // cluster that rejects the request
+		via       []string
+	}{
+		{"z1111", "z1111-4zz18-aaaaaaaaaaaaaaa", "z1111", nil},
+		{"z1111", "z3333-4zz18-aaaaaaaaaaaaaaa", "z3333", []string{"z1111", "z3333"}},
+		{"z3333", "z2222-4zz18-aaaaaaaaaaaaaaa", "z2222", []string{"z3333", "z2222"}},
+	} {
+		comment := check.Commentf("%+v", trial)
+		_, err := s.super.Conn(trial.clusterID).CollectionGet(userctx1, arvados.GetOptions{UUID: trial.uuid})
+		var terr *arvados.TransactionError
+		if c.Check(errors.As(err, &terr), check.Equals, true, comment) {
+			c.Check(terr.StatusCode, check.Equals, http.StatusNotFound, comment)
+			c.Check(terr.ClusterID, check.Equals, trial.origin, comment)
+			c.Check(terr.Via, check.DeepEquals, trial.via, comment)
+		}
+	}
+}
+
+func (s *IntegrationSuite) TestRetryRemoteUnavailable(c *check.C) {
+	conn1 := s.super.Conn("z1111")
+	rootctx1, _, _ := s.super.RootClients("z1111")
+	conn3 := s.super.Conn("z3333")
+	userctx1, _, _, _ := s.super.UserClients("z1111", rootctx1, c, conn1, s.oidcprovider.AuthEmail, true)
+
+	coll3, err := conn3.CollectionCreate(userctx1, arvados.CreateOptions{})
+	c.Assert(err, check.IsNil)
+
+	// z3333 is briefly unavailable to z1111: z1111 retries the
+	// GET, and the client doesn't see the error.
+	s.z3333proxy.fail(coll3.UUID, 1)
+	coll, err := conn1.CollectionGet(userctx1, arvados.GetOptions{UUID: coll3.UUID})
+	c.Check(err, check.IsNil)
+	c.Check(coll.UUID, check.Equals, coll3.UUID)
+	c.Check(s.z3333proxy.requestCount(), check.Equals, 2)
+
+	// Non-idempotent requests are not retried.
+	s.z3333proxy.fail(coll3.UUID, 1)
+	_, err = conn1.CollectionUpdate(userctx1, arvados.UpdateOptions{UUID: coll3.UUID, Attrs: map[string]interface{}{
+		"name": "TestRetryRemoteUnavailable",
+	}})
+	c.Check(err, check.ErrorMatches, `.*503.*`)
+	c.Check(s.z3333proxy.requestCount(), check.Equals, 1)
+	s.z3333proxy.fail("", 0)
+}
+
+func (s *IntegrationSuite) TestFederatedListOptions(c *check.C) {
+	conn1 := s.super.Conn("z1111")
+	rootctx1, _, _ := s.super.RootClients("z1111")
+	conn3 := s.super.Conn("z3333")
+	userctx1, _, _, _ := s.super.UserClients("z1111", rootctx1, c, conn1, s.oidcprovider.AuthEmail, true)
+
+	var uuids []string
+	for _, name := range []string{"federated list a", "federated list b", "other"} {
+		coll, err := conn3.CollectionCreate(userctx1, arvados.CreateOptions{Attrs: map[string]interface{}{
+			"name": name,
+		}})
+		c.Assert(err, check.IsNil)
+		uuids = append(uuids, coll.UUID)
+	}
+
+	// List the z3333 collections through z1111, with the same
+	// filters, order, count, and select we would use for a
+	// local query.
+	resp, err := conn1.CollectionList(userctx1, arvados.ListOptions{
+		Limit: -1,
+		Count: "exact",
+		Order: []string{"name desc"},
+		Filters: []arvados.Filter{
+			{"uuid", "in", uuids},
+			{"name", "like", "federated list %"},
+		},
+		Select: []string{"uuid", "name"},
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(resp.ItemsAvailable, check.Equals, 2)
+	c.Assert(resp.Items, check.HasLen, 2)
+	c.Check(resp.Items[0].UUID, check.Equals, uuids[1])
+	c.Check(resp.Items[0].Name, check.Equals, "federated list b")
+	c.Check(resp.Items[1].UUID, check.Equals, uuids[0])
+	c.Check(resp.Items[1].Name, check.Equals, "federated list a")
+	for _, item := range resp.Items {
+		// Attributes that were not selected are not returned.
+		c.Check(item.OwnerUUID, check.Equals, "")
+		c.Check(item.PortableDataHash, check.Equals, "")
+	}
+}
+
+func (s *IntegrationSuite) TestRemoteRequestMetrics(c *check.C) {
+	conn1 := s.super.Conn("z1111")
+	rootctx1, _, _ := s.super.RootClients("z1111")
+	conn3 := s.super.Conn("z3333")
+	userctx1, _, _, _ := s.super.UserClients("z1111", rootctx1, c, conn1, s.oidcprovider.AuthEmail, true)
+
+	coll3, err := conn3.CollectionCreate(userctx1, arvados.CreateOptions{})
+	c.Assert(err, check.IsNil)
+	_, err = conn1.CollectionGet(userctx1, arvados.GetOptions{UUID: coll3.UUID})
+	c.Assert(err, check.IsNil)
+
+	cluster1 := s.super.Cluster("z1111")
+	metricsURL := url.URL(cluster1.Services.Controller.ExternalURL)
+	metricsURL.Path = "/metrics"
+	req, err := http.NewRequest("GET", metricsURL.String(), nil)
+	c.Assert(err, check.IsNil)
+	req.Header.Set("Authorization", "Bearer "+cluster1.ManagementToken)
+	hc := http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := hc.Do(req)
+	c.Assert(err, check.IsNil)
+	defer resp.Body.Close()
+	c.Check(resp.StatusCode, check.Equals, http.StatusOK)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, check.IsNil)
+	c.Check(string(body), check.Matches, `(?ms).*^arvados_controller_remote_requests_total{cluster="z3333",method="GET arvados/v1/collections/{uuid}",status="200"} [1-9].*`)
+}
+
 // Tests bug #18004
 func (s *IntegrationSuite) TestRemoteUserAndTokenCacheRace(c *check.C) {
 	conn1 := s.super.Conn("z1111")
@@ -107,6 +107,13 @@ func (conn *Conn) CollectionUpdate(ctx context.Context, opts arvados.UpdateOptio
 	return resp, nil
 }
 
+// CollectionTrashFederated is only implemented by the federation
+// layer, which fans out CollectionTrash calls to each cluster. Rails
+// has no such endpoint, so don't pass it through to railsProxy.
+func (conn *Conn) CollectionTrashFederated(ctx context.Context, opts arvados.DeleteOptions) (arvados.MultiClusterResponse, error) {
+	return arvados.MultiClusterResponse{}, httpserver.ErrorWithStatus(fmt.Errorf("federated trash is not supported by the local database backend"), http.StatusNotImplemented)
+}
+
 func (conn *Conn) signCollection(ctx context.Context, coll *arvados.Collection) {
 	if coll.IsTrashed || coll.ManifestText == "" || !conn.cluster.Collections.BlobSigning {
 		return
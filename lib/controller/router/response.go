@@ -6,12 +6,14 @@ package router
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"regexp"
 	"strings"
 	"time"
 
+	"git.arvados.org/arvados.git/lib/controller/rpc"
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/httpserver"
 )
@@ -73,7 +75,7 @@ func (rtr *router) sendResponse(w http.ResponseWriter, req *http.Request, resp i
 
 	err := rtr.transcode(resp, &tmp)
 	if err != nil {
-		rtr.sendError(w, err)
+		rtr.sendError(w, req, err)
 		return
 	}
 
@@ -129,12 +131,24 @@ func (rtr *router) sendResponse(w http.ResponseWriter, req *http.Request, resp i
 	enc.Encode(tmp)
 }
 
-func (rtr *router) sendError(w http.ResponseWriter, err error) {
+func (rtr *router) sendError(w http.ResponseWriter, req *http.Request, err error) {
 	code := http.StatusInternalServerError
 	if err, ok := err.(interface{ HTTPStatus() int }); ok {
 		code = err.HTTPStatus()
 	}
-	httpserver.Error(w, err.Error(), code)
+	clusterID := rtr.config.ClusterID
+	var via []string
+	var terr *arvados.TransactionError
+	if errors.As(err, &terr) && terr.ClusterID != "" && terr.ClusterID != clusterID {
+		// The error came from (or via) a remote cluster.
+		clusterID = terr.ClusterID
+		via = terr.Via
+	} else if incoming := rpc.ParseVia(req.Header.Get(rpc.HeaderVia)); len(incoming) > 0 && clusterID != "" {
+		// The error came from this cluster, at the end
+		// of a chain of forwarded requests.
+		via = append(incoming, clusterID)
+	}
+	httpserver.ClusterError(w, clusterID, via, err.Error(), code)
 }
 
 var infixMap = map[string]interface{}{
@@ -9,9 +9,11 @@ import (
 	"fmt"
 	"math"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"git.arvados.org/arvados.git/lib/controller/api"
+	"git.arvados.org/arvados.git/lib/controller/rpc"
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/auth"
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
@@ -27,6 +29,11 @@ type router struct {
 }
 
 type Config struct {
+	// ID of the local cluster. Error responses report this as
+	// the originating cluster unless the error came from a
+	// remote cluster.
+	ClusterID string
+
 	// Return an error if request body exceeds this size. 0 means
 	// unlimited.
 	MaxRequestSize int
@@ -184,6 +191,13 @@ func (rtr *router) addRoutes() {
 				return rtr.backend.CollectionUntrash(ctx, *opts.(*arvados.UntrashOptions))
 			},
 		},
+		{
+			arvados.EndpointCollectionTrashFederated,
+			func() interface{} { return &arvados.DeleteOptions{} },
+			func(ctx context.Context, opts interface{}) (interface{}, error) {
+				return rtr.backend.CollectionTrashFederated(ctx, *opts.(*arvados.DeleteOptions))
+			},
+		},
 		{
 			arvados.EndpointContainerCreate,
 			func() interface{} { return &arvados.CreateOptions{} },
@@ -686,20 +700,20 @@ func (rtr *router) addRoute(endpoint arvados.APIEndpoint, defaultOpts func() int
 				"method":   endpoint.Method,
 				"endpoint": endpoint,
 			}).WithError(err).Debug("error loading request params")
-			rtr.sendError(w, err)
+			rtr.sendError(w, req, err)
 			return
 		}
 		respOpts, err := rtr.responseOptions(opts)
 		if err != nil {
 			logger.WithField("opts", opts).WithError(err).Debugf("error getting response options from %T", opts)
-			rtr.sendError(w, err)
+			rtr.sendError(w, req, err)
 			return
 		}
 
 		creds := auth.CredentialsFromRequest(req)
 		err = creds.LoadTokensFromHTTPRequestBody(req)
 		if err != nil {
-			rtr.sendError(w, fmt.Errorf("error loading tokens from request body: %s", err))
+			rtr.sendError(w, req, fmt.Errorf("error loading tokens from request body: %s", err))
 			return
 		}
 		if rt, _ := params["reader_tokens"].([]interface{}); len(rt) > 0 {
@@ -711,6 +725,12 @@ func (rtr *router) addRoute(endpoint arvados.APIEndpoint, defaultOpts func() int
 		}
 		ctx := auth.NewContext(req.Context(), creds)
 		ctx = arvados.ContextWithRequestID(ctx, req.Header.Get("X-Request-Id"))
+		if n, err := strconv.Atoi(req.Header.Get(rpc.HeaderMaxHops)); err == nil && n >= 0 {
+			ctx = rpc.ContextWithMaxHops(ctx, n)
+		}
+		if via := rpc.ParseVia(req.Header.Get(rpc.HeaderVia)); len(via) > 0 {
+			ctx = rpc.ContextWithVia(ctx, via)
+		}
 		req = req.WithContext(ctx)
 
 		// Extract the token UUIDs (or a placeholder for v1 tokens)
@@ -739,7 +759,7 @@ func (rtr *router) addRoute(endpoint arvados.APIEndpoint, defaultOpts func() int
 		resp, err := exec(ctx, opts)
 		if err != nil {
 			logger.WithError(err).Debugf("returning error type %T", err)
-			rtr.sendError(w, err)
+			rtr.sendError(w, req, err)
 			return
 		}
 		rtr.sendResponse(w, req, resp, respOpts)
@@ -773,7 +793,7 @@ func (rtr *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			if err.Error() == "http: request body too large" {
 				err = httpError(http.StatusRequestEntityTooLarge, err)
 			}
-			rtr.sendError(w, err)
+			rtr.sendError(w, r, err)
 			return
 		}
 		if m := r.FormValue("_method"); m != "" {
@@ -19,7 +19,12 @@ import (
 	"git.arvados.org/arvados.git/lib/controller/rpc"
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	"git.arvados.org/arvados.git/sdk/go/httpserver"
 	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 	check "gopkg.in/check.v1"
 )
 
@@ -308,6 +313,75 @@ func (s *RouterSuite) TestOptions(c *check.C) {
 	}
 }
 
+// A trace started by a client continues through controller, which
+// forwards the request to a remote cluster.
+func (s *RouterSuite) TestTraceContextPropagation(c *check.C) {
+	recorder := tracetest.NewSpanRecorder()
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	remoteStub := &arvadostest.APIStub{}
+	remote := httptest.NewServer(httpserver.AddTraceContext(New(remoteStub, Config{ClusterID: "z3333"})))
+	defer remote.Close()
+	remoteURL, err := url.Parse(remote.URL)
+	c.Assert(err, check.IsNil)
+
+	rtr := New(rpc.NewConn("z3333", remoteURL, true, rpc.PassthroughTokenProvider), Config{ClusterID: "z1111"})
+	controller := httptest.NewServer(httpserver.AddTraceContext(rtr))
+	defer controller.Close()
+
+	req, err := http.NewRequest("GET", controller.URL+"/arvados/v1/collections/z3333-4zz18-aaaaaaaaaaaaaaa", nil)
+	c.Assert(err, check.IsNil)
+	req.Header.Set("Authorization", "Bearer "+arvadostest.ActiveToken)
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	resp.Body.Close()
+	c.Check(resp.StatusCode, check.Equals, http.StatusOK)
+
+	// Controller and the remote each record a server span, and
+	// controller records a client span for the forwarded request.
+	ended := recorder.Ended()
+	c.Assert(ended, check.HasLen, 3)
+	var controllerSpan, rpcSpan, remoteSpan sdktrace.ReadOnlySpan
+	for _, span := range ended {
+		c.Check(span.SpanContext().TraceID().String(), check.Equals, "4bf92f3577b34da6a3ce929d0e0e4736")
+		switch {
+		case span.SpanKind() == trace.SpanKindClient:
+			rpcSpan = span
+		case span.Parent().IsRemote() && span.Parent().SpanID().String() == "00f067aa0ba902b7":
+			controllerSpan = span
+		default:
+			remoteSpan = span
+		}
+	}
+	c.Assert(controllerSpan, check.NotNil)
+	c.Assert(rpcSpan, check.NotNil)
+	c.Assert(remoteSpan, check.NotNil)
+
+	// Controller continues the client's trace.
+	c.Check(controllerSpan.SpanKind(), check.Equals, trace.SpanKindServer)
+
+	// Controller's span for the forwarded request is a child of
+	// its own span.
+	c.Check(rpcSpan.Parent().SpanID(), check.Equals, controllerSpan.SpanContext().SpanID())
+	var clusterID string
+	for _, attr := range rpcSpan.Attributes() {
+		if attr.Key == "arvados.cluster_id" {
+			clusterID = attr.Value.AsString()
+		}
+	}
+	c.Check(clusterID, check.Equals, "z3333")
+
+	// The remote continues the same trace, as a child of
+	// controller's span for the forwarded request.
+	c.Check(remoteSpan.SpanKind(), check.Equals, trace.SpanKindServer)
+	c.Check(remoteSpan.Parent().SpanID(), check.Equals, rpcSpan.SpanContext().SpanID())
+	calls := remoteStub.Calls(remoteStub.CollectionGet)
+	c.Assert(calls, check.HasLen, 1)
+	c.Check(trace.SpanContextFromContext(calls[0].Context).SpanID(), check.Equals, remoteSpan.SpanContext().SpanID())
+}
+
 var _ = check.Suite(&RouterIntegrationSuite{})
 
 type RouterIntegrationSuite struct {
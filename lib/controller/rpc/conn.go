@@ -21,12 +21,18 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/auth"
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
 	"git.arvados.org/arvados.git/sdk/go/httpserver"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const rfc3339NanoFixed = "2006-01-02T15:04:05.000000000Z07:00"
@@ -41,10 +47,95 @@ func PassthroughTokenProvider(ctx context.Context) ([]string, error) {
 	return incoming.Tokens, nil
 }
 
+// HeaderMaxHops tells the receiving controller how many more times
+// it may forward the request to another cluster.
+const HeaderMaxHops = "X-Arvados-Max-Hops"
+
+type contextKeyMaxHops struct{}
+
+// ContextWithMaxHops returns a child context in which outgoing
+// requests may be forwarded at most n more times (see Conn.MaxHops).
+func ContextWithMaxHops(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, contextKeyMaxHops{}, n)
+}
+
+// HeaderVia lists the IDs of the clusters that have forwarded a
+// request so far, in order, separated by commas.
+const HeaderVia = "X-Arvados-Via"
+
+type contextKeyVia struct{}
+
+// ContextWithVia returns a child context in which the incoming
+// request is known to have been forwarded by the given clusters, in
+// order (see HeaderVia and Conn.LocalClusterID).
+func ContextWithVia(ctx context.Context, via []string) context.Context {
+	return context.WithValue(ctx, contextKeyVia{}, via)
+}
+
+// ViaFromContext returns the clusters that forwarded the incoming
+// request, as recorded by ContextWithVia.
+func ViaFromContext(ctx context.Context) []string {
+	via, _ := ctx.Value(contextKeyVia{}).([]string)
+	return via
+}
+
+// ParseVia parses a HeaderVia value.
+func ParseVia(hdr string) []string {
+	var via []string
+	for _, id := range strings.Split(hdr, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			via = append(via, id)
+		}
+	}
+	return via
+}
+
 type Conn struct {
 	SendHeader         http.Header
 	RedactHostInErrors bool
 
+	// If LocalClusterID is not empty, each request sent on this
+	// connection has a HeaderVia listing the clusters that
+	// forwarded the incoming request (see ContextWithVia),
+	// followed by LocalClusterID.
+	LocalClusterID string
+
+	// Each request sent on this connection counts as one
+	// forwarding hop. A request is rejected if it would exceed
+	// either MaxHops (if MaxHops > 0) or the remaining hop count
+	// from the incoming request (see ContextWithMaxHops), and
+	// the remote is told how many hops remain after this one.
+	// If neither limit applies, no hop count is sent.
+	MaxHops int
+
+	// Number of times to retry an idempotent request after a
+	// transient error (see transientError), waiting RetryDelay
+	// before the first retry and doubling the delay each time.
+	// Zero means no retries.
+	Retries    int
+	RetryDelay time.Duration
+
+	// If AttemptTimeout > 0, a single attempt that has not
+	// received a response after AttemptTimeout is abandoned, and
+	// treated as a transient error.
+	AttemptTimeout time.Duration
+
+	// If Timeout > 0, a request (including any retries) that
+	// has not succeeded after Timeout fails with an error that
+	// has HTTP status 504 and a Timeout method that returns
+	// true.
+	Timeout time.Duration
+
+	// If not nil, Metrics records each request sent on this
+	// connection.
+	Metrics *Metrics
+
+	// If not nil, RefreshTokens is called when the remote reports
+	// that a token returned by the token provider has expired. If
+	// it returns different tokens, an idempotent request is
+	// retried once with the new tokens.
+	RefreshTokens TokenProvider
+
 	clusterID                string
 	httpClient               http.Client
 	baseURL                  url.URL
@@ -87,7 +178,7 @@ func NewConn(clusterID string, url *url.URL, insecure bool, tp TokenProvider) *C
 	}
 }
 
-func (conn *Conn) requestAndDecode(ctx context.Context, dst interface{}, ep arvados.APIEndpoint, body io.Reader, opts interface{}) error {
+func (conn *Conn) requestAndDecode(ctx context.Context, dst interface{}, ep arvados.APIEndpoint, body io.Reader, opts interface{}) (err error) {
 	aClient := arvados.Client{
 		Client:     &conn.httpClient,
 		Scheme:     conn.baseURL.Scheme,
@@ -99,14 +190,45 @@ func (conn *Conn) requestAndDecode(ctx context.Context, dst interface{}, ep arva
 	tokens, err := conn.tokenProvider(ctx)
 	if err != nil {
 		return err
-	} else if len(tokens) > 0 {
-		ctx = arvados.ContextWithAuthorization(ctx, "Bearer "+tokens[0])
-	} else {
-		// Use a non-empty auth string to ensure we override
-		// any default token set on aClient -- and to avoid
-		// having the remote prompt us to send a token by
-		// responding 401.
-		ctx = arvados.ContextWithAuthorization(ctx, "Bearer -")
+	}
+
+	hops, limited := conn.MaxHops, conn.MaxHops > 0
+	if n, ok := ctx.Value(contextKeyMaxHops{}).(int); ok && (!limited || n < hops) {
+		hops, limited = n, true
+	}
+	if limited {
+		if hops < 1 {
+			return httpserver.ErrorWithStatus(fmt.Errorf("cannot forward request to cluster %s: maximum number of federation hops exceeded", conn.clusterID), http.StatusLoopDetected)
+		}
+		aClient.SendHeader = cloneHeader(aClient.SendHeader)
+		aClient.SendHeader.Set(HeaderMaxHops, strconv.Itoa(hops-1))
+	}
+
+	if conn.LocalClusterID != "" {
+		via := append(append([]string(nil), ViaFromContext(ctx)...), conn.LocalClusterID)
+		aClient.SendHeader = cloneHeader(aClient.SendHeader)
+		aClient.SendHeader.Set(HeaderVia, strings.Join(via, ","))
+	}
+
+	// Start a new span for this operation, and pass it to the
+	// remote so its work is recorded as part of the same trace.
+	ctx, span := otel.Tracer(httpserver.TracerName).Start(ctx, ep.Method+" "+ep.Path,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("arvados.cluster_id", conn.clusterID),
+			attribute.String("http.method", ep.Method),
+			attribute.String("http.route", ep.Path),
+		))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+	if span.SpanContext().IsValid() {
+		aClient.SendHeader = cloneHeader(aClient.SendHeader)
+		propagation.TraceContext{}.Inject(ctx, propagation.HeaderCarrier(aClient.SendHeader))
 	}
 
 	// Encode opts to JSON and decode from there to a
@@ -149,32 +271,220 @@ func (conn *Conn) requestAndDecode(ctx context.Context, dst interface{}, ep arva
 		}
 	}
 
-	if len(tokens) > 1 {
-		if params == nil {
-			params = make(map[string]interface{})
-		}
-		params["reader_tokens"] = tokens[1:]
-	}
 	path := ep.Path
 	if strings.Contains(ep.Path, "/{uuid}") && params != nil {
 		uuid, _ := params["uuid"].(string)
 		path = strings.Replace(path, "/{uuid}", "/"+uuid, 1)
 		delete(params, "uuid")
 	}
-	err = aClient.RequestAndDecodeContext(ctx, dst, ep.Method, path, body, params)
-	if err != nil && conn.RedactHostInErrors {
-		redacted := strings.Replace(err.Error(), strings.TrimSuffix(conn.baseURL.String(), "/"), "//railsapi.internal", -1)
-		if strings.HasPrefix(redacted, "request failed: ") {
-			redacted = strings.Replace(redacted, "request failed: ", "", -1)
+
+	if conn.Timeout > 0 {
+		parent := ctx
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, conn.Timeout)
+		defer cancel()
+		defer func() {
+			if err != nil && ctx.Err() == context.DeadlineExceeded && parent.Err() == nil {
+				err = timeoutError{err: err, clusterID: conn.clusterID, timeout: conn.Timeout}
+			}
+		}()
+	}
+
+	send := func(tokens []string) error {
+		actx := ctx
+		if conn.AttemptTimeout > 0 {
+			var cancel context.CancelFunc
+			actx, cancel = context.WithTimeout(actx, conn.AttemptTimeout)
+			defer cancel()
+		}
+		if len(tokens) > 0 {
+			actx = arvados.ContextWithAuthorization(actx, "Bearer "+tokens[0])
+		} else {
+			// Use a non-empty auth string to ensure we
+			// override any default token set on aClient --
+			// and to avoid having the remote prompt us to
+			// send a token by responding 401.
+			actx = arvados.ContextWithAuthorization(actx, "Bearer -")
+		}
+		if len(tokens) > 1 {
+			if params == nil {
+				params = make(map[string]interface{})
+			}
+			params["reader_tokens"] = tokens[1:]
+		}
+		t0 := time.Now()
+		err := aClient.RequestAndDecodeContext(actx, dst, ep.Method, path, body, params)
+		if err != nil && actx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+			err = timeoutError{err: err, clusterID: conn.clusterID, timeout: conn.AttemptTimeout}
+		}
+		conn.Metrics.observe(conn.clusterID, ep, err, time.Since(t0))
+		return err
+	}
+	err = send(tokens)
+	if body == nil && idempotentMethod[ep.Method] {
+		delay := conn.RetryDelay
+		if delay <= 0 {
+			delay = defaultRetryDelay
 		}
-		if redacted != err.Error() {
-			if err, ok := err.(httpStatusError); ok {
-				return wrapHTTPStatusError(err, redacted)
-			} else {
-				return errors.New(redacted)
+		for attempt := 0; attempt < conn.Retries && conn.transientError(err) && ctx.Err() == nil; attempt++ {
+			ctxlog.FromContext(ctx).WithError(err).Debugf("rpc: retrying %s %s on cluster %s after %v", ep.Method, path, conn.clusterID, delay)
+			select {
+			case <-ctx.Done():
+			case <-time.After(delay):
+				err = send(tokens)
+				delay *= 2
 			}
 		}
 	}
+	if body == nil && idempotentMethod[ep.Method] && conn.RefreshTokens != nil && len(tokens) > 0 && tokenExpired(err) {
+		// The remote rejected a token that it presumably
+		// accepted when a long-running operation started,
+		// because the token has expired. Re-derive the
+		// token(s) and try once more -- unless that gives us
+		// the same token(s) the remote just rejected.
+		newTokens, rerr := conn.RefreshTokens(ctx)
+		if rerr != nil {
+			ctxlog.FromContext(ctx).WithError(rerr).Debugf("rpc: cannot refresh expired token for cluster %s", conn.clusterID)
+		} else if !sameTokens(newTokens, tokens) {
+			ctxlog.FromContext(ctx).Debugf("rpc: retrying %s %s on cluster %s with refreshed token", ep.Method, path, conn.clusterID)
+			tokens = newTokens
+			err = send(tokens)
+		}
+	}
+	if len(tokens) > 0 && tokenExpired(err) {
+		// Report what happened more clearly than a generic
+		// 401.
+		return conn.remoteError(tokenExpiredError{err.(httpStatusError), conn.clusterID})
+	}
+	return conn.remoteError(err)
+}
+
+// tokenExpired returns true if err is a 401 response whose error
+// message says the token has expired. Other 401 responses (e.g.,
+// "Not logged in") don't tell us whether a fresh token would help.
+func tokenExpired(err error) bool {
+	if err, ok := err.(httpStatusError); !ok || err.HTTPStatus() != http.StatusUnauthorized {
+		return false
+	}
+	var terr *arvados.TransactionError
+	if !errors.As(err, &terr) {
+		return false
+	}
+	for _, msg := range terr.Errors {
+		if strings.Contains(strings.ToLower(msg), "expired") {
+			return true
+		}
+	}
+	return false
+}
+
+func sameTokens(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// remoteError records which cluster produced the given error, then
+// redacts it (see redactHost). If the remote was itself forwarding
+// the request, the remote's error response already names the
+// originating cluster; otherwise, the error came from conn's own
+// cluster.
+func (conn *Conn) remoteError(err error) error {
+	var terr *arvados.TransactionError
+	if errors.As(err, &terr) && terr.ClusterID == "" {
+		terr.ClusterID = conn.clusterID
+	}
+	return conn.redactHost(err)
+}
+
+func cloneHeader(h http.Header) http.Header {
+	clone := http.Header{}
+	for k, v := range h {
+		clone[k] = v
+	}
+	return clone
+}
+
+const defaultRetryDelay = time.Second
+
+// transientError returns true if err might not recur if the same
+// request is sent again: a connection-level error (e.g., connection
+// refused while the remote controller is restarting), an attempt
+// that exceeded AttemptTimeout, a 503, or a 502/504 from a proxy in
+// front of the remote controller.
+//
+// A 502 or 504 that the remote relayed from a cluster further along
+// the forwarding chain is not considered transient: that remote has
+// already had a chance to retry, and retrying at every hop would
+// multiply the number of requests.
+func (conn *Conn) transientError(err error) bool {
+	var toerr timeoutError
+	if errors.As(err, &toerr) {
+		// Only attempts that exceeded AttemptTimeout are
+		// reported this way before retries are exhausted.
+		return true
+	}
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if err, ok := err.(httpStatusError); ok {
+		switch err.HTTPStatus() {
+		case http.StatusServiceUnavailable:
+			return true
+		case http.StatusBadGateway, http.StatusGatewayTimeout:
+			return !conn.relayedError(err)
+		default:
+			return false
+		}
+	}
+	var operr *net.OpError
+	if errors.As(err, &operr) && operr.Op == "dial" {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// relayedError returns true if err is an error response that the
+// remote cluster relayed from another cluster, i.e., the response
+// names a different cluster as the origin of the error.
+func (conn *Conn) relayedError(err error) bool {
+	var terr *arvados.TransactionError
+	return errors.As(err, &terr) && terr.ClusterID != "" && terr.ClusterID != conn.clusterID
+}
+
+// idempotentMethod lists the HTTP methods that requestAndDecode can
+// safely repeat after a transient error or with a refreshed token.
+var idempotentMethod = map[string]bool{
+	"GET":  true,
+	"HEAD": true,
+}
+
+// If conn.RedactHostInErrors is true, replace conn's base URL with a
+// generic placeholder in the given error message.
+func (conn *Conn) redactHost(err error) error {
+	if err == nil || !conn.RedactHostInErrors {
+		return err
+	}
+	redacted := strings.Replace(err.Error(), strings.TrimSuffix(conn.baseURL.String(), "/"), "//railsapi.internal", -1)
+	if strings.HasPrefix(redacted, "request failed: ") {
+		redacted = strings.Replace(redacted, "request failed: ", "", -1)
+	}
+	if redacted != err.Error() {
+		if err, ok := err.(httpStatusError); ok {
+			return wrapHTTPStatusError(err, redacted)
+		} else {
+			return errors.New(redacted)
+		}
+	}
 	return err
 }
 
@@ -341,6 +651,13 @@ func (conn *Conn) CollectionUntrash(ctx context.Context, options arvados.Untrash
 	return resp, err
 }
 
+func (conn *Conn) CollectionTrashFederated(ctx context.Context, options arvados.DeleteOptions) (arvados.MultiClusterResponse, error) {
+	ep := arvados.EndpointCollectionTrashFederated
+	var resp arvados.MultiClusterResponse
+	err := conn.requestAndDecode(ctx, &resp, ep, nil, options)
+	return resp, err
+}
+
 func (conn *Conn) ContainerCreate(ctx context.Context, options arvados.CreateOptions) (arvados.Container, error) {
 	ep := arvados.EndpointContainerCreate
 	var resp arvados.Container
@@ -879,3 +1196,54 @@ func wrapHTTPStatusError(err httpStatusError, message string) httpStatusError {
 func (err wrappedHTTPStatusError) Error() string {
 	return err.message
 }
+
+func (err wrappedHTTPStatusError) Unwrap() error {
+	return err.httpStatusError
+}
+
+// tokenExpiredError is returned when a remote cluster reports that
+// the token has expired (see tokenExpired).
+type tokenExpiredError struct {
+	httpStatusError
+	clusterID string
+}
+
+func (err tokenExpiredError) Error() string {
+	return fmt.Sprintf("token expired (rejected by remote cluster %s): %s", err.clusterID, err.httpStatusError.Error())
+}
+
+// timeoutError is returned when a request is abandoned because
+// Conn.Timeout (or, for a single attempt, Conn.AttemptTimeout) was
+// reached.
+type timeoutError struct {
+	err       error
+	clusterID string
+	timeout   time.Duration
+}
+
+func (err timeoutError) Error() string {
+	return fmt.Sprintf("request to remote cluster %s timed out after %v", err.clusterID, err.timeout)
+}
+
+func (err timeoutError) Unwrap() error {
+	return err.err
+}
+
+// Is returns true for context.DeadlineExceeded, even if the
+// underlying error doesn't wrap it.
+func (timeoutError) Is(target error) bool {
+	return target == context.DeadlineExceeded
+}
+
+func (timeoutError) HTTPStatus() int {
+	return http.StatusGatewayTimeout
+}
+
+// Timeout returns true, like a net.Error caused by a timeout.
+func (timeoutError) Timeout() bool {
+	return true
+}
+
+func (err tokenExpiredError) Unwrap() error {
+	return err.httpStatusError
+}
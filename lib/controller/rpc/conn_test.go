@@ -6,15 +6,31 @@ package rpc
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"git.arvados.org/arvados.git/lib/config"
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/arvadostest"
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 	check "gopkg.in/check.v1"
 )
 
@@ -133,3 +149,445 @@ func (s *RPCSuite) TestSpecimenCRUD(c *check.C) {
 	c.Check(err, check.IsNil)
 	c.Check(spDel.UUID, check.Equals, sp.UUID)
 }
+
+func (s *RPCSuite) TestExpiredToken(c *check.C) {
+	var requests int32
+	var unauthorizedMsg atomic.Value
+	unauthorizedMsg.Store("Token expired")
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, `{"errors":[%q]}`, unauthorizedMsg.Load().(string))
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	c.Assert(err, check.IsNil)
+	var tokenCalls int32
+	s.conn = NewConn("zzzzz", u, true, func(ctx context.Context) ([]string, error) {
+		atomic.AddInt32(&tokenCalls, 1)
+		return []string{"token"}, nil
+	})
+	s.conn.Retries = 3
+	s.conn.RetryDelay = time.Millisecond
+
+	// Without RefreshTokens, an expired token is reported
+	// clearly, and not retried, whether or not the request is
+	// idempotent.
+	_, err = s.conn.CollectionGet(s.ctx, arvados.GetOptions{UUID: "zzzzz-4zz18-aaaaaaaaaaaaaaa"})
+	c.Check(err, check.ErrorMatches, `token expired \(rejected by remote cluster zzzzz\): .*401 Unauthorized.*`)
+	c.Check(err.(httpStatusError).HTTPStatus(), check.Equals, http.StatusUnauthorized)
+	c.Check(atomic.LoadInt32(&tokenCalls), check.Equals, int32(1))
+	c.Check(atomic.LoadInt32(&requests), check.Equals, int32(1))
+
+	atomic.StoreInt32(&requests, 0)
+	_, err = s.conn.CollectionCreate(s.ctx, arvados.CreateOptions{})
+	c.Check(err, check.ErrorMatches, `token expired \(rejected by remote cluster zzzzz\): .*401 Unauthorized.*`)
+	c.Check(err.(httpStatusError).HTTPStatus(), check.Equals, http.StatusUnauthorized)
+	c.Check(atomic.LoadInt32(&requests), check.Equals, int32(1))
+
+	// Other 401 responses are not reported as an expired
+	// token.
+	unauthorizedMsg.Store("Not logged in")
+	atomic.StoreInt32(&requests, 0)
+	_, err = s.conn.CollectionGet(s.ctx, arvados.GetOptions{UUID: "zzzzz-4zz18-aaaaaaaaaaaaaaa"})
+	c.Check(err, check.ErrorMatches, `.*401 Unauthorized.*Not logged in.*`)
+	c.Check(err, check.Not(check.ErrorMatches), `token expired.*`)
+	c.Check(err.(httpStatusError).HTTPStatus(), check.Equals, http.StatusUnauthorized)
+	c.Check(atomic.LoadInt32(&requests), check.Equals, int32(1))
+}
+
+func (s *RPCSuite) TestRefreshExpiredToken(c *check.C) {
+	var receivedTokens []string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		receivedTokens = append(receivedTokens, req.Header.Get("Authorization"))
+		if req.Header.Get("Authorization") != "Bearer token2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"errors":["Token expired"]}`))
+			return
+		}
+		w.Write([]byte(`{"uuid":"zzzzz-4zz18-aaaaaaaaaaaaaaa"}`))
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	c.Assert(err, check.IsNil)
+	s.conn = NewConn("zzzzz", u, true, func(ctx context.Context) ([]string, error) {
+		return []string{"token1"}, nil
+	})
+	var refreshed []string
+	var refreshCalls int32
+	s.conn.RefreshTokens = func(ctx context.Context) ([]string, error) {
+		atomic.AddInt32(&refreshCalls, 1)
+		return refreshed, nil
+	}
+
+	// Idempotent request is retried once with the refreshed
+	// token.
+	refreshed = []string{"token2"}
+	coll, err := s.conn.CollectionGet(s.ctx, arvados.GetOptions{UUID: "zzzzz-4zz18-aaaaaaaaaaaaaaa"})
+	c.Check(err, check.IsNil)
+	c.Check(coll.UUID, check.Equals, "zzzzz-4zz18-aaaaaaaaaaaaaaa")
+	c.Check(receivedTokens, check.DeepEquals, []string{"Bearer token1", "Bearer token2"})
+	c.Check(atomic.LoadInt32(&refreshCalls), check.Equals, int32(1))
+
+	// Non-idempotent request is not retried.
+	receivedTokens = nil
+	_, err = s.conn.CollectionCreate(s.ctx, arvados.CreateOptions{})
+	c.Check(err, check.ErrorMatches, `token expired \(rejected by remote cluster zzzzz\): .*401 Unauthorized.*`)
+	c.Check(receivedTokens, check.DeepEquals, []string{"Bearer token1"})
+	c.Check(atomic.LoadInt32(&refreshCalls), check.Equals, int32(1))
+
+	// If the refreshed token is the same one the remote just
+	// rejected, it is not sent again.
+	receivedTokens = nil
+	refreshed = []string{"token1"}
+	_, err = s.conn.CollectionGet(s.ctx, arvados.GetOptions{UUID: "zzzzz-4zz18-aaaaaaaaaaaaaaa"})
+	c.Check(err, check.ErrorMatches, `token expired \(rejected by remote cluster zzzzz\): .*401 Unauthorized.*`)
+	c.Check(receivedTokens, check.DeepEquals, []string{"Bearer token1"})
+	c.Check(atomic.LoadInt32(&refreshCalls), check.Equals, int32(2))
+
+	// If the refreshed token has also expired, the request is
+	// only retried once.
+	receivedTokens = nil
+	refreshed = []string{"token3"}
+	_, err = s.conn.CollectionGet(s.ctx, arvados.GetOptions{UUID: "zzzzz-4zz18-aaaaaaaaaaaaaaa"})
+	c.Check(err, check.ErrorMatches, `token expired \(rejected by remote cluster zzzzz\): .*401 Unauthorized.*`)
+	c.Check(receivedTokens, check.DeepEquals, []string{"Bearer token1", "Bearer token3"})
+	c.Check(atomic.LoadInt32(&refreshCalls), check.Equals, int32(3))
+}
+
+func (s *RPCSuite) TestTraceContext(c *check.C) {
+	recorder := tracetest.NewSpanRecorder()
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	var received []string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received = append(received, req.Header.Get("Traceparent"))
+		if req.Method == "DELETE" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"uuid":"zzzzz-4zz18-aaaaaaaaaaaaaaa"}`))
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	c.Assert(err, check.IsNil)
+	s.conn = NewConn("zzzzz", u, true, func(ctx context.Context) ([]string, error) {
+		return []string{arvadostest.ActiveToken}, nil
+	})
+
+	// Each forwarded operation gets its own client span, a
+	// child of the caller's span, and the remote receives a
+	// Traceparent header identifying it.
+	ctx, parent := otel.Tracer("test").Start(s.ctx, "parent")
+	_, err = s.conn.CollectionGet(ctx, arvados.GetOptions{UUID: "zzzzz-4zz18-aaaaaaaaaaaaaaa"})
+	c.Check(err, check.IsNil)
+	_, err = s.conn.CollectionDelete(ctx, arvados.DeleteOptions{UUID: "zzzzz-4zz18-aaaaaaaaaaaaaaa"})
+	c.Check(err, check.NotNil)
+	parent.End()
+
+	ended := recorder.Ended()
+	c.Assert(ended, check.HasLen, 3)
+	c.Assert(received, check.HasLen, 2)
+	for i, span := range ended[:2] {
+		c.Check(span.SpanKind(), check.Equals, trace.SpanKindClient)
+		c.Check(span.Parent().SpanID(), check.Equals, parent.SpanContext().SpanID())
+		c.Check(span.SpanContext().TraceID(), check.Equals, parent.SpanContext().TraceID())
+		c.Check(received[i], check.Equals, "00-"+span.SpanContext().TraceID().String()+"-"+span.SpanContext().SpanID().String()+"-01")
+	}
+	c.Check(ended[0].Name(), check.Equals, "GET arvados/v1/collections/{uuid}")
+	c.Check(ended[0].Status().Code, check.Equals, codes.Unset)
+	c.Check(ended[1].Status().Code, check.Equals, codes.Error)
+	c.Check(ended[1].Status().Description, check.Matches, `.*404 Not Found.*`)
+	c.Check(s.conn.SendHeader, check.IsNil)
+}
+
+func (s *RPCSuite) TestMaxHops(c *check.C) {
+	var received []string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received = append(received, req.Header.Get(HeaderMaxHops))
+		w.Write([]byte(`{"uuid":"zzzzz-4zz18-aaaaaaaaaaaaaaa"}`))
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	c.Assert(err, check.IsNil)
+	s.conn = NewConn("zzzzz", u, true, func(ctx context.Context) ([]string, error) {
+		return []string{arvadostest.ActiveToken}, nil
+	})
+	opts := arvados.GetOptions{UUID: "zzzzz-4zz18-aaaaaaaaaaaaaaa"}
+
+	// No limit configured or received: no header is sent.
+	_, err = s.conn.CollectionGet(s.ctx, opts)
+	c.Check(err, check.IsNil)
+	// No limit configured, but the incoming request had one:
+	// it still applies.
+	_, err = s.conn.CollectionGet(ContextWithMaxHops(s.ctx, 2), opts)
+	c.Check(err, check.IsNil)
+	_, err = s.conn.CollectionGet(ContextWithMaxHops(s.ctx, 0), opts)
+	c.Check(err, check.ErrorMatches, `.*maximum number of federation hops exceeded`)
+	c.Check(received, check.DeepEquals, []string{"", "1"})
+	received = nil
+
+	s.conn.MaxHops = 3
+	// Request from a client: the configured limit applies.
+	_, err = s.conn.CollectionGet(s.ctx, opts)
+	c.Check(err, check.IsNil)
+	// Request forwarded by another cluster: the lower of the two
+	// limits applies.
+	_, err = s.conn.CollectionGet(ContextWithMaxHops(s.ctx, 1), opts)
+	c.Check(err, check.IsNil)
+	_, err = s.conn.CollectionGet(ContextWithMaxHops(s.ctx, 5), opts)
+	c.Check(err, check.IsNil)
+	c.Check(received, check.DeepEquals, []string{"", "2", "0", "2"})
+
+	// No hops remaining: the request is not sent.
+	_, err = s.conn.CollectionGet(ContextWithMaxHops(s.ctx, 0), opts)
+	c.Check(err, check.ErrorMatches, `cannot forward request to cluster zzzzz: maximum number of federation hops exceeded`)
+	c.Check(err.(httpStatusError).HTTPStatus(), check.Equals, http.StatusLoopDetected)
+	c.Check(received, check.HasLen, 4)
+}
+
+// flakyTransport fails the given number of requests with a
+// connection-level error before passing requests through to next.
+type flakyTransport struct {
+	next     http.RoundTripper
+	failures int32
+	requests int32
+}
+
+func (t *flakyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&t.requests, 1)
+	if atomic.AddInt32(&t.failures, -1) >= 0 {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	}
+	return t.next.RoundTrip(req)
+}
+
+func (s *RPCSuite) TestRetryTransientErrors(c *check.C) {
+	// The server responds with the given status (and an error
+	// naming errClusterID as the originating cluster) to the
+	// next statusFailures requests.
+	var status, statusFailures int32
+	var errClusterID atomic.Value
+	errClusterID.Store("")
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&statusFailures, -1) >= 0 {
+			w.WriteHeader(int(atomic.LoadInt32(&status)))
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"errors":     []string{"stub error"},
+				"cluster_id": errClusterID.Load().(string),
+			})
+			return
+		}
+		w.Write([]byte(`{"uuid":"zzzzz-4zz18-aaaaaaaaaaaaaaa"}`))
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	c.Assert(err, check.IsNil)
+	s.conn = NewConn("zzzzz", u, true, func(ctx context.Context) ([]string, error) {
+		return []string{arvadostest.ActiveToken}, nil
+	})
+	transport := &flakyTransport{next: s.conn.httpClient.Transport}
+	s.conn.httpClient.Transport = transport
+	s.conn.Retries = 3
+	s.conn.RetryDelay = time.Millisecond
+
+	// GET succeeds after retrying.
+	atomic.StoreInt32(&transport.failures, 2)
+	coll, err := s.conn.CollectionGet(s.ctx, arvados.GetOptions{UUID: "zzzzz-4zz18-aaaaaaaaaaaaaaa"})
+	c.Check(err, check.IsNil)
+	c.Check(coll.UUID, check.Equals, "zzzzz-4zz18-aaaaaaaaaaaaaaa")
+	c.Check(atomic.LoadInt32(&transport.requests), check.Equals, int32(3))
+
+	// GET gives up after Retries retries.
+	atomic.StoreInt32(&transport.requests, 0)
+	atomic.StoreInt32(&transport.failures, 10)
+	_, err = s.conn.CollectionGet(s.ctx, arvados.GetOptions{UUID: "zzzzz-4zz18-aaaaaaaaaaaaaaa"})
+	c.Check(err, check.ErrorMatches, `.*connection refused.*`)
+	c.Check(atomic.LoadInt32(&transport.requests), check.Equals, int32(4))
+
+	// GET succeeds after the remote responds 503.
+	atomic.StoreInt32(&transport.requests, 0)
+	atomic.StoreInt32(&transport.failures, 0)
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+	atomic.StoreInt32(&statusFailures, 1)
+	_, err = s.conn.CollectionGet(s.ctx, arvados.GetOptions{UUID: "zzzzz-4zz18-aaaaaaaaaaaaaaa"})
+	c.Check(err, check.IsNil)
+	c.Check(atomic.LoadInt32(&transport.requests), check.Equals, int32(2))
+
+	// 503 is retried. 502 and 504 are retried unless the remote
+	// relayed them from another cluster it was forwarding the
+	// request to. Other error responses are not retried.
+	for _, trial := range []struct {
+		code        int
+		clusterID   string
+		expectRetry bool
+	}{
+		{http.StatusServiceUnavailable, "", true},
+		{http.StatusServiceUnavailable, "yyyyy", true},
+		{http.StatusBadGateway, "", true},
+		{http.StatusBadGateway, "zzzzz", true},
+		{http.StatusBadGateway, "yyyyy", false},
+		{http.StatusGatewayTimeout, "", true},
+		{http.StatusGatewayTimeout, "yyyyy", false},
+		{http.StatusInternalServerError, "", false},
+		{http.StatusNotFound, "", false},
+	} {
+		c.Logf("trial: %+v", trial)
+		atomic.StoreInt32(&transport.requests, 0)
+		atomic.StoreInt32(&transport.failures, 0)
+		atomic.StoreInt32(&status, int32(trial.code))
+		atomic.StoreInt32(&statusFailures, 10)
+		errClusterID.Store(trial.clusterID)
+		_, err = s.conn.CollectionGet(s.ctx, arvados.GetOptions{UUID: "zzzzz-4zz18-aaaaaaaaaaaaaaa"})
+		c.Check(err, check.ErrorMatches, fmt.Sprintf(`.*%d %s.*`, trial.code, http.StatusText(trial.code)))
+		if trial.expectRetry {
+			c.Check(atomic.LoadInt32(&transport.requests), check.Equals, int32(4))
+		} else {
+			c.Check(atomic.LoadInt32(&transport.requests), check.Equals, int32(1))
+		}
+	}
+	atomic.StoreInt32(&statusFailures, 0)
+	errClusterID.Store("")
+
+	// Non-idempotent request is not retried.
+	atomic.StoreInt32(&transport.requests, 0)
+	atomic.StoreInt32(&transport.failures, 1)
+	_, err = s.conn.CollectionCreate(s.ctx, arvados.CreateOptions{})
+	c.Check(err, check.ErrorMatches, `.*connection refused.*`)
+	c.Check(atomic.LoadInt32(&transport.requests), check.Equals, int32(1))
+
+	// Retries stop when the caller's context is cancelled.
+	atomic.StoreInt32(&transport.requests, 0)
+	atomic.StoreInt32(&transport.failures, 10)
+	s.conn.RetryDelay = time.Hour
+	ctx, cancel := context.WithTimeout(s.ctx, 100*time.Millisecond)
+	defer cancel()
+	t0 := time.Now()
+	_, err = s.conn.CollectionGet(ctx, arvados.GetOptions{UUID: "zzzzz-4zz18-aaaaaaaaaaaaaaa"})
+	c.Check(err, check.ErrorMatches, `.*connection refused.*`)
+	c.Check(time.Since(t0) < time.Minute, check.Equals, true)
+	c.Check(atomic.LoadInt32(&transport.requests), check.Equals, int32(1))
+}
+
+func (s *RPCSuite) TestTimeout(c *check.C) {
+	var requests int32
+	hang := make(chan struct{})
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		select {
+		case <-hang:
+		case <-req.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(hang)
+	u, err := url.Parse(srv.URL)
+	c.Assert(err, check.IsNil)
+	s.conn = NewConn("zzzzz", u, true, func(ctx context.Context) ([]string, error) {
+		return []string{arvadostest.ActiveToken}, nil
+	})
+	s.conn.Retries = 3
+	s.conn.RetryDelay = time.Millisecond
+	s.conn.Timeout = 200 * time.Millisecond
+
+	t0 := time.Now()
+	_, err = s.conn.CollectionGet(s.ctx, arvados.GetOptions{UUID: "zzzzz-4zz18-aaaaaaaaaaaaaaa"})
+	elapsed := time.Since(t0)
+	c.Check(err, check.ErrorMatches, `request to remote cluster zzzzz timed out after 200ms`)
+	c.Check(err.(httpStatusError).HTTPStatus(), check.Equals, http.StatusGatewayTimeout)
+	c.Check(err.(interface{ Timeout() bool }).Timeout(), check.Equals, true)
+	c.Check(errors.Is(err, context.DeadlineExceeded), check.Equals, true)
+	c.Check(elapsed >= s.conn.Timeout, check.Equals, true)
+	c.Check(elapsed < 5*time.Second, check.Equals, true)
+	// The timeout applies to the request as a whole, so there
+	// are no retries.
+	c.Check(atomic.LoadInt32(&requests), check.Equals, int32(1))
+
+	// If the caller's context is cancelled first, the caller's
+	// error is not reported as a timeout.
+	ctx, cancel := context.WithTimeout(s.ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = s.conn.CollectionGet(ctx, arvados.GetOptions{UUID: "zzzzz-4zz18-aaaaaaaaaaaaaaa"})
+	c.Check(err, check.NotNil)
+	_, isTimeout := err.(timeoutError)
+	c.Check(isTimeout, check.Equals, false)
+}
+
+func (s *RPCSuite) TestAttemptTimeout(c *check.C) {
+	// The server doesn't respond to the first hangs requests.
+	var requests, hangs int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.AddInt32(&hangs, -1) >= 0 {
+			<-req.Context().Done()
+			return
+		}
+		w.Write([]byte(`{"uuid":"zzzzz-4zz18-aaaaaaaaaaaaaaa"}`))
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	c.Assert(err, check.IsNil)
+	s.conn = NewConn("zzzzz", u, true, func(ctx context.Context) ([]string, error) {
+		return []string{arvadostest.ActiveToken}, nil
+	})
+	s.conn.Retries = 3
+	s.conn.RetryDelay = time.Millisecond
+	s.conn.AttemptTimeout = 100 * time.Millisecond
+
+	// GET succeeds after two attempts time out.
+	atomic.StoreInt32(&hangs, 2)
+	coll, err := s.conn.CollectionGet(s.ctx, arvados.GetOptions{UUID: "zzzzz-4zz18-aaaaaaaaaaaaaaa"})
+	c.Check(err, check.IsNil)
+	c.Check(coll.UUID, check.Equals, "zzzzz-4zz18-aaaaaaaaaaaaaaa")
+	c.Check(atomic.LoadInt32(&requests), check.Equals, int32(3))
+
+	// GET gives up after Retries retries.
+	atomic.StoreInt32(&requests, 0)
+	atomic.StoreInt32(&hangs, 10)
+	_, err = s.conn.CollectionGet(s.ctx, arvados.GetOptions{UUID: "zzzzz-4zz18-aaaaaaaaaaaaaaa"})
+	c.Check(err, check.ErrorMatches, `request to remote cluster zzzzz timed out after 100ms`)
+	c.Check(err.(httpStatusError).HTTPStatus(), check.Equals, http.StatusGatewayTimeout)
+	c.Check(atomic.LoadInt32(&requests), check.Equals, int32(4))
+
+	// Non-idempotent request is not retried.
+	atomic.StoreInt32(&requests, 0)
+	atomic.StoreInt32(&hangs, 1)
+	_, err = s.conn.CollectionCreate(s.ctx, arvados.CreateOptions{})
+	c.Check(err, check.ErrorMatches, `request to remote cluster zzzzz timed out after 100ms`)
+	c.Check(atomic.LoadInt32(&requests), check.Equals, int32(1))
+
+	// Conn.Timeout still limits the request as a whole.
+	atomic.StoreInt32(&requests, 0)
+	atomic.StoreInt32(&hangs, 10)
+	s.conn.Timeout = 150 * time.Millisecond
+	_, err = s.conn.CollectionGet(s.ctx, arvados.GetOptions{UUID: "zzzzz-4zz18-aaaaaaaaaaaaaaa"})
+	c.Check(err, check.ErrorMatches, `request to remote cluster zzzzz timed out after 150ms`)
+	c.Check(atomic.LoadInt32(&requests), check.Equals, int32(2))
+}
+
+func (s *RPCSuite) TestMetrics(c *check.C) {
+	var requests int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&requests, 1) > 2 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"uuid":"zzzzz-4zz18-aaaaaaaaaaaaaaa"}`))
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	c.Assert(err, check.IsNil)
+	s.conn = NewConn("zzzzz", u, true, func(ctx context.Context) ([]string, error) {
+		return []string{arvadostest.ActiveToken}, nil
+	})
+	s.conn.Metrics = NewMetrics(prometheus.NewRegistry())
+
+	for i := 0; i < 3; i++ {
+		s.conn.CollectionGet(s.ctx, arvados.GetOptions{UUID: "zzzzz-4zz18-aaaaaaaaaaaaaaa"})
+	}
+	method := "GET arvados/v1/collections/{uuid}"
+	c.Check(testutil.ToFloat64(s.conn.Metrics.requests.WithLabelValues("zzzzz", method, "200")), check.Equals, float64(2))
+	c.Check(testutil.ToFloat64(s.conn.Metrics.requests.WithLabelValues("zzzzz", method, "404")), check.Equals, float64(1))
+	c.Check(testutil.CollectAndCount(s.conn.Metrics.duration), check.Equals, 1)
+}
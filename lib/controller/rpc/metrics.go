@@ -0,0 +1,62 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package rpc
+
+import (
+	"strconv"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics records the number, outcome, and duration of requests
+// sent on one or more Conns. A single Metrics can be shared by all
+// of a process's Conns, since each observation is labeled with the
+// target cluster ID.
+type Metrics struct {
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+// NewMetrics returns a new Metrics, registered with reg.
+func NewMetrics(reg *prometheus.Registry) *Metrics {
+	m := &Metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "controller",
+			Name:      "remote_requests_total",
+			Help:      "Number of requests sent to other clusters, by target cluster, API method, and response status (\"error\" if no response was received).",
+		}, []string{"cluster", "method", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "arvados",
+			Subsystem: "controller",
+			Name:      "remote_request_duration_seconds",
+			Help:      "Time taken to get a response to a request sent to another cluster, by target cluster and API method.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+		}, []string{"cluster", "method"}),
+	}
+	reg.MustRegister(m.requests)
+	reg.MustRegister(m.duration)
+	return m
+}
+
+// observe records the outcome of one request. It is a no-op if m is
+// nil.
+func (m *Metrics) observe(clusterID string, ep arvados.APIEndpoint, err error, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	method := ep.Method + " " + ep.Path
+	status := "200"
+	if err != nil {
+		status = "error"
+		if err, ok := err.(httpStatusError); ok {
+			status = strconv.Itoa(err.HTTPStatus())
+		}
+	}
+	m.requests.WithLabelValues(clusterID, method, status).Inc()
+	m.duration.WithLabelValues(clusterID, method).Observe(elapsed.Seconds())
+}
@@ -15,11 +15,21 @@ import (
 var Command = command{}
 
 type command struct {
-	uuids      arrayFlags
-	resultsDir string
-	cache      bool
-	begin      time.Time
-	end        time.Time
+	uuids           arrayFlags
+	resultsDir      string
+	cache           bool
+	cacheDir        string
+	begin           time.Time
+	end             time.Time
+	mergeFile       string
+	budget          float64
+	clusterConfig   string
+	pricingFile     string
+	format          string
+	spotDiscount    float64
+	groupBy         string
+	noChargeOnReuse bool
+	storageRate     float64
 }
 
 // RunCommand implements the subcommand "costanalyzer <collection> <collection> ..."
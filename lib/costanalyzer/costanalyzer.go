@@ -5,6 +5,8 @@
 package costanalyzer
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -13,14 +15,18 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"git.arvados.org/arvados.git/lib/cmd"
+	"git.arvados.org/arvados.git/lib/config"
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
 	"git.arvados.org/arvados.git/sdk/go/keepclient"
+	"github.com/ghodss/yaml"
 	"github.com/sirupsen/logrus"
 )
 
@@ -42,14 +48,159 @@ type nodeInfo struct {
 	Preemptible  bool
 }
 
+// clusterPrices maps ProviderType to the instance types with that
+// ProviderType in the cluster configuration.
+type clusterPrices map[string][]arvados.InstanceType
+
+func loadClusterPrices(logger *logrus.Logger, path string) (clusterPrices, error) {
+	loader := config.NewLoader(nil, logger)
+	loader.Path = path
+	loader.SkipLegacy = true
+	loader.SkipAPICalls = true
+	cfg, err := loader.Load()
+	if err != nil {
+		return nil, err
+	}
+	cluster, err := cfg.GetCluster("")
+	if err != nil {
+		return nil, err
+	}
+	cp := clusterPrices{}
+	for _, it := range cluster.InstanceTypes {
+		cp[it.ProviderType] = append(cp[it.ProviderType], it)
+	}
+	for _, its := range cp {
+		sort.Slice(its, func(i, j int) bool { return its[i].Name < its[j].Name })
+	}
+	return cp, nil
+}
+
+// priceTable maps ProviderType to hourly price, as given in a
+// -pricing-file.
+type priceTable map[string]float64
+
+// loadPriceTable reads a JSON or YAML map of ProviderType to hourly
+// price.
+func loadPriceTable(path string) (priceTable, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var pt priceTable
+	err = yaml.Unmarshal(data, &pt)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	for k, v := range pt {
+		if v < 0 {
+			return nil, fmt.Errorf("%s: invalid price %v for %q: must not be negative", path, v, k)
+		}
+	}
+	return pt, nil
+}
+
+// lookup returns the configured instance type with the given
+// ProviderType, preferring one whose Preemptible flag matches.
+func (cp clusterPrices) lookup(providerType string, preemptible bool) (arvados.InstanceType, bool) {
+	its := cp[providerType]
+	for _, it := range its {
+		if it.Preemptible == preemptible {
+			return it, true
+		}
+	}
+	if len(its) > 0 {
+		return its[0], true
+	}
+	return arvados.InstanceType{}, false
+}
+
+// timeRange is the date range given with -begin and -end. The zero
+// value includes all containers.
+type timeRange struct {
+	begin time.Time
+	end   time.Time
+}
+
+// includes returns true if the container finished (or, if it hasn't
+// finished, started) within the range.
+func (r timeRange) includes(container arvados.Container) bool {
+	if r.begin.IsZero() {
+		return true
+	}
+	t := container.FinishedAt
+	if t == nil {
+		t = container.StartedAt
+	}
+	return t != nil && !t.Before(r.begin) && t.Before(r.end)
+}
+
+// pricing determines the hourly price of the node each container
+// ran on.
+type pricing struct {
+	// Instance types from -cluster-config, or nil to use the
+	// prices in node.json.
+	clusterPrices clusterPrices
+	// Prices from -pricing-file, which take precedence over
+	// clusterPrices and node.json, or nil.
+	priceTable priceTable
+	// Percentage discount (from -spot-discount) applied to the
+	// price of preemptible instances.
+	spotDiscount float64
+	// Charge nothing for containers that were reused from a
+	// previous container request (-no-charge-on-reuse).
+	noChargeOnReuse bool
+	// Monthly price per GB (from -storage-rate) of the data in
+	// the output and log collections, or 0 to leave out storage
+	// cost.
+	storageRate float64
+}
+
+// storageCost returns the monthly cost of storing the given number
+// of bytes.
+func (p pricing) storageCost(size int64) float64 {
+	return float64(size) / 1e9 * p.storageRate
+}
+
+// nodePrice returns the instance type and hourly price for the given
+// node.
+func (p pricing) nodePrice(logger *logrus.Logger, node nodeInfo, containerUUID string) (size string, price float64) {
+	if node.Properties.CloudNode.Price != 0 {
+		price = node.Properties.CloudNode.Price
+		size = node.Properties.CloudNode.Size
+	} else {
+		price = node.Price
+		size = node.ProviderType
+	}
+	if tablePrice, ok := p.priceTable[size]; ok {
+		price = tablePrice
+	} else if p.clusterPrices != nil {
+		if it, ok := p.clusterPrices.lookup(size, node.Preemptible); ok {
+			price = it.Price
+		} else {
+			logger.Warnf("Instance type %q for container %s not found in cluster configuration, using price from node.json", size, containerUUID)
+		}
+	}
+	if node.Preemptible && p.spotDiscount > 0 {
+		price = price * (100 - p.spotDiscount) / 100
+	}
+	return
+}
+
 type consumption struct {
 	cost     float64
 	duration float64
+	// Monthly cost of the data in the output and log
+	// collections, with -storage-rate.
+	storage float64
+	// Owner of the top level container request, used with
+	// -group-by=project. Not preserved in CSV aggregate files.
+	project string
 }
 
 func (c *consumption) Add(n consumption) {
 	c.cost += n.cost
 	c.duration += n.duration
+	c.storage += n.storage
 }
 
 type arrayFlags []string
@@ -82,6 +233,11 @@ Usage:
 	all the containers used to fulfill the container request, together with the
 	machine type and cost of each container.
 
+	When the '-output' option is '-', no files are written. Instead, the
+	aggregate cost accounting report is written to stdout (in the same
+	format as the aggregate file, so it can be used with '-merge'), and the
+	total cost is logged on stderr.
+
 	When supplied with the UUID of a container request, it will calculate the
 	cost of that container request and all its children.
 
@@ -94,13 +250,88 @@ Usage:
 	supplied UUIDs.
 
 	When supplied with a 'begin' and 'end' timestamp (format:
-	%s), it will calculate the cost for all top-level container
-	requests whose containers finished during the specified interval.
+	%s, or RFC3339), it will calculate the cost for all top-level
+	container requests whose containers finished during the specified
+	interval. If UUIDs are also supplied, container requests found
+	through those UUIDs are skipped if their containers did not finish
+	(or, if still running, start) during the interval.
 
 	The total cost calculation takes container reuse into account: if a container
 	was reused between several container requests, its cost will only be counted
 	once.
 
+	When the '-merge' option is specified, the containers listed in a previous
+	aggregate cost accounting file are combined with the results of this run,
+	producing a running total. Containers that appear in both are only counted
+	once, using the cost calculated in this run. The date range covered by the
+	merged results is noted in the new aggregate file.
+
+	When the '-cluster-config' option is specified, instance prices are
+	taken from the InstanceTypes section of the given cluster configuration
+	file, matched by ProviderType, instead of the 'node.json' file in each
+	container's log collection. If a container's instance type is not found
+	in the cluster configuration, a warning is logged and the price from
+	'node.json' is used.
+
+	When the '-pricing-file' option is specified, instance prices are
+	taken from the given JSON or YAML file, which maps ProviderType to
+	hourly price, e.g., '{"Standard_E4s_v3": 0.25}'. This can be used to
+	recompute the cost of old containers at current or negotiated rates.
+	Prices in the pricing file take precedence over '-cluster-config'
+	and 'node.json'. Instance types that are not listed in the pricing
+	file use the price from '-cluster-config' or 'node.json'.
+
+	When the '-spot-discount' option is specified, the hourly price of
+	each container that ran on a preemptible ("spot") instance is
+	reduced by the given percentage, e.g., '-spot-discount 70' uses 30%%
+	of the price from node.json (or '-cluster-config'). This can be used
+	to approximate the spot pricing in effect when the containers ran.
+
+	A container request can reuse a container that was originally run for
+	a different (earlier) container request. By default, the full cost of
+	the container is reported for each container request that used it, but
+	the container is only counted once in the aggregate report. When the
+	'-no-charge-on-reuse' option is specified, the container request that
+	reused the container reports a cost of zero, since no new compute was
+	consumed, and the container is only charged to the container request
+	that originally ran it. With this option, the UUID report has an extra
+	'Reused' column that indicates which containers were reused.
+
+	When the '-group-by project' option is specified, the aggregate report
+	also lists a subtotal for each project that owns one or more of the
+	top level container requests (on 'SUBTOTAL' lines in CSV format). The
+	cost of child containers is attributed to the project that owns the
+	top level container request.
+
+	When the '-format json' option is specified, the reports are written
+	in JSON format instead of CSV, with a '.json' extension. The UUID
+	report lists the containers with their instance type, price,
+	runtime and cost, and the total. The aggregate report lists the
+	cost of each container and the total, and can also be used with
+	'-merge'.
+
+	Unless '-cache=false' is specified, container requests and containers in a
+	final state, and the 'node.json' file of each log collection, are cached in
+	'-cache-dir' so they do not need to be fetched again by later runs. Cached
+	'node.json' files are keyed by the portable data hash of the log
+	collection, so a cached copy is not used after the collection changes.
+
+	When the '-budget' (or '-max-cost') option is specified, the program
+	exits with status 4 (after writing all reports and printing the total)
+	if the total cost exceeds the given amount, and logs a message saying
+	so on stderr. This can be used to stop a pipeline that has become too
+	expensive. The amount is in the same currency as the instance prices in
+	the cluster configuration.
+
+	When the '-storage-rate' option is specified, the reports also list
+	the monthly cost of storing the output and log collections of each
+	container request, at the given price per GB (10^9 bytes) per month.
+	The size of a collection is the total size of the distinct data
+	blocks in its manifest, so data blocks shared by the output and log
+	collections of a container request are only counted once. Storage
+	cost is reported in a separate 'Storage cost' column, and is not
+	included in the total cost (or the '-budget' check).
+
 	Caveats:
 
 	- This program uses the cost data from config.yml at the time of the
@@ -110,7 +341,8 @@ Usage:
 
 	- If a container was run on a preemptible ("spot") instance, the cost data
 	reported by this program may be wildly inaccurate, because it does not have
-	access to the spot pricing in effect for the node then the container ran. The
+	access to the spot pricing in effect for the node then the container ran
+	(see '-spot-discount' for an approximation). The
 	UUID report file that is generated when the '-output' option is specified has
 	a column that indicates the preemptible state of the instance that ran the
 	container.
@@ -118,28 +350,60 @@ Usage:
 	- This program does not take into account overhead costs like the time spent
 	starting and stopping compute nodes that run containers, the cost of the
 	permanent cloud nodes that provide the Arvados services, the cost of data
-	stored in Arvados, etc.
+	stored in Arvados (other than the output and log collections, with
+	'-storage-rate'), etc.
 
 	- When provided with a project UUID, subprojects will not be considered.
 
 	In order to get the data for the UUIDs supplied, the ARVADOS_API_HOST and
 	ARVADOS_API_TOKEN environment variables must be set.
 
-	This program prints the total dollar amount from the aggregate cost
-	accounting across all provided UUIDs on stdout.
+	Unless '-output -' is given, this program prints the total dollar amount
+	from the aggregate cost accounting across all provided UUIDs on stdout.
 
 Options:
 `, prog, timestampFormat)
 		flags.PrintDefaults()
 	}
 	loglevel := flags.String("log-level", "info", "logging `level` (debug, info, ...)")
-	flags.StringVar(&c.resultsDir, "output", "", "output `directory` for the CSV reports")
+	flags.StringVar(&c.resultsDir, "output", "", "output `directory` for the CSV reports, or \"-\" to write the aggregate report to stdout")
 	flags.StringVar(&beginStr, "begin", "", fmt.Sprintf("timestamp `begin` for date range operation (format: %s)", timestampFormat))
 	flags.StringVar(&endStr, "end", "", fmt.Sprintf("timestamp `end` for date range operation (format: %s)", timestampFormat))
 	flags.BoolVar(&c.cache, "cache", true, "create and use a local disk cache of Arvados objects")
+	flags.StringVar(&c.cacheDir, "cache-dir", "", "`directory` for the local disk cache (default ~/.cache/arvados/costanalyzer)")
+	flags.StringVar(&c.mergeFile, "merge", "", "previous aggregate cost accounting `file` to merge with the results of this run")
+	flags.StringVar(&c.clusterConfig, "cluster-config", "", "use instance prices from the cluster configuration `file` instead of node.json")
+	flags.StringVar(&c.pricingFile, "pricing-file", "", "use instance prices from the given JSON or YAML `file` (mapping ProviderType to hourly price) instead of node.json")
+	flags.Float64Var(&c.budget, "budget", 0, "exit with status 4 if the total cost exceeds `amount` (0 means no budget)")
+	flags.Float64Var(&c.budget, "max-cost", 0, "same as -budget")
+	flags.Float64Var(&c.spotDiscount, "spot-discount", 0, "discount `percentage` to apply to the price of preemptible instances")
+	flags.BoolVar(&c.noChargeOnReuse, "no-charge-on-reuse", false, "report zero cost for container requests that reused an existing container")
+	flags.StringVar(&c.groupBy, "group-by", "", "also report subtotals grouped by `attribute` in the aggregate report: project")
+	flags.StringVar(&c.format, "format", "csv", "`format` of the reports written with -output: csv or json")
+	flags.Float64Var(&c.storageRate, "storage-rate", 0, "also report the cost of the output and log collections, at `price` per GB-month (0 means no storage cost)")
 	if ok, code := cmd.ParseFlags(flags, prog, args, "[uuid ...]", stderr); !ok {
 		return false, code
 	}
+	if c.budget < 0 {
+		fmt.Fprintf(stderr, "invalid argument to -budget: must not be negative\n")
+		return false, 2
+	}
+	if c.spotDiscount < 0 || c.spotDiscount > 100 {
+		fmt.Fprintf(stderr, "invalid argument to -spot-discount: must be between 0 and 100\n")
+		return false, 2
+	}
+	if c.storageRate < 0 {
+		fmt.Fprintf(stderr, "invalid argument to -storage-rate: must not be negative\n")
+		return false, 2
+	}
+	if c.groupBy != "" && c.groupBy != "project" {
+		fmt.Fprintf(stderr, "invalid argument to -group-by: must be project\n")
+		return false, 2
+	}
+	if c.format != "csv" && c.format != "json" {
+		fmt.Fprintf(stderr, "invalid argument to -format: must be csv or json\n")
+		return false, 2
+	}
 	c.uuids = flags.Args()
 
 	if (len(beginStr) != 0 && len(endStr) == 0) || (len(beginStr) == 0 && len(endStr) != 0) {
@@ -149,15 +413,15 @@ Options:
 
 	if len(beginStr) != 0 {
 		var errB, errE error
-		c.begin, errB = time.Parse(timestampFormat, beginStr)
-		c.end, errE = time.Parse(timestampFormat, endStr)
+		c.begin, errB = parseTimestamp(beginStr)
+		c.end, errE = parseTimestamp(endStr)
 		if (errB != nil) || (errE != nil) {
 			fmt.Fprintf(stderr, "When specifying a date range, both begin and end must be of the format %s %+v, %+v\n", timestampFormat, errB, errE)
 			return false, 2
 		}
 	}
 
-	if (len(c.uuids) < 1) && (len(beginStr) == 0) {
+	if (len(c.uuids) < 1) && (len(beginStr) == 0) && (len(c.mergeFile) == 0) {
 		fmt.Fprintf(stderr, "error: no uuid(s) provided (try -help)\n")
 		return false, 2
 	}
@@ -174,6 +438,18 @@ Options:
 	return true, 0
 }
 
+// parseTimestamp parses a -begin or -end argument, which can be in
+// timestampFormat (UTC) or RFC3339 format.
+func parseTimestamp(s string) (time.Time, error) {
+	t, err := time.Parse(timestampFormat, s)
+	if err != nil {
+		if t, err2 := time.Parse(time.RFC3339, s); err2 == nil {
+			return t, nil
+		}
+	}
+	return t, err
+}
+
 func ensureDirectory(logger *logrus.Logger, dir string) (err error) {
 	statData, err := os.Stat(dir)
 	if os.IsNotExist(err) {
@@ -189,9 +465,287 @@ func ensureDirectory(logger *logrus.Logger, dir string) (err error) {
 	return
 }
 
-func addContainerLine(logger *logrus.Logger, node nodeInfo, cr arvados.ContainerRequest, container arvados.Container) (string, consumption) {
+// aggregate holds the contents of an aggregate cost accounting file.
+type aggregate struct {
+	uuids []string
+	begin time.Time
+	end   time.Time
+	cost  map[string]consumption
+	// Report subtotals per project
+	groupByProject bool
+}
+
+// projectTotals returns the total consumption of each project. Costs
+// with no known project (e.g., merged from a CSV aggregate file) are
+// not included.
+func (agg *aggregate) projectTotals() map[string]consumption {
+	totals := make(map[string]consumption)
+	for _, v := range agg.cost {
+		if v.project == "" {
+			continue
+		}
+		t := totals[v.project]
+		t.Add(v)
+		totals[v.project] = t
+	}
+	return totals
+}
+
+const (
+	aggregateHeader        = "# Aggregate cost accounting for uuids:\n# UUID, Duration in seconds, Total cost\n"
+	aggregateStorageHeader = "# Aggregate cost accounting for uuids:\n# UUID, Duration in seconds, Total cost, Storage cost\n"
+	aggregateDateRange     = "# Date range: "
+)
+
+// hasStorage returns true if any of the costs include storage cost,
+// i.e., the aggregate report needs a storage cost column.
+func (agg *aggregate) hasStorage() bool {
+	for _, v := range agg.cost {
+		if v.storage != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// aggregateJSON is the JSON version of the aggregate cost accounting
+// file.
+type aggregateJSON struct {
+	UUIDs      []string             `json:"uuids"`
+	Begin      string               `json:"begin,omitempty"`
+	End        string               `json:"end,omitempty"`
+	Containers map[string]costTotal `json:"containers"`
+	Projects   map[string]costTotal `json:"projects,omitempty"`
+	Total      costTotal            `json:"total"`
+}
+
+func (agg *aggregate) marshalJSON() ([]byte, error) {
+	aj := aggregateJSON{
+		UUIDs:      agg.uuids,
+		Containers: make(map[string]costTotal, len(agg.cost)),
+	}
+	if aj.UUIDs == nil {
+		aj.UUIDs = []string{}
+	}
+	if !agg.begin.IsZero() {
+		aj.Begin = agg.begin.Format(timestampFormat)
+		aj.End = agg.end.Format(timestampFormat)
+	}
+	for k, v := range agg.cost {
+		aj.Containers[k] = v.costTotal()
+		aj.Total.Duration += v.duration
+		aj.Total.Cost += v.cost
+		aj.Total.StorageCost += v.storage
+	}
+	if agg.groupByProject {
+		aj.Projects = make(map[string]costTotal)
+		for k, v := range agg.projectTotals() {
+			aj.Projects[k] = v.costTotal()
+		}
+	}
+	buf, err := json.MarshalIndent(aj, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, '\n'), nil
+}
+
+func unmarshalAggregateJSON(path string, data []byte) (*aggregate, error) {
+	var aj aggregateJSON
+	err := json.Unmarshal(data, &aj)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	agg := &aggregate{uuids: aj.UUIDs, cost: make(map[string]consumption)}
+	if aj.Begin != "" {
+		var errB, errE error
+		agg.begin, errB = time.Parse(timestampFormat, aj.Begin)
+		agg.end, errE = time.Parse(timestampFormat, aj.End)
+		if errB != nil || errE != nil {
+			return nil, fmt.Errorf("%s: invalid date range %q to %q", path, aj.Begin, aj.End)
+		}
+	}
+	for k, v := range aj.Containers {
+		agg.cost[k] = consumption{duration: v.Duration, cost: v.Cost, storage: v.StorageCost}
+	}
+	return agg, nil
+}
+
+// loadAggregate reads an aggregate cost accounting file (CSV or
+// JSON) previously written by costAnalyzer.
+func loadAggregate(path string) (*aggregate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		return unmarshalAggregateJSON(path, data)
+	}
+	agg := &aggregate{cost: make(map[string]consumption)}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		switch {
+		case line == "" || strings.Contains(aggregateHeader, line+"\n") || strings.Contains(aggregateStorageHeader, line+"\n"):
+		case strings.HasPrefix(line, aggregateDateRange):
+			r := strings.SplitN(strings.TrimPrefix(line, aggregateDateRange), " to ", 2)
+			if len(r) != 2 {
+				return nil, fmt.Errorf("%s:%d: invalid date range %q", path, lineno, line)
+			}
+			var errB, errE error
+			agg.begin, errB = time.Parse(timestampFormat, r[0])
+			agg.end, errE = time.Parse(timestampFormat, r[1])
+			if errB != nil || errE != nil {
+				return nil, fmt.Errorf("%s:%d: invalid date range %q", path, lineno, line)
+			}
+		case strings.HasPrefix(line, "# "):
+			agg.uuids = append(agg.uuids, strings.TrimPrefix(line, "# "))
+		case strings.HasPrefix(line, "TOTAL,"), strings.HasPrefix(line, "SUBTOTAL,"):
+		default:
+			fields := strings.Split(line, ",")
+			if len(fields) != 3 && len(fields) != 4 {
+				return nil, fmt.Errorf("%s:%d: expected 3 or 4 fields, found %d", path, lineno, len(fields))
+			}
+			var v consumption
+			var errD, errC, errS error
+			v.duration, errD = strconv.ParseFloat(fields[1], 64)
+			v.cost, errC = strconv.ParseFloat(fields[2], 64)
+			if len(fields) == 4 {
+				v.storage, errS = strconv.ParseFloat(fields[3], 64)
+			}
+			if errD != nil || errC != nil || errS != nil {
+				return nil, fmt.Errorf("%s:%d: invalid line %q", path, lineno, line)
+			}
+			agg.cost[fields[0]] = v
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return agg, nil
+}
+
+// merge adds the entries of prev that are not already present in
+// agg, and extends agg's date range to cover prev's. Entries already
+// in agg take precedence, so containers that were costed again are
+// not counted twice.
+func (agg *aggregate) merge(prev *aggregate) {
+	for k, v := range prev.cost {
+		if _, ok := agg.cost[k]; !ok {
+			agg.cost[k] = v
+		}
+	}
+	seen := make(map[string]bool)
+	for _, uuid := range agg.uuids {
+		seen[uuid] = true
+	}
+	for _, uuid := range prev.uuids {
+		if !seen[uuid] {
+			seen[uuid] = true
+			agg.uuids = append(agg.uuids, uuid)
+		}
+	}
+	if prev.begin.IsZero() {
+		return
+	}
+	if agg.begin.IsZero() || prev.begin.Before(agg.begin) {
+		agg.begin = prev.begin
+	}
+	if agg.end.IsZero() || prev.end.After(agg.end) {
+		agg.end = prev.end
+	}
+}
+
+// containerCost is the cost of a single container, as reported in
+// the per-UUID report.
+type containerCost struct {
+	ContainerRequestUUID string                 `json:"container_request_uuid"`
+	ContainerRequestName string                 `json:"container_request_name"`
+	ContainerUUID        string                 `json:"container_uuid"`
+	State                arvados.ContainerState `json:"state"`
+	StartedAt            *time.Time             `json:"started_at"`
+	FinishedAt           *time.Time             `json:"finished_at"`
+	Duration             float64                `json:"duration_seconds"`
+	InstanceType         string                 `json:"instance_type"`
+	Preemptible          bool                   `json:"preemptible"`
+	HourlyPrice          float64                `json:"hourly_price"`
+	Cost                 float64                `json:"cost"`
+	Reused               bool                   `json:"reused,omitempty"`
+	StorageSize          int64                  `json:"storage_bytes,omitempty"`
+	StorageCost          float64                `json:"storage_cost,omitempty"`
+}
+
+// costTotal is the JSON representation of a consumption.
+type costTotal struct {
+	Duration    float64 `json:"duration_seconds"`
+	Cost        float64 `json:"cost"`
+	StorageCost float64 `json:"storage_cost,omitempty"`
+}
+
+func (c consumption) costTotal() costTotal {
+	return costTotal{Duration: c.duration, Cost: c.cost, StorageCost: c.storage}
+}
+
+// crReport is the JSON version of the per-UUID report.
+type crReport struct {
+	UUID       string          `json:"uuid"`
+	Containers []containerCost `json:"containers"`
+	Total      costTotal       `json:"total"`
+}
+
+// Matches the hash and size of a block locator in a manifest,
+// without any hints.
+var blockLocatorRe = regexp.MustCompile(`^[0-9a-f]{32}\+[0-9]+`)
+
+// getStorageSize returns the total size of the distinct data blocks
+// in the output and log collections of the given container request.
+// Collections that cannot be loaded are logged and skipped.
+func getStorageSize(logger *logrus.Logger, ac *arvados.Client, cr arvados.ContainerRequest) int64 {
+	blocks := make(map[string]int64)
+	for _, uuid := range []string{cr.OutputUUID, cr.LogUUID} {
+		if uuid == "" {
+			continue
+		}
+		var coll arvados.Collection
+		err := ac.RequestAndDecode(&coll, "GET", "arvados/v1/collections/"+uuid, nil, map[string]interface{}{
+			"select":        []string{"manifest_text"},
+			"include_trash": true,
+		})
+		if err != nil {
+			logger.Warnf("Not counting storage cost of collection %s: %s", uuid, err)
+			continue
+		}
+		for _, tok := range strings.Fields(coll.ManifestText) {
+			loc := blockLocatorRe.FindString(tok)
+			if loc == "" {
+				continue
+			}
+			size, err := strconv.ParseInt(loc[33:], 10, 64)
+			if err != nil {
+				continue
+			}
+			blocks[loc] = size
+		}
+	}
+	var total int64
+	for _, size := range blocks {
+		total += size
+	}
+	return total
+}
+
+func addContainerLine(logger *logrus.Logger, prices pricing, node nodeInfo, cr arvados.ContainerRequest, container arvados.Container, reused bool, storageSize int64) (string, containerCost) {
+	cc := containerCost{
+		Reused:               reused,
+		ContainerRequestUUID: cr.UUID,
+		ContainerRequestName: cr.Name,
+		ContainerUUID:        container.UUID,
+		State:                container.State,
+		StartedAt:            container.StartedAt,
+		FinishedAt:           container.FinishedAt,
+		Preemptible:          node.Preemptible,
+	}
 	var csv string
-	var containerConsumption consumption
 	csv = cr.UUID + ","
 	csv += cr.Name + ","
 	csv += container.UUID + ","
@@ -210,19 +764,52 @@ func addContainerLine(logger *logrus.Logger, node nodeInfo, cr arvados.Container
 	} else {
 		csv += ",,"
 	}
-	var price float64
-	var size string
-	if node.Properties.CloudNode.Price != 0 {
-		price = node.Properties.CloudNode.Price
-		size = node.Properties.CloudNode.Size
-	} else {
-		price = node.Price
-		size = node.ProviderType
+	size, price := prices.nodePrice(logger, node, container.UUID)
+	cc.InstanceType = size
+	cc.HourlyPrice = price
+	cc.Cost = delta.Seconds() / 3600 * price
+	if reused && prices.noChargeOnReuse {
+		cc.Cost = 0
+	}
+	cc.Duration = delta.Seconds()
+	csv += size + "," + fmt.Sprintf("%+v", node.Preemptible) + "," + strconv.FormatFloat(price, 'f', 8, 64) + "," + strconv.FormatFloat(cc.Cost, 'f', 8, 64)
+	if prices.noChargeOnReuse {
+		csv += "," + fmt.Sprintf("%+v", reused)
 	}
-	containerConsumption.cost = delta.Seconds() / 3600 * price
-	containerConsumption.duration = delta.Seconds()
-	csv += size + "," + fmt.Sprintf("%+v", node.Preemptible) + "," + strconv.FormatFloat(price, 'f', 8, 64) + "," + strconv.FormatFloat(containerConsumption.cost, 'f', 8, 64) + "\n"
-	return csv, containerConsumption
+	if prices.storageRate > 0 {
+		cc.StorageSize = storageSize
+		cc.StorageCost = prices.storageCost(storageSize)
+		csv += "," + strconv.FormatFloat(cc.StorageCost, 'f', 8, 64)
+	}
+	csv += "\n"
+	return csv, cc
+}
+
+// isReused returns true if the container of the given container
+// request was originally run for a different container request, i.e.,
+// cr is not the oldest container request that uses it.
+func isReused(ac *arvados.Client, cr arvados.ContainerRequest) (bool, error) {
+	limit := 1
+	var resp arvados.ContainerRequestList
+	err := ac.RequestAndDecode(&resp, "GET", "arvados/v1/container_requests", nil, arvados.ResourceListParams{
+		Filters: []arvados.Filter{{
+			Attr:     "container_uuid",
+			Operator: "=",
+			Operand:  cr.ContainerUUID,
+		}},
+		Select: []string{"uuid"},
+		Limit:  &limit,
+		Order:  "created_at, uuid",
+		Count:  "none",
+	})
+	if err != nil {
+		return false, fmt.Errorf("error querying container_requests: %w", err)
+	}
+	return len(resp.Items) > 0 && resp.Items[0].UUID != cr.UUID, nil
+}
+
+func (cc containerCost) consumption() consumption {
+	return consumption{cost: cc.Cost, duration: cc.Duration, storage: cc.StorageCost}
 }
 
 func loadCachedObject(logger *logrus.Logger, file string, uuid string, object interface{}) (reload bool) {
@@ -263,30 +850,34 @@ func loadCachedObject(logger *logrus.Logger, file string, uuid string, object in
 	return
 }
 
-// Load an Arvados object.
-func loadObject(logger *logrus.Logger, ac *arvados.Client, path string, uuid string, cache bool, object interface{}) (err error) {
-	file := uuid + ".json"
-
-	var reload bool
-	var cacheDir string
-
-	if !cache {
-		reload = true
-	} else {
+// setupCacheDir returns the cache directory to use (with a trailing
+// slash), or "" if the cache cannot be used.
+func setupCacheDir(logger *logrus.Logger, cacheDir string) string {
+	if cacheDir == "" {
 		homeDir, err := os.UserHomeDir()
 		if err != nil {
-			reload = true
 			logger.Info("Unable to determine current user home directory, not using cache")
-		} else {
-			cacheDir = homeDir + "/.cache/arvados/costanalyzer/"
-			err = ensureDirectory(logger, cacheDir)
-			if err != nil {
-				reload = true
-				logger.Infof("Unable to create cache directory at %s, not using cache: %s", cacheDir, err.Error())
-			} else {
-				reload = loadCachedObject(logger, cacheDir+file, uuid, object)
-			}
+			return ""
 		}
+		cacheDir = homeDir + "/.cache/arvados/costanalyzer"
+	}
+	cacheDir = strings.TrimSuffix(cacheDir, "/") + "/"
+	err := ensureDirectory(logger, cacheDir)
+	if err != nil {
+		logger.Infof("Unable to create cache directory at %s, not using cache: %s", cacheDir, err.Error())
+		return ""
+	}
+	return cacheDir
+}
+
+// Load an Arvados object. If cacheDir is not empty, use (and
+// update) the cached copy in cacheDir.
+func loadObject(logger *logrus.Logger, ac *arvados.Client, path string, uuid string, cacheDir string, object interface{}) (err error) {
+	file := uuid + ".json"
+
+	reload := true
+	if cacheDir != "" {
+		reload = loadCachedObject(logger, cacheDir+file, uuid, object)
 	}
 	if !reload {
 		return
@@ -323,7 +914,10 @@ func loadObject(logger *logrus.Logger, ac *arvados.Client, path string, uuid str
 	return
 }
 
-func getNode(arv *arvadosclient.ArvadosClient, ac *arvados.Client, kc *keepclient.KeepClient, cr arvados.ContainerRequest) (node nodeInfo, err error) {
+// getNode returns the contents of the node.json file in the log
+// collection of the given container request. If cacheDir is not
+// empty, use (and update) the cached copy in cacheDir.
+func getNode(logger *logrus.Logger, arv *arvadosclient.ArvadosClient, ac *arvados.Client, kc *keepclient.KeepClient, cr arvados.ContainerRequest, cacheDir string) (node nodeInfo, err error) {
 	if cr.LogUUID == "" {
 		err = errors.New("no log collection")
 		return
@@ -336,6 +930,24 @@ func getNode(arv *arvadosclient.ArvadosClient, ac *arvados.Client, kc *keepclien
 		return
 	}
 
+	// The cache is keyed by portable data hash, so a cached
+	// node.json is never used after the collection changes.
+	var cacheFile string
+	if cacheDir != "" && collection.PortableDataHash != "" {
+		cacheFile = cacheDir + "node-" + collection.PortableDataHash + ".json"
+		data, err := ioutil.ReadFile(cacheFile)
+		if err == nil {
+			err = json.Unmarshal(data, &node)
+			if err == nil {
+				logger.Debugf("Loaded node.json for %s from local cache (%s)", cr.LogUUID, cacheFile)
+				return node, nil
+			}
+			logger.Errorf("failed to unmarshal cached node.json %s, removing: %s", cacheFile, err)
+			os.Remove(cacheFile)
+		}
+		node = nodeInfo{}
+	}
+
 	var fs arvados.CollectionFileSystem
 	fs, err = collection.FileSystem(ac, kc)
 	if err != nil {
@@ -348,12 +960,23 @@ func getNode(arv *arvadosclient.ArvadosClient, ac *arvados.Client, kc *keepclien
 		err = fmt.Errorf("error opening file 'node.json' in collection %s: %s", cr.LogUUID, err)
 		return
 	}
+	defer f.Close()
 
-	err = json.NewDecoder(f).Decode(&node)
+	data, err := ioutil.ReadAll(f)
+	if err == nil {
+		err = json.Unmarshal(data, &node)
+	}
 	if err != nil {
 		err = fmt.Errorf("error reading file 'node.json' in collection %s: %s", cr.LogUUID, err)
 		return
 	}
+	if cacheFile != "" {
+		err = ioutil.WriteFile(cacheFile, data, 0644)
+		if err != nil {
+			logger.Errorf("error writing file %s: %s", cacheFile, err)
+			err = nil
+		}
+	}
 	return
 }
 
@@ -386,11 +1009,11 @@ func getContainerRequests(ac *arvados.Client, filters []arvados.Filter) ([]arvad
 	}
 }
 
-func handleProject(logger *logrus.Logger, uuid string, arv *arvadosclient.ArvadosClient, ac *arvados.Client, kc *keepclient.KeepClient, resultsDir string, cache bool) (cost map[string]consumption, err error) {
+func handleProject(logger *logrus.Logger, uuid string, arv *arvadosclient.ArvadosClient, ac *arvados.Client, kc *keepclient.KeepClient, prices pricing, window timeRange, resultsDir string, format string, cacheDir string) (cost map[string]consumption, err error) {
 	cost = make(map[string]consumption)
 
 	var project arvados.Group
-	err = loadObject(logger, ac, uuid, uuid, cache, &project)
+	err = loadObject(logger, ac, uuid, uuid, cacheDir, &project)
 	if err != nil {
 		return nil, fmt.Errorf("error loading object %s: %s", uuid, err.Error())
 	}
@@ -415,7 +1038,7 @@ func handleProject(logger *logrus.Logger, uuid string, arv *arvadosclient.Arvado
 	}
 	logger.Infof("Collecting top level container requests in project %s", uuid)
 	for _, cr := range allItems {
-		crInfo, err := generateCrInfo(logger, cr.UUID, arv, ac, kc, resultsDir, cache)
+		crInfo, err := generateCrInfo(logger, cr.UUID, arv, ac, kc, prices, window, resultsDir, format, cacheDir)
 		if err != nil {
 			return nil, fmt.Errorf("error generating container_request CSV for %s: %s", cr.UUID, err)
 		}
@@ -426,20 +1049,29 @@ func handleProject(logger *logrus.Logger, uuid string, arv *arvadosclient.Arvado
 	return
 }
 
-func generateCrInfo(logger *logrus.Logger, uuid string, arv *arvadosclient.ArvadosClient, ac *arvados.Client, kc *keepclient.KeepClient, resultsDir string, cache bool) (cost map[string]consumption, err error) {
+func generateCrInfo(logger *logrus.Logger, uuid string, arv *arvadosclient.ArvadosClient, ac *arvados.Client, kc *keepclient.KeepClient, prices pricing, window timeRange, resultsDir string, format string, cacheDir string) (cost map[string]consumption, err error) {
 
 	cost = make(map[string]consumption)
 
-	csv := "CR UUID,CR name,Container UUID,State,Started At,Finished At,Duration in seconds,Compute node type,Preemptible,Hourly node cost,Total cost\n"
+	csv := "CR UUID,CR name,Container UUID,State,Started At,Finished At,Duration in seconds,Compute node type,Preemptible,Hourly node cost,Total cost"
+	if prices.noChargeOnReuse {
+		csv += ",Reused"
+	}
+	if prices.storageRate > 0 {
+		csv += ",Storage cost"
+	}
+	csv += "\n"
 	var tmpCsv string
-	var total, tmpTotal consumption
+	var cc containerCost
+	var containers []containerCost
+	var total consumption
 	logger.Debugf("Processing %s", uuid)
 
 	var crUUID = uuid
 	if strings.Contains(uuid, "-4zz18-") {
 		// This is a collection, find the associated container request (if any)
 		var c arvados.Collection
-		err = loadObject(logger, ac, uuid, uuid, cache, &c)
+		err = loadObject(logger, ac, uuid, uuid, cacheDir, &c)
 		if err != nil {
 			return nil, fmt.Errorf("error loading collection object %s: %s", uuid, err)
 		}
@@ -455,7 +1087,7 @@ func generateCrInfo(logger *logrus.Logger, uuid string, arv *arvadosclient.Arvad
 
 	// This is a container request, find the container
 	var cr arvados.ContainerRequest
-	err = loadObject(logger, ac, crUUID, crUUID, cache, &cr)
+	err = loadObject(logger, ac, crUUID, crUUID, cacheDir, &cr)
 	if err != nil {
 		return nil, fmt.Errorf("error loading cr object %s: %s", uuid, err)
 	}
@@ -465,19 +1097,40 @@ func generateCrInfo(logger *logrus.Logger, uuid string, arv *arvadosclient.Arvad
 		return nil, nil
 	}
 	var container arvados.Container
-	err = loadObject(logger, ac, crUUID, cr.ContainerUUID, cache, &container)
+	err = loadObject(logger, ac, crUUID, cr.ContainerUUID, cacheDir, &container)
 	if err != nil {
 		return nil, fmt.Errorf("error loading container object %s: %s", cr.ContainerUUID, err)
 	}
+	if !window.includes(container) {
+		logger.Debugf("Skipping container request %s: container %s is outside the requested date range", crUUID, container.UUID)
+		return nil, nil
+	}
 
-	topNode, err := getNode(arv, ac, kc, cr)
+	topNode, err := getNode(logger, arv, ac, kc, cr, cacheDir)
 	if err != nil {
 		logger.Errorf("Skipping container request %s: error getting node %s: %s", cr.UUID, cr.UUID, err)
 		return nil, nil
 	}
-	tmpCsv, total = addContainerLine(logger, topNode, cr, container)
+	var reused bool
+	if prices.noChargeOnReuse {
+		reused, err = isReused(ac, cr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var storageSize int64
+	if prices.storageRate > 0 {
+		storageSize = getStorageSize(logger, ac, cr)
+	}
+	tmpCsv, cc = addContainerLine(logger, prices, topNode, cr, container, reused, storageSize)
 	csv += tmpCsv
-	cost[container.UUID] = total
+	containers = append(containers, cc)
+	total = cc.consumption()
+	if !reused || !prices.noChargeOnReuse {
+		// With -no-charge-on-reuse, a reused container is
+		// charged to the container request that ran it.
+		cost[container.UUID] = consumption{cost: cc.Cost, duration: cc.Duration, storage: cc.StorageCost, project: cr.OwnerUUID}
+	}
 
 	// Find all container requests that have the container we
 	// found above as requesting_container_uuid.
@@ -495,30 +1148,62 @@ func generateCrInfo(logger *logrus.Logger, uuid string, arv *arvadosclient.Arvad
 			logger.Infof("... %d of %d", i+1, len(allItems))
 		default:
 		}
-		node, err := getNode(arv, ac, kc, cr2)
+		node, err := getNode(logger, arv, ac, kc, cr2, cacheDir)
 		if err != nil {
 			logger.Errorf("Skipping container request %s: error getting node %s: %s", cr2.UUID, cr2.UUID, err)
 			continue
 		}
 		logger.Debug("Child container: " + cr2.ContainerUUID)
 		var c2 arvados.Container
-		err = loadObject(logger, ac, cr.UUID, cr2.ContainerUUID, cache, &c2)
+		err = loadObject(logger, ac, cr.UUID, cr2.ContainerUUID, cacheDir, &c2)
 		if err != nil {
 			return nil, fmt.Errorf("error loading object %s: %s", cr2.ContainerUUID, err)
 		}
-		tmpCsv, tmpTotal = addContainerLine(logger, node, cr2, c2)
-		cost[cr2.ContainerUUID] = tmpTotal
+		var reused bool
+		if prices.noChargeOnReuse {
+			reused, err = isReused(ac, cr2)
+			if err != nil {
+				return nil, err
+			}
+		}
+		var storageSize int64
+		if prices.storageRate > 0 {
+			storageSize = getStorageSize(logger, ac, cr2)
+		}
+		tmpCsv, cc = addContainerLine(logger, prices, node, cr2, c2, reused, storageSize)
+		if !reused || !prices.noChargeOnReuse {
+			cost[cr2.ContainerUUID] = consumption{cost: cc.Cost, duration: cc.Duration, storage: cc.StorageCost, project: cr.OwnerUUID}
+		}
 		csv += tmpCsv
-		total.Add(tmpTotal)
+		containers = append(containers, cc)
+		total.Add(cc.consumption())
 	}
 	logger.Debug("Done collecting child containers")
 
-	csv += "TOTAL,,,,,," + strconv.FormatFloat(total.duration, 'f', 3, 64) + ",,,," + strconv.FormatFloat(total.cost, 'f', 2, 64) + "\n"
+	csv += "TOTAL,,,,,," + strconv.FormatFloat(total.duration, 'f', 3, 64) + ",,,," + strconv.FormatFloat(total.cost, 'f', 2, 64)
+	if prices.noChargeOnReuse {
+		csv += ","
+	}
+	if prices.storageRate > 0 {
+		csv += "," + strconv.FormatFloat(total.storage, 'f', 2, 64)
+	}
+	csv += "\n"
 
 	if resultsDir != "" {
-		// Write the resulting CSV file
-		fName := resultsDir + "/" + crUUID + ".csv"
-		err = ioutil.WriteFile(fName, []byte(csv), 0644)
+		// Write the resulting CSV (or JSON) file
+		fName := resultsDir + "/" + crUUID + "." + format
+		data := []byte(csv)
+		if format == "json" {
+			data, err = json.MarshalIndent(crReport{
+				UUID:       crUUID,
+				Containers: containers,
+				Total:      total.costTotal(),
+			}, "", "  ")
+			if err != nil {
+				return nil, fmt.Errorf("error encoding JSON report for %s: %s", crUUID, err)
+			}
+		}
+		err = ioutil.WriteFile(fName, data, 0644)
 		if err != nil {
 			return nil, fmt.Errorf("error writing file with path %s: %s", fName, err.Error())
 		}
@@ -534,14 +1219,42 @@ func (c *command) costAnalyzer(prog string, args []string, logger *logrus.Logger
 	if !ok {
 		return
 	}
-	if c.resultsDir != "" {
-		err = ensureDirectory(logger, c.resultsDir)
+	toStdout := c.resultsDir == "-"
+	resultsDir := c.resultsDir
+	if toStdout {
+		resultsDir = ""
+	}
+	if resultsDir != "" {
+		err = ensureDirectory(logger, resultsDir)
 		if err != nil {
 			exitcode = 3
 			return
 		}
 	}
 
+	prices := pricing{spotDiscount: c.spotDiscount, noChargeOnReuse: c.noChargeOnReuse, storageRate: c.storageRate}
+	if c.clusterConfig != "" {
+		prices.clusterPrices, err = loadClusterPrices(logger, c.clusterConfig)
+		if err != nil {
+			err = fmt.Errorf("error loading cluster configuration: %s", err)
+			exitcode = 1
+			return
+		}
+	}
+	if c.pricingFile != "" {
+		prices.priceTable, err = loadPriceTable(c.pricingFile)
+		if err != nil {
+			err = fmt.Errorf("error loading pricing file: %s", err)
+			exitcode = 1
+			return
+		}
+	}
+
+	var cacheDir string
+	if c.cache {
+		cacheDir = setupCacheDir(logger, c.cacheDir)
+	}
+
 	uuidChannel := make(chan string)
 
 	// Arvados Client setup
@@ -599,23 +1312,25 @@ func (c *command) costAnalyzer(prog string, args []string, logger *logrus.Logger
 	}()
 
 	cost := make(map[string]consumption)
+	window := timeRange{begin: c.begin, end: c.end}
 
 	for uuid := range uuidChannel {
 		logger.Debugf("Considering %s", uuid)
 		if strings.Contains(uuid, "-j7d0g-") {
 			// This is a project (group)
-			cost, err = handleProject(logger, uuid, arv, ac, kc, c.resultsDir, c.cache)
+			var projectCost map[string]consumption
+			projectCost, err = handleProject(logger, uuid, arv, ac, kc, prices, window, resultsDir, c.format, cacheDir)
 			if err != nil {
 				exitcode = 1
 				return
 			}
-			for k, v := range cost {
+			for k, v := range projectCost {
 				cost[k] = v
 			}
 		} else if strings.Contains(uuid, "-xvhdp-") || strings.Contains(uuid, "-4zz18-") {
 			// This is a container request or collection
 			var crInfo map[string]consumption
-			crInfo, err = generateCrInfo(logger, uuid, arv, ac, kc, c.resultsDir, c.cache)
+			crInfo, err = generateCrInfo(logger, uuid, arv, ac, kc, prices, window, resultsDir, c.format, cacheDir)
 			if err != nil {
 				err = fmt.Errorf("error generating CSV for uuid %s: %s", uuid, err.Error())
 				exitcode = 2
@@ -637,30 +1352,97 @@ func (c *command) costAnalyzer(prog string, args []string, logger *logrus.Logger
 		}
 	}
 
-	if len(cost) == 0 {
+	agg := &aggregate{
+		uuids: c.uuids,
+		begin: c.begin,
+		end:   c.end,
+		cost:  cost,
+
+		groupByProject: c.groupBy == "project",
+	}
+	if c.mergeFile != "" {
+		var prev *aggregate
+		prev, err = loadAggregate(c.mergeFile)
+		if err != nil {
+			err = fmt.Errorf("error loading aggregate file to merge: %s", err)
+			exitcode = 1
+			return
+		}
+		agg.merge(prev)
+		logger.Infof("Merged %d containers from %s", len(prev.cost), c.mergeFile)
+	}
+
+	if len(agg.cost) == 0 {
 		logger.Info("Nothing to do!")
 		return
 	}
 
 	var csv string
 
-	csv = "# Aggregate cost accounting for uuids:\n# UUID, Duration in seconds, Total cost\n"
-	for _, uuid := range c.uuids {
+	withStorage := agg.hasStorage()
+	// storageField returns the storage cost column of an
+	// aggregate CSV line, if there is one.
+	storageField := func(v consumption, prec int) string {
+		if !withStorage {
+			return ""
+		}
+		return "," + strconv.FormatFloat(v.storage, 'f', prec, 64)
+	}
+
+	csv = aggregateHeader
+	if withStorage {
+		csv = aggregateStorageHeader
+	}
+	if !agg.begin.IsZero() {
+		csv += aggregateDateRange + agg.begin.Format(timestampFormat) + " to " + agg.end.Format(timestampFormat) + "\n"
+	}
+	for _, uuid := range agg.uuids {
 		csv += "# " + uuid + "\n"
 	}
 
 	var total consumption
-	for k, v := range cost {
-		csv += k + "," + strconv.FormatFloat(v.duration, 'f', 3, 64) + "," + strconv.FormatFloat(v.cost, 'f', 8, 64) + "\n"
+	for k, v := range agg.cost {
+		csv += k + "," + strconv.FormatFloat(v.duration, 'f', 3, 64) + "," + strconv.FormatFloat(v.cost, 'f', 8, 64) + storageField(v, 8) + "\n"
 		total.Add(v)
 	}
 
-	csv += "TOTAL," + strconv.FormatFloat(total.duration, 'f', 3, 64) + "," + strconv.FormatFloat(total.cost, 'f', 2, 64) + "\n"
+	if agg.groupByProject {
+		totals := agg.projectTotals()
+		var projects []string
+		for k := range totals {
+			projects = append(projects, k)
+		}
+		sort.Strings(projects)
+		for _, k := range projects {
+			csv += "SUBTOTAL," + k + "," + strconv.FormatFloat(totals[k].duration, 'f', 3, 64) + "," + strconv.FormatFloat(totals[k].cost, 'f', 2, 64) + storageField(totals[k], 2) + "\n"
+		}
+	}
 
-	if c.resultsDir != "" {
-		// Write the resulting CSV file
-		aFile := c.resultsDir + "/" + time.Now().Format("2006-01-02-15-04-05") + "-aggregate-costaccounting.csv"
-		err = ioutil.WriteFile(aFile, []byte(csv), 0644)
+	csv += "TOTAL," + strconv.FormatFloat(total.duration, 'f', 3, 64) + "," + strconv.FormatFloat(total.cost, 'f', 2, 64) + storageField(total, 2) + "\n"
+
+	report := []byte(csv)
+	if c.format == "json" {
+		report, err = agg.marshalJSON()
+		if err != nil {
+			err = fmt.Errorf("error encoding JSON aggregate report: %s", err)
+			exitcode = 1
+			return
+		}
+	}
+
+	if toStdout {
+		// Write the aggregate report on stdout, and keep
+		// stdout free of anything else.
+		stdout.Write(report)
+		logger.Infof("Total cost: %s", strconv.FormatFloat(total.cost, 'f', 2, 64))
+	}
+	if withStorage {
+		logger.Infof("Total storage cost per month: %s", strconv.FormatFloat(total.storage, 'f', 2, 64))
+	}
+	if resultsDir != "" {
+		// Write the resulting CSV (or JSON) file
+		aFile := resultsDir + "/" + time.Now().Format("2006-01-02-15-04-05") + "-aggregate-costaccounting." + c.format
+		err = ioutil.WriteFile(aFile, report, 0644)
 		if err != nil {
 			err = fmt.Errorf("error writing file with path %s: %s", aFile, err.Error())
 			exitcode = 1
@@ -669,8 +1451,15 @@ func (c *command) costAnalyzer(prog string, args []string, logger *logrus.Logger
 		logger.Infof("Aggregate cost accounting for all supplied uuids in %s", aFile)
 	}
 
-	// Output the total dollar amount on stdout
-	fmt.Fprintf(stdout, "%s\n", strconv.FormatFloat(total.cost, 'f', 2, 64))
+	if !toStdout {
+		// Output the total dollar amount on stdout
+		fmt.Fprintf(stdout, "%s\n", strconv.FormatFloat(total.cost, 'f', 2, 64))
+	}
+
+	if c.budget > 0 && total.cost > c.budget {
+		logger.Warnf("Total cost %s exceeds budget %s", strconv.FormatFloat(total.cost, 'f', 2, 64), strconv.FormatFloat(c.budget, 'f', -1, 64))
+		exitcode = 4
+	}
 
 	return
 }
@@ -6,10 +6,13 @@ package costanalyzer
 
 import (
 	"bytes"
+	"encoding/json"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"testing"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
@@ -318,6 +321,138 @@ func (*Suite) TestDoubleContainerRequestUUID(c *check.C) {
 	c.Check(string(aggregateCostReport), check.Matches, "(?ms).*TOTAL,172924.000,49.28")
 }
 
+func (*Suite) TestTwoProjectUUIDs(c *check.C) {
+	// Put the container requests in two different projects, and
+	// run the analysis with both project uuids. The costs from
+	// both projects should be included.
+	ac := arvados.NewClientFromEnv()
+	for uuid, owner := range map[string]string{
+		arvadostest.CompletedContainerRequestUUID:  arvadostest.AProjectUUID,
+		arvadostest.CompletedContainerRequestUUID2: arvadostest.ASubprojectUUID,
+	} {
+		var cr arvados.ContainerRequest
+		err := ac.RequestAndDecode(&cr, "PUT", "arvados/v1/container_requests/"+uuid, nil, map[string]interface{}{
+			"container_request": map[string]interface{}{
+				"owner_uuid": owner,
+			},
+		})
+		c.Assert(err, check.IsNil)
+	}
+
+	var stdout, stderr bytes.Buffer
+	resultsDir := c.MkDir()
+	exitcode := Command.RunCommand("costanalyzer.test", []string{"-cache=false", "-output", resultsDir, arvadostest.AProjectUUID, arvadostest.ASubprojectUUID}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 0)
+	c.Check(stdout.String(), check.Equals, "49.28\n")
+
+	matches := regexp.MustCompile(`(?ms).*supplied uuids in (.*?)\n`).FindStringSubmatch(stderr.String())
+	c.Assert(matches, check.HasLen, 2)
+	aggregateCostReport, err := ioutil.ReadFile(matches[1])
+	c.Assert(err, check.IsNil)
+	c.Check(string(aggregateCostReport), check.Matches, "(?ms).*TOTAL,172924.000,49.28")
+}
+
+func (*Suite) TestGroupByProject(c *check.C) {
+	// Move both container requests into an existing project (as
+	// in TestDoubleContainerRequestUUID).
+	ac := arvados.NewClientFromEnv()
+	for _, uuid := range []string{arvadostest.CompletedContainerRequestUUID, arvadostest.CompletedContainerRequestUUID2} {
+		var cr arvados.ContainerRequest
+		err := ac.RequestAndDecode(&cr, "PUT", "arvados/v1/container_requests/"+uuid, nil, map[string]interface{}{
+			"container_request": map[string]interface{}{
+				"owner_uuid": arvadostest.AProjectUUID,
+			},
+		})
+		c.Assert(err, check.IsNil)
+	}
+
+	var stdout, stderr bytes.Buffer
+	resultsDir := c.MkDir()
+	exitcode := Command.RunCommand("costanalyzer.test", []string{"-cache=false", "-group-by", "project", "-format", "json", "-output", resultsDir, arvadostest.CompletedContainerRequestUUID, arvadostest.CompletedContainerRequestUUID2}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 0)
+	c.Check(stdout.String(), check.Equals, "49.28\n")
+
+	var crTotal float64
+	for _, uuid := range []string{arvadostest.CompletedContainerRequestUUID, arvadostest.CompletedContainerRequestUUID2} {
+		buf, err := ioutil.ReadFile(resultsDir + "/" + uuid + ".json")
+		c.Assert(err, check.IsNil)
+		var report crReport
+		c.Assert(json.Unmarshal(buf, &report), check.IsNil)
+		crTotal += report.Total.Cost
+	}
+
+	matches := regexp.MustCompile(`(?ms).*supplied uuids in (.*?)\n`).FindStringSubmatch(stderr.String())
+	c.Assert(matches, check.HasLen, 2)
+	buf, err := ioutil.ReadFile(matches[1])
+	c.Assert(err, check.IsNil)
+	var agg aggregateJSON
+	c.Assert(json.Unmarshal(buf, &agg), check.IsNil)
+	c.Check(agg.Projects, check.HasLen, 1)
+	c.Check(strconv.FormatFloat(agg.Projects[arvadostest.AProjectUUID].Cost, 'f', 8, 64), check.Equals, strconv.FormatFloat(crTotal, 'f', 8, 64))
+	c.Check(agg.Projects[arvadostest.AProjectUUID].Duration, check.Equals, 172924.0)
+
+	// In CSV format, the subtotal is on a SUBTOTAL line, which is
+	// ignored by -merge.
+	stdout.Truncate(0)
+	stderr.Truncate(0)
+	exitcode = Command.RunCommand("costanalyzer.test", []string{"-cache=false", "-group-by", "project", "-output", "-", arvadostest.CompletedContainerRequestUUID, arvadostest.CompletedContainerRequestUUID2}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 0)
+	c.Check(stdout.String(), check.Matches, "(?ms).*\nSUBTOTAL,"+arvadostest.AProjectUUID+",172924.000,49.28\nTOTAL,172924.000,49.28\n")
+	aFile := c.MkDir() + "/aggregate.csv"
+	c.Assert(ioutil.WriteFile(aFile, stdout.Bytes(), 0644), check.IsNil)
+	prev, err := loadAggregate(aFile)
+	c.Assert(err, check.IsNil)
+	var total consumption
+	for _, v := range prev.cost {
+		total.Add(v)
+	}
+	c.Check(strconv.FormatFloat(total.cost, 'f', 2, 64), check.Equals, "49.28")
+
+	// Unsupported grouping
+	stderr.Truncate(0)
+	exitcode = Command.RunCommand("costanalyzer.test", []string{"-group-by", "user", arvadostest.CompletedContainerRequestUUID}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 2)
+	c.Check(stderr.String(), check.Matches, `(?ms).*invalid argument to -group-by.*`)
+}
+
+func (*Suite) TestNodeCache(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	cacheDir := c.MkDir()
+	args := []string{"-cache-dir", cacheDir, "-log-level", "debug", arvadostest.CompletedContainerRequestUUID}
+
+	exitcode := Command.RunCommand("costanalyzer.test", args, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 0)
+	c.Check(stdout.String(), check.Equals, "7.01\n")
+	c.Check(stderr.String(), check.Not(check.Matches), `(?ms).*Loaded node.json .* from local cache.*`)
+	cached, err := filepath.Glob(cacheDir + "/node-*.json")
+	c.Assert(err, check.IsNil)
+	c.Check(cached, check.Not(check.HasLen), 0)
+
+	// The second run uses the cached node.json files.
+	stdout.Truncate(0)
+	stderr.Truncate(0)
+	exitcode = Command.RunCommand("costanalyzer.test", args, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 0)
+	c.Check(stdout.String(), check.Equals, "7.01\n")
+	c.Check(stderr.String(), check.Matches, `(?ms).*Loaded node.json for .* from local cache \(`+regexp.QuoteMeta(cacheDir)+`/node-.*`)
+
+	// A corrupt cache entry is removed and fetched again.
+	for _, fnm := range cached {
+		c.Assert(ioutil.WriteFile(fnm, []byte("{"), 0644), check.IsNil)
+	}
+	stdout.Truncate(0)
+	stderr.Truncate(0)
+	exitcode = Command.RunCommand("costanalyzer.test", args, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 0)
+	c.Check(stdout.String(), check.Equals, "7.01\n")
+	c.Check(stderr.String(), check.Matches, `(?ms).*failed to unmarshal cached node.json.*`)
+	for _, fnm := range cached {
+		buf, err := ioutil.ReadFile(fnm)
+		c.Assert(err, check.IsNil)
+		c.Check(json.Valid(buf), check.Equals, true)
+	}
+}
+
 func (*Suite) TestUncommittedContainerRequest(c *check.C) {
 	var stdout, stderr bytes.Buffer
 	// Run costanalyzer with 2 container request uuids, one of which is in the Uncommitted state, without output directory specified
@@ -365,3 +500,482 @@ func (*Suite) TestMultipleContainerRequestUUIDWithReuse(c *check.C) {
 
 	c.Check(string(aggregateCostReport), check.Matches, "(?ms).*TOTAL,1245.564,0.01")
 }
+
+func (*Suite) TestNoChargeOnReuse(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	resultsDir := c.MkDir()
+	// The child containers of CompletedDiagnosticsContainerRequest2UUID
+	// were reused from CompletedDiagnosticsContainerRequest1UUID.
+	exitcode := Command.RunCommand("costanalyzer.test", []string{"-no-charge-on-reuse", "-format", "json", "-output", resultsDir, arvadostest.CompletedDiagnosticsContainerRequest1UUID, arvadostest.CompletedDiagnosticsContainerRequest2UUID}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 0)
+
+	loadReport := func(uuid string) crReport {
+		buf, err := ioutil.ReadFile(resultsDir + "/" + uuid + ".json")
+		c.Assert(err, check.IsNil)
+		var report crReport
+		c.Assert(json.Unmarshal(buf, &report), check.IsNil)
+		return report
+	}
+	reports := map[string]crReport{
+		arvadostest.CompletedDiagnosticsContainerRequest1UUID: loadReport(arvadostest.CompletedDiagnosticsContainerRequest1UUID),
+		arvadostest.CompletedDiagnosticsContainerRequest2UUID: loadReport(arvadostest.CompletedDiagnosticsContainerRequest2UUID),
+	}
+	original := map[string]containerCost{}
+	for _, cc := range reports[arvadostest.CompletedDiagnosticsContainerRequest1UUID].Containers {
+		c.Check(cc.Reused, check.Equals, false)
+		c.Check(cc.Cost > 0, check.Equals, true)
+		original[cc.ContainerUUID] = cc
+	}
+	var reusedCount int
+	for _, cc := range reports[arvadostest.CompletedDiagnosticsContainerRequest2UUID].Containers {
+		if _, ok := original[cc.ContainerUUID]; ok {
+			reusedCount++
+			c.Check(cc.Reused, check.Equals, true)
+			c.Check(cc.Cost, check.Equals, 0.0)
+		} else {
+			c.Check(cc.Reused, check.Equals, false)
+			c.Check(cc.Cost > 0, check.Equals, true)
+		}
+	}
+	c.Check(reusedCount, check.Equals, 3)
+
+	// The reused containers are still charged (once) in the
+	// aggregate report.
+	matches := regexp.MustCompile(`(?ms).*supplied uuids in (.*?)\n`).FindStringSubmatch(stderr.String())
+	c.Assert(matches, check.HasLen, 2)
+	buf, err := ioutil.ReadFile(matches[1])
+	c.Assert(err, check.IsNil)
+	var agg aggregateJSON
+	c.Assert(json.Unmarshal(buf, &agg), check.IsNil)
+	for uuid, cc := range original {
+		c.Check(agg.Containers[uuid].Cost, check.Equals, cc.Cost)
+	}
+
+	// The CSV report indicates reuse.
+	stdout.Truncate(0)
+	stderr.Truncate(0)
+	exitcode = Command.RunCommand("costanalyzer.test", []string{"-no-charge-on-reuse", "-output", resultsDir, arvadostest.CompletedDiagnosticsContainerRequest2UUID}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 0)
+	uuidReport, err := ioutil.ReadFile(resultsDir + "/" + arvadostest.CompletedDiagnosticsContainerRequest2UUID + ".csv")
+	c.Assert(err, check.IsNil)
+	c.Check(string(uuidReport), check.Matches, `(?ms)CR UUID,.*,Total cost,Reused\n.*`)
+	c.Check(string(uuidReport), check.Matches, `(?ms).*,`+arvadostest.CompletedDiagnosticsHasher1ContainerUUID+`,.*,0\.00000000,true\n.*`)
+	c.Check(string(uuidReport), check.Matches, `(?ms).*,`+arvadostest.CompletedDiagnosticsContainer2UUID+`,.*,[0-9.]+,false\n.*`)
+	c.Check(string(uuidReport), check.Matches, `(?ms).*TOTAL,,,,,,488\.775,,,,[0-9.]+,\n`)
+
+	// By default, the reusing container request is charged the
+	// full cost, and the CSV report has no Reused column.
+	stdout.Truncate(0)
+	stderr.Truncate(0)
+	exitcode = Command.RunCommand("costanalyzer.test", []string{"-output", resultsDir, arvadostest.CompletedDiagnosticsContainerRequest2UUID}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 0)
+	uuidReport, err = ioutil.ReadFile(resultsDir + "/" + arvadostest.CompletedDiagnosticsContainerRequest2UUID + ".csv")
+	c.Assert(err, check.IsNil)
+	c.Check(string(uuidReport), check.Matches, `(?ms)CR UUID,.*,Total cost\n.*`)
+	c.Check(string(uuidReport), check.Matches, "(?ms).*TOTAL,,,,,,488.775,,,,0.01\n")
+}
+
+func (*Suite) TestMerge(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	resultsDir := c.MkDir()
+	// Run costanalyzer with 1 container request uuid, producing
+	// an aggregate file to merge later.
+	exitcode := Command.RunCommand("costanalyzer.test", []string{"-output", resultsDir, arvadostest.CompletedDiagnosticsContainerRequest1UUID}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 0)
+	re := regexp.MustCompile(`(?ms).*supplied uuids in (.*?)\n`)
+	matches := re.FindStringSubmatch(stderr.String())
+	c.Assert(matches, check.HasLen, 2)
+	previous := matches[1]
+
+	stdout.Truncate(0)
+	stderr.Truncate(0)
+
+	// Run with a timestamp range that includes the same container
+	// request, and merge the previous results. Containers found by
+	// both runs must only be counted once.
+	resultsDir = c.MkDir()
+	exitcode = Command.RunCommand("costanalyzer.test", []string{"-output", resultsDir, "-merge", previous, "-begin", "2020-11-02T00:00:00", "-end", "2020-11-03T23:59:00"}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 0)
+	c.Assert(stderr.String(), check.Matches, "(?ms).*supplied uuids in .*")
+	matches = re.FindStringSubmatch(stderr.String())
+	c.Assert(matches, check.HasLen, 2)
+
+	aggregateCostReport, err := ioutil.ReadFile(matches[1])
+	c.Assert(err, check.IsNil)
+	c.Check(string(aggregateCostReport), check.Matches, "(?ms).*# Date range: 2020-11-02T00:00:00 to 2020-11-03T23:59:00\n.*")
+	c.Check(string(aggregateCostReport), check.Matches, "(?ms).*# "+arvadostest.CompletedDiagnosticsContainerRequest1UUID+"\n.*")
+	c.Check(string(aggregateCostReport), check.Matches, "(?ms).*TOTAL,1245.564,0.01")
+	c.Check(stdout.String(), check.Equals, "0.01\n")
+
+	// Merge with a malformed file
+	bogus := c.MkDir() + "/bogus.csv"
+	err = ioutil.WriteFile(bogus, []byte("foo,bar\n"), 0644)
+	c.Assert(err, check.IsNil)
+	exitcode = Command.RunCommand("costanalyzer.test", []string{"-merge", bogus, arvadostest.CompletedDiagnosticsContainerRequest1UUID}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 1)
+	c.Check(stderr.String(), check.Matches, "(?ms).*expected 3 or 4 fields, found 2.*")
+
+	// Merge a file with a storage cost column
+	stdout.Truncate(0)
+	stderr.Truncate(0)
+	withStorage := c.MkDir() + "/storage.csv"
+	err = ioutil.WriteFile(withStorage, []byte(aggregateStorageHeader+"zzzzz-dz642-000000000000001,100.000,0.50000000,0.25000000\n"), 0644)
+	c.Assert(err, check.IsNil)
+	exitcode = Command.RunCommand("costanalyzer.test", []string{"-output", "-", "-merge", withStorage}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 0)
+	c.Check(stdout.String(), check.Matches, `(?ms).*\nzzzzz-dz642-000000000000001,100.000,0.50000000,0.25000000\n.*`)
+	c.Check(stdout.String(), check.Matches, `(?ms).*TOTAL,100.000,0.50,0.25\n`)
+}
+
+func (*Suite) TestBudget(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	resultsDir := c.MkDir()
+	// Total cost is below budget
+	exitcode := Command.RunCommand("costanalyzer.test", []string{"-budget", "1", arvadostest.CompletedDiagnosticsContainerRequest1UUID}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 0)
+	c.Check(stdout.String(), check.Equals, "0.01\n")
+	c.Check(stderr.String(), check.Not(check.Matches), "(?ms).*exceeds budget.*")
+
+	stdout.Truncate(0)
+	stderr.Truncate(0)
+
+	// Total cost exceeds budget: reports are still written
+	exitcode = Command.RunCommand("costanalyzer.test", []string{"-budget", "0.001", "-output", resultsDir, arvadostest.CompletedDiagnosticsContainerRequest1UUID}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 4)
+	c.Check(stdout.String(), check.Equals, "0.01\n")
+	c.Check(stderr.String(), check.Matches, "(?ms).*Total cost 0.01 exceeds budget 0.001\n.*")
+	c.Check(stderr.String(), check.Matches, "(?ms).*supplied uuids in .*")
+	_, err := os.Stat(resultsDir + "/" + arvadostest.CompletedDiagnosticsContainerRequest1UUID + ".csv")
+	c.Check(err, check.IsNil)
+
+	// Negative budget is rejected
+	exitcode = Command.RunCommand("costanalyzer.test", []string{"-budget", "-1", arvadostest.CompletedDiagnosticsContainerRequest1UUID}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 2)
+}
+
+func (*Suite) TestMaxCost(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	// -max-cost is the same as -budget. The total cost of these
+	// two container requests is 49.28.
+	exitcode := Command.RunCommand("costanalyzer.test", []string{"-max-cost", "50", arvadostest.CompletedContainerRequestUUID, arvadostest.CompletedContainerRequestUUID2}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 0)
+	c.Check(stdout.String(), check.Equals, "49.28\n")
+
+	stdout.Truncate(0)
+	stderr.Truncate(0)
+	exitcode = Command.RunCommand("costanalyzer.test", []string{"-max-cost", "10", arvadostest.CompletedContainerRequestUUID, arvadostest.CompletedContainerRequestUUID2}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 4)
+	c.Check(stdout.String(), check.Equals, "49.28\n")
+	c.Check(stderr.String(), check.Matches, "(?ms).*Total cost 49.28 exceeds budget 10\n.*")
+
+	exitcode = Command.RunCommand("costanalyzer.test", []string{"-max-cost", "-1", arvadostest.CompletedContainerRequestUUID}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 2)
+}
+
+func (*Suite) TestClusterConfigPrices(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	resultsDir := c.MkDir()
+	configFile := c.MkDir() + "/config.yml"
+	err := ioutil.WriteFile(configFile, []byte(`
+Clusters:
+  zzzzz:
+    InstanceTypes:
+      e4s:
+        ProviderType: Standard_E4s_v3
+        VCPUs: 4
+        RAM: 32GiB
+        Price: 1.0
+        Preemptible: true
+      e4s_ondemand:
+        ProviderType: Standard_E4s_v3
+        VCPUs: 4
+        RAM: 32GiB
+        Price: 2.0
+`), 0644)
+	c.Assert(err, check.IsNil)
+
+	// The configured price for Standard_E4s_v3 overrides the one
+	// in node.json.
+	exitcode := Command.RunCommand("costanalyzer.test", []string{"-cluster-config", configFile, "-output", resultsDir, arvadostest.CompletedContainerRequestUUID}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 0)
+	c.Check(stdout.String(), check.Equals, "24.02\n")
+	uuidReport, err := ioutil.ReadFile(resultsDir + "/" + arvadostest.CompletedContainerRequestUUID + ".csv")
+	c.Assert(err, check.IsNil)
+	c.Check(string(uuidReport), check.Matches, "(?ms).*,Standard_E4s_v3,true,1.00000000,.*")
+	c.Check(string(uuidReport), check.Matches, "(?ms).*TOTAL,,,,,,86462.000,,,,24.02")
+
+	stdout.Truncate(0)
+	stderr.Truncate(0)
+
+	// Instance types missing from the cluster config fall back
+	// to node.json, with a warning.
+	exitcode = Command.RunCommand("costanalyzer.test", []string{"-cluster-config", configFile, arvadostest.CompletedDiagnosticsContainerRequest1UUID}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 0)
+	c.Check(stdout.String(), check.Equals, "0.01\n")
+	c.Check(stderr.String(), check.Matches, `(?ms).*Instance type "Standard_A1_v2" for container .* not found in cluster configuration, using price from node.json.*`)
+
+	// Unreadable config file
+	exitcode = Command.RunCommand("costanalyzer.test", []string{"-cluster-config", c.MkDir() + "/nonexistent.yml", arvadostest.CompletedContainerRequestUUID}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 1)
+	c.Check(stderr.String(), check.Matches, `(?ms).*error loading cluster configuration.*`)
+}
+
+func (*Suite) TestPricingFile(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	resultsDir := c.MkDir()
+	// Half of the 0.292 price in node.json.
+	pricingFile := c.MkDir() + "/pricing.json"
+	err := ioutil.WriteFile(pricingFile, []byte(`{"Standard_E4s_v3": 0.146}`), 0644)
+	c.Assert(err, check.IsNil)
+
+	exitcode := Command.RunCommand("costanalyzer.test", []string{"-pricing-file", pricingFile, "-format", "json", "-output", resultsDir, arvadostest.CompletedContainerRequestUUID}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 0)
+	c.Check(stdout.String(), check.Equals, "3.51\n")
+	buf, err := ioutil.ReadFile(resultsDir + "/" + arvadostest.CompletedContainerRequestUUID + ".json")
+	c.Assert(err, check.IsNil)
+	var report crReport
+	c.Assert(json.Unmarshal(buf, &report), check.IsNil)
+	c.Assert(report.Containers, check.HasLen, 1)
+	c.Check(report.Containers[0].HourlyPrice, check.Equals, 0.146)
+	c.Check(strconv.FormatFloat(report.Total.Cost, 'f', 8, 64), check.Equals, "3.50651444")
+
+	// YAML works too, and the pricing file takes precedence over
+	// -cluster-config. Instance types not listed in the pricing
+	// file use the price from node.json.
+	pricingFile = c.MkDir() + "/pricing.yml"
+	err = ioutil.WriteFile(pricingFile, []byte("Standard_E4s_v3: 0.146\n"), 0644)
+	c.Assert(err, check.IsNil)
+	configFile := c.MkDir() + "/config.yml"
+	err = ioutil.WriteFile(configFile, []byte(`
+Clusters:
+  zzzzz:
+    InstanceTypes:
+      e4s:
+        ProviderType: Standard_E4s_v3
+        VCPUs: 4
+        RAM: 32GiB
+        Price: 1.0
+        Preemptible: true
+`), 0644)
+	c.Assert(err, check.IsNil)
+	stdout.Truncate(0)
+	stderr.Truncate(0)
+	exitcode = Command.RunCommand("costanalyzer.test", []string{"-pricing-file", pricingFile, "-cluster-config", configFile, arvadostest.CompletedContainerRequestUUID, arvadostest.CompletedContainerRequestUUID2}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 0)
+	c.Check(stdout.String(), check.Equals, "45.78\n")
+
+	// Invalid pricing files are rejected
+	for _, content := range []string{`{"Standard_E4s_v3": "cheap"}`, `{"Standard_E4s_v3": -1}`} {
+		err = ioutil.WriteFile(pricingFile, []byte(content), 0644)
+		c.Assert(err, check.IsNil)
+		stderr.Truncate(0)
+		exitcode = Command.RunCommand("costanalyzer.test", []string{"-pricing-file", pricingFile, arvadostest.CompletedContainerRequestUUID}, &bytes.Buffer{}, &stdout, &stderr)
+		c.Check(exitcode, check.Equals, 1)
+		c.Check(stderr.String(), check.Matches, `(?ms).*error loading pricing file: .*`)
+	}
+}
+
+func (*Suite) TestOutputStdout(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	// Run in an empty directory, to make sure no "-" output
+	// directory is created.
+	origDir, err := os.Getwd()
+	c.Assert(err, check.IsNil)
+	defer os.Chdir(origDir)
+	cwd := c.MkDir()
+	c.Assert(os.Chdir(cwd), check.IsNil)
+
+	exitcode := Command.RunCommand("costanalyzer.test", []string{"-output", "-", arvadostest.CompletedDiagnosticsContainerRequest1UUID}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 0)
+	c.Check(stdout.String(), check.Matches, `(?ms)# Aggregate cost accounting for uuids:\n.*# `+arvadostest.CompletedDiagnosticsContainerRequest1UUID+`\n.*TOTAL,763.467,0.01\n`)
+	c.Check(stderr.String(), check.Matches, `(?ms).*Total cost: 0.01.*`)
+	c.Check(stderr.String(), check.Not(check.Matches), `(?ms).*supplied uuids in .*`)
+
+	// No report files or directories were created.
+	ents, err := ioutil.ReadDir(cwd)
+	c.Check(err, check.IsNil)
+	c.Check(ents, check.HasLen, 0)
+
+	// The stdout report can be merged into a later run.
+	mergeFile := c.MkDir() + "/aggregate.csv"
+	c.Assert(ioutil.WriteFile(mergeFile, stdout.Bytes(), 0644), check.IsNil)
+	stdout.Truncate(0)
+	stderr.Truncate(0)
+	exitcode = Command.RunCommand("costanalyzer.test", []string{"-merge", mergeFile}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 0)
+	c.Check(stdout.String(), check.Equals, "0.01\n")
+}
+
+func (*Suite) TestJSONFormat(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	resultsDir := c.MkDir()
+	exitcode := Command.RunCommand("costanalyzer.test", []string{"-format", "json", "-output", resultsDir, arvadostest.CompletedContainerRequestUUID}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 0)
+	c.Check(stdout.String(), check.Equals, "7.01\n")
+
+	buf, err := ioutil.ReadFile(resultsDir + "/" + arvadostest.CompletedContainerRequestUUID + ".json")
+	c.Assert(err, check.IsNil)
+	var report crReport
+	c.Assert(json.Unmarshal(buf, &report), check.IsNil)
+	c.Check(report.UUID, check.Equals, arvadostest.CompletedContainerRequestUUID)
+	c.Assert(report.Containers, check.Not(check.HasLen), 0)
+	c.Check(report.Containers[0].InstanceType, check.Equals, "Standard_E4s_v3")
+	c.Check(report.Containers[0].Preemptible, check.Equals, true)
+	c.Check(report.Containers[0].HourlyPrice, check.Equals, 0.292)
+	c.Check(report.Total.Duration, check.Equals, 86462.0)
+	c.Check(strconv.FormatFloat(report.Total.Cost, 'f', 8, 64), check.Equals, "7.01302889")
+
+	re := regexp.MustCompile(`(?ms).*supplied uuids in (.*?)\n`)
+	matches := re.FindStringSubmatch(stderr.String())
+	c.Assert(matches, check.HasLen, 2)
+	c.Check(matches[1], check.Matches, `.*-aggregate-costaccounting\.json`)
+	buf, err = ioutil.ReadFile(matches[1])
+	c.Assert(err, check.IsNil)
+	var agg aggregateJSON
+	c.Assert(json.Unmarshal(buf, &agg), check.IsNil)
+	c.Check(agg.UUIDs, check.DeepEquals, []string{arvadostest.CompletedContainerRequestUUID})
+	c.Check(agg.Containers, check.HasLen, len(report.Containers))
+	c.Check(strconv.FormatFloat(agg.Total.Cost, 'f', 8, 64), check.Equals, "7.01302889")
+
+	// The JSON aggregate report can be merged into a later run.
+	stdout.Truncate(0)
+	stderr.Truncate(0)
+	exitcode = Command.RunCommand("costanalyzer.test", []string{"-merge", matches[1]}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 0)
+	c.Check(stdout.String(), check.Equals, "7.01\n")
+
+	// Unsupported format
+	exitcode = Command.RunCommand("costanalyzer.test", []string{"-format", "xml", arvadostest.CompletedContainerRequestUUID}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 2)
+	c.Check(stderr.String(), check.Matches, `(?ms).*invalid argument to -format.*`)
+}
+
+func (*Suite) TestSpotDiscount(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	resultsDir := c.MkDir()
+	exitcode := Command.RunCommand("costanalyzer.test", []string{"-spot-discount", "50", "-format", "json", "-output", resultsDir, arvadostest.CompletedContainerRequestUUID}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 0)
+
+	buf, err := ioutil.ReadFile(resultsDir + "/" + arvadostest.CompletedContainerRequestUUID + ".json")
+	c.Assert(err, check.IsNil)
+	var report crReport
+	c.Assert(json.Unmarshal(buf, &report), check.IsNil)
+	c.Assert(report.Containers, check.Not(check.HasLen), 0)
+	c.Check(report.Containers[0].Preemptible, check.Equals, true)
+	c.Check(report.Containers[0].HourlyPrice, check.Equals, 0.146)
+	c.Check(report.Total.Cost < 7.01302889, check.Equals, true)
+
+	// Containers on non-preemptible instances are not discounted.
+	stdout.Truncate(0)
+	stderr.Truncate(0)
+	exitcode = Command.RunCommand("costanalyzer.test", []string{"-spot-discount", "50", "-output", resultsDir, arvadostest.CompletedContainerRequestUUID2}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 0)
+	c.Check(stdout.String(), check.Equals, "42.27\n")
+
+	for _, arg := range []string{"-1", "101"} {
+		stderr.Truncate(0)
+		exitcode = Command.RunCommand("costanalyzer.test", []string{"-spot-discount", arg, arvadostest.CompletedContainerRequestUUID}, &bytes.Buffer{}, &stdout, &stderr)
+		c.Check(exitcode, check.Equals, 2)
+		c.Check(stderr.String(), check.Matches, `(?ms).*invalid argument to -spot-discount.*`)
+	}
+}
+
+func (*Suite) TestContainerRequestUUIDStdout(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	// Same as TestContainerRequestUUID, but capture the aggregate
+	// report from stdout instead of reading it from a file.
+	exitcode := Command.RunCommand("costanalyzer.test", []string{"-output", "-", arvadostest.CompletedContainerRequestUUID}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 0)
+	matches := regexp.MustCompile(`(?m)^TOTAL,([0-9.]+),([0-9.]+)$`).FindStringSubmatch(stdout.String())
+	c.Assert(matches, check.HasLen, 3)
+	c.Check(matches[1], check.Equals, "86462.000")
+	c.Check(matches[2], check.Equals, "7.01")
+
+	// In JSON format, the unrounded total is available.
+	stdout.Truncate(0)
+	stderr.Truncate(0)
+	exitcode = Command.RunCommand("costanalyzer.test", []string{"-output", "-", "-format", "json", arvadostest.CompletedContainerRequestUUID}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 0)
+	var agg aggregateJSON
+	c.Assert(json.Unmarshal(stdout.Bytes(), &agg), check.IsNil)
+	c.Check(agg.Total.Duration, check.Equals, 86462.0)
+	c.Check(strconv.FormatFloat(agg.Total.Cost, 'f', 8, 64), check.Equals, "7.01302889")
+	c.Check(stderr.String(), check.Matches, `(?ms).*Total cost: 7.01.*`)
+}
+
+func (*Suite) TestContainerRequestUUIDTimestampRange(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	resultsDir := c.MkDir()
+	// Only the second diagnostics container request finished
+	// during this range. The first one is skipped.
+	exitcode := Command.RunCommand("costanalyzer.test", []string{"-output", resultsDir, "-begin", "2020-11-03T00:00:00Z", "-end", "2020-11-04T00:00:00Z", arvadostest.CompletedDiagnosticsContainerRequest1UUID, arvadostest.CompletedDiagnosticsContainerRequest2UUID}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 0)
+	c.Assert(stderr.String(), check.Matches, "(?ms).*supplied uuids in .*")
+
+	_, err := os.Stat(resultsDir + "/" + arvadostest.CompletedDiagnosticsContainerRequest1UUID + ".csv")
+	c.Check(os.IsNotExist(err), check.Equals, true)
+	uuid2Report, err := ioutil.ReadFile(resultsDir + "/" + arvadostest.CompletedDiagnosticsContainerRequest2UUID + ".csv")
+	c.Assert(err, check.IsNil)
+	c.Check(string(uuid2Report), check.Matches, "(?ms).*TOTAL,,,,,,488.775,,,,0.01")
+
+	re := regexp.MustCompile(`(?ms).*supplied uuids in (.*?)\n`)
+	matches := re.FindStringSubmatch(stderr.String())
+	c.Assert(matches, check.HasLen, 2)
+	aggregateCostReport, err := ioutil.ReadFile(matches[1])
+	c.Assert(err, check.IsNil)
+	c.Check(string(aggregateCostReport), check.Not(check.Matches), "(?ms).*"+arvadostest.CompletedDiagnosticsContainer1UUID+".*")
+	c.Check(string(aggregateCostReport), check.Matches, "(?ms).*TOTAL,488.775,0.01")
+}
+
+func (*Suite) TestStorageRate(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	resultsDir := c.MkDir()
+	// The output collection is the "foo" fixture (one 3-byte
+	// block). The log collection has one 7882-byte block from its
+	// fixture, plus the 244-byte node.json block added in
+	// SetUpSuite. That's 8129 bytes, or $8.129 per month at $1M
+	// per GB-month.
+	exitcode := Command.RunCommand("costanalyzer.test", []string{"-storage-rate", "1000000", "-output", resultsDir, arvadostest.CompletedContainerRequestUUID}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 0)
+	// Storage cost is not included in the total cost.
+	c.Check(stdout.String(), check.Equals, "7.01\n")
+	c.Check(stderr.String(), check.Matches, `(?ms).*Total storage cost per month: 8.13.*`)
+
+	uuidReport, err := ioutil.ReadFile(resultsDir + "/" + arvadostest.CompletedContainerRequestUUID + ".csv")
+	c.Assert(err, check.IsNil)
+	c.Check(string(uuidReport), check.Matches, `(?ms)CR UUID,.*,Total cost,Storage cost\n.*`)
+	c.Check(string(uuidReport), check.Matches, `(?ms).*,Standard_E4s_v3,true,0\.29200000,7\.01302889,8\.12900000\n.*`)
+	c.Check(string(uuidReport), check.Matches, `(?ms).*TOTAL,,,,,,86462.000,,,,7.01,8.13\n`)
+
+	re := regexp.MustCompile(`(?ms).*supplied uuids in (.*?)\n`)
+	matches := re.FindStringSubmatch(stderr.String())
+	c.Assert(matches, check.HasLen, 2)
+	aggregateCostReport, err := ioutil.ReadFile(matches[1])
+	c.Assert(err, check.IsNil)
+	c.Check(string(aggregateCostReport), check.Matches, `(?ms).*# UUID, Duration in seconds, Total cost, Storage cost\n.*`)
+	c.Check(string(aggregateCostReport), check.Matches, `(?ms).*\nzzzzz-dz642-compltcontainer,86462.000,7.01302889,8.12900000\n.*`)
+	c.Check(string(aggregateCostReport), check.Matches, `(?ms).*TOTAL,86462.000,7.01,8.13\n`)
+
+	// The storage cost column is preserved when merging.
+	stdout.Truncate(0)
+	stderr.Truncate(0)
+	exitcode = Command.RunCommand("costanalyzer.test", []string{"-output", "-", "-merge", matches[1]}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 0)
+	c.Check(stdout.String(), check.Matches, `(?ms).*TOTAL,86462.000,7.01,8.13\n`)
+
+	// JSON format
+	exitcode = Command.RunCommand("costanalyzer.test", []string{"-storage-rate", "1000000", "-format", "json", "-output", resultsDir, arvadostest.CompletedContainerRequestUUID}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 0)
+	buf, err := ioutil.ReadFile(resultsDir + "/" + arvadostest.CompletedContainerRequestUUID + ".json")
+	c.Assert(err, check.IsNil)
+	var report crReport
+	c.Assert(json.Unmarshal(buf, &report), check.IsNil)
+	c.Assert(report.Containers, check.HasLen, 1)
+	c.Check(report.Containers[0].StorageSize, check.Equals, int64(8129))
+	c.Check(strconv.FormatFloat(report.Total.StorageCost, 'f', 8, 64), check.Equals, "8.12900000")
+
+	stderr.Truncate(0)
+	exitcode = Command.RunCommand("costanalyzer.test", []string{"-storage-rate", "-1", arvadostest.CompletedContainerRequestUUID}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 2)
+	c.Check(stderr.String(), check.Matches, `(?ms).*invalid argument to -storage-rate.*`)
+}
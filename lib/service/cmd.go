@@ -144,6 +144,12 @@ func (c *command) RunCommand(prog string, args []string, stdin io.Reader, stdout
 	mVersion.WithLabelValues(cmd.Version.String()).Set(1)
 	reg.MustRegister(mVersion)
 
+	shutdownTracing, err := setupTracing(ctx, cluster, c.svcName, logger)
+	if err != nil {
+		return 1
+	}
+	defer shutdownTracing()
+
 	handler := c.newHandler(ctx, cluster, cluster.SystemRootToken, reg)
 	if err = handler.CheckHealth(); err != nil {
 		return 1
@@ -152,10 +158,11 @@ func (c *command) RunCommand(prog string, args []string, stdin io.Reader, stdout
 	instrumented := httpserver.Instrument(reg, log,
 		httpserver.HandlerWithDeadline(cluster.API.RequestTimeout.Duration(),
 			httpserver.AddRequestIDs(
-				httpserver.Inspect(reg, cluster.ManagementToken,
-					httpserver.LogRequests(
-						interceptHealthReqs(cluster.ManagementToken, handler.CheckHealth,
-							c.requestLimiter(handler, cluster, reg)))))))
+				httpserver.AddTraceContext(
+					httpserver.Inspect(reg, cluster.ManagementToken,
+						httpserver.LogRequests(
+							interceptHealthReqs(cluster.ManagementToken, handler.CheckHealth,
+								c.requestLimiter(handler, cluster, reg))))))))
 	srv := &httpserver.Server{
 		Server: http.Server{
 			Handler:     ifCollectionInHost(instrumented, instrumented.ServeAPI(cluster.ManagementToken, instrumented)),
@@ -0,0 +1,71 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/cmd"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+)
+
+// setupTracing installs the W3C Trace Context propagator and, if
+// SystemLogs.TraceExporterURL is configured, a global TracerProvider
+// that exports spans to an OTLP/HTTP collector at that URL.
+//
+// The returned func flushes pending spans and shuts down the
+// exporter. It should be called before the process exits.
+func setupTracing(ctx context.Context, cluster *arvados.Cluster, svcName arvados.ServiceName, logger logrus.FieldLogger) (func(), error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	u := cluster.SystemLogs.TraceExporterURL
+	if u.Host == "" {
+		return func() {}, nil
+	}
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(u.Host),
+	}
+	if u.Path != "" {
+		opts = append(opts, otlptracehttp.WithURLPath(u.Path))
+	}
+	switch u.Scheme {
+	case "http":
+		opts = append(opts, otlptracehttp.WithInsecure())
+	case "https":
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q in SystemLogs.TraceExporterURL", u.Scheme)
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error setting up trace exporter: %w", err)
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceName(string(svcName)),
+			semconv.ServiceVersion(cmd.Version.String()),
+			semconv.ServiceNamespace(cluster.ClusterID),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logger.WithError(err).Warn("error exporting trace spans")
+	}))
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := tp.Shutdown(ctx); err != nil {
+			logger.WithError(err).Warn("error flushing trace spans")
+		}
+	}, nil
+}
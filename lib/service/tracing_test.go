@@ -0,0 +1,66 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"git.arvados.org/arvados.git/sdk/go/httpserver"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+	check "gopkg.in/check.v1"
+)
+
+func (*Suite) TestTraceExporter(c *check.C) {
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	var mtx sync.Mutex
+	var exported [][]byte
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Check(req.Method, check.Equals, "POST")
+		c.Check(req.URL.Path, check.Equals, "/v1/traces")
+		body, err := ioutil.ReadAll(req.Body)
+		c.Check(err, check.IsNil)
+		mtx.Lock()
+		exported = append(exported, body)
+		mtx.Unlock()
+	}))
+	defer collector.Close()
+
+	var cluster arvados.Cluster
+	cluster.ClusterID = "zzzzz"
+	c.Assert(cluster.SystemLogs.TraceExporterURL.UnmarshalText([]byte(collector.URL+"/v1/traces")), check.IsNil)
+	shutdown, err := setupTracing(context.Background(), &cluster, arvados.ServiceNameController, ctxlog.TestLogger(c))
+	c.Assert(err, check.IsNil)
+
+	h := httpserver.AddTraceContext(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	req := httptest.NewRequest("GET", "https://foo.example/bar", nil)
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Pending spans are flushed on shutdown.
+	shutdown()
+	mtx.Lock()
+	defer mtx.Unlock()
+	c.Assert(exported, check.HasLen, 1)
+	traceID, _ := hex.DecodeString("4bf92f3577b34da6a3ce929d0e0e4736")
+	c.Check(bytes.Contains(exported[0], traceID), check.Equals, true)
+	c.Check(bytes.Contains(exported[0], []byte("arvados-controller")), check.Equals, true)
+}
+
+func (*Suite) TestTraceExporterBadScheme(c *check.C) {
+	var cluster arvados.Cluster
+	c.Assert(cluster.SystemLogs.TraceExporterURL.UnmarshalText([]byte("ftp://localhost/v1/traces")), check.IsNil)
+	_, err := setupTracing(context.Background(), &cluster, arvados.ServiceNameController, ctxlog.TestLogger(c))
+	c.Check(err, check.ErrorMatches, `unsupported scheme "ftp".*`)
+}
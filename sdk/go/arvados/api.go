@@ -11,6 +11,7 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"sort"
 
 	"github.com/sirupsen/logrus"
 )
@@ -42,6 +43,7 @@ var (
 	EndpointCollectionDelete              = APIEndpoint{"DELETE", "arvados/v1/collections/{uuid}", ""}
 	EndpointCollectionTrash               = APIEndpoint{"POST", "arvados/v1/collections/{uuid}/trash", ""}
 	EndpointCollectionUntrash             = APIEndpoint{"POST", "arvados/v1/collections/{uuid}/untrash", ""}
+	EndpointCollectionTrashFederated      = APIEndpoint{"POST", "arvados/v1/collections/{uuid}/trash_federated", ""}
 	EndpointSpecimenCreate                = APIEndpoint{"POST", "arvados/v1/specimens", "specimen"}
 	EndpointSpecimenUpdate                = APIEndpoint{"PATCH", "arvados/v1/specimens/{uuid}", "specimen"}
 	EndpointSpecimenGet                   = APIEndpoint{"GET", "arvados/v1/specimens/{uuid}", ""}
@@ -225,6 +227,40 @@ type DeleteOptions struct {
 	UUID string `json:"uuid"`
 }
 
+// MultiClusterResponse reports the outcome of a federated batch
+// operation on each cluster it touched, keyed by cluster ID. A
+// failure on one cluster does not prevent the operation from
+// proceeding on the others.
+type MultiClusterResponse struct {
+	Clusters map[string]ClusterOutcome `json:"clusters"`
+}
+
+// ClusterOutcome reports the outcome of a federated batch operation
+// on a single cluster.
+type ClusterOutcome struct {
+	// UUIDs of the objects affected on this cluster. This can be
+	// non-empty even if Error is set, if the operation succeeded
+	// for some objects and failed for others.
+	UUIDs []string `json:"uuids"`
+	// Error encountered on this cluster, if any.
+	Error string `json:"error,omitempty"`
+	// HTTP status code corresponding to Error, if any.
+	HTTPStatus int `json:"http_status,omitempty"`
+}
+
+// Failed returns the IDs of the clusters where the operation
+// encountered an error, in sorted order.
+func (resp MultiClusterResponse) Failed() []string {
+	var ids []string
+	for id, outcome := range resp.Clusters {
+		if outcome.Error != "" {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
 type LoginOptions struct {
 	ReturnTo string `json:"return_to"`        // On success, redirect to this target with api_token=xxx query param
 	Remote   string `json:"remote,omitempty"` // Salt token for remote Cluster ID
@@ -255,6 +291,13 @@ type BlockWriteOptions struct {
 	StorageClasses []string
 	Replicas       int
 	Attempts       int
+
+	// If OnReplicaStored is not nil, it is called each time a
+	// server confirms that it has stored the block. host is the
+	// server's base URL, and replicas is the total number of
+	// replicas stored so far. Calls are made one at a time, but
+	// not necessarily from the caller's goroutine.
+	OnReplicaStored func(host string, replicas int)
 }
 
 type BlockWriteResponse struct {
@@ -293,6 +336,7 @@ type API interface {
 	CollectionDelete(ctx context.Context, options DeleteOptions) (Collection, error)
 	CollectionTrash(ctx context.Context, options DeleteOptions) (Collection, error)
 	CollectionUntrash(ctx context.Context, options UntrashOptions) (Collection, error)
+	CollectionTrashFederated(ctx context.Context, options DeleteOptions) (MultiClusterResponse, error)
 	ContainerCreate(ctx context.Context, options CreateOptions) (Container, error)
 	ContainerUpdate(ctx context.Context, options UpdateOptions) (Container, error)
 	ContainerPriorityUpdate(ctx context.Context, options UpdateOptions) (Container, error)
@@ -107,6 +107,7 @@ type Cluster struct {
 		LogCreateRequestFraction         float64
 		MaxKeepBlobBuffers               int
 		MaxRequestAmplification          int
+		MaxFederationHops                int
 		MaxRequestSize                   int
 		MaxTokenLifetime                 Duration
 		RequestTimeout                   Duration
@@ -144,6 +145,8 @@ type Cluster struct {
 		TrustAllContent              bool
 		ForwardSlashNameSubstitution string
 		S3FolderObjects              bool
+		RemotePDHSelection           string
+		RemotePDHCacheTTL            Duration
 
 		BlobMissingReport        string
 		BalancePeriod            Duration
@@ -231,6 +234,7 @@ type Cluster struct {
 		Format                    string
 		MaxRequestLogParamsSize   int
 		RequestQueueDumpDirectory string
+		TraceExporterURL          URL
 	}
 	TLS struct {
 		Certificate string
@@ -314,20 +318,42 @@ type Volume struct {
 }
 
 type S3VolumeDriverParameters struct {
-	IAMRole            string
-	AccessKeyID        string
-	SecretAccessKey    string
-	Endpoint           string
-	Region             string
-	Bucket             string
-	LocationConstraint bool
-	V2Signature        bool
-	IndexPageSize      int
-	ConnectTimeout     Duration
-	ReadTimeout        Duration
-	RaceWindow         Duration
-	UnsafeDelete       bool
-	PrefixLength       int
+	IAMRole             string
+	AccessKeyID         string
+	SecretAccessKey     string
+	Endpoint            string
+	Region              string
+	Bucket              string
+	LocationConstraint  bool
+	V2Signature         bool
+	IndexPageSize       int
+	ConnectTimeout      Duration
+	ReadTimeout         Duration
+	RaceWindow          Duration
+	UnsafeDelete        bool
+	PrefixLength        int
+	TrashPrefix         string
+	RecentPrefix        string
+	ChecksumAlgorithm   string
+	ACL                 string
+	StorageClass        string
+	SSEType             string
+	SSEKMSKeyID         string
+	UploadPartSize      ByteSize
+	UploadConcurrency   int
+	MaxRetries          int
+	Prefix              string
+	RequestTimeout      Duration
+	WebIdentity         bool
+	Tags                map[string]string
+	IndexWorkers        int
+	ReadAfterWriteCheck bool
+	UsePathStyle        bool
+	CACertificates      string
+	InsecureTLS         bool
+	IAMMetadataEndpoint string
+	ReadEndpoint        string
+	TrashPageSize       int
 }
 
 type AzureVolumeDriverParameters struct {
@@ -463,11 +489,15 @@ type PostgreSQL struct {
 type PostgreSQLConnection map[string]string
 
 type RemoteCluster struct {
-	Host          string
-	Proxy         bool
-	Scheme        string
-	Insecure      bool
-	ActivateUsers bool
+	Host           string
+	Proxy          bool
+	Scheme         string
+	Insecure       bool
+	ActivateUsers  bool
+	Weight         int
+	RequestTimeout Duration
+	AttemptTimeout Duration
+	Retries        int
 }
 
 type CUDAFeatures struct {
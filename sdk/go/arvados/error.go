@@ -18,6 +18,16 @@ type TransactionError struct {
 	StatusCode int
 	Status     string
 	Errors     []string
+
+	// ClusterID is the ID of the cluster that originally
+	// produced the error, if the server reported it. When a
+	// request is forwarded through several federated clusters,
+	// this identifies the hop that rejected it.
+	ClusterID string `json:"cluster_id"`
+
+	// Via lists the clusters the request passed through, in
+	// order, ending with ClusterID, if the server reported it.
+	Via []string `json:"via"`
 }
 
 func (e TransactionError) Error() (s string) {
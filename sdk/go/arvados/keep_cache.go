@@ -6,6 +6,8 @@ package arvados
 
 import (
 	"bytes"
+	"compress/gzip"
+	"container/list"
 	"context"
 	"crypto/md5"
 	"errors"
@@ -33,21 +35,207 @@ type KeepGateway interface {
 	LocalLocator(locator string) (string, error)
 }
 
+// BlockSizer is an optional interface a KeepGateway can implement to
+// report the size of a block, for use when the locator does not
+// have a size hint.
+type BlockSizer interface {
+	BlockSize(locator string) (int, error)
+}
+
 // DiskCache wraps KeepGateway, adding a disk-based cache layer.
 //
+// To fetch blocks that are missing from the cache from several
+// backends in turn, use a KeepGatewayChain as the KeepGateway.
+//
 // A DiskCache is automatically incorporated into the backend stack of
 // each keepclient.KeepClient. Most programs do not need to use
 // DiskCache directly.
+//
+// All DiskCaches in a process that use the same Dir share a single
+// set of cache files, held-open filehandles, and background
+// goroutines. They also share the settings of the first one to be
+// used: MaxSize, ShardLevels, EvictionPolicy, MaxEntries,
+// Compression, MaxOpenFiles, and TidyInterval. If a later DiskCache
+// has different values for these fields, they are ignored and a
+// warning is logged.
 type DiskCache struct {
 	KeepGateway
 	Dir     string
 	MaxSize ByteSizeOrPercent
 	Logger  logrus.FieldLogger
 
+	// If DropPageCache is true, advise the kernel to drop cache
+	// file pages from the OS page cache after they have been
+	// read, so streaming large blocks through the cache does not
+	// evict the rest of the application's working set.
+	//
+	// This uses posix_fadvise(POSIX_FADV_DONTNEED), which is
+	// only implemented on Linux; elsewhere DropPageCache has no
+	// effect. O_DIRECT is not used because it requires read
+	// buffers and offsets to be aligned to the filesystem's
+	// logical block size (typically 512 or 4096 bytes), which
+	// ReadAt callers cannot be expected to provide.
+	DropPageCache bool
+
+	// If OnBackendFetch is not nil, it is called whenever a
+	// ReadAt (or BlockRead) call misses the cache and starts
+	// fetching the block from the backend KeepGateway. offset
+	// and length describe the portion of the block requested by
+	// the caller that caused the fetch. It is not called for
+	// reads that are served from the cache, or that wait for a
+	// fetch already started by another caller.
+	//
+	// OnBackendFetch is called without holding any DiskCache
+	// locks, but it is called synchronously, so it should return
+	// quickly.
+	OnBackendFetch func(locator string, offset, length int)
+
+	// If ReadTimeout is non-zero, a ReadAt call that waits
+	// longer than ReadTimeout for data from a local cache file
+	// (e.g., because Dir is on a hung network filesystem or a
+	// failing disk) abandons the cache file and reads the
+	// requested data from the backend KeepGateway instead. The
+	// cache file is then removed, so the block will be fetched
+	// into a new cache file the next time it is needed.
+	ReadTimeout time.Duration
+
+	// ShardLevels is the number of levels of subdirectories used
+	// to spread cache files across directories. With the default
+	// (zero or 1), each cache file is stored in a subdirectory
+	// named after the first 3 hex digits of the block hash, i.e.,
+	// up to 4096 subdirectories. Each additional level adds a
+	// subdirectory named after the next 2 hex digits, e.g.,
+	// "abc/de/abcdef0123...". This reduces the number of files
+	// per directory when the cache holds millions of blocks.
+	//
+	// If ShardLevels is changed for an existing cache directory,
+	// existing files are moved to their new locations in the
+	// background when the cache is first used. Until then, they
+	// are not found.
+	ShardLevels int
+
+	// If MirrorDir is not empty, each block written by
+	// BlockWrite is also copied (in the background, on a
+	// best-effort basis) to a cache directory at MirrorDir,
+	// which should be on a different device than Dir. ReadAt
+	// uses the mirror copy when a block is missing from Dir, or
+	// reading it from Dir fails, before resorting to the
+	// backend. The mirror directory is tidied independently,
+	// using the same MaxSize.
+	MirrorDir string
+
+	// EvictionPolicy determines which cache files are deleted
+	// first when the cache exceeds MaxSize.
+	//
+	// "lru" (or empty) deletes the least recently accessed files
+	// first.
+	//
+	// "lfu" deletes the least frequently accessed files first,
+	// using access times to break ties. Writing a block, or
+	// reading from the beginning of a block, counts as one
+	// access. Counts are kept in memory, so they start over
+	// when the program restarts, and they are halved each time
+	// files are deleted, so blocks that were popular in the past
+	// but are no longer read eventually become eligible for
+	// deletion. This avoids evicting a few frequently re-read
+	// blocks when they are read alongside a large sequential
+	// scan.
+	EvictionPolicy string
+
+	// If MaxEntries is non-zero, the cache is also tidied when
+	// the number of cache files exceeds MaxEntries, even if
+	// their total size is below MaxSize. This prevents a cache
+	// of many small blocks from exhausting the filesystem's
+	// inodes.
+	MaxEntries int
+
+	// If VerifyChecksum is true, the MD5 hash of each block
+	// fetched from the backend is checked as it is copied into
+	// the cache, and the content of an existing cache file is
+	// checked the first time it is opened for reading. A cache
+	// file that does not match its locator is deleted, and the
+	// block is fetched from the backend again.
+	//
+	// Checking happens once per fetch or open, not on each
+	// ReadAt call. Data returned to ReadAt callers while a fetch
+	// is still in progress cannot be checked before it is
+	// returned, but a mismatch is still reported as an error to
+	// callers waiting for the rest of the block.
+	VerifyChecksum bool
+
+	// Compression is the format used to store cache files:
+	// "none" (or empty) or "gzip". ("zstd" is not supported.)
+	//
+	// With "gzip", each block is first cached uncompressed as
+	// usual, so it can be read while it is being fetched, and is
+	// then compressed in the background. A compressed cache file
+	// is replaced by the original if compression doesn't make it
+	// smaller. Since ReadAt supports arbitrary offsets, a
+	// compressed cache file is decompressed in full when it is
+	// opened, into an unlinked temporary file in Dir that is
+	// held open for subsequent reads and deleted when it is
+	// closed. Temporary files in use don't count toward MaxSize,
+	// which is enforced using the compressed sizes of the cache
+	// files.
+	//
+	// Existing compressed cache files are readable regardless of
+	// the Compression setting.
+	Compression string
+
+	// MaxOpenFiles is the maximum number of cache files held
+	// open for reading. When the limit is reached, the least
+	// recently used file is closed. Each file is opened once and
+	// the filehandle is shared by concurrent readers of the same
+	// block. If MaxOpenFiles is zero, a limit is chosen based on
+	// RLIMIT_NOFILE.
+	MaxOpenFiles int
+
+	// If TidyInterval is non-zero, the cache directory is also
+	// tidied periodically in the background, not just after
+	// writes. This keeps usage under MaxSize when files are
+	// added by other processes, or when MaxSize is a percentage
+	// and other data on the filesystem grows. The background
+	// tidying stops when all DiskCaches using the same Dir have
+	// been closed (see Close).
+	TidyInterval time.Duration
+
+	// If NotFoundTTL is non-zero, a block that the backend fails
+	// to return is remembered as missing for NotFoundTTL (or
+	// maxNotFoundTTL, if that is shorter), and ReadAt and
+	// BlockRead calls for the block during that time return the
+	// same error without contacting the backend. Errors that
+	// report themselves as temporary (see keepclient.Error) and
+	// errors writing to the cache filesystem are not remembered.
+	// Writing the block with BlockWrite forgets the error.
+	//
+	// Unlike the cache files, remembered errors are not shared
+	// with other DiskCaches using the same Dir, since their
+	// backends might use different credentials.
+	NotFoundTTL time.Duration
+
 	*sharedCache
+	mirror    *DiskCache
 	setupOnce sync.Once
+
+	notFound     map[string]notFoundEnt // cache file name => error from backend
+	notFoundLock sync.Mutex
+}
+
+type notFoundEnt struct {
+	err     error
+	expires time.Time
 }
 
+const (
+	// Upper limit for NotFoundTTL, so a block that is written
+	// by another client soon becomes readable.
+	maxNotFoundTTL = 10 * time.Second
+	// Maximum number of remembered errors. When full, expired
+	// entries are removed, and if none have expired, all
+	// entries are forgotten.
+	maxNotFoundEntries = 1000
+)
+
 var (
 	sharedCachesLock sync.Mutex
 	sharedCaches     = map[string]*sharedCache{}
@@ -61,8 +249,15 @@ var (
 // keep-web) uses multiple KeepGateway stacks that use different auth
 // tokens, etc.
 type sharedCache struct {
-	dir     string
-	maxSize ByteSizeOrPercent
+	settings    diskCacheSettings // settings of the first DiskCache, see setup()
+	refs        int               // number of DiskCaches using this, guarded by sharedCachesLock
+	stopTidy    chan struct{}     // closed to stop tidyPeriodically
+	dir         string
+	maxSize     ByteSizeOrPercent
+	maxEntries  int64
+	shardLevels int
+	lfu         bool
+	compress    bool
 
 	tidying        int32 // see tidy()
 	defaultMaxSize int64
@@ -71,6 +266,7 @@ type sharedCache struct {
 	// reading, and leave them open for future/concurrent ReadAt
 	// operations. See quickReadAt.
 	heldopen     map[string]*openFileEnt
+	heldopenLRU  *list.List // cache file names, most recently used first
 	heldopenMax  int
 	heldopenLock sync.Mutex
 
@@ -82,10 +278,25 @@ type sharedCache struct {
 	writingCond *sync.Cond
 	writingLock sync.Mutex
 
+	// The "accessCount" fields track the number of reads of each
+	// cache file, for use by tidy() when lfu is true.
+	accessCount     map[string]int64
+	accessCountLock sync.Mutex
+
 	sizeMeasured    int64 // actual size on disk after last tidy(); zero if not measured yet
 	sizeEstimated   int64 // last measured size, plus files we have written since
 	lastFileCount   int64 // number of files on disk at last count
+	lastTidy        int64 // time of last completed tidy(), as UnixNano; zero if none
 	writesSinceTidy int64 // number of files written since last tidy()
+	noSpaceErrors   int64 // number of cache writes abandoned because the disk was full
+	compressing     int64 // number of compressCacheFile goroutines running
+
+	// Counters reported by Stats()
+	hits         int64
+	misses       int64
+	evictions    int64
+	cacheBytes   int64
+	backendBytes int64
 }
 
 type writeprogress struct {
@@ -95,35 +306,179 @@ type writeprogress struct {
 	err     error          // error encountered while copying from backend to cache
 	sharedf *os.File       // readable filehandle, usable if done && err==nil
 	readers sync.WaitGroup // goroutines that haven't finished reading from f yet
+
+	cancel  context.CancelFunc // cancels the backend fetch
+	waiters int                // readers waiting for data to arrive
+	pinned  bool               // fetch must not be cancelled (see fetchAt)
 }
 
 type openFileEnt struct {
 	sync.RWMutex
 	f   *os.File
-	err error // if err is non-nil, f should not be used.
+	err error         // if err is non-nil, f should not be used.
+	lru *list.Element // position in heldopenLRU (guarded by heldopenLock)
+}
+
+// close closes the filehandle after waiting for current readers to
+// finish.
+func (ent *openFileEnt) close() {
+	ent.Lock()
+	defer ent.Unlock()
+	if ent.f != nil {
+		ent.f.Close()
+		ent.f = nil
+	}
 }
 
 const (
-	cacheFileSuffix = ".keepcacheblock"
-	tmpFileSuffix   = ".tmp"
+	cacheFileSuffix      = ".keepcacheblock"
+	tmpFileSuffix        = ".tmp"
+	compressedFileSuffix = ".gz"
 )
 
+// diskCacheSettings holds the DiskCache fields that are shared by
+// all DiskCaches using the same Dir.
+type diskCacheSettings struct {
+	MaxSize        ByteSizeOrPercent
+	ShardLevels    int
+	EvictionPolicy string
+	MaxEntries     int
+	Compression    string
+	MaxOpenFiles   int
+	TidyInterval   time.Duration
+}
+
+func (cache *DiskCache) sharedSettings() diskCacheSettings {
+	return diskCacheSettings{
+		MaxSize:        cache.MaxSize,
+		ShardLevels:    cache.ShardLevels,
+		EvictionPolicy: cache.EvictionPolicy,
+		MaxEntries:     cache.MaxEntries,
+		Compression:    cache.Compression,
+		MaxOpenFiles:   cache.MaxOpenFiles,
+		TidyInterval:   cache.TidyInterval,
+	}
+}
+
 func (cache *DiskCache) setup() {
 	sharedCachesLock.Lock()
 	defer sharedCachesLock.Unlock()
 	dir := cache.Dir
+	created := false
+	settings := cache.sharedSettings()
+	if shared := sharedCaches[dir]; shared != nil && shared.settings != settings && cache.Logger != nil {
+		cache.Logger.Warnf("DiskCache: ignoring settings %+v for %s, using %+v from the first DiskCache that used it", settings, dir, shared.settings)
+	}
 	if sharedCaches[dir] == nil {
-		sharedCaches[dir] = &sharedCache{dir: dir, maxSize: cache.MaxSize}
+		created = true
+		var lfu bool
+		switch cache.EvictionPolicy {
+		case "", "lru":
+		case "lfu":
+			lfu = true
+		default:
+			if cache.Logger != nil {
+				cache.Logger.Warnf("DiskCache: unknown EvictionPolicy %q, using \"lru\"", cache.EvictionPolicy)
+			}
+		}
+		var compress bool
+		switch cache.Compression {
+		case "", "none":
+		case "gzip":
+			compress = true
+		default:
+			if cache.Logger != nil {
+				cache.Logger.Warnf("DiskCache: unsupported Compression %q, using \"none\"", cache.Compression)
+			}
+		}
+		sharedCaches[dir] = &sharedCache{settings: settings, stopTidy: make(chan struct{}), dir: dir, maxSize: cache.MaxSize, maxEntries: int64(cache.MaxEntries), shardLevels: cache.ShardLevels, lfu: lfu, compress: compress, heldopenMax: cache.MaxOpenFiles}
 	}
 	cache.sharedCache = sharedCaches[dir]
+	cache.refs++
+	if created {
+		go cache.reshard()
+		if cache.TidyInterval > 0 {
+			go cache.tidyPeriodically(cache.TidyInterval, cache.stopTidy)
+		}
+	}
+	if cache.MirrorDir != "" && cache.MirrorDir != dir {
+		cache.mirror = &DiskCache{
+			KeepGateway:    cache.KeepGateway,
+			Dir:            cache.MirrorDir,
+			MaxSize:        cache.MaxSize,
+			Logger:         cache.Logger,
+			ReadTimeout:    cache.ReadTimeout,
+			ShardLevels:    cache.ShardLevels,
+			EvictionPolicy: cache.EvictionPolicy,
+			MaxEntries:     cache.MaxEntries,
+			VerifyChecksum: cache.VerifyChecksum,
+			Compression:    cache.Compression,
+			MaxOpenFiles:   cache.MaxOpenFiles,
+			TidyInterval:   cache.TidyInterval,
+		}
+	}
 }
 
+// cacheFile returns the path to the cache file for the given
+// locator. It can be called before any other DiskCache methods (e.g.,
+// on a mirror cache that hasn't been used yet).
 func (cache *DiskCache) cacheFile(locator string) string {
+	cache.setupOnce.Do(cache.setup)
 	hash := locator
 	if i := strings.Index(hash, "+"); i > 0 {
 		hash = hash[:i]
 	}
-	return filepath.Join(cache.dir, hash[:3], hash+cacheFileSuffix)
+	dir := filepath.Join(cache.dir, hash[:3])
+	for level, i := 1, 3; level < cache.shardLevels && i+2 <= len(hash); level, i = level+1, i+2 {
+		dir = filepath.Join(dir, hash[i:i+2])
+	}
+	return filepath.Join(dir, hash+cacheFileSuffix)
+}
+
+// reshard moves any cache files that are not in the expected
+// subdirectory for the current ShardLevels (e.g., files written by a
+// previous version or with a different ShardLevels) to their
+// expected locations.
+func (cache *DiskCache) reshard() {
+	moved := 0
+	filepath.Walk(cache.dir, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			cache.debugf("reshard: skipping dir %s: %s", path, err)
+			return nil
+		}
+		if info.IsDir() {
+			if path == filepath.Join(cache.dir, "tmp") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		suffix := ""
+		if strings.HasSuffix(path, cacheFileSuffix+compressedFileSuffix) {
+			suffix = compressedFileSuffix
+		} else if !strings.HasSuffix(path, cacheFileSuffix) {
+			return nil
+		}
+		hash := cacheFileHash(strings.TrimSuffix(path, suffix))
+		if len(hash) != 32 {
+			return nil
+		}
+		target := cache.cacheFile(hash) + suffix
+		if target == path {
+			return nil
+		}
+		if _, err := os.Stat(target); err == nil {
+			// Already have this block in the right place.
+			os.Remove(path)
+		} else if err := cache.rename(path, target); err != nil {
+			cache.debugf("reshard: rename(%s, %s) failed: %s", path, target, err)
+		} else {
+			moved++
+		}
+		return nil
+	})
+	if moved > 0 && cache.Logger != nil {
+		cache.Logger.WithField("moved", moved).Infof("DiskCache: moved cache files to match ShardLevels=%d", cache.shardLevels)
+	}
 }
 
 // Open a cache file, creating the parent dir if necessary.
@@ -135,7 +490,7 @@ func (cache *DiskCache) openFile(name string, flags int) (*os.File, error) {
 		// would be less efficient in the much more common
 		// situation where it already exists.)
 		parent, _ := filepath.Split(name)
-		os.Mkdir(parent, 0700)
+		os.MkdirAll(parent, 0700)
 		f, err = os.OpenFile(name, flags, 0600)
 	}
 	return f, err
@@ -147,10 +502,24 @@ func (cache *DiskCache) rename(old, new string) error {
 		return nil
 	}
 	parent, _ := filepath.Split(new)
-	os.Mkdir(parent, 0700)
+	os.MkdirAll(parent, 0700)
 	return os.Rename(old, new)
 }
 
+// countAccess increments the access count used by the "lfu"
+// EvictionPolicy. It is a no-op with other policies.
+func (cache *DiskCache) countAccess(cachefilename string) {
+	if !cache.lfu {
+		return
+	}
+	cache.accessCountLock.Lock()
+	defer cache.accessCountLock.Unlock()
+	if cache.accessCount == nil {
+		cache.accessCount = map[string]int64{}
+	}
+	cache.accessCount[cachefilename]++
+}
+
 func (cache *DiskCache) debugf(format string, args ...interface{}) {
 	logger := cache.Logger
 	if logger == nil {
@@ -174,6 +543,14 @@ func (cache *DiskCache) BlockWrite(ctx context.Context, opts BlockWriteOptions)
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	copyerr := make(chan error, 1)
+	// written receives the locator computed from the data we
+	// copied, and commit tells the copying goroutine whether to
+	// rename tmpfile into the cache.
+	written := make(chan string, 1)
+	commit := make(chan bool, 1)
+	// done is closed when the copying goroutine has finished
+	// (including renaming tmpfile into the cache, if applicable).
+	done := make(chan struct{})
 
 	// Start a goroutine to copy the caller's source data to
 	// tmpfile, a hash checker, and (via pipe) the wrapped
@@ -181,6 +558,7 @@ func (cache *DiskCache) BlockWrite(ctx context.Context, opts BlockWriteOptions)
 	pipereader, pipewriter := io.Pipe()
 	defer pipereader.Close()
 	go func() {
+		defer close(done)
 		// Note this is a double-close (which is a no-op) in
 		// the happy path.
 		defer tmpfile.Close()
@@ -199,7 +577,8 @@ func (cache *DiskCache) BlockWrite(ctx context.Context, opts BlockWriteOptions)
 		}
 
 		hashcheck := md5.New()
-		n, err := io.Copy(io.MultiWriter(tmpfile, pipewriter, hashcheck), src)
+		cw := &cacheFileWriter{cache: cache, f: tmpfile}
+		n, err := io.Copy(io.MultiWriter(cw, pipewriter, hashcheck), src)
 		if err != nil {
 			copyerr <- err
 			cancel()
@@ -209,13 +588,7 @@ func (cache *DiskCache) BlockWrite(ctx context.Context, opts BlockWriteOptions)
 			cancel()
 			return
 		}
-		err = tmpfile.Close()
-		if err != nil {
-			// Don't rename tmpfile into place, but allow
-			// the BlockWrite call to succeed if nothing
-			// else goes wrong.
-			return
-		}
+		closeerr := tmpfile.Close()
 		hash := fmt.Sprintf("%x", hashcheck.Sum(nil))
 		if opts.Hash != "" && opts.Hash != hash {
 			// Even if the wrapped KeepGateway doesn't
@@ -225,10 +598,40 @@ func (cache *DiskCache) BlockWrite(ctx context.Context, opts BlockWriteOptions)
 			cancel()
 			return
 		}
+		// Let the wrapped KeepGateway see EOF, then wait
+		// until our caller has checked the locator it
+		// returned.
+		pipewriter.Close()
+		written <- fmt.Sprintf("%s+%d", hash, n)
+		if closeerr != nil || cw.err != nil {
+			// Don't rename tmpfile into place, but allow
+			// the BlockWrite call to succeed if nothing
+			// else goes wrong.
+			return
+		}
+		if !<-commit {
+			return
+		}
 		cachefilename := cache.cacheFile(hash)
 		err = cache.rename(tmpfilename, cachefilename)
 		if err != nil {
 			cache.debugf("BlockWrite: rename(%s, %s) failed: %s", tmpfilename, cachefilename, err)
+		} else {
+			// Count the write as an access, so a block
+			// that was just written isn't the first
+			// candidate for deletion.
+			cache.countAccess(cachefilename)
+			cache.forgetNotFound(cachefilename)
+			// Don't keep using a filehandle on the file
+			// we just replaced (e.g., an empty file left
+			// behind by a failed fetch).
+			cache.deleteHeldopen(cachefilename, nil)
+			if cache.mirror != nil {
+				go cache.mirror.copyFrom(cachefilename, hash)
+			}
+			if cache.compress {
+				cache.goCompress(cachefilename)
+			}
 		}
 		atomic.AddInt64(&cache.sizeEstimated, int64(n))
 		cache.gotidy()
@@ -258,10 +661,37 @@ func (cache *DiskCache) BlockWrite(ctx context.Context, opts BlockWriteOptions)
 		// len(copyerr)==0 here, so the wrapped KeepGateway
 		// error is the one we return to our caller.
 		err = <-copyerr
+	} else if err == nil {
+		// Closing pipereader ensures the goroutine can't
+		// block forever if the wrapped KeepGateway returned
+		// without reading all of the data.
+		pipereader.Close()
+		select {
+		case locator := <-written:
+			if !sameBlock(locator, resp.Locator) {
+				err = fmt.Errorf("backend returned locator %q, expected %q", resp.Locator, locator)
+			}
+		case err = <-copyerr:
+		}
+	}
+	commit <- err == nil
+	if err == nil {
+		// Wait for the goroutine to rename tmpfile into the
+		// cache, so the block can be read from the cache as
+		// soon as we return.
+		<-done
 	}
 	return resp, err
 }
 
+// sameBlock returns true if the hash and size parts of the given
+// locators are equal. Other hints (signatures, etc.) are ignored.
+func sameBlock(a, b string) bool {
+	aparts := strings.SplitN(a, "+", 3)
+	bparts := strings.SplitN(b, "+", 3)
+	return len(aparts) >= 2 && len(bparts) >= 2 && aparts[0] == bparts[0] && aparts[1] == bparts[1]
+}
+
 type funcwriter func([]byte) (int, error)
 
 func (fw funcwriter) Write(p []byte) (int, error) {
@@ -276,20 +706,103 @@ func (fw funcwriter) Write(p []byte) (int, error) {
 // cache. The remainder of the block may continue to be copied into
 // the cache in the background.
 func (cache *DiskCache) ReadAt(locator string, dst []byte, offset int) (int, error) {
+	return cache.ReadAtContext(context.Background(), locator, dst, offset)
+}
+
+// ReadAtContext is like ReadAt, but if ctx is done before the
+// requested data arrives from the backend, it returns ctx's error
+// without waiting. The backend fetch is cancelled too, unless other
+// readers are still waiting for it or it was started or joined by a
+// reader whose context cannot be cancelled (e.g., ReadAt or
+// Prefetch).
+func (cache *DiskCache) ReadAtContext(ctx context.Context, locator string, dst []byte, offset int) (int, error) {
 	cache.setupOnce.Do(cache.setup)
+	if size, err := cache.BlockSize(locator); err == nil && len(dst) > 0 {
+		// Don't wait for (or fetch) data beyond the end of
+		// the block.
+		if offset >= size {
+			return 0, io.EOF
+		} else if offset+len(dst) > size {
+			n, err := cache.readAt(ctx, locator, dst[:size-offset], offset)
+			if err == nil {
+				err = io.EOF
+			}
+			return n, err
+		}
+	}
+	return cache.readAt(ctx, locator, dst, offset)
+}
+
+func (cache *DiskCache) readAt(ctx context.Context, locator string, dst []byte, offset int) (int, error) {
 	cachefilename := cache.cacheFile(locator)
+	if offset == 0 {
+		cache.countAccess(cachefilename)
+	}
 	if n, err := cache.quickReadAt(cachefilename, dst, offset); err == nil {
+		cache.countHit(n)
+		return n, nil
+	} else if n, merr := cache.readMirror(locator, dst, offset); merr == nil {
+		cache.countHit(n)
 		return n, nil
+	} else if err == errCacheReadTimeout {
+		n, err := cache.readAtBackend(locator, cachefilename, dst, offset)
+		cache.countMiss(n)
+		return n, err
+	} else if err := cache.checkNotFound(cachefilename); err != nil {
+		return 0, err
 	}
+	n, err := cache.fetchAt(ctx, locator, cachefilename, dst, offset)
+	cache.countMiss(n)
+	return n, err
+}
+
+// Prefetch starts fetching the indicated block from the backend into
+// the cache, if it is not already cached or being fetched, and
+// returns without waiting for the fetch to finish. Subsequent ReadAt
+// calls for the block use the cache file as soon as the requested
+// data is available.
+//
+// ctx is only checked before the fetch starts; once started, the
+// fetch runs to completion like one started by ReadAt.
+func (cache *DiskCache) Prefetch(ctx context.Context, locator string) {
+	cache.setupOnce.Do(cache.setup)
+	go func() {
+		if ctx.Err() != nil {
+			return
+		}
+		cachefilename := cache.cacheFile(locator)
+		if _, err := os.Stat(cachefilename); err == nil {
+			return
+		} else if _, err := os.Stat(cachefilename + compressedFileSuffix); err == nil {
+			return
+		}
+		cache.fetchAt(context.Background(), locator, cachefilename, nil, 0)
+	}()
+}
 
+// fetchAt reads the requested data from a cache file that is being
+// filled from the backend, starting a new fetch from the backend if
+// one isn't already in progress.
+//
+// If ctx is done before the requested data arrives, fetchAt returns
+// ctx's error. In that case the backend fetch is cancelled if no
+// other readers are waiting for it and no reader with an
+// uncancellable context (ctx.Done() == nil) has used it.
+func (cache *DiskCache) fetchAt(ctx context.Context, locator, cachefilename string, dst []byte, offset int) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
 	cache.writingLock.Lock()
 	progress := cache.writing[cachefilename]
-	if progress == nil {
+	fetching := progress == nil
+	if fetching {
 		// Nobody else is fetching from backend, so we'll add
 		// a new entry to cache.writing, fetch in a separate
 		// goroutine.
 		progress = &writeprogress{}
 		progress.cond = sync.NewCond(&sync.Mutex{})
+		fetchctx, cancel := context.WithCancel(context.Background())
+		progress.cancel = cancel
 		if cache.writing == nil {
 			cache.writing = map[string]*writeprogress{}
 		}
@@ -303,8 +816,15 @@ func (cache *DiskCache) ReadAt(locator string, dst []byte, offset int) (int, err
 			var size int
 			var err error
 			defer func() {
+				cancel()
 				if err == nil && progress.sharedf != nil {
 					err = progress.sharedf.Sync()
+					if err == nil && cache.DropPageCache {
+						// Pages are clean after
+						// Sync, so they can
+						// actually be dropped.
+						dropPageCache(progress.sharedf, 0, 0)
+					}
 				}
 				progress.cond.L.Lock()
 				progress.err = err
@@ -329,6 +849,17 @@ func (cache *DiskCache) ReadAt(locator string, dst []byte, offset int) (int, err
 				// need to lock anything.
 				progress.readers.Wait()
 				progress.sharedf.Close()
+				if errors.Is(err, syscall.ENOSPC) || errors.Is(err, context.Canceled) {
+					// Don't leave a partial cache
+					// file taking up space.
+					os.Remove(cachefilename)
+				} else if errors.Is(err, errChecksumMismatch) {
+					// Don't leave bad data in the
+					// cache.
+					os.Remove(cachefilename)
+				} else if err == nil && cache.compress {
+					cache.goCompress(cachefilename)
+				}
 			}()
 			progress.sharedf, err = cache.openFile(cachefilename, os.O_CREATE|os.O_RDWR)
 			if err != nil {
@@ -340,11 +871,15 @@ func (cache *DiskCache) ReadAt(locator string, dst []byte, offset int) (int, err
 				err = fmt.Errorf("flock(%s, lock_sh) failed: %w", cachefilename, err)
 				return
 			}
-			size, err = cache.KeepGateway.BlockRead(context.Background(), BlockReadOptions{
+			hashcheck := md5.New()
+			size, err = cache.KeepGateway.BlockRead(fetchctx, BlockReadOptions{
 				Locator: locator,
 				WriteTo: funcwriter(func(p []byte) (int, error) {
-					n, err := progress.sharedf.Write(p)
+					n, err := cache.writeCacheFile(progress.sharedf, p)
 					if n > 0 {
+						if cache.VerifyChecksum {
+							hashcheck.Write(p[:n])
+						}
 						progress.cond.L.Lock()
 						progress.size += n
 						progress.cond.L.Unlock()
@@ -352,6 +887,13 @@ func (cache *DiskCache) ReadAt(locator string, dst []byte, offset int) (int, err
 					}
 					return n, err
 				})})
+			if err == nil && cache.VerifyChecksum {
+				if hash := fmt.Sprintf("%x", hashcheck.Sum(nil)); hash != cacheFileHash(cachefilename) {
+					err = fmt.Errorf("fetching %s from backend: got data with hash %s: %w", locator, hash, errChecksumMismatch)
+				}
+			} else if err != nil && size == 0 {
+				cache.rememberNotFound(cachefilename, err)
+			}
 			atomic.AddInt64(&cache.sizeEstimated, int64(size))
 			cache.gotidy()
 		}()
@@ -363,20 +905,58 @@ func (cache *DiskCache) ReadAt(locator string, dst []byte, offset int) (int, err
 	defer progress.readers.Done()
 	cache.writingLock.Unlock()
 
+	if fetching && cache.OnBackendFetch != nil {
+		cache.OnBackendFetch(locator, offset, len(dst))
+	}
+
 	progress.cond.L.Lock()
-	for !progress.done && progress.size < len(dst)+offset {
+	if ctx.Done() == nil {
+		progress.pinned = true
+	} else {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				// Wake up the wait loop below.
+				progress.cond.L.Lock()
+				progress.cond.L.Unlock()
+				progress.cond.Broadcast()
+			case <-stop:
+			}
+		}()
+	}
+	progress.waiters++
+	for !progress.done && progress.size < len(dst)+offset && ctx.Err() == nil {
 		progress.cond.Wait()
 	}
+	progress.waiters--
+	if !progress.done && progress.size < len(dst)+offset {
+		// ctx is done and our data hasn't arrived yet.
+		if progress.waiters == 0 && !progress.pinned {
+			progress.cancel()
+		}
+		progress.cond.L.Unlock()
+		return 0, ctx.Err()
+	}
 	sharedf := progress.sharedf
 	err := progress.err
 	progress.cond.L.Unlock()
 
-	if err != nil {
+	if errors.Is(err, syscall.ENOSPC) {
+		// The cache disk is full, but the backend is still
+		// usable.
+		return cache.KeepGateway.ReadAt(locator, dst, offset)
+	} else if err != nil {
 		// If the copy-from-backend goroutine encountered an
 		// error, we return that error. (Even if we read the
 		// desired number of bytes, the error might be
 		// something like BadChecksum so we should not ignore
-		// it.)
+		// it.) But first, see whether the mirror has a good
+		// copy.
+		if n, merr := cache.readMirror(locator, dst, offset); merr == nil {
+			return n, nil
+		}
 		return 0, err
 	}
 	if len(dst) == 0 {
@@ -389,7 +969,491 @@ func (cache *DiskCache) ReadAt(locator string, dst []byte, offset int) (int, err
 		// calling sharedf.ReadAt() when sharedf is nil.
 		return 0, nil
 	}
-	return sharedf.ReadAt(dst, int64(offset))
+	n, err := cache.readCacheFile(sharedf, dst, offset)
+	if err == errCacheReadTimeout {
+		return cache.readAtBackend(locator, cachefilename, dst, offset)
+	}
+	if n > 0 && cache.DropPageCache {
+		dropPageCache(sharedf, int64(offset), int64(n))
+	}
+	return n, err
+}
+
+// rememberNotFound records that the backend could not return the
+// block for cachefilename, if NotFoundTTL is set and err is not
+// temporary.
+func (cache *DiskCache) rememberNotFound(cachefilename string, err error) {
+	ttl := cache.NotFoundTTL
+	if ttl <= 0 {
+		return
+	}
+	if ttl > maxNotFoundTTL {
+		ttl = maxNotFoundTTL
+	}
+	var temp interface{ Temporary() bool }
+	if errors.As(err, &temp) && temp.Temporary() {
+		return
+	} else if errors.Is(err, syscall.ENOSPC) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return
+	}
+	now := time.Now()
+	cache.notFoundLock.Lock()
+	defer cache.notFoundLock.Unlock()
+	if cache.notFound == nil {
+		cache.notFound = map[string]notFoundEnt{}
+	}
+	if len(cache.notFound) >= maxNotFoundEntries {
+		for k, ent := range cache.notFound {
+			if now.After(ent.expires) {
+				delete(cache.notFound, k)
+			}
+		}
+		if len(cache.notFound) >= maxNotFoundEntries {
+			cache.notFound = map[string]notFoundEnt{}
+		}
+	}
+	cache.notFound[cachefilename] = notFoundEnt{err: err, expires: now.Add(ttl)}
+}
+
+// checkNotFound returns the error remembered by rememberNotFound
+// for cachefilename, or nil if there is none or it has expired.
+func (cache *DiskCache) checkNotFound(cachefilename string) error {
+	cache.notFoundLock.Lock()
+	defer cache.notFoundLock.Unlock()
+	ent, ok := cache.notFound[cachefilename]
+	if !ok {
+		return nil
+	} else if time.Now().After(ent.expires) {
+		delete(cache.notFound, cachefilename)
+		return nil
+	}
+	return ent.err
+}
+
+func (cache *DiskCache) forgetNotFound(cachefilename string) {
+	cache.notFoundLock.Lock()
+	defer cache.notFoundLock.Unlock()
+	delete(cache.notFound, cachefilename)
+}
+
+// copyFrom copies an existing cache file (typically from the primary
+// cache dir of the DiskCache that cache is mirroring) into cache.
+// Errors are logged and otherwise ignored.
+func (cache *DiskCache) copyFrom(srcfilename, hash string) {
+	cache.setupOnce.Do(cache.setup)
+	suffix := ""
+	src, err := os.Open(srcfilename)
+	if os.IsNotExist(err) {
+		// Perhaps already compressed.
+		suffix = compressedFileSuffix
+		src, err = os.Open(srcfilename + suffix)
+	}
+	if err != nil {
+		// Probably deleted by tidy() already.
+		cache.debugf("mirror: open(%s) failed: %s", srcfilename, err)
+		return
+	}
+	defer src.Close()
+	tmpfilename := filepath.Join(cache.dir, "tmp", fmt.Sprintf("%x.%p%s", os.Getpid(), src, tmpFileSuffix))
+	tmpfile, err := cache.openFile(tmpfilename, os.O_CREATE|os.O_EXCL|os.O_RDWR)
+	if err != nil {
+		cache.debugf("mirror: open(%s) failed: %s", tmpfilename, err)
+		return
+	}
+	defer os.Remove(tmpfilename)
+	n, err := io.Copy(tmpfile, src)
+	if closeerr := tmpfile.Close(); err == nil {
+		err = closeerr
+	}
+	if err != nil {
+		cache.debugf("mirror: copy %s to %s failed: %s", srcfilename, tmpfilename, err)
+		return
+	}
+	cachefilename := cache.cacheFile(hash)
+	err = cache.rename(tmpfilename, cachefilename+suffix)
+	if err != nil {
+		cache.debugf("mirror: rename(%s, %s) failed: %s", tmpfilename, cachefilename+suffix, err)
+		return
+	}
+	atomic.AddInt64(&cache.sizeEstimated, n)
+	cache.gotidy()
+	if suffix == "" && cache.compress {
+		cache.goCompress(cachefilename)
+	}
+}
+
+// goCompress starts a goroutine that compresses the given cache
+// file.
+func (cache *DiskCache) goCompress(cachefilename string) {
+	atomic.AddInt64(&cache.compressing, 1)
+	go func() {
+		defer atomic.AddInt64(&cache.compressing, -1)
+		cache.compressCacheFile(cachefilename)
+	}()
+}
+
+// compressCacheFile replaces the given cache file with a compressed
+// copy, unless compression doesn't make it smaller. Errors are
+// logged and otherwise ignored.
+func (cache *DiskCache) compressCacheFile(cachefilename string) {
+	src, err := os.Open(cachefilename)
+	if err != nil {
+		// Probably deleted by tidy() already.
+		cache.debugf("compress: open(%s) failed: %s", cachefilename, err)
+		return
+	}
+	defer src.Close()
+	srcinfo, err := src.Stat()
+	if err != nil {
+		cache.debugf("compress: stat(%s) failed: %s", cachefilename, err)
+		return
+	}
+	tmpfilename := filepath.Join(cache.dir, "tmp", fmt.Sprintf("%x.%p%s", os.Getpid(), src, tmpFileSuffix))
+	tmpfile, err := cache.openFile(tmpfilename, os.O_CREATE|os.O_EXCL|os.O_RDWR)
+	if err != nil {
+		cache.debugf("compress: open(%s) failed: %s", tmpfilename, err)
+		return
+	}
+	defer os.Remove(tmpfilename)
+	zw := gzip.NewWriter(tmpfile)
+	_, err = io.Copy(zw, src)
+	if closeerr := zw.Close(); err == nil {
+		err = closeerr
+	}
+	if closeerr := tmpfile.Close(); err == nil {
+		err = closeerr
+	}
+	if err != nil {
+		cache.debugf("compress: writing %s failed: %s", tmpfilename, err)
+		return
+	}
+	tmpinfo, err := os.Stat(tmpfilename)
+	if err != nil {
+		cache.debugf("compress: stat(%s) failed: %s", tmpfilename, err)
+		return
+	}
+	if tmpinfo.Size() >= srcinfo.Size() {
+		// Not worth it.
+		return
+	}
+	err = cache.rename(tmpfilename, cachefilename+compressedFileSuffix)
+	if err != nil {
+		cache.debugf("compress: rename(%s, %s) failed: %s", tmpfilename, cachefilename+compressedFileSuffix, err)
+		return
+	}
+	os.Remove(cachefilename)
+	// Close any held-open filehandle so the disk space used by
+	// the uncompressed file is freed once current reads finish.
+	cache.deleteHeldopen(cachefilename, nil)
+	atomic.AddInt64(&cache.sizeEstimated, tmpinfo.Size()-srcinfo.Size())
+}
+
+// openCompressed decompresses the compressed version of the given
+// cache file into an unlinked temporary file, and returns the
+// temporary file, positioned at the beginning.
+func (cache *DiskCache) openCompressed(cachefilename string) (*os.File, error) {
+	src, err := os.Open(cachefilename + compressedFileSuffix)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	zr, err := gzip.NewReader(src)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", src.Name(), err)
+	}
+	tmpfilename := filepath.Join(cache.dir, "tmp", fmt.Sprintf("%x.%p%s", os.Getpid(), src, tmpFileSuffix))
+	f, err := cache.openFile(tmpfilename, os.O_CREATE|os.O_EXCL|os.O_RDWR)
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(tmpfilename)
+	_, err = io.Copy(f, zr)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("decompressing %s: %w", src.Name(), err)
+	}
+	return f, nil
+}
+
+// readMirror reads the requested data from the mirror cache dir, if
+// there is one. It does not fetch data from the backend.
+func (cache *DiskCache) readMirror(locator string, dst []byte, offset int) (int, error) {
+	if cache.mirror == nil {
+		return 0, os.ErrNotExist
+	}
+	cache.mirror.setupOnce.Do(cache.mirror.setup)
+	return cache.mirror.quickReadAt(cache.mirror.cacheFile(locator), dst, offset)
+}
+
+// cacheFileWrite is the function used to write data to cache files.
+// Tests can replace it to simulate a full disk.
+var cacheFileWrite = func(f *os.File, p []byte) (int, error) {
+	return f.Write(p)
+}
+
+// writeCacheFile writes p to a cache file. If the disk is full, it
+// tidies the cache to reclaim space and retries once before giving
+// up.
+func (cache *DiskCache) writeCacheFile(f *os.File, p []byte) (int, error) {
+	n, err := cacheFileWrite(f, p)
+	if !errors.Is(err, syscall.ENOSPC) {
+		return n, err
+	}
+	cache.tidyNow()
+	n2, err := cacheFileWrite(f, p[n:])
+	n += n2
+	if err != nil {
+		atomic.AddInt64(&cache.noSpaceErrors, 1)
+		if cache.Logger != nil {
+			cache.Logger.Warnf("DiskCache: cache filesystem is full, bypassing cache: %s", err)
+		}
+	}
+	return n, err
+}
+
+// cacheFileWriter writes to a BlockWrite temp file. If the disk is
+// full (even after tidying), it stops writing to the file and
+// discards the rest of the data, so the write through to the backend
+// can still succeed.
+type cacheFileWriter struct {
+	cache *DiskCache
+	f     *os.File
+	err   error // if non-nil, the file is incomplete and should be discarded
+}
+
+func (cw *cacheFileWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return len(p), nil
+	}
+	n, err := cw.cache.writeCacheFile(cw.f, p)
+	if errors.Is(err, syscall.ENOSPC) {
+		cw.err = err
+		return len(p), nil
+	}
+	return n, err
+}
+
+// Delete removes the indicated block from the cache (including the
+// mirror cache dir, if any), so the next read fetches it from the
+// backend. It is safe to call while other goroutines are reading
+// the block: a read already in progress might still return data
+// from the deleted cache file.
+func (cache *DiskCache) Delete(locator string) error {
+	cache.setupOnce.Do(cache.setup)
+	err := cache.deleteCacheFile(cache.cacheFile(locator))
+	if cache.mirror != nil {
+		cache.mirror.setupOnce.Do(cache.mirror.setup)
+		if merr := cache.mirror.deleteCacheFile(cache.mirror.cacheFile(locator)); err == nil {
+			err = merr
+		}
+	}
+	return err
+}
+
+// Clear removes all blocks from the cache (including the mirror
+// cache dir, if any). Like Delete, it is safe to call while other
+// goroutines are reading.
+func (cache *DiskCache) Clear() error {
+	cache.setupOnce.Do(cache.setup)
+	var firsterr error
+	filepath.Walk(cache.dir, func(path string, info fs.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if strings.HasSuffix(path, cacheFileSuffix) || strings.HasSuffix(path, cacheFileSuffix+compressedFileSuffix) {
+			if err := cache.deleteCacheFile(strings.TrimSuffix(path, compressedFileSuffix)); err != nil && firsterr == nil {
+				firsterr = err
+			}
+		}
+		return nil
+	})
+	if cache.mirror != nil {
+		if err := cache.mirror.Clear(); err != nil && firsterr == nil {
+			firsterr = err
+		}
+	}
+	return firsterr
+}
+
+// Close releases this DiskCache's share of the resources used for
+// its cache directory (and mirror directory, if any). When all of
+// the DiskCaches using the same Dir have been closed, the background
+// tidying goroutine (see TidyInterval) is stopped, held-open cache
+// files are closed, and the next DiskCache to use Dir starts afresh
+// with its own settings. Cache files are not deleted.
+//
+// The DiskCache must not be used after Close.
+func (cache *DiskCache) Close() error {
+	// If setup hasn't run yet, prevent it from running later;
+	// there is nothing to release.
+	cache.setupOnce.Do(func() {})
+	if cache.sharedCache == nil {
+		return nil
+	}
+	sharedCachesLock.Lock()
+	cache.refs--
+	last := cache.refs == 0
+	if last {
+		close(cache.stopTidy)
+		delete(sharedCaches, cache.dir)
+	}
+	sharedCachesLock.Unlock()
+	if last {
+		cache.heldopenLock.Lock()
+		var names []string
+		for name := range cache.heldopen {
+			names = append(names, name)
+		}
+		cache.heldopenLock.Unlock()
+		for _, name := range names {
+			cache.deleteHeldopen(name, nil)
+		}
+	}
+	if cache.mirror != nil {
+		return cache.mirror.Close()
+	}
+	return nil
+}
+
+// deleteCacheFile removes the given cache file (and its compressed
+// version, if any), closes any held-open filehandle, and forgets its
+// access count. It is not an error if the file doesn't exist.
+func (cache *DiskCache) deleteCacheFile(cachefilename string) error {
+	var err error
+	for _, fnm := range []string{cachefilename, cachefilename + compressedFileSuffix} {
+		fi, staterr := os.Stat(fnm)
+		if os.IsNotExist(staterr) {
+			continue
+		}
+		if rmerr := os.Remove(fnm); rmerr == nil && staterr == nil {
+			atomic.AddInt64(&cache.sizeEstimated, -fi.Size())
+		} else if rmerr != nil && !os.IsNotExist(rmerr) && err == nil {
+			err = rmerr
+		}
+	}
+	cache.deleteHeldopen(cachefilename, nil)
+	cache.accessCountLock.Lock()
+	delete(cache.accessCount, cachefilename)
+	cache.accessCountLock.Unlock()
+	return err
+}
+
+// DiskCacheStats reports cumulative cache activity and current
+// usage. Hits and Misses count ReadAt calls (BlockRead makes one
+// ReadAt call per 128 KiB of data).
+//
+// BytesUsed is the size measured by the last tidy, plus the size of
+// files written since then. Entries is the number of cache files
+// found by the last tidy (less any it deleted). Neither requires
+// scanning the cache directory.
+type DiskCacheStats struct {
+	Hits         int64 // reads served from existing cache files
+	Misses       int64 // reads that waited for data from the backend
+	Evictions    int64 // cache files deleted to stay under MaxSize
+	CacheBytes   int64 // bytes returned by hits
+	BackendBytes int64 // bytes returned by misses
+
+	BytesUsed int64     // estimated total size of cache files
+	Entries   int64     // number of cache files at last tidy
+	MaxSize   int64     // effective size limit in bytes; zero if not yet known
+	LastTidy  time.Time // time the last tidy finished; zero if none yet
+}
+
+// Stats returns a snapshot of the cache activity counters and
+// current usage. The counters are shared by all DiskCaches using the
+// same Dir in a process.
+func (cache *DiskCache) Stats() DiskCacheStats {
+	cache.setupOnce.Do(cache.setup)
+	stats := DiskCacheStats{
+		Hits:         atomic.LoadInt64(&cache.hits),
+		Misses:       atomic.LoadInt64(&cache.misses),
+		Evictions:    atomic.LoadInt64(&cache.evictions),
+		CacheBytes:   atomic.LoadInt64(&cache.cacheBytes),
+		BackendBytes: atomic.LoadInt64(&cache.backendBytes),
+		BytesUsed:    atomic.LoadInt64(&cache.sizeEstimated),
+		Entries:      atomic.LoadInt64(&cache.lastFileCount),
+		MaxSize:      int64(cache.maxSize.ByteSize()),
+	}
+	if stats.MaxSize < 1 {
+		stats.MaxSize = atomic.LoadInt64(&cache.defaultMaxSize)
+	}
+	if t := atomic.LoadInt64(&cache.lastTidy); t != 0 {
+		stats.LastTidy = time.Unix(0, t)
+	}
+	return stats
+}
+
+func (cache *DiskCache) countHit(n int) {
+	atomic.AddInt64(&cache.hits, 1)
+	atomic.AddInt64(&cache.cacheBytes, int64(n))
+}
+
+func (cache *DiskCache) countMiss(n int) {
+	atomic.AddInt64(&cache.misses, 1)
+	atomic.AddInt64(&cache.backendBytes, int64(n))
+}
+
+// NoSpaceErrors returns the number of times the cache has been
+// bypassed because the cache filesystem was full.
+func (cache *DiskCache) NoSpaceErrors() int64 {
+	cache.setupOnce.Do(cache.setup)
+	return atomic.LoadInt64(&cache.noSpaceErrors)
+}
+
+var errCacheReadTimeout = errors.New("timed out reading from cache file")
+
+// cacheFileReadAt is the function used to read data from cache
+// files. Tests can replace it to simulate a slow disk.
+var cacheFileReadAt = func(f *os.File, dst []byte, offset int64) (int, error) {
+	return f.ReadAt(dst, offset)
+}
+
+// readCacheFile reads from a cache file into dst. If ReadTimeout is
+// set and the read does not finish in time, it returns
+// errCacheReadTimeout. In that case the abandoned read continues in
+// the background using a private buffer, so dst is not modified
+// after readCacheFile returns.
+func (cache *DiskCache) readCacheFile(f *os.File, dst []byte, offset int) (int, error) {
+	if cache.ReadTimeout <= 0 {
+		return cacheFileReadAt(f, dst, int64(offset))
+	}
+	type result struct {
+		n   int
+		err error
+	}
+	done := make(chan result, 1)
+	buf := make([]byte, len(dst))
+	readAt := cacheFileReadAt
+	go func() {
+		n, err := readAt(f, buf, int64(offset))
+		done <- result{n, err}
+	}()
+	timer := time.NewTimer(cache.ReadTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		copy(dst, buf[:r.n])
+		return r.n, r.err
+	case <-timer.C:
+		return 0, errCacheReadTimeout
+	}
+}
+
+// readAtBackend is called when reading a cache file has timed out.
+// It removes the (suspect) cache file and reads the requested data
+// directly from the backend.
+func (cache *DiskCache) readAtBackend(locator, cachefilename string, dst []byte, offset int) (int, error) {
+	if cache.Logger != nil {
+		cache.Logger.Warnf("DiskCache: timed out after %v reading cache file %s, reading from backend instead", cache.ReadTimeout, cachefilename)
+	}
+	go func() {
+		cache.deleteHeldopen(cachefilename, nil)
+		os.Remove(cachefilename)
+	}()
+	return cache.KeepGateway.ReadAt(locator, dst, offset)
 }
 
 var quickReadAtLostRace = errors.New("quickReadAt: lost race")
@@ -409,17 +1473,13 @@ func (cache *DiskCache) deleteHeldopen(cachefilename string, expect *openFileEnt
 	found := cache.heldopen[cachefilename]
 	if found != nil && (expect == nil || expect == found) {
 		delete(cache.heldopen, cachefilename)
+		cache.heldopenLRU.Remove(found.lru)
 		needclose = found
 	}
 	cache.heldopenLock.Unlock()
 
 	if needclose != nil {
-		needclose.Lock()
-		defer needclose.Unlock()
-		if needclose.f != nil {
-			needclose.f.Close()
-			needclose.f = nil
-		}
+		needclose.close()
 	}
 }
 
@@ -432,7 +1492,7 @@ func (cache *DiskCache) deleteHeldopen(cachefilename string, expect *openFileEnt
 func (cache *DiskCache) quickReadAt(cachefilename string, dst []byte, offset int) (int, error) {
 	isnew := false
 	cache.heldopenLock.Lock()
-	if cache.heldopenMax == 0 {
+	if cache.heldopenMax < 1 {
 		// Choose a reasonable limit on open cache files based
 		// on RLIMIT_NOFILE. Note Go automatically raises
 		// softlimit to hardlimit, so it's typically 1048576,
@@ -443,8 +1503,10 @@ func (cache *DiskCache) quickReadAt(cachefilename string, dst []byte, offset int
 			cache.heldopenMax = 100
 		} else if lim.Cur > 400000 {
 			cache.heldopenMax = 10000
-		} else {
+		} else if lim.Cur >= 40 {
 			cache.heldopenMax = int(lim.Cur / 40)
+		} else {
+			cache.heldopenMax = 1
 		}
 	}
 	heldopen := cache.heldopen[cachefilename]
@@ -453,27 +1515,20 @@ func (cache *DiskCache) quickReadAt(cachefilename string, dst []byte, offset int
 		heldopen = &openFileEnt{}
 		if cache.heldopen == nil {
 			cache.heldopen = make(map[string]*openFileEnt, cache.heldopenMax)
-		} else if len(cache.heldopen) > cache.heldopenMax {
-			// Rather than go to the trouble of tracking
-			// last access time, just close all files, and
-			// open again as needed. Even in the worst
-			// pathological case, this causes one extra
-			// open+close per read, which is not
-			// especially bad (see benchmarks).
-			go func(m map[string]*openFileEnt) {
-				for _, heldopen := range m {
-					heldopen.Lock()
-					defer heldopen.Unlock()
-					if heldopen.f != nil {
-						heldopen.f.Close()
-						heldopen.f = nil
-					}
-				}
-			}(cache.heldopen)
-			cache.heldopen = nil
+			cache.heldopenLRU = list.New()
+		}
+		for len(cache.heldopen) >= cache.heldopenMax && cache.heldopenLRU.Len() > 0 {
+			// Close the least recently used file. It
+			// will be opened again if needed.
+			oldest := cache.heldopenLRU.Remove(cache.heldopenLRU.Back()).(string)
+			go cache.heldopen[oldest].close()
+			delete(cache.heldopen, oldest)
 		}
+		heldopen.lru = cache.heldopenLRU.PushFront(cachefilename)
 		cache.heldopen[cachefilename] = heldopen
 		heldopen.Lock()
+	} else {
+		cache.heldopenLRU.MoveToFront(heldopen.lru)
 	}
 	cache.heldopenLock.Unlock()
 
@@ -483,8 +1538,14 @@ func (cache *DiskCache) quickReadAt(cachefilename string, dst []byte, offset int
 		// other goroutines waiting at heldopen.RLock() below
 		// can use the shared filehandle (or shared error).
 		f, err := os.Open(cachefilename)
+		if os.IsNotExist(err) {
+			f, err = cache.openCompressed(cachefilename)
+		}
 		if err == nil {
 			err = syscall.Flock(int(f.Fd()), syscall.LOCK_SH)
+			if err == nil && cache.VerifyChecksum {
+				err = cache.verifyCacheFile(cachefilename, f)
+			}
 			if err == nil {
 				heldopen.f = f
 			} else {
@@ -530,7 +1591,10 @@ func (cache *DiskCache) quickReadAt(cachefilename string, dst []byte, offset int
 		// error, it just retries.
 	}
 
-	n, err := heldopen.f.ReadAt(dst, int64(offset))
+	n, err := cache.readCacheFile(heldopen.f, dst, offset)
+	if n > 0 && cache.DropPageCache {
+		dropPageCache(heldopen.f, int64(offset), int64(n))
+	}
 	if err != nil {
 		// wait for any concurrent users to finish, then
 		// delete this cache entry in case reopening the
@@ -540,33 +1604,60 @@ func (cache *DiskCache) quickReadAt(cachefilename string, dst []byte, offset int
 	return n, err
 }
 
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// cacheFileHash returns the block hash part of a cache file name.
+func cacheFileHash(cachefilename string) string {
+	return strings.TrimSuffix(filepath.Base(cachefilename), cacheFileSuffix)
+}
+
+// verifyCacheFile checks that the content of the given cache file
+// matches the hash in its name. If not, it deletes the file and
+// returns an error wrapping errChecksumMismatch.
+//
+// Files that are still being fetched from the backend are not
+// checked here; the fetching goroutine checks them when the fetch
+// is finished.
+func (cache *DiskCache) verifyCacheFile(cachefilename string, f *os.File) error {
+	cache.writingLock.Lock()
+	fetching := cache.writing[cachefilename] != nil
+	cache.writingLock.Unlock()
+	if fetching {
+		return nil
+	}
+	hashcheck := md5.New()
+	_, err := io.Copy(hashcheck, f)
+	if err != nil {
+		return err
+	}
+	if hash := fmt.Sprintf("%x", hashcheck.Sum(nil)); hash != cacheFileHash(cachefilename) {
+		if cache.Logger != nil {
+			cache.Logger.Warnf("DiskCache: deleting cache file %s with wrong content hash %s", cachefilename, hash)
+		}
+		os.Remove(cachefilename)
+		return fmt.Errorf("cache file %s has content hash %s: %w", cachefilename, hash, errChecksumMismatch)
+	}
+	return nil
+}
+
 // BlockRead reads an entire block using a 128 KiB buffer.
 func (cache *DiskCache) BlockRead(ctx context.Context, opts BlockReadOptions) (int, error) {
 	cache.setupOnce.Do(cache.setup)
-	i := strings.Index(opts.Locator, "+")
-	if i < 0 || i >= len(opts.Locator) {
-		return 0, errors.New("invalid block locator: no size hint")
-	}
-	sizestr := opts.Locator[i+1:]
-	i = strings.Index(sizestr, "+")
-	if i > 0 {
-		sizestr = sizestr[:i]
-	}
-	blocksize, err := strconv.ParseInt(sizestr, 10, 32)
-	if err != nil || blocksize < 0 {
-		return 0, errors.New("invalid block locator: invalid size hint")
+	blocksize, err := cache.BlockSize(opts.Locator)
+	if err != nil {
+		return 0, err
 	}
 
 	offset := 0
 	buf := make([]byte, 131072)
-	for offset < int(blocksize) {
+	for offset < blocksize {
 		if ctx.Err() != nil {
 			return offset, ctx.Err()
 		}
-		if int(blocksize)-offset < len(buf) {
-			buf = buf[:int(blocksize)-offset]
+		if blocksize-offset < len(buf) {
+			buf = buf[:blocksize-offset]
 		}
-		nr, err := cache.ReadAt(opts.Locator, buf, offset)
+		nr, err := cache.ReadAtContext(ctx, opts.Locator, buf, offset)
 		if nr > 0 {
 			nw, err := opts.WriteTo.Write(buf[:nr])
 			if err != nil {
@@ -581,6 +1672,29 @@ func (cache *DiskCache) BlockRead(ctx context.Context, opts BlockReadOptions) (i
 	return offset, nil
 }
 
+// BlockSize returns the size of the indicated block. It uses the
+// locator's size hint if there is one, otherwise the backend's
+// BlockSize method, if the backend implements BlockSizer.
+func (cache *DiskCache) BlockSize(locator string) (int, error) {
+	i := strings.Index(locator, "+")
+	if i < 0 || i >= len(locator)-1 {
+		if bs, ok := cache.KeepGateway.(BlockSizer); ok {
+			return bs.BlockSize(locator)
+		}
+		return 0, errors.New("invalid block locator: no size hint")
+	}
+	sizestr := locator[i+1:]
+	i = strings.Index(sizestr, "+")
+	if i > 0 {
+		sizestr = sizestr[:i]
+	}
+	size, err := strconv.ParseInt(sizestr, 10, 32)
+	if err != nil || size < 0 {
+		return 0, errors.New("invalid block locator: invalid size hint")
+	}
+	return int(size), nil
+}
+
 // Start a tidy() goroutine, unless one is already running / recently
 // finished.
 func (cache *DiskCache) gotidy() {
@@ -594,10 +1708,11 @@ func (cache *DiskCache) gotidy() {
 	// Skip if sizeEstimated is based on an actual measurement and
 	// is below maxSize, and we haven't done very many writes
 	// since last tidy (defined as 1% of number of cache files at
-	// last count).
+	// last count), and we can't have exceeded maxEntries.
 	if cache.sizeMeasured > 0 &&
 		atomic.LoadInt64(&cache.sizeEstimated) < atomic.LoadInt64(&cache.defaultMaxSize) &&
-		writes < cache.lastFileCount/100 {
+		writes < atomic.LoadInt64(&cache.lastFileCount)/100 &&
+		(cache.maxEntries == 0 || atomic.LoadInt64(&cache.lastFileCount)+writes <= cache.maxEntries) {
 		atomic.AddInt32(&cache.tidying, -1)
 		return
 	}
@@ -608,6 +1723,51 @@ func (cache *DiskCache) gotidy() {
 	}()
 }
 
+// Run tidy() immediately in the current goroutine, unless another
+// tidy is already running in this process.
+func (cache *DiskCache) tidyNow() {
+	if atomic.AddInt32(&cache.tidying, 1) == 1 {
+		cache.tidy()
+		atomic.StoreInt64(&cache.writesSinceTidy, 0)
+	}
+	atomic.AddInt32(&cache.tidying, -1)
+}
+
+// Tidy deletes cache files as needed to bring disk usage under
+// MaxSize (and MaxEntries, if set), without waiting for the next
+// write to trigger it. If a tidy is already running in this process,
+// Tidy waits for it to finish and then starts another, so sweeps
+// never overlap. If another process is tidying the same directory,
+// Tidy returns without doing anything.
+func (cache *DiskCache) Tidy() {
+	cache.setupOnce.Do(cache.setup)
+	for atomic.AddInt32(&cache.tidying, 1) != 1 {
+		atomic.AddInt32(&cache.tidying, -1)
+		time.Sleep(10 * time.Millisecond)
+	}
+	cache.tidy()
+	atomic.StoreInt64(&cache.writesSinceTidy, 0)
+	atomic.AddInt32(&cache.tidying, -1)
+	if cache.mirror != nil {
+		cache.mirror.Tidy()
+	}
+}
+
+// tidyPeriodically runs tidyNow() every interval, until stop is
+// closed.
+func (cache *DiskCache) tidyPeriodically(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			cache.tidyNow()
+		case <-stop:
+			return
+		}
+	}
+}
+
 // Delete cache files as needed to control disk usage.
 func (cache *DiskCache) tidy() {
 	maxsize := int64(cache.maxSize.ByteSize())
@@ -646,6 +1806,7 @@ func (cache *DiskCache) tidy() {
 
 	type entT struct {
 		path  string
+		name  string // cache file name (i.e., path without compressedFileSuffix)
 		atime time.Time
 		size  int64
 	}
@@ -659,7 +1820,7 @@ func (cache *DiskCache) tidy() {
 		if info.IsDir() {
 			return nil
 		}
-		if !strings.HasSuffix(path, cacheFileSuffix) && !strings.HasSuffix(path, tmpFileSuffix) {
+		if !strings.HasSuffix(path, cacheFileSuffix) && !strings.HasSuffix(path, tmpFileSuffix) && !strings.HasSuffix(path, cacheFileSuffix+compressedFileSuffix) {
 			return nil
 		}
 		var atime time.Time
@@ -672,7 +1833,7 @@ func (cache *DiskCache) tidy() {
 			// to sorting by modification time.
 			atime = info.ModTime()
 		}
-		ents = append(ents, entT{path, atime, info.Size()})
+		ents = append(ents, entT{path, strings.TrimSuffix(path, compressedFileSuffix), atime, info.Size()})
 		totalsize += info.Size()
 		return nil
 	})
@@ -697,16 +1858,19 @@ func (cache *DiskCache) tidy() {
 		return
 	}
 
-	// If we're below MaxSize or there's only one block in the
-	// cache, just update the usage estimate and return.
+	// If we're below MaxSize (and MaxEntries, if set) or there's
+	// only one block in the cache, just update the usage estimate
+	// and return.
 	//
 	// (We never delete the last block because that would merely
 	// cause the same block to get re-fetched repeatedly from the
 	// backend.)
-	if totalsize <= maxsize || len(ents) == 1 {
+	tooMany := cache.maxEntries > 0 && int64(len(ents)) > cache.maxEntries
+	if (totalsize <= maxsize && !tooMany) || len(ents) == 1 {
 		atomic.StoreInt64(&cache.sizeMeasured, totalsize)
 		atomic.StoreInt64(&cache.sizeEstimated, totalsize)
-		cache.lastFileCount = int64(len(ents))
+		atomic.StoreInt64(&cache.lastFileCount, int64(len(ents)))
+		atomic.StoreInt64(&cache.lastTidy, time.Now().UnixNano())
 		return
 	}
 
@@ -714,23 +1878,58 @@ func (cache *DiskCache) tidy() {
 	// room for sizeEstimate to grow before it triggers another
 	// tidy. We don't want to walk/sort an entire large cache
 	// directory each time we write a block.
+	// Likewise, if there are too many entries, set a new entry
+	// count target of maxEntries minus 5%.
 	target := maxsize - (maxsize / 20)
+	if totalsize <= maxsize {
+		target = totalsize
+	}
+	entriesTarget := int64(len(ents))
+	if tooMany {
+		entriesTarget = cache.maxEntries - (cache.maxEntries / 20)
+	}
 
-	// Delete oldest entries until totalsize < target or we're
-	// down to a single cached block.
+	// Delete oldest (or, with lfu, least frequently read)
+	// entries until totalsize <= target and the number of
+	// entries is <= entriesTarget, or we're down to a single
+	// cached block.
+	var counts map[string]int64
+	if cache.lfu {
+		cache.accessCountLock.Lock()
+		counts = cache.accessCount
+		cache.accessCount = make(map[string]int64, len(counts))
+		cache.accessCountLock.Unlock()
+	}
 	sort.Slice(ents, func(i, j int) bool {
+		if ci, cj := counts[ents[i].name], counts[ents[j].name]; ci != cj {
+			return ci < cj
+		}
 		return ents[i].atime.Before(ents[j].atime)
 	})
 	deleted := 0
 	for _, ent := range ents {
 		os.Remove(ent.path)
-		go cache.deleteHeldopen(ent.path, nil)
+		go cache.deleteHeldopen(ent.name, nil)
 		deleted++
 		totalsize -= ent.size
-		if totalsize <= target || deleted == len(ents)-1 {
+		if (totalsize <= target && int64(len(ents)-deleted) <= entriesTarget) || deleted == len(ents)-1 {
 			break
 		}
 	}
+	atomic.AddInt64(&cache.evictions, int64(deleted))
+	if cache.lfu {
+		// Carry over halved counts for the remaining files,
+		// adding to any reads that happened while we were
+		// deleting. Counts for deleted (or otherwise
+		// missing) files are dropped.
+		cache.accessCountLock.Lock()
+		for _, ent := range ents[deleted:] {
+			if n := counts[ent.name] / 2; n > 0 {
+				cache.accessCount[ent.name] += n
+			}
+		}
+		cache.accessCountLock.Unlock()
+	}
 
 	if cache.Logger != nil {
 		cache.Logger.WithFields(logrus.Fields{
@@ -740,5 +1939,6 @@ func (cache *DiskCache) tidy() {
 	}
 	atomic.StoreInt64(&cache.sizeMeasured, totalsize)
 	atomic.StoreInt64(&cache.sizeEstimated, totalsize)
-	cache.lastFileCount = int64(len(ents) - deleted)
+	atomic.StoreInt64(&cache.lastFileCount, int64(len(ents)-deleted))
+	atomic.StoreInt64(&cache.lastTidy, time.Now().UnixNano())
 }
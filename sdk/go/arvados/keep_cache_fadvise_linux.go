@@ -0,0 +1,21 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build linux
+
+package arvados
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// dropPageCache advises the kernel that the given range of f (or,
+// if length is zero, everything from offset to the end of the file)
+// will not be accessed again soon, so its pages can be dropped from
+// the page cache. Errors are ignored: this is only a hint.
+func dropPageCache(f *os.File, offset, length int64) {
+	unix.Fadvise(int(f.Fd()), offset, length, unix.FADV_DONTNEED)
+}
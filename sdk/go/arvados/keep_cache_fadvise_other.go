@@ -0,0 +1,15 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !linux
+
+package arvados
+
+import (
+	"os"
+)
+
+// dropPageCache is a no-op on platforms without posix_fadvise
+// support. See DiskCache.DropPageCache.
+func dropPageCache(f *os.File, offset, length int64) {}
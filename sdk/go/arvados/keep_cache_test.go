@@ -14,8 +14,10 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
@@ -50,6 +52,38 @@ func (*keepGatewayBlackHole) BlockWrite(ctx context.Context, opts BlockWriteOpti
 	return BlockWriteResponse{Locator: fmt.Sprintf("%x+%d", h.Sum(nil), size), Replicas: 1}, nil
 }
 
+// keepGatewayCounting counts BlockRead calls to the wrapped
+// KeepGateway.
+type keepGatewayCounting struct {
+	KeepGateway
+	blockReads int64
+}
+
+func (k *keepGatewayCounting) BlockRead(ctx context.Context, opts BlockReadOptions) (int, error) {
+	atomic.AddInt64(&k.blockReads, 1)
+	return k.KeepGateway.BlockRead(ctx, opts)
+}
+
+// keepGatewaySlow wraps a KeepGateway. Its BlockRead method waits
+// until release is closed or ctx is done.
+type keepGatewaySlow struct {
+	KeepGateway
+	release   chan struct{}
+	started   chan struct{}
+	cancelled chan struct{}
+}
+
+func (k *keepGatewaySlow) BlockRead(ctx context.Context, opts BlockReadOptions) (int, error) {
+	k.started <- struct{}{}
+	select {
+	case <-ctx.Done():
+		k.cancelled <- struct{}{}
+		return 0, ctx.Err()
+	case <-k.release:
+		return k.KeepGateway.BlockRead(ctx, opts)
+	}
+}
+
 type keepGatewayMemoryBacked struct {
 	mtx                 sync.RWMutex
 	data                map[string][]byte
@@ -144,19 +178,353 @@ func (s *keepCacheSuite) TestBlockWrite(c *check.C) {
 	c.Check(err, check.IsNil)
 }
 
+type keepGatewayWrongLocator struct {
+	keepGatewayMemoryBacked
+}
+
+func (k *keepGatewayWrongLocator) BlockWrite(ctx context.Context, opts BlockWriteOptions) (BlockWriteResponse, error) {
+	resp, err := k.keepGatewayMemoryBacked.BlockWrite(ctx, opts)
+	resp.Locator = fmt.Sprintf("%x+%d", md5.Sum([]byte("wrong")), opts.DataSize)
+	return resp, err
+}
+
+func (s *keepCacheSuite) TestBlockWriteWrongLocator(c *check.C) {
+	backend := &keepGatewayWrongLocator{}
+	cache := DiskCache{
+		KeepGateway: backend,
+		MaxSize:     40000000,
+		Dir:         c.MkDir(),
+		Logger:      ctxlog.TestLogger(c),
+	}
+	ctx := context.Background()
+	data := make([]byte, 1000)
+	_, err := cache.BlockWrite(ctx, BlockWriteOptions{
+		Data: data,
+	})
+	c.Check(err, check.ErrorMatches, `backend returned locator ".+", expected "`+fmt.Sprintf("%x", md5.Sum(data))+`\+1000"`)
+
+	// The data must not have been cached under either locator.
+	for _, locator := range []string{fmt.Sprintf("%x+1000", md5.Sum(data)), fmt.Sprintf("%x+1000", md5.Sum([]byte("wrong")))} {
+		_, err = os.Stat(cache.cacheFile(locator))
+		c.Check(os.IsNotExist(err), check.Equals, true)
+	}
+}
+
+func (s *keepCacheSuite) TestOnBackendFetch(c *check.C) {
+	backend := &keepGatewayMemoryBacked{}
+	type fetch struct {
+		locator        string
+		offset, length int
+	}
+	var fetches []fetch
+	cache := DiskCache{
+		KeepGateway: backend,
+		MaxSize:     40000000,
+		Dir:         c.MkDir(),
+		Logger:      ctxlog.TestLogger(c),
+		OnBackendFetch: func(locator string, offset, length int) {
+			fetches = append(fetches, fetch{locator, offset, length})
+		},
+	}
+	ctx := context.Background()
+	// Write directly to the backend so the block is not already
+	// in the cache.
+	resp, err := backend.BlockWrite(ctx, BlockWriteOptions{
+		Data: make([]byte, 100000),
+	})
+	c.Assert(err, check.IsNil)
+
+	// Cold miss: hook is called with the requested range.
+	n, err := cache.ReadAt(resp.Locator, make([]byte, 100), 1000)
+	c.Check(n, check.Equals, 100)
+	c.Check(err, check.IsNil)
+	c.Check(fetches, check.DeepEquals, []fetch{{resp.Locator, 1000, 100}})
+
+	// Wait for the rest of the block to arrive in the cache.
+	n, err = cache.BlockRead(ctx, BlockReadOptions{Locator: resp.Locator, WriteTo: io.Discard})
+	c.Check(n, check.Equals, 100000)
+	c.Check(err, check.IsNil)
+
+	// Hit: hook is not called again.
+	n, err = cache.ReadAt(resp.Locator, make([]byte, 100), 2000)
+	c.Check(n, check.Equals, 100)
+	c.Check(err, check.IsNil)
+	c.Check(fetches, check.HasLen, 1)
+}
+
+func (s *keepCacheSuite) TestReadTimeout(c *check.C) {
+	backend := &keepGatewayMemoryBacked{}
+	cache := DiskCache{
+		KeepGateway: backend,
+		MaxSize:     40000000,
+		Dir:         c.MkDir(),
+		Logger:      ctxlog.TestLogger(c),
+		ReadTimeout: 100 * time.Millisecond,
+	}
+	ctx := context.Background()
+	resp, err := cache.BlockWrite(ctx, BlockWriteOptions{
+		Data: []byte("foobar"),
+	})
+	c.Assert(err, check.IsNil)
+
+	// Normal read from cache file
+	buf := make([]byte, 3)
+	n, err := cache.ReadAt(resp.Locator, buf, 3)
+	c.Check(n, check.Equals, 3)
+	c.Check(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "bar")
+
+	// Simulate a cache file read that hangs
+	unblock := make(chan struct{})
+	defer close(unblock)
+	orig := cacheFileReadAt
+	defer func() { cacheFileReadAt = orig }()
+	cacheFileReadAt = func(f *os.File, dst []byte, offset int64) (int, error) {
+		<-unblock
+		return orig(f, dst, offset)
+	}
+
+	t0 := time.Now()
+	n, err = cache.ReadAt(resp.Locator, buf, 0)
+	c.Check(n, check.Equals, 3)
+	c.Check(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "foo")
+	c.Check(time.Since(t0) >= cache.ReadTimeout, check.Equals, true)
+	c.Check(time.Since(t0) < time.Second, check.Equals, true)
+
+	// Suspect cache file is removed
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		_, err = os.Stat(cache.cacheFile(resp.Locator))
+		if os.IsNotExist(err) || time.Now().After(deadline) {
+			break
+		}
+	}
+	c.Check(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *keepCacheSuite) TestNoSpace(c *check.C) {
+	backend := &keepGatewayMemoryBacked{}
+	var fetches int
+	cache := DiskCache{
+		KeepGateway:    backend,
+		MaxSize:        40000000,
+		Dir:            c.MkDir(),
+		Logger:         ctxlog.TestLogger(c),
+		OnBackendFetch: func(string, int, int) { fetches++ },
+	}
+	ctx := context.Background()
+
+	// Simulate a full disk
+	var full bool
+	var writes int
+	orig := cacheFileWrite
+	defer func() { cacheFileWrite = orig }()
+	cacheFileWrite = func(f *os.File, p []byte) (int, error) {
+		writes++
+		if full {
+			return 0, &os.PathError{Op: "write", Path: f.Name(), Err: syscall.ENOSPC}
+		}
+		return orig(f, p)
+	}
+
+	// BlockWrite succeeds by writing through to the backend,
+	// after retrying the cache write once.
+	full = true
+	resp, err := cache.BlockWrite(ctx, BlockWriteOptions{
+		Data: []byte("foobar"),
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(writes, check.Equals, 2)
+	c.Check(cache.NoSpaceErrors(), check.Equals, int64(1))
+	_, err = os.Stat(cache.cacheFile(resp.Locator))
+	c.Check(os.IsNotExist(err), check.Equals, true)
+
+	// ReadAt succeeds by reading from the backend.
+	buf := make([]byte, 3)
+	n, err := cache.ReadAt(resp.Locator, buf, 3)
+	c.Check(n, check.Equals, 3)
+	c.Check(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "bar")
+	c.Check(fetches, check.Equals, 1)
+	c.Check(cache.NoSpaceErrors(), check.Equals, int64(2))
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		_, err = os.Stat(cache.cacheFile(resp.Locator))
+		if os.IsNotExist(err) || time.Now().After(deadline) {
+			break
+		}
+	}
+	c.Check(os.IsNotExist(err), check.Equals, true)
+
+	// Once there is space again, blocks are cached as usual.
+	full = false
+	n, err = cache.ReadAt(resp.Locator, buf, 0)
+	c.Check(n, check.Equals, 3)
+	c.Check(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "foo")
+	c.Check(fetches, check.Equals, 2)
+	n, err = cache.ReadAt(resp.Locator, buf, 3)
+	c.Check(n, check.Equals, 3)
+	c.Check(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "bar")
+	c.Check(fetches, check.Equals, 2)
+	c.Check(cache.NoSpaceErrors(), check.Equals, int64(2))
+}
+
+func (s *keepCacheSuite) TestMirrorDir(c *check.C) {
+	backend := &keepGatewayMemoryBacked{}
+	cache := DiskCache{
+		KeepGateway: backend,
+		MaxSize:     40000000,
+		Dir:         c.MkDir(),
+		MirrorDir:   c.MkDir(),
+		Logger:      ctxlog.TestLogger(c),
+	}
+	ctx := context.Background()
+	resp, err := cache.BlockWrite(ctx, BlockWriteOptions{
+		Data: []byte("foobar"),
+	})
+	c.Assert(err, check.IsNil)
+
+	// Wait for the background copy to the mirror dir.
+	mirrorfile := cache.mirror.cacheFile(resp.Locator)
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		_, err = os.Stat(mirrorfile)
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+	}
+	c.Assert(err, check.IsNil)
+	c.Check(strings.HasPrefix(mirrorfile, cache.MirrorDir+"/"), check.Equals, true)
+
+	// With the primary cache file and the backend copy gone,
+	// ReadAt uses the mirror.
+	c.Assert(os.Remove(cache.cacheFile(resp.Locator)), check.IsNil)
+	delete(backend.data, resp.Locator)
+	buf := make([]byte, 3)
+	n, err := cache.ReadAt(resp.Locator, buf, 3)
+	c.Check(n, check.Equals, 3)
+	c.Check(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "bar")
+
+	// A mirror dir that can't be written doesn't cause
+	// BlockWrite to fail.
+	notadir := filepath.Join(c.MkDir(), "file")
+	c.Assert(os.WriteFile(notadir, nil, 0600), check.IsNil)
+	cache = DiskCache{
+		KeepGateway: backend,
+		MaxSize:     40000000,
+		Dir:         c.MkDir(),
+		MirrorDir:   notadir,
+		Logger:      ctxlog.TestLogger(c),
+	}
+	resp, err = cache.BlockWrite(ctx, BlockWriteOptions{
+		Data: []byte("foobaz"),
+	})
+	c.Assert(err, check.IsNil)
+	n, err = cache.ReadAt(resp.Locator, buf, 3)
+	c.Check(n, check.Equals, 3)
+	c.Check(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "baz")
+}
+
+type keepGatewayBlockSizer struct {
+	keepGatewayMemoryBacked
+}
+
+func (k *keepGatewayBlockSizer) BlockSize(locator string) (int, error) {
+	k.mtx.RLock()
+	defer k.mtx.RUnlock()
+	for loc, data := range k.data {
+		if loc[:32] == locator[:32] {
+			return len(data), nil
+		}
+	}
+	return 0, errors.New("block not found: " + locator)
+}
+
+func (s *keepCacheSuite) TestBlockSize(c *check.C) {
+	backend := &keepGatewayBlockSizer{}
+	var fetches int
+	cache := DiskCache{
+		KeepGateway:    backend,
+		MaxSize:        40000000,
+		Dir:            c.MkDir(),
+		Logger:         ctxlog.TestLogger(c),
+		OnBackendFetch: func(string, int, int) { fetches++ },
+	}
+	ctx := context.Background()
+	resp, err := backend.BlockWrite(ctx, BlockWriteOptions{
+		Data: []byte("foobar"),
+	})
+	c.Assert(err, check.IsNil)
+
+	size, err := cache.BlockSize(resp.Locator)
+	c.Check(err, check.IsNil)
+	c.Check(size, check.Equals, 6)
+	size, err = cache.BlockSize(resp.Locator[:32])
+	c.Check(err, check.IsNil)
+	c.Check(size, check.Equals, 6)
+	_, err = cache.BlockSize(resp.Locator[:32] + "+bogus")
+	c.Check(err, check.ErrorMatches, `invalid block locator: invalid size hint`)
+
+	// Reading past the end of the block returns EOF without
+	// fetching from the backend.
+	n, err := cache.ReadAt(resp.Locator, make([]byte, 4), 6)
+	c.Check(n, check.Equals, 0)
+	c.Check(err, check.Equals, io.EOF)
+	c.Check(fetches, check.Equals, 0)
+
+	// A read that extends past the end of the block returns the
+	// available data and EOF.
+	buf := make([]byte, 4)
+	n, err = cache.ReadAt(resp.Locator, buf, 3)
+	c.Check(n, check.Equals, 3)
+	c.Check(err, check.Equals, io.EOF)
+	c.Check(string(buf[:n]), check.Equals, "bar")
+	c.Check(fetches, check.Equals, 1)
+
+	// BlockRead uses BlockSize when the locator has no size hint.
+	var out bytes.Buffer
+	n, err = cache.BlockRead(ctx, BlockReadOptions{Locator: resp.Locator[:32], WriteTo: &out})
+	c.Check(n, check.Equals, 6)
+	c.Check(err, check.IsNil)
+	c.Check(out.String(), check.Equals, "foobar")
+
+	// Without a size hint or a BlockSizer backend, BlockRead
+	// fails as before.
+	cache.KeepGateway = &backend.keepGatewayMemoryBacked
+	_, err = cache.BlockRead(ctx, BlockReadOptions{Locator: resp.Locator[:32], WriteTo: &out})
+	c.Check(err, check.ErrorMatches, `invalid block locator: no size hint`)
+}
+
 func (s *keepCacheSuite) TestMaxSize(c *check.C) {
+	s.testMaxSize(c, 0)
+}
+func (s *keepCacheSuite) TestMaxSizeSharded(c *check.C) {
+	s.testMaxSize(c, 3)
+}
+func (s *keepCacheSuite) testMaxSize(c *check.C, shardLevels int) {
 	backend := &keepGatewayMemoryBacked{}
 	cache := DiskCache{
 		KeepGateway: backend,
 		MaxSize:     40000000,
 		Dir:         c.MkDir(),
 		Logger:      ctxlog.TestLogger(c),
+		ShardLevels: shardLevels,
 	}
 	ctx := context.Background()
 	resp1, err := cache.BlockWrite(ctx, BlockWriteOptions{
 		Data: make([]byte, 44000000),
 	})
 	c.Check(err, check.IsNil)
+	hash := resp1.Locator[:32]
+	if shardLevels > 1 {
+		c.Check(cache.cacheFile(resp1.Locator), check.Equals, filepath.Join(cache.Dir, hash[:3], hash[3:5], hash[5:7], hash+cacheFileSuffix))
+	} else {
+		c.Check(cache.cacheFile(resp1.Locator), check.Equals, filepath.Join(cache.Dir, hash[:3], hash+cacheFileSuffix))
+	}
+	_, err = os.Stat(cache.cacheFile(resp1.Locator))
+	c.Check(err, check.IsNil)
 
 	// Wait for tidy to finish, check that it doesn't delete the
 	// only block.
@@ -190,21 +558,787 @@ func (s *keepCacheSuite) TestMaxSize(c *check.C) {
 	c.Check(err, check.IsNil)
 }
 
-func (s *keepCacheSuite) TestConcurrentReadersNoRefresh(c *check.C) {
-	s.testConcurrentReaders(c, true, false)
+func (s *keepCacheSuite) TestStats(c *check.C) {
+	backend := &keepGatewayMemoryBacked{}
+	cache := DiskCache{
+		KeepGateway: backend,
+		MaxSize:     40000000,
+		Dir:         c.MkDir(),
+		Logger:      ctxlog.TestLogger(c),
+	}
+	ctx := context.Background()
+	cached, err := cache.BlockWrite(ctx, BlockWriteOptions{Data: []byte("cached")})
+	c.Assert(err, check.IsNil)
+	uncached, err := backend.BlockWrite(ctx, BlockWriteOptions{Data: []byte("uncached")})
+	c.Assert(err, check.IsNil)
+	c.Check(activityStats(cache.Stats()), check.DeepEquals, DiskCacheStats{})
+
+	buf := make([]byte, 6)
+	n, err := cache.ReadAt(cached.Locator, buf, 0)
+	c.Check(n, check.Equals, 6)
+	c.Check(err, check.IsNil)
+	c.Check(activityStats(cache.Stats()), check.DeepEquals, DiskCacheStats{Hits: 1, CacheBytes: 6})
+
+	buf = make([]byte, 8)
+	n, err = cache.ReadAt(uncached.Locator, buf, 0)
+	c.Check(n, check.Equals, 8)
+	c.Check(err, check.IsNil)
+	c.Check(activityStats(cache.Stats()), check.DeepEquals, DiskCacheStats{Hits: 1, CacheBytes: 6, Misses: 1, BackendBytes: 8})
 }
-func (s *keepCacheSuite) TestConcurrentReadersMangleCache(c *check.C) {
-	s.testConcurrentReaders(c, false, true)
+
+// activityStats returns the activity counters from s, omitting the
+// usage fields, which depend on tidy timing.
+func activityStats(s DiskCacheStats) DiskCacheStats {
+	return DiskCacheStats{
+		Hits:         s.Hits,
+		Misses:       s.Misses,
+		Evictions:    s.Evictions,
+		CacheBytes:   s.CacheBytes,
+		BackendBytes: s.BackendBytes,
+	}
 }
-func (s *keepCacheSuite) testConcurrentReaders(c *check.C, cannotRefresh, mangleCache bool) {
-	blksize := 64000000
+
+func (s *keepCacheSuite) TestStatsUsage(c *check.C) {
 	backend := &keepGatewayMemoryBacked{}
 	cache := DiskCache{
 		KeepGateway: backend,
-		MaxSize:     ByteSizeOrPercent(blksize),
+		MaxSize:     40000000,
 		Dir:         c.MkDir(),
 		Logger:      ctxlog.TestLogger(c),
 	}
+	c.Check(cache.Stats().LastTidy.IsZero(), check.Equals, true)
+	ctx := context.Background()
+	for _, data := range []string{"foo", "barbaz"} {
+		_, err := cache.BlockWrite(ctx, BlockWriteOptions{Data: []byte(data)})
+		c.Assert(err, check.IsNil)
+	}
+	time.Sleep(time.Millisecond)
+	for atomic.LoadInt32(&cache.tidying) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cache.tidyNow()
+
+	stats := cache.Stats()
+	c.Check(stats.BytesUsed, check.Equals, int64(9))
+	c.Check(stats.Entries, check.Equals, int64(2))
+	c.Check(stats.MaxSize, check.Equals, int64(40000000))
+	c.Check(stats.LastTidy.IsZero(), check.Equals, false)
+}
+
+func (s *keepCacheSuite) TestEvictionPolicyLRU(c *check.C) {
+	c.Check(s.testEvictionPolicy(c, "lru"), check.Equals, false)
+}
+func (s *keepCacheSuite) TestEvictionPolicyLFU(c *check.C) {
+	c.Check(s.testEvictionPolicy(c, "lfu"), check.Equals, true)
+}
+
+// testEvictionPolicy writes several blocks, reads the oldest one
+// repeatedly, forces a tidy, and returns true if the frequently read
+// block survived.
+func (s *keepCacheSuite) testEvictionPolicy(c *check.C, policy string) bool {
+	backend := &keepGatewayMemoryBacked{}
+	cache := DiskCache{
+		KeepGateway:    backend,
+		MaxSize:        45000000,
+		Dir:            c.MkDir(),
+		Logger:         ctxlog.TestLogger(c),
+		EvictionPolicy: policy,
+	}
+	waitTidy := func() {
+		time.Sleep(time.Millisecond)
+		for atomic.LoadInt32(&cache.tidying) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	ctx := context.Background()
+	var locators []string
+	for i := 0; i < 4; i++ {
+		data := make([]byte, 10000000)
+		data[0] = byte(i)
+		resp, err := cache.BlockWrite(ctx, BlockWriteOptions{Data: data})
+		c.Assert(err, check.IsNil)
+		locators = append(locators, resp.Locator)
+	}
+	waitTidy()
+	hot := locators[0]
+	for i := 0; i < 5; i++ {
+		_, err := cache.ReadAt(hot, make([]byte, 2), 0)
+		c.Assert(err, check.IsNil)
+	}
+	// Make the hot block look like the least recently used one,
+	// followed by the others in the order they were written.
+	for i, loc := range locators {
+		t := time.Now().Add(time.Duration(i-10) * time.Minute)
+		c.Assert(os.Chtimes(cache.cacheFile(loc), t, t), check.IsNil)
+	}
+
+	// Exceed MaxSize, so tidy has to delete one block.
+	data := make([]byte, 10000000)
+	data[0] = byte(len(locators))
+	_, err := cache.BlockWrite(ctx, BlockWriteOptions{Data: data})
+	c.Assert(err, check.IsNil)
+	waitTidy()
+	cache.tidyNow()
+	c.Check(atomic.LoadInt64(&cache.sizeMeasured), check.Equals, int64(40000000))
+	c.Check(cache.Stats().Evictions, check.Equals, int64(1))
+
+	// The least recently used of the other blocks is deleted
+	// only if the hot block survives.
+	_, err = os.Stat(cache.cacheFile(locators[1]))
+	_, hotErr := os.Stat(cache.cacheFile(hot))
+	c.Check(os.IsNotExist(err), check.Equals, hotErr == nil)
+	return hotErr == nil
+}
+
+func (s *keepCacheSuite) TestNotFoundTTL(c *check.C) {
+	backend := &keepGatewayCounting{KeepGateway: &keepGatewayBlackHole{}}
+	cache := DiskCache{
+		KeepGateway: backend,
+		MaxSize:     40000000,
+		Dir:         c.MkDir(),
+		Logger:      ctxlog.TestLogger(c),
+		NotFoundTTL: 100 * time.Millisecond,
+	}
+	locator := fmt.Sprintf("%x+3", md5.Sum([]byte("foo")))
+	buf := make([]byte, 3)
+	_, err := cache.ReadAt(locator, buf, 0)
+	c.Check(err, check.ErrorMatches, `block not found`)
+	c.Check(atomic.LoadInt64(&backend.blockReads), check.Equals, int64(1))
+
+	// Within the TTL, the error is returned without contacting
+	// the backend.
+	_, err = cache.ReadAt(locator, buf, 0)
+	c.Check(err, check.ErrorMatches, `block not found`)
+	_, err = cache.BlockRead(context.Background(), BlockReadOptions{Locator: locator, WriteTo: io.Discard})
+	c.Check(err, check.ErrorMatches, `block not found`)
+	c.Check(atomic.LoadInt64(&backend.blockReads), check.Equals, int64(1))
+
+	// After the TTL, the backend is tried again.
+	time.Sleep(100 * time.Millisecond)
+	_, err = cache.ReadAt(locator, buf, 0)
+	c.Check(err, check.ErrorMatches, `block not found`)
+	c.Check(atomic.LoadInt64(&backend.blockReads), check.Equals, int64(2))
+
+	// Writing the block forgets the error.
+	_, err = cache.BlockWrite(context.Background(), BlockWriteOptions{Data: []byte("foo")})
+	c.Assert(err, check.IsNil)
+	n, err := cache.ReadAt(locator, buf, 0)
+	c.Check(n, check.Equals, 3)
+	c.Check(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "foo")
+
+	// Without NotFoundTTL, every read tries the backend.
+	cache.NotFoundTTL = 0
+	locator = fmt.Sprintf("%x+3", md5.Sum([]byte("bar")))
+	for i := 0; i < 2; i++ {
+		_, err = cache.ReadAt(locator, buf, 0)
+		c.Check(err, check.ErrorMatches, `block not found`)
+	}
+	c.Check(atomic.LoadInt64(&backend.blockReads), check.Equals, int64(4))
+}
+
+// Fill the cache to MaxSize using cache, then add a cache file
+// behind its back (as another process might) so the cache is over
+// MaxSize without any write having triggered a tidy.
+func (s *keepCacheSuite) overfillCache(c *check.C, cache *DiskCache) {
+	ctx := context.Background()
+	for i := 0; i < 4; i++ {
+		data := make([]byte, 10000000)
+		data[0] = byte(i)
+		_, err := cache.BlockWrite(ctx, BlockWriteOptions{Data: data})
+		c.Assert(err, check.IsNil)
+	}
+	time.Sleep(time.Millisecond)
+	for atomic.LoadInt32(&cache.tidying) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cache.tidyNow()
+	c.Assert(cache.Stats().Evictions, check.Equals, int64(0))
+
+	fn := cache.cacheFile(fmt.Sprintf("%x", md5.Sum([]byte("extra"))))
+	c.Assert(os.MkdirAll(filepath.Dir(fn), 0700), check.IsNil)
+	c.Assert(os.WriteFile(fn, make([]byte, 10000000), 0600), check.IsNil)
+}
+
+func (s *keepCacheSuite) TestTidy(c *check.C) {
+	cache := DiskCache{
+		KeepGateway: &keepGatewayMemoryBacked{},
+		MaxSize:     40000000,
+		Dir:         c.MkDir(),
+		Logger:      ctxlog.TestLogger(c),
+	}
+	s.overfillCache(c, &cache)
+
+	// Concurrent calls must not run overlapping sweeps: the
+	// first one deletes enough files to get under the target
+	// size (MaxSize - 5%), so the others have nothing to do.
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cache.Tidy()
+		}()
+	}
+	wg.Wait()
+	c.Check(cache.Stats().Evictions, check.Equals, int64(2))
+	c.Check(cache.Stats().BytesUsed, check.Equals, int64(30000000))
+}
+
+func (s *keepCacheSuite) TestTidyInterval(c *check.C) {
+	cache := DiskCache{
+		KeepGateway:  &keepGatewayMemoryBacked{},
+		MaxSize:      40000000,
+		Dir:          c.MkDir(),
+		Logger:       ctxlog.TestLogger(c),
+		TidyInterval: 10 * time.Millisecond,
+	}
+	s.overfillCache(c, &cache)
+	deadline := time.Now().Add(5 * time.Second)
+	for cache.Stats().Evictions == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	c.Check(cache.Stats().Evictions, check.Equals, int64(2))
+}
+
+func (s *keepCacheSuite) TestCloseStopsTidy(c *check.C) {
+	cache := DiskCache{
+		KeepGateway:  &keepGatewayMemoryBacked{},
+		MaxSize:      40000000,
+		Dir:          c.MkDir(),
+		Logger:       ctxlog.TestLogger(c),
+		TidyInterval: 10 * time.Millisecond,
+	}
+	cache.Tidy()
+	shared := cache.sharedCache
+	lastTidy := func() int64 { return atomic.LoadInt64(&shared.lastTidy) }
+
+	// The periodic tidy is running.
+	t0 := lastTidy()
+	deadline := time.Now().Add(5 * time.Second)
+	for lastTidy() == t0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	c.Check(lastTidy(), check.Not(check.Equals), t0)
+
+	// After Close, it stops.
+	c.Check(cache.Close(), check.IsNil)
+	time.Sleep(50 * time.Millisecond)
+	t0 = lastTidy()
+	time.Sleep(50 * time.Millisecond)
+	c.Check(lastTidy(), check.Equals, t0)
+
+	// The next DiskCache using the same Dir starts afresh.
+	cache2 := DiskCache{
+		KeepGateway: &keepGatewayMemoryBacked{},
+		MaxSize:     40000000,
+		Dir:         cache.Dir,
+		Logger:      ctxlog.TestLogger(c),
+	}
+	cache2.Tidy()
+	c.Check(cache2.sharedCache, check.Not(check.Equals), shared)
+	c.Check(cache2.Close(), check.IsNil)
+}
+
+func (s *keepCacheSuite) TestSharedSettingsMismatch(c *check.C) {
+	var logbuf bytes.Buffer
+	logger := ctxlog.New(&logbuf, "text", "info")
+	dir := c.MkDir()
+	cache1 := DiskCache{
+		KeepGateway: &keepGatewayMemoryBacked{},
+		MaxSize:     40000000,
+		Dir:         dir,
+		Logger:      logger,
+	}
+	cache1.Tidy()
+	defer cache1.Close()
+
+	// Same settings: no warning.
+	cache2 := newDiskCacheLike(&cache1)
+	cache2.Tidy()
+	defer cache2.Close()
+	c.Check(logbuf.String(), check.Equals, "")
+
+	// Different settings are ignored, with a warning.
+	cache3 := newDiskCacheLike(&cache1)
+	cache3.MaxEntries = 10
+	cache3.Tidy()
+	defer cache3.Close()
+	c.Check(logbuf.String(), check.Matches, `(?ms).*DiskCache: ignoring settings .*MaxEntries:10.* for `+dir+`.*`)
+	c.Check(cache3.maxEntries, check.Equals, int64(0))
+}
+
+// newDiskCacheLike returns a new DiskCache with the same Dir and
+// settings as cache.
+func newDiskCacheLike(cache *DiskCache) *DiskCache {
+	return &DiskCache{
+		KeepGateway: cache.KeepGateway,
+		MaxSize:     cache.MaxSize,
+		Dir:         cache.Dir,
+		Logger:      cache.Logger,
+	}
+}
+
+func (s *keepCacheSuite) TestMaxEntries(c *check.C) {
+	backend := &keepGatewayMemoryBacked{}
+	cache := DiskCache{
+		KeepGateway: backend,
+		MaxSize:     40000000,
+		MaxEntries:  10,
+		Dir:         c.MkDir(),
+		Logger:      ctxlog.TestLogger(c),
+	}
+	ctx := context.Background()
+	for i := 0; i < 15; i++ {
+		_, err := cache.BlockWrite(ctx, BlockWriteOptions{
+			Data: []byte(fmt.Sprintf("block %d", i)),
+		})
+		c.Assert(err, check.IsNil)
+	}
+	time.Sleep(time.Millisecond)
+	for atomic.LoadInt32(&cache.tidying) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// The tidy triggered by the last write might have been
+	// skipped because an earlier one was still running.
+	cache.tidyNow()
+
+	count := 0
+	filepath.Walk(cache.Dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && strings.HasSuffix(path, cacheFileSuffix) {
+			count++
+		}
+		return nil
+	})
+	c.Check(count, check.Equals, 10)
+	c.Check(cache.lastFileCount, check.Equals, int64(10))
+}
+
+func (s *keepCacheSuite) TestPrefetch(c *check.C) {
+	backend := &keepGatewayMemoryBacked{}
+	var fetched int32
+	cache := DiskCache{
+		KeepGateway: backend,
+		MaxSize:     40000000,
+		Dir:         c.MkDir(),
+		Logger:      ctxlog.TestLogger(c),
+		OnBackendFetch: func(string, int, int) {
+			atomic.AddInt32(&fetched, 1)
+		},
+	}
+	ctx := context.Background()
+	resp, err := backend.BlockWrite(ctx, BlockWriteOptions{
+		Data: make([]byte, 1000000),
+	})
+	c.Assert(err, check.IsNil)
+
+	cache.Prefetch(ctx, resp.Locator)
+	// Prefetching again while the first fetch is in progress (or
+	// after it finishes) should not start another fetch.
+	cache.Prefetch(ctx, resp.Locator)
+
+	// Wait for the fetch to finish.
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(time.Millisecond) {
+		if fi, err := os.Stat(cache.cacheFile(resp.Locator)); err == nil && fi.Size() == 1000000 {
+			cache.writingLock.Lock()
+			done := len(cache.writing) == 0
+			cache.writingLock.Unlock()
+			if done {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			c.Fatal("timed out waiting for prefetch")
+		}
+	}
+	c.Check(atomic.LoadInt32(&fetched), check.Equals, int32(1))
+
+	// Subsequent reads are served from the cache.
+	delete(backend.data, resp.Locator)
+	buf := make([]byte, 1000)
+	n, err := cache.ReadAt(resp.Locator, buf, 999000)
+	c.Check(n, check.Equals, 1000)
+	c.Check(err, check.IsNil)
+	c.Check(atomic.LoadInt32(&fetched), check.Equals, int32(1))
+}
+
+func (s *keepCacheSuite) TestReadAtContext(c *check.C) {
+	backend := &keepGatewaySlow{
+		KeepGateway: &keepGatewayMemoryBacked{},
+		release:     make(chan struct{}),
+		started:     make(chan struct{}, 10),
+		cancelled:   make(chan struct{}, 10),
+	}
+	cache := DiskCache{
+		KeepGateway: backend,
+		MaxSize:     40000000,
+		Dir:         c.MkDir(),
+		Logger:      ctxlog.TestLogger(c),
+	}
+	resp, err := backend.BlockWrite(context.Background(), BlockWriteOptions{
+		Data: []byte("foobar"),
+	})
+	c.Assert(err, check.IsNil)
+
+	// Nobody else is waiting for the block, so the backend fetch
+	// is cancelled when our context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	t0 := time.Now()
+	buf := make([]byte, 3)
+	n, err := cache.ReadAtContext(ctx, resp.Locator, buf, 0)
+	c.Check(n, check.Equals, 0)
+	c.Check(errors.Is(err, context.DeadlineExceeded), check.Equals, true, check.Commentf("%v", err))
+	c.Check(time.Since(t0) < time.Second, check.Equals, true, check.Commentf("took %v", time.Since(t0)))
+	<-backend.started
+	select {
+	case <-backend.cancelled:
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for backend fetch to be cancelled")
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		cache.writingLock.Lock()
+		done := len(cache.writing) == 0
+		cache.writingLock.Unlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			c.Fatal("timed out waiting for cancelled fetch to finish")
+		}
+	}
+
+	// A ReadAt caller is waiting for the same block, so giving up
+	// does not cancel the backend fetch.
+	readAtDone := make(chan struct{})
+	go func() {
+		defer close(readAtDone)
+		buf := make([]byte, 3)
+		n, err := cache.ReadAt(resp.Locator, buf, 3)
+		c.Check(err, check.IsNil)
+		c.Check(string(buf[:n]), check.Equals, "bar")
+	}()
+	<-backend.started
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = cache.ReadAtContext(ctx, resp.Locator, buf, 0)
+	c.Check(errors.Is(err, context.DeadlineExceeded), check.Equals, true, check.Commentf("%v", err))
+	select {
+	case <-backend.cancelled:
+		c.Error("backend fetch was cancelled while ReadAt was waiting for it")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(backend.release)
+	<-readAtDone
+
+	// The block is now cached.
+	n, err = cache.ReadAtContext(context.Background(), resp.Locator, buf, 0)
+	c.Check(err, check.IsNil)
+	c.Check(string(buf[:n]), check.Equals, "foo")
+}
+
+func (s *keepCacheSuite) TestVerifyChecksum(c *check.C) {
+	c.Check(s.testVerifyChecksum(c, true), check.Equals, "correct data")
+}
+func (s *keepCacheSuite) TestNoVerifyChecksum(c *check.C) {
+	c.Check(s.testVerifyChecksum(c, false), check.Equals, "corrupt data")
+}
+
+// testVerifyChecksum replaces a cache file with corrupt data of the
+// right length, and returns the data subsequently returned by
+// ReadAt.
+func (s *keepCacheSuite) testVerifyChecksum(c *check.C, verify bool) string {
+	backend := &keepGatewayMemoryBacked{}
+	cache := DiskCache{
+		KeepGateway:    backend,
+		MaxSize:        40000000,
+		Dir:            c.MkDir(),
+		Logger:         ctxlog.TestLogger(c),
+		VerifyChecksum: verify,
+	}
+	ctx := context.Background()
+	resp, err := cache.BlockWrite(ctx, BlockWriteOptions{Data: []byte("correct data")})
+	c.Assert(err, check.IsNil)
+	cachefilename := cache.cacheFile(resp.Locator)
+	err = os.WriteFile(cachefilename, []byte("corrupt data"), 0600)
+	c.Assert(err, check.IsNil)
+
+	buf := make([]byte, 12)
+	n, err := cache.ReadAt(resp.Locator, buf, 0)
+	c.Check(n, check.Equals, 12)
+	c.Check(err, check.IsNil)
+
+	if verify {
+		// The cache file has been replaced with the correct
+		// data.
+		data, err := os.ReadFile(cachefilename)
+		c.Check(err, check.IsNil)
+		c.Check(string(data), check.Equals, "correct data")
+	}
+	return string(buf[:n])
+}
+
+func (s *keepCacheSuite) TestCompression(c *check.C) {
+	backend := &keepGatewayMemoryBacked{}
+	cache := DiskCache{
+		KeepGateway: backend,
+		MaxSize:     40000000,
+		Dir:         c.MkDir(),
+		Logger:      ctxlog.TestLogger(c),
+		Compression: "gzip",
+	}
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("compressible "), 100000)
+	written, err := cache.BlockWrite(ctx, BlockWriteOptions{Data: data})
+	c.Assert(err, check.IsNil)
+	fetched, err := backend.BlockWrite(ctx, BlockWriteOptions{Data: data[1:]})
+	c.Assert(err, check.IsNil)
+	n, err := cache.ReadAt(fetched.Locator, make([]byte, 10), 0)
+	c.Check(n, check.Equals, 10)
+	c.Check(err, check.IsNil)
+
+	for _, locator := range []string{written.Locator, fetched.Locator} {
+		cachefilename := cache.cacheFile(locator)
+		for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(time.Millisecond) {
+			if _, err := os.Stat(cachefilename + compressedFileSuffix); err == nil && atomic.LoadInt64(&cache.compressing) == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				c.Fatalf("timed out waiting for %s to be compressed", cachefilename)
+			}
+		}
+		_, err := os.Stat(cachefilename)
+		c.Check(os.IsNotExist(err), check.Equals, true)
+		fi, err := os.Stat(cachefilename + compressedFileSuffix)
+		c.Assert(err, check.IsNil)
+		c.Check(fi.Size() < int64(len(data))/10, check.Equals, true)
+		delete(backend.data, locator)
+	}
+
+	// Read the compressed blocks at various offsets.
+	buf := make([]byte, 13)
+	for _, offset := range []int{0, 13, 500000, len(data) - 14} {
+		n, err := cache.ReadAt(written.Locator, buf, offset)
+		c.Check(n, check.Equals, 13)
+		c.Check(err, check.IsNil)
+		c.Check(buf, check.DeepEquals, data[offset:offset+13])
+
+		n, err = cache.ReadAt(fetched.Locator, buf, offset)
+		c.Check(n, check.Equals, 13)
+		c.Check(err, check.IsNil)
+		c.Check(buf, check.DeepEquals, data[offset+1:offset+14])
+	}
+
+	// Blocks that don't compress are left alone.
+	incompressible := make([]byte, 100000)
+	rand.Read(incompressible)
+	resp, err := cache.BlockWrite(ctx, BlockWriteOptions{Data: incompressible})
+	c.Assert(err, check.IsNil)
+	time.Sleep(time.Millisecond)
+	for atomic.LoadInt64(&cache.compressing) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	_, err = os.Stat(cache.cacheFile(resp.Locator))
+	c.Check(err, check.IsNil)
+	_, err = os.Stat(cache.cacheFile(resp.Locator) + compressedFileSuffix)
+	c.Check(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *keepCacheSuite) TestMaxOpenFiles(c *check.C) {
+	backend := &keepGatewayMemoryBacked{}
+	cache := DiskCache{
+		KeepGateway:  backend,
+		MaxSize:      40000000,
+		MaxOpenFiles: 2,
+		Dir:          c.MkDir(),
+		Logger:       ctxlog.TestLogger(c),
+	}
+	ctx := context.Background()
+	var locators []string
+	for i := 0; i < 3; i++ {
+		resp, err := cache.BlockWrite(ctx, BlockWriteOptions{Data: []byte(fmt.Sprintf("block %d", i))})
+		c.Assert(err, check.IsNil)
+		locators = append(locators, resp.Locator)
+	}
+	// Wait for BlockWrite to rename the cache files into place.
+	for _, locator := range locators {
+		for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(time.Millisecond) {
+			if _, err := os.Stat(cache.cacheFile(locator)); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				c.Fatalf("timed out waiting for %s", cache.cacheFile(locator))
+			}
+		}
+	}
+	buf := make([]byte, 7)
+	for _, i := range []int{0, 1, 0, 2} {
+		n, err := cache.ReadAt(locators[i], buf, 0)
+		c.Check(n, check.Equals, 7)
+		c.Check(err, check.IsNil)
+	}
+	// Block 1 was least recently used when block 2 was opened.
+	cache.heldopenLock.Lock()
+	defer cache.heldopenLock.Unlock()
+	c.Check(cache.heldopen, check.HasLen, 2)
+	c.Check(cache.heldopen[cache.cacheFile(locators[0])], check.NotNil)
+	c.Check(cache.heldopen[cache.cacheFile(locators[1])], check.IsNil)
+	c.Check(cache.heldopen[cache.cacheFile(locators[2])], check.NotNil)
+}
+
+func (s *keepCacheSuite) TestDelete(c *check.C) {
+	backend := &keepGatewayMemoryBacked{}
+	var fetched int32
+	cache := DiskCache{
+		KeepGateway: backend,
+		MaxSize:     40000000,
+		Dir:         c.MkDir(),
+		Logger:      ctxlog.TestLogger(c),
+		OnBackendFetch: func(string, int, int) {
+			atomic.AddInt32(&fetched, 1)
+		},
+	}
+	ctx := context.Background()
+	var locators []string
+	for i := 0; i < 3; i++ {
+		resp, err := backend.BlockWrite(ctx, BlockWriteOptions{Data: []byte(fmt.Sprintf("block %d", i))})
+		c.Assert(err, check.IsNil)
+		locators = append(locators, resp.Locator)
+	}
+	readAll := func() {
+		buf := make([]byte, 7)
+		for _, locator := range locators {
+			n, err := cache.ReadAt(locator, buf, 0)
+			c.Check(n, check.Equals, 7)
+			c.Check(err, check.IsNil)
+		}
+		// Wait for fetches to finish, and for failed
+		// quickReadAt attempts to be forgotten, so the next
+		// reads don't depend on timing.
+		for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(time.Millisecond) {
+			cache.writingLock.Lock()
+			busy := len(cache.writing) > 0
+			cache.writingLock.Unlock()
+			cache.heldopenLock.Lock()
+			for _, ent := range cache.heldopen {
+				ent.RLock()
+				busy = busy || ent.err != nil
+				ent.RUnlock()
+			}
+			cache.heldopenLock.Unlock()
+			if !busy {
+				break
+			}
+			if time.Now().After(deadline) {
+				c.Fatal("timed out waiting for reads to settle")
+			}
+		}
+	}
+	readAll()
+	c.Check(atomic.LoadInt32(&fetched), check.Equals, int32(3))
+	readAll()
+	c.Check(atomic.LoadInt32(&fetched), check.Equals, int32(3))
+
+	// Deleted block is re-fetched from the backend, others are
+	// still cached.
+	c.Check(cache.Delete(locators[1]), check.IsNil)
+	_, err := os.Stat(cache.cacheFile(locators[1]))
+	c.Check(os.IsNotExist(err), check.Equals, true)
+	readAll()
+	c.Check(atomic.LoadInt32(&fetched), check.Equals, int32(4))
+
+	// Deleting a block that isn't cached is not an error.
+	c.Check(cache.Delete("acbd18db4cc2f85cedef654fccc4a4d8+3"), check.IsNil)
+
+	// All blocks are re-fetched after Clear.
+	c.Check(cache.Clear(), check.IsNil)
+	for _, locator := range locators {
+		_, err := os.Stat(cache.cacheFile(locator))
+		c.Check(os.IsNotExist(err), check.Equals, true)
+	}
+	readAll()
+	c.Check(atomic.LoadInt32(&fetched), check.Equals, int32(7))
+}
+
+func (s *keepCacheSuite) TestReshard(c *check.C) {
+	dir := c.MkDir()
+	data := []byte("foo")
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	locator := fmt.Sprintf("%s+%d", hash, len(data))
+	// Cache files written with the default ShardLevels, and with
+	// no subdirectories at all.
+	oldpaths := []string{
+		filepath.Join(dir, hash[:3], hash+cacheFileSuffix),
+		filepath.Join(dir, "37b51d194a7513e45b56f6524f2d51f2"+cacheFileSuffix),
+	}
+	for _, path := range oldpaths {
+		c.Assert(os.MkdirAll(filepath.Dir(path), 0700), check.IsNil)
+		c.Assert(os.WriteFile(path, data, 0600), check.IsNil)
+	}
+
+	cache := DiskCache{
+		KeepGateway: &keepGatewayBlackHole{},
+		MaxSize:     40000000,
+		Dir:         dir,
+		Logger:      ctxlog.TestLogger(c),
+		ShardLevels: 3,
+	}
+	// Computing a cache file path sets up the cache, which
+	// starts moving existing files in the background.
+	c.Check(cache.cacheFile(locator), check.Equals, filepath.Join(dir, hash[:3], hash[3:5], hash[5:7], hash+cacheFileSuffix))
+	for _, hash := range []string{hash, "37b51d194a7513e45b56f6524f2d51f2"} {
+		newpath := cache.cacheFile(hash)
+		for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(time.Millisecond) {
+			if _, err := os.Stat(newpath); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				c.Fatalf("timed out waiting for %s", newpath)
+			}
+		}
+	}
+	for _, path := range oldpaths {
+		_, err := os.Stat(path)
+		c.Check(os.IsNotExist(err), check.Equals, true)
+	}
+
+	// The backend doesn't have the block, so this read is
+	// served from the moved cache file.
+	buf := make([]byte, 3)
+	n, err := cache.ReadAt(locator, buf, 0)
+	c.Check(err, check.IsNil)
+	c.Check(string(buf[:n]), check.Equals, "foo")
+}
+
+func (s *keepCacheSuite) TestConcurrentReadersNoRefresh(c *check.C) {
+	s.testConcurrentReaders(c, true, false, false, 0)
+}
+func (s *keepCacheSuite) TestConcurrentReadersMangleCache(c *check.C) {
+	s.testConcurrentReaders(c, false, true, false, 0)
+}
+func (s *keepCacheSuite) TestConcurrentReadersNoRefreshDropPageCache(c *check.C) {
+	s.testConcurrentReaders(c, true, false, true, 0)
+}
+func (s *keepCacheSuite) TestConcurrentReadersMangleCacheDropPageCache(c *check.C) {
+	s.testConcurrentReaders(c, false, true, true, 0)
+}
+func (s *keepCacheSuite) TestConcurrentReadersNoRefreshSharded(c *check.C) {
+	s.testConcurrentReaders(c, true, false, false, 2)
+}
+func (s *keepCacheSuite) TestConcurrentReadersMangleCacheSharded(c *check.C) {
+	s.testConcurrentReaders(c, false, true, false, 2)
+}
+func (s *keepCacheSuite) testConcurrentReaders(c *check.C, cannotRefresh, mangleCache, dropPageCache bool, shardLevels int) {
+	blksize := 64000000
+	backend := &keepGatewayMemoryBacked{}
+	cache := DiskCache{
+		KeepGateway:   backend,
+		MaxSize:       ByteSizeOrPercent(blksize),
+		Dir:           c.MkDir(),
+		Logger:        ctxlog.TestLogger(c),
+		DropPageCache: dropPageCache,
+		ShardLevels:   shardLevels,
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -339,6 +1473,7 @@ func (s *keepCacheSuite) TestStreaming(c *check.C) {
 }
 
 var _ = check.Suite(&keepCacheBenchSuite{})
+var _ = check.Suite(&keepCacheGzipBenchSuite{})
 
 type keepCacheBenchSuite struct {
 	blksize  int
@@ -349,6 +1484,10 @@ type keepCacheBenchSuite struct {
 }
 
 func (s *keepCacheBenchSuite) SetUpTest(c *check.C) {
+	s.setUp(c, "")
+}
+
+func (s *keepCacheBenchSuite) setUp(c *check.C, compression string) {
 	s.blksize = 64000000
 	s.blkcount = 8
 	s.backend = &keepGatewayMemoryBacked{}
@@ -357,6 +1496,7 @@ func (s *keepCacheBenchSuite) SetUpTest(c *check.C) {
 		MaxSize:     ByteSizeOrPercent(s.blksize),
 		Dir:         c.MkDir(),
 		Logger:      ctxlog.TestLogger(c),
+		Compression: compression,
 	}
 	s.locators = make([]string, s.blkcount)
 	data := make([]byte, s.blksize)
@@ -399,8 +1539,78 @@ func (s *keepCacheBenchSuite) BenchmarkSequentialReads(c *check.C) {
 	}
 }
 
+// keepCacheGzipBenchSuite runs the keepCacheBenchSuite benchmarks
+// with gzip-compressed cache files, for comparison.
+type keepCacheGzipBenchSuite struct {
+	keepCacheBenchSuite
+}
+
+func (s *keepCacheGzipBenchSuite) SetUpTest(c *check.C) {
+	s.setUp(c, "gzip")
+	// Wait for the written blocks to be compressed.
+	time.Sleep(time.Millisecond)
+	for atomic.LoadInt64(&s.cache.compressing) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
 const benchReadSize = 1000
 
+var _ = check.Suite(&keepCacheOpenFilesBenchSuite{})
+
+// keepCacheOpenFilesBenchSuite compares read throughput when cache
+// files are held open between reads vs. reopened for each read
+// (MaxOpenFiles=1, reading from several blocks in turn).
+type keepCacheOpenFilesBenchSuite struct{}
+
+func (s *keepCacheOpenFilesBenchSuite) setUp(c *check.C, maxOpenFiles int) (*DiskCache, []string) {
+	cache := &DiskCache{
+		KeepGateway:  &keepGatewayMemoryBacked{},
+		MaxSize:      1 << 30,
+		MaxOpenFiles: maxOpenFiles,
+		Dir:          c.MkDir(),
+		Logger:       ctxlog.TestLogger(c),
+	}
+	var locators []string
+	data := make([]byte, 1<<20)
+	for b := 0; b < 8; b++ {
+		data[0] = byte(b)
+		resp, err := cache.BlockWrite(context.Background(), BlockWriteOptions{
+			Data: data,
+		})
+		c.Assert(err, check.IsNil)
+		locators = append(locators, resp.Locator)
+	}
+	// Make sure all blocks are in the cache before starting the
+	// timer.
+	buf := make([]byte, benchReadSize)
+	for _, locator := range locators {
+		_, err := cache.ReadAt(locator, buf, 0)
+		c.Assert(err, check.IsNil)
+	}
+	c.ResetTimer()
+	return cache, locators
+}
+
+func (s *keepCacheOpenFilesBenchSuite) benchmarkReads(c *check.C, maxOpenFiles int) {
+	cache, locators := s.setUp(c, maxOpenFiles)
+	buf := make([]byte, benchReadSize)
+	for i := 0; i < c.N; i++ {
+		_, err := cache.ReadAt(locators[i%len(locators)], buf, (i*1234)%(1<<20-benchReadSize))
+		if err != nil {
+			c.Fail()
+		}
+	}
+}
+
+func (s *keepCacheOpenFilesBenchSuite) BenchmarkReadsHeldOpen(c *check.C) {
+	s.benchmarkReads(c, 0)
+}
+
+func (s *keepCacheOpenFilesBenchSuite) BenchmarkReadsReopen(c *check.C) {
+	s.benchmarkReads(c, 1)
+}
+
 var _ = check.Suite(&fileOpsSuite{})
 
 type fileOpsSuite struct{}
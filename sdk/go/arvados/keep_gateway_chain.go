@@ -0,0 +1,87 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// KeepGatewayChain is a KeepGateway that reads blocks from the first
+// of its gateways that has them, e.g., a fast local gateway followed
+// by a slower remote one. Writes go to the first (primary) gateway
+// only.
+//
+// A KeepGatewayChain can be used as the KeepGateway of a DiskCache,
+// so a cache miss tries each gateway in order before returning an
+// error.
+type KeepGatewayChain []KeepGateway
+
+var errEmptyKeepGatewayChain = errors.New("KeepGatewayChain has no gateways")
+
+// ReadAt reads from each gateway in turn until one succeeds. If all
+// of them fail, it returns the last gateway's error.
+func (chain KeepGatewayChain) ReadAt(locator string, dst []byte, offset int) (int, error) {
+	err := errEmptyKeepGatewayChain
+	for _, kg := range chain {
+		var n int
+		n, err = kg.ReadAt(locator, dst, offset)
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+	}
+	return 0, err
+}
+
+// BlockRead reads from each gateway in turn until one succeeds. A
+// gateway that fails after writing some data to opts.WriteTo is not
+// followed by the next one, since the data already written cannot be
+// taken back; in that case its error is returned.
+func (chain KeepGatewayChain) BlockRead(ctx context.Context, opts BlockReadOptions) (int, error) {
+	err := errEmptyKeepGatewayChain
+	for _, kg := range chain {
+		var n int
+		n, err = kg.BlockRead(ctx, opts)
+		if err == nil || n > 0 || ctx.Err() != nil {
+			return n, err
+		}
+	}
+	return 0, err
+}
+
+// BlockWrite writes to the primary gateway.
+func (chain KeepGatewayChain) BlockWrite(ctx context.Context, opts BlockWriteOptions) (BlockWriteResponse, error) {
+	if len(chain) == 0 {
+		return BlockWriteResponse{}, errEmptyKeepGatewayChain
+	}
+	return chain[0].BlockWrite(ctx, opts)
+}
+
+// LocalLocator calls LocalLocator on the primary gateway.
+func (chain KeepGatewayChain) LocalLocator(locator string) (string, error) {
+	if len(chain) == 0 {
+		return "", errEmptyKeepGatewayChain
+	}
+	return chain[0].LocalLocator(locator)
+}
+
+// BlockSize returns the size reported by the first gateway that
+// implements BlockSizer and succeeds. If none of the gateways
+// implement BlockSizer, it returns the same error as a DiskCache
+// whose backend doesn't.
+func (chain KeepGatewayChain) BlockSize(locator string) (int, error) {
+	err := errors.New("invalid block locator: no size hint")
+	for _, kg := range chain {
+		if bs, ok := kg.(BlockSizer); ok {
+			var size int
+			size, err = bs.BlockSize(locator)
+			if err == nil {
+				return size, nil
+			}
+		}
+	}
+	return 0, err
+}
@@ -0,0 +1,64 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"bytes"
+	"context"
+
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&keepGatewayChainSuite{})
+
+type keepGatewayChainSuite struct{}
+
+func (s *keepGatewayChainSuite) TestFallback(c *check.C) {
+	ctx := context.Background()
+	local := &keepGatewayMemoryBacked{}
+	remote := &keepGatewayMemoryBacked{}
+	resp, err := remote.BlockWrite(ctx, BlockWriteOptions{Data: []byte("foobar")})
+	c.Assert(err, check.IsNil)
+	cache := DiskCache{
+		KeepGateway: KeepGatewayChain{local, remote},
+		MaxSize:     40000000,
+		Dir:         c.MkDir(),
+		Logger:      ctxlog.TestLogger(c),
+	}
+
+	buf := make([]byte, 3)
+	n, err := cache.ReadAt(resp.Locator, buf, 3)
+	c.Check(n, check.Equals, 3)
+	c.Check(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "bar")
+
+	var out bytes.Buffer
+	n, err = cache.BlockRead(ctx, BlockReadOptions{Locator: resp.Locator, WriteTo: &out})
+	c.Check(n, check.Equals, 6)
+	c.Check(err, check.IsNil)
+	c.Check(out.String(), check.Equals, "foobar")
+
+	// Reading directly from the chain (bypassing the cache)
+	// also falls back to the second gateway.
+	out.Reset()
+	n, err = KeepGatewayChain{local, remote}.BlockRead(ctx, BlockReadOptions{Locator: resp.Locator, WriteTo: &out})
+	c.Check(n, check.Equals, 6)
+	c.Check(err, check.IsNil)
+	c.Check(out.String(), check.Equals, "foobar")
+
+	// Writes go to the primary only.
+	resp, err = cache.BlockWrite(ctx, BlockWriteOptions{Data: []byte("bazwaz")})
+	c.Assert(err, check.IsNil)
+	c.Check(local.data[resp.Locator], check.DeepEquals, []byte("bazwaz"))
+	c.Check(remote.data[resp.Locator], check.IsNil)
+
+	// Blocks that none of the gateways have are reported as
+	// errors.
+	_, err = KeepGatewayChain{local, remote}.ReadAt("acbd18db4cc2f85cedef654fccc4a4d8+3", buf, 0)
+	c.Check(err, check.ErrorMatches, `block not found: .*`)
+	_, err = KeepGatewayChain{}.ReadAt("acbd18db4cc2f85cedef654fccc4a4d8+3", buf, 0)
+	c.Check(err, check.Equals, errEmptyKeepGatewayChain)
+}
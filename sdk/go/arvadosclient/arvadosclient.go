@@ -90,6 +90,12 @@ type ArvadosClient struct {
 	// Arvados API server, form "host:port"
 	ApiServer string
 
+	// Additional API servers, form "host:port", that serve the
+	// same cluster as ApiServer. Keep service discovery queries
+	// ApiServer and all of these concurrently, and uses the first
+	// valid response.
+	ApiServerFallbacks []string
+
 	// Arvados API token for authentication
 	ApiToken string
 
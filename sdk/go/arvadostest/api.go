@@ -108,6 +108,10 @@ func (as *APIStub) CollectionUntrash(ctx context.Context, options arvados.Untras
 	as.appendCall(ctx, as.CollectionUntrash, options)
 	return arvados.Collection{}, as.Error
 }
+func (as *APIStub) CollectionTrashFederated(ctx context.Context, options arvados.DeleteOptions) (arvados.MultiClusterResponse, error) {
+	as.appendCall(ctx, as.CollectionTrashFederated, options)
+	return arvados.MultiClusterResponse{}, as.Error
+}
 func (as *APIStub) ContainerCreate(ctx context.Context, options arvados.CreateOptions) (arvados.Container, error) {
 	as.appendCall(ctx, as.ContainerCreate, options)
 	return arvados.Container{}, as.Error
@@ -33,7 +33,9 @@ func (ews errorWithStatus) HTTPStatus() int {
 }
 
 type ErrorResponse struct {
-	Errors []string `json:"errors"`
+	Errors    []string `json:"errors"`
+	ClusterID string   `json:"cluster_id,omitempty"`
+	Via       []string `json:"via,omitempty"`
 }
 
 func Error(w http.ResponseWriter, error string, code int) {
@@ -41,8 +43,20 @@ func Error(w http.ResponseWriter, error string, code int) {
 }
 
 func Errors(w http.ResponseWriter, errors []string, code int) {
+	writeErrorResponse(w, ErrorResponse{Errors: errors}, code)
+}
+
+// ClusterError is like Error, but also reports the ID of the cluster
+// that produced the error, and the clusters a federated request
+// passed through to reach it (ending with clusterID), so clients of
+// a federated request can tell which cluster rejected it.
+func ClusterError(w http.ResponseWriter, clusterID string, via []string, error string, code int) {
+	writeErrorResponse(w, ErrorResponse{Errors: []string{error}, ClusterID: clusterID, Via: via}, code)
+}
+
+func writeErrorResponse(w http.ResponseWriter, resp ErrorResponse, code int) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.WriteHeader(code)
-	json.NewEncoder(w).Encode(ErrorResponse{Errors: errors})
+	json.NewEncoder(w).Encode(resp)
 }
@@ -101,6 +101,9 @@ func LogRequests(h http.Handler) http.Handler {
 			"reqQuery":        req.URL.RawQuery,
 			"reqBytes":        req.ContentLength,
 		})
+		if fields := TraceLogFields(req.Context()); fields != nil {
+			lgr = lgr.WithFields(fields)
+		}
 		ctx := req.Context()
 		ctx = context.WithValue(ctx, &requestTimeContextKey, time.Now())
 		ctx = context.WithValue(ctx, &responseLogFieldsContextKey, logrus.Fields{})
@@ -0,0 +1,67 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package httpserver
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName is the instrumentation name used for spans started by
+// Arvados services.
+const TracerName = "git.arvados.org/arvados.git"
+
+// AddTraceContext wraps an http.Handler, starting a new OpenTelemetry
+// server span for each request. If the request has a valid W3C
+// Traceparent header, the new span continues the caller's trace;
+// otherwise it starts a new trace.
+//
+// Spans are sent to the global TracerProvider (see
+// otel.SetTracerProvider). If none has been installed, spans are
+// not recorded, but the incoming trace context is still available
+// to the handler and propagated to outgoing requests.
+func AddTraceContext(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(wrapped http.ResponseWriter, req *http.Request) {
+		ctx := propagation.TraceContext{}.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		ctx, span := otel.Tracer(TracerName).Start(ctx, req.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", req.Method),
+				attribute.String("http.target", req.URL.Path),
+				attribute.String("net.host.name", req.Host),
+			))
+		defer span.End()
+		w := WrapResponseWriter(wrapped)
+		h.ServeHTTP(w, req.WithContext(ctx))
+		status := w.WroteStatus()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.status_code", status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
+
+// TraceLogFields returns logrus fields identifying the current span,
+// or nil if ctx has no valid span context.
+func TraceLogFields(ctx context.Context) logrus.Fields {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return nil
+	}
+	return logrus.Fields{
+		"traceID": sc.TraceID().String(),
+		"spanID":  sc.SpanID().String(),
+	}
+}
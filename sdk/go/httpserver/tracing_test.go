@@ -0,0 +1,66 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package httpserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	check "gopkg.in/check.v1"
+)
+
+func (s *Suite) TestAddTraceContext(c *check.C) {
+	recorder := tracetest.NewSpanRecorder()
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	var got trace.SpanContext
+	h := AddTraceContext(LogRequests(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = trace.SpanContextFromContext(req.Context())
+		w.WriteHeader(http.StatusTeapot)
+	})))
+
+	// Incoming trace context is continued.
+	req := httptest.NewRequest("GET", "https://foo.example/bar", nil).WithContext(s.ctx)
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	c.Check(got.TraceID().String(), check.Equals, "4bf92f3577b34da6a3ce929d0e0e4736")
+	c.Check(got.SpanID().String(), check.Not(check.Equals), "00f067aa0ba902b7")
+
+	ended := recorder.Ended()
+	c.Assert(ended, check.HasLen, 1)
+	c.Check(ended[0].SpanContext().SpanID(), check.Equals, got.SpanID())
+	c.Check(ended[0].Parent().SpanID().String(), check.Equals, "00f067aa0ba902b7")
+	c.Check(ended[0].Parent().IsRemote(), check.Equals, true)
+	c.Check(ended[0].SpanKind(), check.Equals, trace.SpanKindServer)
+	var status int64
+	for _, attr := range ended[0].Attributes() {
+		if attr.Key == "http.status_code" {
+			status = attr.Value.AsInt64()
+		}
+	}
+	c.Check(status, check.Equals, int64(http.StatusTeapot))
+
+	var logged map[string]interface{}
+	dec := json.NewDecoder(s.logdata)
+	c.Assert(dec.Decode(&logged), check.IsNil)
+	c.Check(logged["traceID"], check.Equals, got.TraceID().String())
+	c.Check(logged["spanID"], check.Equals, got.SpanID().String())
+
+	// Without a valid Traceparent header, a new trace is started.
+	req = httptest.NewRequest("GET", "https://foo.example/bar", nil).WithContext(s.ctx)
+	req.Header.Set("Traceparent", "bogus")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	c.Check(got.IsValid(), check.Equals, true)
+	c.Check(got.TraceID().String(), check.Not(check.Equals), "4bf92f3577b34da6a3ce929d0e0e4736")
+	ended = recorder.Ended()
+	c.Assert(ended, check.HasLen, 2)
+	c.Check(ended[1].Parent().IsValid(), check.Equals, false)
+}
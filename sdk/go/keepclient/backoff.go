@@ -0,0 +1,75 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keepclient
+
+import (
+	"context"
+	"time"
+)
+
+// Backoff describes how long to wait between retries. The first
+// retry waits BaseDelay, and each subsequent retry waits Multiplier
+// times longer than the previous one, up to MaxDelay.
+//
+// If MaxAttempts is positive, it limits the total number of attempts
+// (including the first one) regardless of any other retry settings.
+type Backoff struct {
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Multiplier  float64
+	MaxAttempts int
+}
+
+// DefaultBackoff is used by KeepClients whose Backoff field is the
+// zero value.
+var DefaultBackoff = Backoff{
+	BaseDelay:  100 * time.Millisecond,
+	MaxDelay:   3 * time.Second,
+	Multiplier: 2,
+}
+
+// Delay returns the time to wait before the given retry (the first
+// retry is retry 0).
+func (b Backoff) Delay(retry int) time.Duration {
+	delay := float64(b.BaseDelay)
+	for i := 0; i < retry && (b.MaxDelay <= 0 || delay < float64(b.MaxDelay)); i++ {
+		if b.Multiplier > 1 {
+			delay *= b.Multiplier
+		}
+	}
+	if b.MaxDelay > 0 && delay > float64(b.MaxDelay) {
+		return b.MaxDelay
+	}
+	return time.Duration(delay)
+}
+
+// Attempts returns the number of attempts allowed by b, given that
+// the caller would otherwise make the given number of attempts.
+func (b Backoff) Attempts(attempts int) int {
+	if b.MaxAttempts > 0 && (attempts <= 0 || attempts > b.MaxAttempts) {
+		return b.MaxAttempts
+	}
+	return attempts
+}
+
+// Sleep waits until it is time to make the given retry. It returns
+// ctx.Err() if ctx is done before then.
+func (b Backoff) Sleep(ctx context.Context, retry int) error {
+	timer := time.NewTimer(b.Delay(retry))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (kc *KeepClient) backoff() Backoff {
+	if kc.Backoff == (Backoff{}) {
+		return DefaultBackoff
+	}
+	return kc.Backoff
+}
@@ -0,0 +1,74 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keepclient
+
+import (
+	"context"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type BackoffSuite struct{}
+
+var _ = Suite(&BackoffSuite{})
+
+func (*BackoffSuite) TestDelay(c *C) {
+	b := Backoff{
+		BaseDelay:  time.Second,
+		MaxDelay:   10 * time.Second,
+		Multiplier: 2,
+	}
+	var delays []time.Duration
+	for retry := 0; retry < 6; retry++ {
+		delays = append(delays, b.Delay(retry))
+	}
+	c.Check(delays, DeepEquals, []time.Duration{
+		time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		8 * time.Second,
+		10 * time.Second,
+		10 * time.Second,
+	})
+
+	// No multiplier means constant delay
+	b.Multiplier = 0
+	c.Check(b.Delay(5), Equals, time.Second)
+
+	// No MaxDelay means no limit
+	b = Backoff{BaseDelay: time.Millisecond, Multiplier: 10}
+	c.Check(b.Delay(4), Equals, 10*time.Second)
+}
+
+func (*BackoffSuite) TestAttempts(c *C) {
+	c.Check(Backoff{}.Attempts(3), Equals, 3)
+	c.Check(Backoff{MaxAttempts: 2}.Attempts(3), Equals, 2)
+	c.Check(Backoff{MaxAttempts: 5}.Attempts(3), Equals, 3)
+	c.Check(Backoff{MaxAttempts: 5}.Attempts(0), Equals, 5)
+}
+
+func (*BackoffSuite) TestSleepCancel(c *C) {
+	b := Backoff{BaseDelay: time.Minute}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	t0 := time.Now()
+	err := b.Sleep(ctx, 0)
+	c.Check(err, Equals, context.Canceled)
+	c.Check(time.Since(t0) < time.Second, Equals, true)
+
+	b = Backoff{BaseDelay: time.Millisecond}
+	c.Check(b.Sleep(context.Background(), 0), IsNil)
+}
+
+func (*BackoffSuite) TestDefault(c *C) {
+	kc := &KeepClient{}
+	c.Check(kc.backoff(), Equals, DefaultBackoff)
+	kc.Backoff = Backoff{BaseDelay: time.Second}
+	c.Check(kc.backoff(), Equals, kc.Backoff)
+}
@@ -8,15 +8,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"os"
 	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	"github.com/sirupsen/logrus"
 )
 
 // RefreshServiceDiscovery clears the Keep service discovery cache.
@@ -27,9 +28,9 @@ func RefreshServiceDiscovery() {
 	defer svcListCacheMtx.Unlock()
 	for _, ent := range svcListCache {
 		wg.Add(1)
-		clear := ent.clear
+		ent := ent
 		go func() {
-			clear <- struct{}{}
+			ent.refresh()
 			wg.Done()
 		}()
 	}
@@ -53,43 +54,86 @@ func RefreshServiceDiscoveryOnSIGHUP() {
 }
 
 var (
-	svcListCache       = map[string]cachedSvcList{}
+	svcListCache       = map[string]*cachedSvcList{}
 	svcListCacheSignal chan os.Signal
 	svcListCacheMtx    sync.Mutex
 )
 
+// defaultDiscoveryInterval is the interval between keep service
+// list refreshes when KeepClient.DiscoveryInterval is zero.
+const defaultDiscoveryInterval = 5 * time.Minute
+
 type cachedSvcList struct {
-	arv    *arvadosclient.ArvadosClient
-	latest chan svcList
-	clear  chan struct{}
+	arv      *arvadosclient.ArvadosClient
+	apiToken *atomic.Value // string, used instead of arv.ApiToken
+	backoff  Backoff
+	interval time.Duration
+	logger   logrus.FieldLogger
+	latest   chan svcList
+	clear    chan struct{}
+	stop     chan struct{} // closed when refs drops to zero
+	refs     int           // number of KeepClients using this entry, guarded by svcListCacheMtx
+}
+
+// refresh asks the poll goroutine to fetch a new list, unless it has
+// been stopped.
+func (ent *cachedSvcList) refresh() {
+	select {
+	case ent.clear <- struct{}{}:
+	case <-ent.stop:
+	}
 }
 
-// Check for new services list every few minutes. Send the latest list
-// to the "latest" channel as needed.
+// Check for new services list every few minutes (or the configured
+// interval). Send the latest list to the "latest" channel as needed.
+// If a refresh fails, the previous list is still used.
 func (ent *cachedSvcList) poll() {
 	wakeup := make(chan struct{})
 
 	replace := make(chan svcList)
 	go func() {
-		wakeup <- struct{}{}
-		current := <-replace
+		var current svcList
+		select {
+		case wakeup <- struct{}{}:
+		case <-ent.stop:
+			return
+		}
+		select {
+		case current = <-replace:
+		case <-ent.stop:
+			return
+		}
 		for {
 			select {
 			case <-ent.clear:
-				wakeup <- struct{}{}
+				select {
+				case wakeup <- struct{}{}:
+				case <-ent.stop:
+					return
+				}
 				// Wait here for the next success, in
 				// order to avoid returning stale
 				// results on the "latest" channel.
-				current = <-replace
+				select {
+				case current = <-replace:
+				case <-ent.stop:
+					return
+				}
 			case current = <-replace:
 			case ent.latest <- current:
+			case <-ent.stop:
+				return
 			}
 		}
 	}()
 
-	okDelay := 5 * time.Minute
-	errDelay := 3 * time.Second
+	okDelay := ent.interval
+	if okDelay <= 0 {
+		okDelay = defaultDiscoveryInterval
+	}
+	failures := 0
 	timer := time.NewTimer(okDelay)
+	defer timer.Stop()
 	for {
 		select {
 		case <-timer.C:
@@ -98,19 +142,87 @@ func (ent *cachedSvcList) poll() {
 				// Lost race stopping timer; skip extra firing
 				<-timer.C
 			}
+		case <-ent.stop:
+			return
 		}
-		var next svcList
-		err := ent.arv.Call("GET", "keep_services", "", "accessible", nil, &next)
+		next, err := ent.fetch()
 		if err != nil {
-			log.Printf("WARNING: Error retrieving services list: %v (retrying in %v)", err, errDelay)
+			failures++
+			errDelay := ent.backoff.Delay(failures - 1)
+			if ent.backoff.MaxAttempts > 0 && failures >= ent.backoff.MaxAttempts {
+				// Give up until the next regular
+				// poll (or clear).
+				errDelay = okDelay
+				failures = 0
+			}
+			ent.logger.Warnf("Error retrieving services list: %v (retrying in %v)", err, errDelay)
 			timer.Reset(errDelay)
 			continue
 		}
-		replace <- next
+		failures = 0
+		select {
+		case replace <- next:
+		case <-ent.stop:
+			return
+		}
 		timer.Reset(okDelay)
 	}
 }
 
+// fetch retrieves the list of accessible keep services. If the
+// client has ApiServerFallbacks, all API servers are queried
+// concurrently and the first successful response is returned.
+func (ent *cachedSvcList) fetch() (svcList, error) {
+	hosts := append([]string{ent.arv.ApiServer}, ent.arv.ApiServerFallbacks...)
+	type result struct {
+		list svcList
+		err  error
+	}
+	results := make(chan result, len(hosts))
+	for _, host := range hosts {
+		arv := *ent.arv
+		arv.ApiServer = host
+		arv.ApiToken = ent.apiToken.Load().(string)
+		go func() {
+			var r result
+			r.err = arv.Call("GET", "keep_services", "", "accessible", nil, &r.list)
+			results <- r
+		}()
+	}
+	var errs []string
+	for range hosts {
+		r := <-results
+		if r.err == nil {
+			return r.list, nil
+		}
+		errs = append(errs, r.err.Error())
+	}
+	if len(errs) == 1 {
+		return svcList{}, errors.New(errs[0])
+	}
+	return svcList{}, fmt.Errorf("all API servers failed: %s", strings.Join(errs, "; "))
+}
+
+// svcListCacheKey returns the svcListCache key for the given client.
+func svcListCacheKey(arv *arvadosclient.ArvadosClient) string {
+	return strings.Join(append([]string{arv.ApiServer}, arv.ApiServerFallbacks...), ",")
+}
+
+// updateSvcListCacheToken replaces oldToken with newToken in the
+// service discovery cache entry for the given client's API
+// server(s), if any, so the entry stops using a token that has been
+// replaced by RefreshToken. An entry that uses a different token
+// (i.e., it was created by a client with other credentials) is left
+// alone.
+func updateSvcListCacheToken(arv *arvadosclient.ArvadosClient, oldToken, newToken string) {
+	svcListCacheMtx.Lock()
+	ent, ok := svcListCache[svcListCacheKey(arv)]
+	svcListCacheMtx.Unlock()
+	if ok {
+		ent.apiToken.CompareAndSwap(oldToken, newToken)
+	}
+}
+
 // discoverServices gets the list of available keep services from
 // the API server.
 //
@@ -118,9 +230,18 @@ func (ent *cachedSvcList) poll() {
 // an environment variable or local config), that list is used
 // instead.
 //
-// If an API call is made, the result is cached for 5 minutes or until
-// ClearCache() is called, and during this interval it is reused by
-// other KeepClients that use the same API server host.
+// If an API call is made, the result is cached for 5 minutes (or the
+// DiscoveryInterval of the first KeepClient that used that API server
+// host) or until ClearCache() is called, and during this interval it
+// is reused by other KeepClients that use the same API server
+// host(s). Failed API calls are retried according to the Backoff (and
+// logged to the Logger) of the first KeepClient that used that API
+// server host. If the API calls still fail, the previous list is used
+// until the next refresh. Refreshes stop when all of the KeepClients
+// using the cache entry have been closed.
+//
+// If ApiServerFallbacks are configured, they are queried concurrently
+// with ApiServer, and the first valid response is used.
 func (kc *KeepClient) discoverServices() error {
 	if kc.disableDiscovery {
 		return nil
@@ -142,36 +263,77 @@ func (kc *KeepClient) discoverServices() error {
 		return fmt.Errorf("Arvados client is not configured (target API host is not set). Maybe env var ARVADOS_API_HOST should be set first?")
 	}
 
+	key := svcListCacheKey(kc.Arvados)
 	svcListCacheMtx.Lock()
-	cacheEnt, ok := svcListCache[kc.Arvados.ApiServer]
+	cacheEnt, ok := svcListCache[key]
 	if !ok {
 		arv := *kc.Arvados
-		cacheEnt = cachedSvcList{
-			latest: make(chan svcList),
-			clear:  make(chan struct{}),
-			arv:    &arv,
+		arv.ApiServerFallbacks = append([]string(nil), kc.Arvados.ApiServerFallbacks...)
+		cacheEnt = &cachedSvcList{
+			latest:   make(chan svcList),
+			clear:    make(chan struct{}),
+			stop:     make(chan struct{}),
+			arv:      &arv,
+			apiToken: &atomic.Value{},
+			backoff:  kc.backoff(),
+			interval: kc.DiscoveryInterval,
+			logger:   kc.logger(),
 		}
+		cacheEnt.apiToken.Store(kc.apiToken())
 		go cacheEnt.poll()
-		svcListCache[kc.Arvados.ApiServer] = cacheEnt
+		svcListCache[key] = cacheEnt
+	}
+	if kc.svcListKey != key {
+		kc.releaseSvcListLocked()
+		kc.svcListKey = key
+		cacheEnt.refs++
 	}
 	svcListCacheMtx.Unlock()
 
 	select {
 	case <-time.After(time.Minute):
 		return errors.New("timed out while getting initial list of keep services")
+	case <-cacheEnt.stop:
+		return errors.New("keep client was closed while getting list of keep services")
 	case sl := <-cacheEnt.latest:
 		return kc.loadKeepServers(sl)
 	}
 }
 
+// releaseSvcList releases kc's reference to the service discovery
+// cache entry it has been using, if any. When the last reference is
+// released, the entry's poll goroutine is stopped and the entry is
+// removed from the cache.
+func (kc *KeepClient) releaseSvcList() {
+	svcListCacheMtx.Lock()
+	defer svcListCacheMtx.Unlock()
+	kc.releaseSvcListLocked()
+}
+
+// releaseSvcListLocked is like releaseSvcList, but the caller must
+// hold svcListCacheMtx.
+func (kc *KeepClient) releaseSvcListLocked() {
+	if kc.svcListKey == "" {
+		return
+	}
+	if ent, ok := svcListCache[kc.svcListKey]; ok {
+		ent.refs--
+		if ent.refs <= 0 {
+			close(ent.stop)
+			delete(svcListCache, kc.svcListKey)
+		}
+	}
+	kc.svcListKey = ""
+}
+
 func (kc *KeepClient) RefreshServiceDiscovery() {
 	svcListCacheMtx.Lock()
-	ent, ok := svcListCache[kc.Arvados.ApiServer]
+	ent, ok := svcListCache[svcListCacheKey(kc.Arvados)]
 	svcListCacheMtx.Unlock()
 	if !ok || kc.Arvados.KeepServiceURIs != nil || kc.disableDiscovery {
 		return
 	}
-	ent.clear <- struct{}{}
+	ent.refresh()
 }
 
 // LoadKeepServicesFromJSON gets list of available keep services from
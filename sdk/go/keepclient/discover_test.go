@@ -6,9 +6,14 @@ package keepclient
 
 import (
 	"crypto/md5"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"gopkg.in/check.v1"
 
@@ -55,3 +60,164 @@ func (s *ServerRequiredSuite) TestOverrideDiscovery(c *check.C) {
 	_, _, _, err = kc2.Get(hash)
 	c.Check(err, check.IsNil)
 }
+
+func (s *ServerRequiredSuite) TestDiscoveryFallback(c *check.C) {
+	arv, err := arvadosclient.MakeArvadosClient()
+	c.Assert(err, check.IsNil)
+	arv.ApiToken = arvadostest.ActiveToken
+	arv.KeepServiceURIs = nil
+	arv.ApiServerFallbacks = []string{arv.ApiServer}
+	arv.ApiServer = "127.0.0.1:1"
+	arv.Retries = 0
+
+	kc, err := MakeKeepClient(arv)
+	c.Assert(err, check.IsNil)
+	c.Check(kc.LocalRoots(), check.Not(check.HasLen), 0)
+	for _, root := range kc.LocalRoots() {
+		c.Check(root, check.Not(check.Equals), "")
+	}
+}
+
+// stubDiscoveryHandler is a stub API server that returns the given
+// list of keep services, or an error if fail is true.
+type stubDiscoveryHandler struct {
+	mtx      sync.Mutex
+	services []keepService
+	fail     bool
+	requests int
+}
+
+func (h *stubDiscoveryHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if req.URL.Path != "/arvados/v1/keep_services/accessible" {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	h.requests++
+	if h.fail {
+		http.Error(w, "stub failure", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(svcList{Items: h.services})
+}
+
+func (h *stubDiscoveryHandler) set(services []keepService, fail bool) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.services = services
+	h.fail = fail
+}
+
+func (s *StandaloneSuite) TestDiscoveryInterval(c *check.C) {
+	svc := func(i int) keepService {
+		return keepService{
+			Uuid:     fmt.Sprintf("zzzzz-bi6l4-00000000000000%d", i),
+			Hostname: fmt.Sprintf("keep%d.zzzzz.example", i),
+			Port:     25107,
+			SvcType:  "disk",
+		}
+	}
+	stub := &stubDiscoveryHandler{}
+	stub.set([]keepService{svc(0)}, false)
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+
+	arv := &arvadosclient.ArvadosClient{
+		Scheme:    "http",
+		ApiServer: strings.TrimPrefix(srv.URL, "http://"),
+		ApiToken:  "abc123",
+		Client:    http.DefaultClient,
+	}
+	kc := New(arv)
+	kc.DiscoveryInterval = 100 * time.Millisecond
+	kc.Backoff = Backoff{BaseDelay: 10 * time.Millisecond, MaxDelay: 10 * time.Millisecond, MaxAttempts: 1}
+	c.Check(kc.LocalRoots(), check.HasLen, 1)
+
+	// After the interval, the new list is used.
+	stub.set([]keepService{svc(0), svc(1)}, false)
+	waitForRoots := func(n int) {
+		deadline := time.Now().Add(5 * time.Second)
+		for len(kc.LocalRoots()) != n && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		c.Check(kc.LocalRoots(), check.HasLen, n)
+	}
+	waitForRoots(2)
+
+	// If a refresh fails, the previous list is still used.
+	stub.set(nil, true)
+	stub.mtx.Lock()
+	requests := stub.requests
+	stub.mtx.Unlock()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		stub.mtx.Lock()
+		done := stub.requests > requests+1
+		stub.mtx.Unlock()
+		if done {
+			break
+		}
+	}
+	c.Check(kc.LocalRoots(), check.HasLen, 2)
+
+	// After the API server recovers, the next refresh is used.
+	stub.set([]keepService{svc(1)}, false)
+	waitForRoots(1)
+	c.Check(kc.LocalRoots()[svc(1).Uuid], check.Equals, "http://keep1.zzzzz.example:25107")
+}
+
+func (s *StandaloneSuite) TestCloseStopsDiscovery(c *check.C) {
+	stub := &stubDiscoveryHandler{}
+	stub.set([]keepService{{
+		Uuid:     "zzzzz-bi6l4-000000000000000",
+		Hostname: "keep0.zzzzz.example",
+		Port:     25107,
+		SvcType:  "disk",
+	}}, false)
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+
+	arv := &arvadosclient.ArvadosClient{
+		Scheme:    "http",
+		ApiServer: strings.TrimPrefix(srv.URL, "http://"),
+		ApiToken:  "abc123",
+		Client:    http.DefaultClient,
+	}
+	requests := func() int {
+		stub.mtx.Lock()
+		defer stub.mtx.Unlock()
+		return stub.requests
+	}
+	// polling reports whether the discovery goroutine is still
+	// sending requests to the API server.
+	polling := func() bool {
+		n := requests()
+		time.Sleep(200 * time.Millisecond)
+		return requests() > n
+	}
+
+	var kcs []*KeepClient
+	for i := 0; i < 2; i++ {
+		kc := New(arv)
+		kc.DiscoveryInterval = 10 * time.Millisecond
+		c.Check(kc.LocalRoots(), check.HasLen, 1)
+		kcs = append(kcs, kc)
+	}
+
+	// The discovery goroutine is shared, so it keeps running
+	// until the last client is closed.
+	c.Check(kcs[0].Close(), check.IsNil)
+	c.Check(polling(), check.Equals, true)
+	c.Check(kcs[1].Close(), check.IsNil)
+	c.Check(polling(), check.Equals, false)
+	svcListCacheMtx.Lock()
+	_, ok := svcListCache[svcListCacheKey(arv)]
+	svcListCacheMtx.Unlock()
+	c.Check(ok, check.Equals, false)
+
+	// A closed client restarts discovery when it is used
+	// again.
+	c.Check(kcs[1].LocalRoots(), check.HasLen, 1)
+	c.Check(polling(), check.Equals, true)
+	c.Check(kcs[1].Close(), check.IsNil)
+}
@@ -23,11 +23,13 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
 	"git.arvados.org/arvados.git/sdk/go/httpserver"
+	"github.com/sirupsen/logrus"
 )
 
 // BLOCKSIZE defines the length of a Keep "block", which is 64MB.
@@ -75,7 +77,45 @@ type ErrNotFound struct {
 	multipleResponseError
 }
 
-type InsufficientReplicasError struct{ error }
+// InsufficientReplicasError is returned when a block was written
+// with fewer replicas than requested. Replicas and Locator report the
+// replicas that were actually stored, so callers can decide whether a
+// partial write is acceptable. Attempts and TriedServers report the
+// number of PUT requests sent and the servers they were sent to.
+// Failures reports each PUT request that did not succeed, in the
+// order the responses were received.
+type InsufficientReplicasError struct {
+	error
+	Replicas     int
+	Locator      string
+	Attempts     int
+	TriedServers []string
+	Failures     []UploadError
+}
+
+// UploadError describes a failed PUT request to one server.
+// StatusCode is zero if no response was received (e.g., the
+// connection failed), in which case Err is the transport error.
+type UploadError struct {
+	Server     string
+	StatusCode int
+	Err        error
+}
+
+func (e UploadError) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("%s: %s", e.Server, e.Err)
+	}
+	return fmt.Sprintf("%s: [%d] %s", e.Server, e.StatusCode, e.Err)
+}
+
+func (e UploadError) Unwrap() error {
+	return e.Err
+}
+
+// InvalidTokenError is returned by RefreshToken when the API server
+// does not accept the token. The caller should obtain a new token.
+type InvalidTokenError struct{ error }
 
 type OversizeBlockError struct{ error }
 
@@ -103,6 +143,19 @@ type HTTPClient interface {
 
 const DiskCacheDisabled = arvados.ByteSizeOrPercent(1)
 
+// BlockCache is a read-through cache of block data, keyed by block
+// hash, that can be used by BlockGet. See KeepClient.BlockCache.
+//
+// Implementations must be safe to call from multiple goroutines.
+type BlockCache interface {
+	// Get returns the cached data for the given block hash, if
+	// any.
+	Get(hash string) ([]byte, bool)
+	// Put adds data to the cache. The caller will not modify
+	// data after calling Put.
+	Put(hash string, data []byte)
+}
+
 // KeepClient holds information about Arvados and Keep servers.
 type KeepClient struct {
 	Arvados               *arvadosclient.ArvadosClient
@@ -118,6 +171,53 @@ type KeepClient struct {
 	DefaultStorageClasses []string                  // Set by cluster's exported config
 	DiskCacheSize         arvados.ByteSizeOrPercent // See also DiskCacheDisabled
 
+	// If BlockCache is not nil, BlockGet checks it before
+	// retrieving a block, and adds each retrieved block to it.
+	BlockCache BlockCache
+
+	// Delay schedule for upload retries and service discovery
+	// retries. If zero, DefaultBackoff is used.
+	Backoff Backoff
+
+	// Interval between refreshes of the list of keep services
+	// retrieved from the API server. If zero, the list is
+	// refreshed every 5 minutes.
+	DiscoveryInterval time.Duration
+
+	// Number of servers to send each block read request to at
+	// once, in probe order. The first successful response is
+	// used, and the other requests are cancelled. If zero, servers
+	// are tried one at a time.
+	ReadConcurrency int
+
+	// Maximum number of block uploads in progress at once when
+	// writing a block. If zero, up to Want_replicas uploads are
+	// started at once.
+	MaxConcurrentUploads int
+
+	// If SkipExistingReplicas is true, writing a block starts by
+	// sending a HEAD request for the block to each writable
+	// server (see ExistingReplicas), and servers that already
+	// have the block are counted toward the desired number of
+	// replicas instead of being sent a PUT request.
+	SkipExistingReplicas bool
+
+	// Transport settings for the default HTTP client, used when
+	// HTTPClient is nil. If zero, MaxIdleConnsPerHost is Go's
+	// default (2), which can cause connection churn when writing
+	// to many servers at once, IdleConnTimeout is 90 seconds,
+	// and TLSHandshakeTimeout is DefaultTLSHandshakeTimeout (or
+	// DefaultProxyTLSHandshakeTimeout if the keep services are
+	// proxies).
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	TLSHandshakeTimeout time.Duration
+
+	// Logger for service discovery and block upload messages. If
+	// nil, messages are discarded (or, if the ARVADOS_DEBUG
+	// environment variable is set, written to stderr).
+	Logger logrus.FieldLogger
+
 	// set to 1 if all writable services are of disk type, otherwise 0
 	replicasPerService int
 
@@ -128,6 +228,28 @@ type KeepClient struct {
 	disableDiscovery bool
 
 	gatewayStack arvados.KeepGateway
+
+	// Token set by RefreshToken, shared with clones.
+	refreshed *refreshedToken
+
+	// Default HTTP clients this client has used since it was
+	// created or last closed. Guarded by defaultClientMtx.
+	defaultClientsUsed map[defaultClientKey]bool
+
+	// Key of the service discovery cache entry this client has
+	// used since it was created or last closed. Guarded by
+	// svcListCacheMtx.
+	svcListKey string
+}
+
+// refreshedToken holds a token set by RefreshToken, which is used
+// instead of arv.ApiToken in Keep requests. It is shared by a
+// KeepClient and its clones, but ignored by a client whose Arvados
+// field has been changed to a different ArvadosClient (e.g., a clone
+// that was given a different token).
+type refreshedToken struct {
+	arv   *arvadosclient.ArvadosClient
+	token atomic.Value // string
 }
 
 func (kc *KeepClient) Clone() *KeepClient {
@@ -145,9 +267,20 @@ func (kc *KeepClient) Clone() *KeepClient {
 		StorageClasses:        kc.StorageClasses,
 		DefaultStorageClasses: kc.DefaultStorageClasses,
 		DiskCacheSize:         kc.DiskCacheSize,
+		BlockCache:            kc.BlockCache,
+		Backoff:               kc.Backoff,
+		DiscoveryInterval:     kc.DiscoveryInterval,
+		MaxConcurrentUploads:  kc.MaxConcurrentUploads,
+		SkipExistingReplicas:  kc.SkipExistingReplicas,
+		MaxIdleConnsPerHost:   kc.MaxIdleConnsPerHost,
+		IdleConnTimeout:       kc.IdleConnTimeout,
+		TLSHandshakeTimeout:   kc.TLSHandshakeTimeout,
+		ReadConcurrency:       kc.ReadConcurrency,
+		Logger:                kc.Logger,
 		replicasPerService:    kc.replicasPerService,
 		foundNonDiskSvc:       kc.foundNonDiskSvc,
 		disableDiscovery:      kc.disableDiscovery,
+		refreshed:             kc.sharedToken(),
 	}
 }
 
@@ -205,7 +338,8 @@ func New(arv *arvadosclient.ArvadosClient) *KeepClient {
 // written, and an error.
 //
 // Returns an InsufficientReplicasError if 0 <= replicas <
-// kc.Wants_replicas.
+// kc.Wants_replicas. In that case, the returned locator and replica
+// count still reflect the replicas that were written.
 func (kc *KeepClient) PutHR(hash string, r io.Reader, dataBytes int64) (string, int, error) {
 	resp, err := kc.BlockWrite(context.Background(), arvados.BlockWriteOptions{
 		Hash:     hash,
@@ -282,24 +416,17 @@ func (kc *KeepClient) getOrHead(method string, locator string, header http.Heade
 		triesRemaining--
 		retryList = nil
 
-		for _, host := range serversToTry {
-			url := host + "/" + locator
-
-			req, err := http.NewRequest(method, url, nil)
-			if err != nil {
+		next, stop := kc.startReads(method, locator, header, reqid, serversToTry)
+		for {
+			attempt, ok := next()
+			if !ok {
+				break
+			}
+			host, url, resp, err := attempt.host, attempt.url, attempt.resp, attempt.err
+			if err != nil && !attempt.sent {
 				errs = append(errs, fmt.Sprintf("%s: %v", url, err))
 				continue
 			}
-			for k, v := range header {
-				req.Header[k] = append([]string(nil), v...)
-			}
-			if req.Header.Get("Authorization") == "" {
-				req.Header.Set("Authorization", "OAuth2 "+kc.Arvados.ApiToken)
-			}
-			if req.Header.Get("X-Request-Id") == "" {
-				req.Header.Set("X-Request-Id", reqid)
-			}
-			resp, err := kc.httpClient().Do(req)
 			if err != nil {
 				// Probably a network error, may be transient,
 				// can try again.
@@ -326,6 +453,7 @@ func (kc *KeepClient) getOrHead(method string, locator string, header http.Heade
 				}
 				continue
 			}
+			stop(attempt)
 			if expectLength < 0 {
 				if resp.ContentLength < 0 {
 					resp.Body.Close()
@@ -363,6 +491,106 @@ func (kc *KeepClient) getOrHead(method string, locator string, header http.Heade
 	return nil, 0, "", nil, err
 }
 
+// readAttempt is the outcome of a single GET or HEAD request sent by
+// startReads.
+type readAttempt struct {
+	index int
+	host  string
+	url   string
+	resp  *http.Response
+	err   error
+	// false if the request could not be sent at all
+	sent bool
+}
+
+// cancelOnClose is a response body that cancels the request's
+// context when closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// startReads sends GET or HEAD requests for locator to the given
+// hosts, in order, with up to kc.ReadConcurrency requests in
+// progress at once.
+//
+// Each call to next returns the next completed request, starting
+// another one if needed, or false if all requests have completed.
+// The caller must close the body of each response it receives.
+//
+// When the caller decides to use a response, it must call stop with
+// that response. stop cancels all other outstanding requests.
+func (kc *KeepClient) startReads(method, locator string, header http.Header, reqid string, hosts []string) (next func() (readAttempt, bool), stop func(keep readAttempt)) {
+	concurrency := kc.ReadConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	results := make(chan readAttempt, len(hosts))
+	var cancels []context.CancelFunc
+	started, received := 0, 0
+	next = func() (readAttempt, bool) {
+		for started < len(hosts) && started-received < concurrency {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancels = append(cancels, cancel)
+			go func(attempt readAttempt) {
+				attempt.url = attempt.host + "/" + locator
+				req, err := http.NewRequestWithContext(ctx, method, attempt.url, nil)
+				if err != nil {
+					cancel()
+					attempt.err = err
+					results <- attempt
+					return
+				}
+				for k, v := range header {
+					req.Header[k] = append([]string(nil), v...)
+				}
+				if req.Header.Get("Authorization") == "" {
+					req.Header.Set("Authorization", "OAuth2 "+kc.apiToken())
+				}
+				if req.Header.Get("X-Request-Id") == "" {
+					req.Header.Set("X-Request-Id", reqid)
+				}
+				attempt.sent = true
+				attempt.resp, attempt.err = kc.httpClient().Do(req)
+				if attempt.err != nil {
+					cancel()
+				} else {
+					attempt.resp.Body = cancelOnClose{attempt.resp.Body, cancel}
+				}
+				results <- attempt
+			}(readAttempt{index: started, host: hosts[started]})
+			started++
+		}
+		if received == started {
+			return readAttempt{}, false
+		}
+		received++
+		return <-results, true
+	}
+	stop = func(keep readAttempt) {
+		for i, cancel := range cancels {
+			if i != keep.index {
+				cancel()
+			}
+		}
+		outstanding := started - received
+		go func() {
+			for ; outstanding > 0; outstanding-- {
+				if attempt := <-results; attempt.resp != nil {
+					attempt.resp.Body.Close()
+				}
+			}
+		}()
+	}
+	return
+}
+
 // attempt to create dir/subdir/ and its parents, up to but not
 // including dir itself, using mode 0700.
 func makedirs(dir, subdir string) {
@@ -470,6 +698,42 @@ func (kc *KeepClient) BlockRead(ctx context.Context, opts arvados.BlockReadOptio
 	return kc.upstreamGateway().BlockRead(ctx, opts)
 }
 
+// BlockGet returns the full content of the specified block.
+//
+// If kc.BlockCache is set, it is consulted first; on a cache miss,
+// the block is retrieved using BlockRead and then added to
+// kc.BlockCache. In that case the returned slice is shared with the
+// cache, so the caller must not modify it.
+func (kc *KeepClient) BlockGet(ctx context.Context, locator string) ([]byte, error) {
+	loc, err := MakeLocator(locator)
+	if err != nil {
+		return nil, err
+	}
+	if kc.BlockCache != nil {
+		if data, ok := kc.BlockCache.Get(loc.Hash); ok {
+			return data, nil
+		}
+	}
+	var buf bytes.Buffer
+	if loc.Size > 0 {
+		buf.Grow(loc.Size)
+	}
+	n, err := kc.BlockRead(ctx, arvados.BlockReadOptions{
+		Locator: locator,
+		WriteTo: &buf,
+	})
+	if err != nil {
+		return nil, err
+	} else if loc.Size >= 0 && n != loc.Size {
+		return nil, fmt.Errorf("expected block size %d but read %d bytes", loc.Size, n)
+	}
+	data := buf.Bytes()
+	if kc.BlockCache != nil {
+		kc.BlockCache.Put(loc.Hash, data)
+	}
+	return data, nil
+}
+
 // ReadAt retrieves a portion of block from the cache if it's
 // present, otherwise from the network.
 func (kc *KeepClient) ReadAt(locator string, p []byte, off int) (int, error) {
@@ -517,7 +781,7 @@ func (kc *KeepClient) GetIndex(keepServiceUUID, prefix string) (io.Reader, error
 		return nil, err
 	}
 
-	req.Header.Add("Authorization", "OAuth2 "+kc.Arvados.ApiToken)
+	req.Header.Add("Authorization", "OAuth2 "+kc.apiToken())
 	req.Header.Set("X-Request-Id", kc.getRequestID())
 	resp, err := kc.httpClient().Do(req)
 	if err != nil {
@@ -621,36 +885,174 @@ func (kc *KeepClient) getSortedRoots(locator string) []string {
 	return found
 }
 
+var probeHashMatcher = regexp.MustCompile(`^[0-9a-f]{8,}$`)
+
+// ProbeSequence returns the base URIs of the local Keep services in
+// the order the client tries them when reading the block with the
+// given hash. Writes use the same order, skipping services that are
+// not writable. Service hints in a locator (+K@...) are not
+// considered: hash must be a bare block hash, or a prefix of at least
+// 8 lowercase hex digits. Digits after the first 32 are ignored.
+//
+// The order depends only on the hash and the service UUIDs, so it is
+// the same for every client that knows about the same services.
+func (kc *KeepClient) ProbeSequence(hash string) ([]string, error) {
+	if !probeHashMatcher.MatchString(hash) {
+		return nil, fmt.Errorf("invalid block hash %q: must be at least 8 lowercase hex digits", hash)
+	}
+	if len(hash) > 32 {
+		hash = hash[:32]
+	}
+	return NewRootSorter(kc.LocalRoots(), hash).GetSortedRoots(), nil
+}
+
 func (kc *KeepClient) SetStorageClasses(sc []string) {
 	// make a copy so the caller can't mess with it.
 	kc.StorageClasses = append([]string{}, sc...)
 }
 
-var (
-	// There are four global http.Client objects for the four
-	// possible permutations of TLS behavior (verify/skip-verify)
-	// and timeout settings (proxy/non-proxy).
-	defaultClient = map[bool]map[bool]HTTPClient{
-		// defaultClient[false] is used for verified TLS reqs
-		false: {},
-		// defaultClient[true] is used for unverified
-		// (insecure) TLS reqs
-		true: {},
+// RefreshToken checks that the given token is accepted by the API
+// server, and if so, uses it for all subsequent Keep requests. If
+// token is empty, the current token is checked.
+//
+// If the API server rejects the token, RefreshToken returns an
+// InvalidTokenError and leaves the current token unchanged. Other
+// failures (e.g., the API server is unreachable) are returned as
+// is, so the caller can distinguish "token is bad" from "could not
+// check".
+//
+// RefreshToken is safe to call while other goroutines are reading
+// and writing blocks with kc or its clones. It does not modify
+// kc.Arvados, which may be shared with other clients. The new token
+// is used by kc, by clones of kc that use the same Arvados client,
+// and for service discovery if the discovery cache was using the
+// old token.
+func (kc *KeepClient) RefreshToken(token string) error {
+	oldToken := kc.apiToken()
+	if token == "" {
+		token = oldToken
+	}
+	kc.lock.RLock()
+	arv := *kc.Arvados
+	kc.lock.RUnlock()
+	arv.ApiToken = token
+	var auth arvados.APIClientAuthorization
+	err := arv.Call("GET", "api_client_authorizations", "", "current", nil, &auth)
+	if ase, ok := err.(arvadosclient.APIServerError); ok && (ase.HttpStatusCode == http.StatusUnauthorized || ase.HttpStatusCode == http.StatusForbidden) {
+		return InvalidTokenError{fmt.Errorf("API server rejected token: %w", err)}
+	} else if err != nil {
+		return err
+	}
+	kc.lock.Lock()
+	kc.sharedToken().token.Store(token)
+	kc.lock.Unlock()
+	updateSvcListCacheToken(kc.Arvados, oldToken, token)
+	return nil
+}
+
+// Close releases the client's share of the resources it has been
+// using: idle network connections and the service discovery
+// refresh goroutine. The client can still be used afterward: new
+// connections are opened, and service discovery restarts, as
+// needed.
+//
+// If HTTPClient is not nil, its idle connections are closed.
+// Otherwise, the default HTTP client and the service discovery
+// goroutine are shared with other KeepClients, and they are only
+// released when all of the clients using them have been closed.
+func (kc *KeepClient) Close() error {
+	if kc.HTTPClient != nil {
+		if c, ok := kc.HTTPClient.(interface{ CloseIdleConnections() }); ok {
+			c.CloseIdleConnections()
+		}
+	}
+	defaultClientMtx.Lock()
+	for key := range kc.defaultClientsUsed {
+		defaultClientRefs[key]--
+		if defaultClientRefs[key] == 0 {
+			delete(defaultClientRefs, key)
+			if c, ok := defaultClient[key].(interface{ CloseIdleConnections() }); ok {
+				c.CloseIdleConnections()
+			}
+		}
+	}
+	kc.defaultClientsUsed = nil
+	defaultClientMtx.Unlock()
+	kc.releaseSvcList()
+	return nil
+}
+
+// apiToken returns the token to use in Keep requests.
+func (kc *KeepClient) apiToken() string {
+	kc.lock.RLock()
+	defer kc.lock.RUnlock()
+	if rt := kc.refreshed; rt != nil && rt.arv == kc.Arvados {
+		if token, _ := rt.token.Load().(string); token != "" {
+			return token
+		}
 	}
+	return kc.Arvados.ApiToken
+}
+
+// sharedToken returns the refreshedToken for kc's current Arvados
+// client, creating it if needed. The caller must hold kc.lock.
+func (kc *KeepClient) sharedToken() *refreshedToken {
+	if kc.refreshed == nil || kc.refreshed.arv != kc.Arvados {
+		kc.refreshed = &refreshedToken{arv: kc.Arvados}
+	}
+	return kc.refreshed
+}
+
+// defaultClientKey identifies a global http.Client suitable for a
+// given environment (TLS verification on/off, keep services
+// are/aren't proxies) and transport configuration.
+type defaultClientKey struct {
+	insecure            bool
+	proxy               bool
+	maxIdleConnsPerHost int
+	idleConnTimeout     time.Duration
+	tlsHandshakeTimeout time.Duration
+}
+
+var (
+	// Global http.Client objects, shared by all KeepClients
+	// with the same defaultClientKey. Without transport
+	// settings, there are four: one for each permutation of TLS
+	// behavior (verify/skip-verify) and timeout settings
+	// (proxy/non-proxy).
+	defaultClient    = map[defaultClientKey]HTTPClient{}
 	defaultClientMtx sync.Mutex
+
+	// Number of KeepClients that have used each of the
+	// defaultClient objects and haven't been closed yet.
+	defaultClientRefs = map[defaultClientKey]int{}
 )
 
 // httpClient returns the HTTPClient field if it's not nil, otherwise
-// whichever of the four global http.Client objects is suitable for
-// the current environment (i.e., TLS verification on/off, keep
-// services are/aren't proxies).
+// whichever of the global http.Client objects is suitable for the
+// current environment (i.e., TLS verification on/off, keep services
+// are/aren't proxies) and transport settings.
 func (kc *KeepClient) httpClient() HTTPClient {
 	if kc.HTTPClient != nil {
 		return kc.HTTPClient
 	}
+	key := defaultClientKey{
+		insecure:            kc.Arvados.ApiInsecure,
+		proxy:               kc.foundNonDiskSvc,
+		maxIdleConnsPerHost: kc.MaxIdleConnsPerHost,
+		idleConnTimeout:     kc.IdleConnTimeout,
+		tlsHandshakeTimeout: kc.TLSHandshakeTimeout,
+	}
 	defaultClientMtx.Lock()
 	defer defaultClientMtx.Unlock()
-	if c, ok := defaultClient[kc.Arvados.ApiInsecure][kc.foundNonDiskSvc]; ok {
+	if !kc.defaultClientsUsed[key] {
+		if kc.defaultClientsUsed == nil {
+			kc.defaultClientsUsed = map[defaultClientKey]bool{}
+		}
+		kc.defaultClientsUsed[key] = true
+		defaultClientRefs[key]++
+	}
+	if c, ok := defaultClient[key]; ok {
 		return c
 	}
 
@@ -669,6 +1071,13 @@ func (kc *KeepClient) httpClient() HTTPClient {
 		tlsTimeout = DefaultTLSHandshakeTimeout
 		keepAlive = DefaultKeepAlive
 	}
+	if kc.TLSHandshakeTimeout > 0 {
+		tlsTimeout = kc.TLSHandshakeTimeout
+	}
+	idleTimeout := 90 * time.Second
+	if kc.IdleConnTimeout > 0 {
+		idleTimeout = kc.IdleConnTimeout
+	}
 
 	c := &http.Client{
 		Timeout: requestTimeout,
@@ -685,13 +1094,14 @@ func (kc *KeepClient) httpClient() HTTPClient {
 				DualStack: true,
 			}).DialContext,
 			MaxIdleConns:          100,
-			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConnsPerHost:   kc.MaxIdleConnsPerHost,
+			IdleConnTimeout:       idleTimeout,
 			TLSHandshakeTimeout:   tlsTimeout,
 			ExpectContinueTimeout: 1 * time.Second,
 			TLSClientConfig:       arvadosclient.MakeTLSConfig(kc.Arvados.ApiInsecure),
 		},
 	}
-	defaultClient[kc.Arvados.ApiInsecure][kc.foundNonDiskSvc] = c
+	defaultClient[key] = c
 	return c
 }
 
@@ -8,21 +8,27 @@ import (
 	"bytes"
 	"context"
 	"crypto/md5"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
 	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	"github.com/sirupsen/logrus"
 	. "gopkg.in/check.v1"
 )
 
@@ -99,6 +105,135 @@ func (s *ServerRequiredSuite) TestDefaultStorageClasses(c *C) {
 	c.Assert(kc.DefaultStorageClasses, DeepEquals, []string{"default"})
 }
 
+func (s *ServerRequiredSuite) TestRefreshToken(c *C) {
+	arv, err := arvadosclient.MakeArvadosClient()
+	c.Assert(err, IsNil)
+	kc := New(arv)
+
+	// Check current token
+	orig := arv.ApiToken
+	c.Check(kc.RefreshToken(""), IsNil)
+	c.Check(kc.apiToken(), Equals, orig)
+
+	// Switch to a different valid token. The ArvadosClient,
+	// which might be shared with other clients, is not modified.
+	c.Check(kc.RefreshToken(arvadostest.SpectatorToken), IsNil)
+	c.Check(kc.apiToken(), Equals, arvadostest.SpectatorToken)
+	c.Check(arv.ApiToken, Equals, orig)
+
+	// Invalid token is rejected, current token is unchanged
+	err = kc.RefreshToken("bogus-token")
+	c.Check(err, FitsTypeOf, InvalidTokenError{})
+	c.Check(kc.apiToken(), Equals, arvadostest.SpectatorToken)
+}
+
+// Run with -race to check that RefreshToken doesn't race with
+// clones that are writing blocks, or with service discovery.
+func (s *StandaloneSuite) TestRefreshTokenConcurrentClone(c *C) {
+	var mtx sync.Mutex
+	putTokens := map[string]int{}
+	ks := RunFakeKeepServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.Copy(ioutil.Discard, req.Body)
+		mtx.Lock()
+		putTokens[req.Header.Get("Authorization")]++
+		mtx.Unlock()
+		w.Header().Set("X-Keep-Replicas-Stored", "1")
+	}))
+	defer ks.listener.Close()
+
+	discoveryTokens := map[string]int{}
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		auth := req.Header.Get("Authorization")
+		switch req.URL.Path {
+		case "/arvados/v1/api_client_authorizations/current":
+			if auth != "OAuth2 abc123" && auth != "OAuth2 def456" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{}`))
+		case "/arvados/v1/keep_services/accessible":
+			mtx.Lock()
+			discoveryTokens[auth]++
+			mtx.Unlock()
+			json.NewEncoder(w).Encode(svcList{Items: []keepService{{
+				Uuid:     "zzzzz-bi6l4-000000000000000",
+				Hostname: "127.0.0.1",
+				Port:     ks.listener.Addr().(*net.TCPAddr).Port,
+				SvcType:  "disk",
+			}}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer api.Close()
+
+	arv := &arvadosclient.ArvadosClient{
+		Scheme:    "http",
+		ApiServer: strings.TrimPrefix(api.URL, "http://"),
+		ApiToken:  "abc123",
+		Client:    http.DefaultClient,
+	}
+	kc := New(arv)
+	kc.Want_replicas = 1
+	kc.DiscoveryInterval = 10 * time.Millisecond
+
+	// Write blocks with clones of kc while the token is
+	// refreshed.
+	early := kc.Clone()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				_, _, err := kc.Clone().PutB([]byte(fmt.Sprintf("foo %d %d", i, j)))
+				c.Check(err, IsNil)
+			}
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	c.Check(kc.RefreshToken("def456"), IsNil)
+	wg.Wait()
+
+	// The shared ArvadosClient is unchanged. Clones of kc,
+	// including clones made before the refresh, use the new
+	// token.
+	c.Check(arv.ApiToken, Equals, "abc123")
+	c.Check(early.apiToken(), Equals, "def456")
+	clone := kc.Clone()
+	c.Check(kc.RefreshToken("bogus"), FitsTypeOf, InvalidTokenError{})
+	mtx.Lock()
+	putTokens = map[string]int{}
+	mtx.Unlock()
+	_, _, err := clone.PutB([]byte("bar"))
+	c.Check(err, IsNil)
+	mtx.Lock()
+	c.Check(putTokens, DeepEquals, map[string]int{"OAuth2 def456": 1})
+	mtx.Unlock()
+
+	// Service discovery uses the new token, too.
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		mtx.Lock()
+		done := discoveryTokens["OAuth2 def456"] > 0
+		mtx.Unlock()
+		if done {
+			break
+		}
+	}
+	mtx.Lock()
+	c.Check(discoveryTokens["OAuth2 def456"] > 0, Equals, true)
+	mtx.Unlock()
+
+	// A clone that is given a different ArvadosClient uses its
+	// token, not the refreshed one.
+	clone = kc.Clone()
+	arv2 := *arv
+	arv2.ApiToken = "ghi789"
+	clone.Arvados = &arv2
+	c.Check(clone.apiToken(), Equals, "ghi789")
+	c.Check(kc.apiToken(), Equals, "def456")
+}
+
 func (s *ServerRequiredSuite) TestDefaultReplications(c *C) {
 	arv, err := arvadosclient.MakeArvadosClient()
 	c.Assert(err, IsNil)
@@ -195,7 +330,7 @@ func (s *StandaloneSuite) TestUploadToStubKeepServer(c *C) {
 
 	UploadToStubHelper(c, st,
 		func(kc *KeepClient, url string, reader io.ReadCloser, writer io.WriteCloser, uploadStatusChan chan uploadStatus) {
-			go kc.uploadToKeepServer(url, st.expectPath, nil, reader, uploadStatusChan, len("foo"), kc.getRequestID())
+			go kc.uploadToKeepServer(context.Background(), url, st.expectPath, nil, reader, uploadStatusChan, len("foo"), kc.getRequestID())
 
 			writer.Write([]byte("foo"))
 			writer.Close()
@@ -219,7 +354,7 @@ func (s *StandaloneSuite) TestUploadToStubKeepServerBufferReader(c *C) {
 
 	UploadToStubHelper(c, st,
 		func(kc *KeepClient, url string, _ io.ReadCloser, _ io.WriteCloser, uploadStatusChan chan uploadStatus) {
-			go kc.uploadToKeepServer(url, st.expectPath, nil, bytes.NewBuffer([]byte("foo")), uploadStatusChan, 3, kc.getRequestID())
+			go kc.uploadToKeepServer(context.Background(), url, st.expectPath, nil, bytes.NewBuffer([]byte("foo")), uploadStatusChan, 3, kc.getRequestID())
 
 			<-st.handled
 
@@ -251,7 +386,7 @@ func (s *StandaloneSuite) TestUploadWithStorageClasses(c *C) {
 
 		UploadToStubHelper(c, st,
 			func(kc *KeepClient, url string, reader io.ReadCloser, writer io.WriteCloser, uploadStatusChan chan uploadStatus) {
-				go kc.uploadToKeepServer(url, st.expectPath, nil, reader, uploadStatusChan, len("foo"), kc.getRequestID())
+				go kc.uploadToKeepServer(context.Background(), url, st.expectPath, nil, reader, uploadStatusChan, len("foo"), kc.getRequestID())
 
 				writer.Write([]byte("foo"))
 				writer.Close()
@@ -407,6 +542,7 @@ func (s *StandaloneSuite) TestPutWithStorageClasses(c *C) {
 			// should have succeeded for class1. Second
 			// request should only ask for class404.
 			c.Check(st.requests[1].Header.Get("X-Keep-Storage-Classes"), Equals, "class404")
+			c.Check(err, ErrorMatches, `Could not write sufficient replicas: replicas still needed in storage classes class404=1; \d+ attempts on \d+ servers \(.*\)`)
 		}
 	}
 }
@@ -457,7 +593,7 @@ func (s *StandaloneSuite) TestFailedUploadToStubKeepServer(c *C) {
 		func(kc *KeepClient, url string, reader io.ReadCloser,
 			writer io.WriteCloser, uploadStatusChan chan uploadStatus) {
 
-			go kc.uploadToKeepServer(url, hash, nil, reader, uploadStatusChan, 3, kc.getRequestID())
+			go kc.uploadToKeepServer(context.Background(), url, hash, nil, reader, uploadStatusChan, 3, kc.getRequestID())
 
 			writer.Write([]byte("foo"))
 			writer.Close()
@@ -529,6 +665,244 @@ func (s *StandaloneSuite) TestPutB(c *C) {
 		true)
 }
 
+func (s *StandaloneSuite) TestBlockWriteOnReplicaStored(c *C) {
+	hash := Md5String("foo")
+
+	st := &StubPutHandler{
+		c:                    c,
+		expectPath:           hash,
+		expectAPIToken:       "abc123",
+		expectBody:           "foo",
+		expectStorageClass:   "default",
+		returnStorageClasses: "",
+		handled:              make(chan string, 5),
+	}
+
+	arv, _ := arvadosclient.MakeArvadosClient()
+	kc, _ := MakeKeepClient(arv)
+
+	kc.Want_replicas = 3
+	arv.ApiToken = "abc123"
+	localRoots := make(map[string]string)
+	writableLocalRoots := make(map[string]string)
+
+	ks := RunSomeFakeKeepServers(st, 5)
+
+	for i, k := range ks {
+		localRoots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i)] = k.url
+		writableLocalRoots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i)] = k.url
+		defer k.listener.Close()
+	}
+
+	kc.SetServiceRoots(localRoots, writableLocalRoots, nil)
+
+	var hosts []string
+	var counts []int
+	resp, err := kc.BlockWrite(context.Background(), arvados.BlockWriteOptions{
+		Data: []byte("foo"),
+		OnReplicaStored: func(host string, replicas int) {
+			hosts = append(hosts, host)
+			counts = append(counts, replicas)
+		},
+	})
+	c.Check(err, IsNil)
+	c.Check(resp.Replicas, Equals, 3)
+	c.Check(counts, DeepEquals, []int{1, 2, 3})
+	c.Assert(hosts, HasLen, 3)
+	shuff := NewRootSorter(kc.LocalRoots(), hash).GetSortedRoots()
+	sort.Strings(hosts)
+	expect := append([]string(nil), shuff[:3]...)
+	sort.Strings(expect)
+	c.Check(hosts, DeepEquals, expect)
+}
+
+// BlockingPutHandler accepts PUT requests and never responds until
+// unblock is closed or the client gives up.
+type BlockingPutHandler struct {
+	handled   chan string
+	cancelled chan string
+	unblock   chan struct{}
+}
+
+func (h *BlockingPutHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	h.handled <- fmt.Sprintf("http://%s", req.Host)
+	select {
+	case <-h.unblock:
+		resp.WriteHeader(http.StatusServiceUnavailable)
+	case <-req.Context().Done():
+		h.cancelled <- fmt.Sprintf("http://%s", req.Host)
+	}
+}
+
+func (s *StandaloneSuite) TestBlockWriteCancel(c *C) {
+	st := &BlockingPutHandler{
+		handled:   make(chan string, 5),
+		cancelled: make(chan string, 5),
+		unblock:   make(chan struct{}),
+	}
+	defer close(st.unblock)
+
+	arv, _ := arvadosclient.MakeArvadosClient()
+	kc, _ := MakeKeepClient(arv)
+
+	kc.Want_replicas = 2
+	arv.ApiToken = "abc123"
+	localRoots := make(map[string]string)
+	writableLocalRoots := make(map[string]string)
+
+	ks := RunSomeFakeKeepServers(st, 2)
+
+	for i, k := range ks {
+		localRoots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i)] = k.url
+		writableLocalRoots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i)] = k.url
+		defer k.listener.Close()
+	}
+
+	kc.SetServiceRoots(localRoots, writableLocalRoots, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var cancelledAt time.Time
+	go func() {
+		// Cancel after both uploads are in progress.
+		<-st.handled
+		<-st.handled
+		cancelledAt = time.Now()
+		cancel()
+	}()
+
+	_, err := kc.BlockWrite(ctx, arvados.BlockWriteOptions{
+		Data: []byte("foo"),
+	})
+	c.Check(errors.Is(err, context.Canceled), Equals, true)
+	c.Check(err, ErrorMatches, `error writing block .*: context canceled`)
+	c.Check(time.Since(cancelledAt) < time.Second, Equals, true)
+
+	// The in-flight requests were cancelled.
+	for i := 0; i < 2; i++ {
+		select {
+		case <-st.cancelled:
+		case <-time.After(10 * time.Second):
+			c.Fatal("timed out waiting for upload to be cancelled")
+		}
+	}
+}
+
+func (s *StandaloneSuite) TestLogger(c *C) {
+	hash := Md5String("foo")
+
+	st := &StubPutHandler{
+		c:                    c,
+		expectPath:           hash,
+		expectAPIToken:       "abc123",
+		expectBody:           "foo",
+		expectStorageClass:   "default",
+		returnStorageClasses: "",
+		handled:              make(chan string, 5),
+	}
+
+	arv, _ := arvadosclient.MakeArvadosClient()
+	kc, _ := MakeKeepClient(arv)
+
+	var logbuf bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &logbuf
+	kc.Logger = logger
+
+	kc.Want_replicas = 1
+	arv.ApiToken = "abc123"
+	ks := RunFakeKeepServer(st)
+	defer ks.listener.Close()
+	roots := map[string]string{"zzzzz-bi6l4-fakefakefake000": ks.url}
+	kc.SetServiceRoots(roots, roots, nil)
+
+	_, _, err := kc.PutB([]byte("foo"))
+	c.Check(err, IsNil)
+	// Per-upload messages are debug level.
+	c.Check(logbuf.String(), Equals, "")
+
+	logger.Level = logrus.DebugLevel
+	_, _, err = kc.PutB([]byte("foo"))
+	c.Check(err, IsNil)
+	c.Check(logbuf.String(), Matches, `(?ms).*level=debug msg=".* Begin upload `+hash+` to `+ks.url+`.*`)
+	c.Check(logbuf.String(), Matches, `(?ms).*level=debug msg=".* Upload `+ks.url+`/`+hash+` success.*`)
+}
+
+// ConcurrencyCountingHandler wraps a PUT handler, and records the
+// maximum number of requests in progress at once.
+type ConcurrencyCountingHandler struct {
+	handler http.Handler
+	mtx     sync.Mutex
+	current int
+	max     int
+}
+
+func (h *ConcurrencyCountingHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	h.mtx.Lock()
+	h.current++
+	if h.max < h.current {
+		h.max = h.current
+	}
+	h.mtx.Unlock()
+	defer func() {
+		h.mtx.Lock()
+		h.current--
+		h.mtx.Unlock()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	h.handler.ServeHTTP(resp, req)
+}
+
+func (s *StandaloneSuite) TestMaxConcurrentUploads(c *C) {
+	for _, trial := range []struct {
+		maxConcurrentUploads int
+		expectMax            int
+	}{
+		{0, 6},
+		{2, 2},
+		{1, 1},
+	} {
+		c.Logf("trial: %+v", trial)
+		st := &ConcurrencyCountingHandler{
+			handler: &StubPutHandler{
+				c:                    c,
+				expectPath:           Md5String("foo"),
+				expectAPIToken:       "abc123",
+				expectBody:           "foo",
+				expectStorageClass:   "default",
+				returnStorageClasses: "",
+				handled:              make(chan string, 10),
+			},
+		}
+
+		arv, _ := arvadosclient.MakeArvadosClient()
+		kc, _ := MakeKeepClient(arv)
+
+		kc.Want_replicas = 6
+		kc.MaxConcurrentUploads = trial.maxConcurrentUploads
+		arv.ApiToken = "abc123"
+		localRoots := make(map[string]string)
+		writableLocalRoots := make(map[string]string)
+
+		ks := RunSomeFakeKeepServers(st, 10)
+
+		for i, k := range ks {
+			localRoots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i)] = k.url
+			writableLocalRoots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i)] = k.url
+			defer k.listener.Close()
+		}
+
+		kc.SetServiceRoots(localRoots, writableLocalRoots, nil)
+
+		_, replicas, err := kc.PutB([]byte("foo"))
+		c.Check(err, IsNil)
+		c.Check(replicas, Equals, 6)
+		st.mtx.Lock()
+		c.Check(st.max <= trial.expectMax, Equals, true, Commentf("max concurrent requests %d", st.max))
+		st.mtx.Unlock()
+	}
+}
+
 func (s *StandaloneSuite) TestPutHR(c *C) {
 	hash := fmt.Sprintf("%x", md5.Sum([]byte("foo")))
 
@@ -691,6 +1065,333 @@ func (s *StandaloneSuite) TestPutWithTooManyFail(c *C) {
 	c.Check(<-st.handled, Equals, ks1[0].url)
 }
 
+func (s *StandaloneSuite) TestPutFailoverToNextServer(c *C) {
+	st := &FailThenSucceedHandler{
+		handled: make(chan string, 1),
+		successhandler: &StubPutHandler{
+			c:                    c,
+			expectPath:           Md5String("foo"),
+			expectAPIToken:       "abc123",
+			expectBody:           "foo",
+			expectStorageClass:   "default",
+			returnStorageClasses: "",
+			handled:              make(chan string, 5),
+		},
+	}
+
+	arv, _ := arvadosclient.MakeArvadosClient()
+	kc, _ := MakeKeepClient(arv)
+
+	kc.Want_replicas = 1
+	kc.Retries = 0
+	arv.ApiToken = "abc123"
+	localRoots := make(map[string]string)
+	writableLocalRoots := make(map[string]string)
+
+	ks := RunSomeFakeKeepServers(st, 2)
+
+	for i, k := range ks {
+		localRoots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i)] = k.url
+		writableLocalRoots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i)] = k.url
+		defer k.listener.Close()
+	}
+
+	kc.SetServiceRoots(localRoots, writableLocalRoots, nil)
+
+	// The first server returns 500, so the block is written to
+	// the second server without waiting for a retry round.
+	_, replicas, err := kc.PutB([]byte("foo"))
+	c.Check(err, IsNil)
+	c.Check(replicas, Equals, 1)
+
+	shuff := NewRootSorter(kc.LocalRoots(), Md5String("foo")).GetSortedRoots()
+	c.Check(<-st.handled, Equals, shuff[0])
+	c.Check(<-st.successhandler.(*StubPutHandler).handled, Equals, shuff[1])
+}
+
+func (s *StandaloneSuite) TestPutExhaustedServersStdout(c *C) {
+	st := &StubPutHandler{
+		c:                    c,
+		expectPath:           Md5String("foo"),
+		expectAPIToken:       "abc123",
+		expectBody:           "foo",
+		expectStorageClass:   "default",
+		returnStorageClasses: "",
+		handled:              make(chan string, 1),
+	}
+	fh := FailHandler{
+		make(chan string, 2)}
+
+	arv, err := arvadosclient.MakeArvadosClient()
+	c.Check(err, IsNil)
+	kc, _ := MakeKeepClient(arv)
+
+	kc.Want_replicas = 3
+	kc.Retries = 0
+	arv.ApiToken = "abc123"
+	localRoots := make(map[string]string)
+	writableLocalRoots := make(map[string]string)
+
+	ks1 := RunSomeFakeKeepServers(st, 1)
+	ks2 := RunSomeFakeKeepServers(fh, 2)
+
+	for i, k := range append(ks1, ks2...) {
+		localRoots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i)] = k.url
+		writableLocalRoots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i)] = k.url
+		defer k.listener.Close()
+	}
+
+	kc.SetServiceRoots(localRoots, writableLocalRoots, nil)
+
+	// Capture anything written to stdout while all servers are
+	// tried and the write fails.
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	c.Assert(err, IsNil)
+	os.Stdout = w
+	_, replicas, err := kc.PutB([]byte("foo"))
+	os.Stdout = stdout
+	w.Close()
+	captured, _ := ioutil.ReadAll(r)
+
+	c.Check(string(captured), Equals, "")
+	c.Assert(err, FitsTypeOf, InsufficientReplicasError{})
+	c.Check(replicas, Equals, 1)
+	c.Check(err.(InsufficientReplicasError).Replicas, Equals, 1)
+	c.Check(err.(InsufficientReplicasError).Attempts, Equals, 3)
+}
+
+func (s *StandaloneSuite) TestPutInsufficientReplicasReportsTriedServers(c *C) {
+	fh := FailHandler{
+		make(chan string, 4)}
+
+	arv, err := arvadosclient.MakeArvadosClient()
+	c.Check(err, IsNil)
+	kc, _ := MakeKeepClient(arv)
+
+	kc.Want_replicas = 1
+	kc.Retries = 1
+	arv.ApiToken = "abc123"
+	localRoots := make(map[string]string)
+	writableLocalRoots := make(map[string]string)
+
+	ks := RunSomeFakeKeepServers(fh, 2)
+
+	for i, k := range ks {
+		localRoots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i)] = k.url
+		writableLocalRoots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i)] = k.url
+		defer k.listener.Close()
+	}
+
+	kc.SetServiceRoots(localRoots, writableLocalRoots, nil)
+
+	_, _, err = kc.PutB([]byte("foo"))
+	c.Assert(err, FitsTypeOf, InsufficientReplicasError{})
+	shuff := NewRootSorter(kc.LocalRoots(), Md5String("foo")).GetSortedRoots()
+	c.Check(err.(InsufficientReplicasError).Attempts, Equals, 4)
+	c.Check(err.(InsufficientReplicasError).TriedServers, DeepEquals, shuff)
+	c.Check(err, ErrorMatches, `.*; 4 attempts on 2 servers \(`+shuff[0]+`, `+shuff[1]+`\)`)
+}
+
+func (s *StandaloneSuite) TestTransportSettings(c *C) {
+	kc := &KeepClient{Arvados: &arvadosclient.ArvadosClient{}}
+	t := kc.httpClient().(*http.Client).Transport.(*http.Transport)
+	c.Check(t.MaxIdleConnsPerHost, Equals, 0)
+	c.Check(t.IdleConnTimeout, Equals, 90*time.Second)
+	c.Check(t.TLSHandshakeTimeout, Equals, DefaultTLSHandshakeTimeout)
+
+	kc = &KeepClient{
+		Arvados:             &arvadosclient.ArvadosClient{},
+		MaxIdleConnsPerHost: 50,
+		IdleConnTimeout:     time.Minute,
+		TLSHandshakeTimeout: 7 * time.Second,
+	}
+	t = kc.httpClient().(*http.Client).Transport.(*http.Transport)
+	c.Check(t.MaxIdleConnsPerHost, Equals, 50)
+	c.Check(t.IdleConnTimeout, Equals, time.Minute)
+	c.Check(t.TLSHandshakeTimeout, Equals, 7*time.Second)
+
+	// Clients with the same settings share a transport.
+	c.Check(kc.Clone().httpClient(), Equals, kc.httpClient())
+	c.Check((&KeepClient{Arvados: &arvadosclient.ArvadosClient{}}).httpClient(), Not(Equals), kc.httpClient())
+}
+
+// HeadHandler responds to HEAD requests with 200 if exists is true,
+// otherwise 404, and passes other requests to next.
+type HeadHandler struct {
+	exists bool
+	next   http.Handler
+	mtx    sync.Mutex
+	puts   int
+}
+
+func (h *HeadHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	h.mtx.Lock()
+	exists := h.exists
+	if req.Method != "HEAD" {
+		h.puts++
+	}
+	h.mtx.Unlock()
+	if req.Method != "HEAD" {
+		h.next.ServeHTTP(resp, req)
+	} else if exists {
+		resp.WriteHeader(http.StatusOK)
+	} else {
+		resp.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (h *HeadHandler) putCount() int {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return h.puts
+}
+
+func (s *StandaloneSuite) TestPutSkipExistingReplicas(c *C) {
+	hash := Md5String("foo")
+	st := &StubPutHandler{
+		c:                    c,
+		expectPath:           hash,
+		expectAPIToken:       "abc123",
+		expectBody:           "foo",
+		expectStorageClass:   "*",
+		returnStorageClasses: "",
+		handled:              make(chan string, 3),
+	}
+	handlers := []*HeadHandler{
+		{exists: true, next: st},
+		{exists: true, next: st},
+		{exists: false, next: st},
+	}
+
+	arv, err := arvadosclient.MakeArvadosClient()
+	c.Check(err, IsNil)
+	kc, _ := MakeKeepClient(arv)
+	kc.Want_replicas = 3
+	kc.SkipExistingReplicas = true
+	arv.ApiToken = "abc123"
+	localRoots := make(map[string]string)
+	writableLocalRoots := make(map[string]string)
+	for i, h := range handlers {
+		k := RunFakeKeepServer(h)
+		defer k.listener.Close()
+		localRoots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i)] = k.url
+		writableLocalRoots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i)] = k.url
+	}
+	kc.SetServiceRoots(localRoots, writableLocalRoots, nil)
+
+	c.Check(kc.ExistingReplicas(context.Background(), hash), HasLen, 2)
+
+	_, replicas, err := kc.PutB([]byte("foo"))
+	c.Check(err, IsNil)
+	c.Check(replicas, Equals, 3)
+	c.Check(handlers[0].putCount(), Equals, 0)
+	c.Check(handlers[1].putCount(), Equals, 0)
+	c.Check(handlers[2].putCount(), Equals, 1)
+
+	// If all of the desired replicas exist, one PUT request is
+	// still needed to get a signed locator. It goes to a server
+	// that already has the block.
+	handlers[2].mtx.Lock()
+	handlers[2].exists = true
+	handlers[2].mtx.Unlock()
+	_, replicas, err = kc.PutB([]byte("foo"))
+	c.Check(err, IsNil)
+	c.Check(replicas, Equals, 3)
+	c.Check(handlers[0].putCount()+handlers[1].putCount()+handlers[2].putCount(), Equals, 2)
+}
+
+func (s *StandaloneSuite) TestPutInsufficientReplicasReportsFailures(c *C) {
+	arv, err := arvadosclient.MakeArvadosClient()
+	c.Check(err, IsNil)
+	kc, _ := MakeKeepClient(arv)
+
+	kc.Want_replicas = 1
+	kc.Retries = 0
+	arv.ApiToken = "abc123"
+	localRoots := make(map[string]string)
+	writableLocalRoots := make(map[string]string)
+
+	ks1 := RunSomeFakeKeepServers(FailHandler{make(chan string, 1)}, 1)
+	ks2 := RunSomeFakeKeepServers(Error404Handler{make(chan string, 1)}, 1)
+	ks3 := RunSomeFakeKeepServers(FailHandler{make(chan string, 1)}, 1)
+	for i, k := range append(append(ks1, ks2...), ks3...) {
+		localRoots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i)] = k.url
+		writableLocalRoots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i)] = k.url
+		defer k.listener.Close()
+	}
+	// The third server is not listening, so its PUT request
+	// gets no response at all.
+	ks3[0].listener.Close()
+
+	kc.SetServiceRoots(localRoots, writableLocalRoots, nil)
+
+	_, _, err = kc.PutB([]byte("foo"))
+	c.Assert(err, FitsTypeOf, InsufficientReplicasError{})
+	failures := err.(InsufficientReplicasError).Failures
+	c.Assert(failures, HasLen, 3)
+	byServer := map[string]UploadError{}
+	for _, f := range failures {
+		byServer[f.Server] = f
+	}
+	c.Check(byServer[ks1[0].url].StatusCode, Equals, 500)
+	c.Check(byServer[ks1[0].url], ErrorMatches, `http://.*: \[500\] 500 Internal Server Error`)
+	c.Check(byServer[ks2[0].url].StatusCode, Equals, 404)
+	c.Check(byServer[ks2[0].url], ErrorMatches, `http://.*: \[404\] 404 Not Found`)
+	c.Check(byServer[ks3[0].url].StatusCode, Equals, 0)
+	c.Check(byServer[ks3[0].url], ErrorMatches, `http://.*: .*connection refused.*`)
+}
+
+func (s *StandaloneSuite) TestPutInsufficientReplicasReportsPartialWrite(c *C) {
+	hash := fmt.Sprintf("%x", md5.Sum([]byte("foo")))
+
+	st := &StubPutHandler{
+		c:                    c,
+		expectPath:           hash,
+		expectAPIToken:       "abc123",
+		expectBody:           "foo",
+		expectStorageClass:   "default",
+		returnStorageClasses: "",
+		handled:              make(chan string, 2),
+	}
+
+	fh := FailHandler{
+		make(chan string, 2)}
+
+	arv, err := arvadosclient.MakeArvadosClient()
+	c.Check(err, IsNil)
+	kc, _ := MakeKeepClient(arv)
+
+	kc.Want_replicas = 3
+	kc.Retries = 0
+	arv.ApiToken = "abc123"
+	localRoots := make(map[string]string)
+	writableLocalRoots := make(map[string]string)
+
+	ks1 := RunSomeFakeKeepServers(st, 2)
+	ks2 := RunSomeFakeKeepServers(fh, 2)
+
+	for i, k := range ks1 {
+		localRoots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i)] = k.url
+		writableLocalRoots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i)] = k.url
+		defer k.listener.Close()
+	}
+	for i, k := range ks2 {
+		localRoots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i+len(ks1))] = k.url
+		writableLocalRoots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i+len(ks1))] = k.url
+		defer k.listener.Close()
+	}
+
+	kc.SetServiceRoots(localRoots, writableLocalRoots, nil)
+
+	locator, replicas, err := kc.PutB([]byte("foo"))
+
+	c.Assert(err, FitsTypeOf, InsufficientReplicasError{})
+	c.Check(replicas, Equals, 2)
+	c.Check(err.(InsufficientReplicasError).Replicas, Equals, 2)
+	c.Check(err.(InsufficientReplicasError).Locator, Equals, locator)
+}
+
 type StubGetHandler struct {
 	c              *C
 	expectPath     string
@@ -736,6 +1437,264 @@ func (s *StandaloneSuite) TestGet(c *C) {
 	c.Check(r.Close(), IsNil)
 }
 
+func (s *StandaloneSuite) TestClose(c *C) {
+	hash := fmt.Sprintf("%x+3", md5.Sum([]byte("foo")))
+	closed := make(chan struct{}, 1)
+	srv := httptest.NewUnstartedServer(StubGetHandler{c, hash, "abc123", http.StatusOK, []byte("foo")})
+	srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			select {
+			case closed <- struct{}{}:
+			default:
+			}
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	arv, err := arvadosclient.MakeArvadosClient()
+	c.Assert(err, IsNil)
+	arv.ApiToken = "abc123"
+	kc, _ := MakeKeepClient(arv)
+	kc.HTTPClient = &http.Client{Transport: &http.Transport{}}
+	kc.SetServiceRoots(map[string]string{"x": srv.URL}, nil, nil)
+
+	r, _, _, err := kc.Get(hash)
+	c.Assert(err, IsNil)
+	_, err = ioutil.ReadAll(r)
+	c.Check(err, IsNil)
+	c.Check(r.Close(), IsNil)
+
+	// The connection stays open in the idle pool until Close.
+	select {
+	case <-closed:
+		c.Fatal("connection closed before kc.Close()")
+	case <-time.After(100 * time.Millisecond):
+	}
+	c.Check(kc.Close(), IsNil)
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		c.Error("timed out waiting for idle connection to close")
+	}
+
+	// The client is still usable after Close.
+	r, _, _, err = kc.Get(hash)
+	c.Assert(err, IsNil)
+	c.Check(r.Close(), IsNil)
+}
+
+func (s *StandaloneSuite) TestCloseDefaultClient(c *C) {
+	hash := fmt.Sprintf("%x+3", md5.Sum([]byte("foo")))
+	closed := make(chan struct{}, 1)
+	srv := httptest.NewUnstartedServer(StubGetHandler{c, hash, "abc123", http.StatusOK, []byte("foo")})
+	srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			select {
+			case closed <- struct{}{}:
+			default:
+			}
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	arv, err := arvadosclient.MakeArvadosClient()
+	c.Assert(err, IsNil)
+	arv.ApiToken = "abc123"
+	var kcs []*KeepClient
+	for i := 0; i < 2; i++ {
+		kc, _ := MakeKeepClient(arv)
+		// Use transport settings no other test uses, so
+		// these clients get a default HTTP client of their
+		// own.
+		kc.IdleConnTimeout = 17 * time.Minute
+		kc.SetServiceRoots(map[string]string{"x": srv.URL}, nil, nil)
+		r, _, _, err := kc.Get(hash)
+		c.Assert(err, IsNil)
+		_, err = ioutil.ReadAll(r)
+		c.Check(err, IsNil)
+		c.Check(r.Close(), IsNil)
+		kcs = append(kcs, kc)
+	}
+
+	// The default HTTP client is shared, so its idle
+	// connections are only closed when the last client using it
+	// is closed.
+	c.Check(kcs[0].Close(), IsNil)
+	select {
+	case <-closed:
+		c.Fatal("connection closed while another client was still using it")
+	case <-time.After(100 * time.Millisecond):
+	}
+	// Closing the same client again doesn't count twice.
+	c.Check(kcs[0].Close(), IsNil)
+	select {
+	case <-closed:
+		c.Fatal("connection closed while another client was still using it")
+	case <-time.After(100 * time.Millisecond):
+	}
+	c.Check(kcs[1].Close(), IsNil)
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		c.Error("timed out waiting for idle connection to close")
+	}
+}
+
+// SlowGetHandler does not respond to requests for slowURL until the
+// client gives up. Other requests are passed to fast.
+type SlowGetHandler struct {
+	mtx       sync.Mutex
+	slowURL   string
+	fast      http.Handler
+	cancelled chan struct{}
+}
+
+func (h *SlowGetHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	h.mtx.Lock()
+	slow := h.slowURL == "http://"+req.Host
+	h.mtx.Unlock()
+	if !slow {
+		h.fast.ServeHTTP(resp, req)
+		return
+	}
+	select {
+	case <-req.Context().Done():
+		h.cancelled <- struct{}{}
+	case <-time.After(10 * time.Second):
+		resp.WriteHeader(http.StatusServiceUnavailable)
+	}
+}
+
+func (s *StandaloneSuite) TestGetReadConcurrency(c *C) {
+	hash := fmt.Sprintf("%x+3", md5.Sum([]byte("foo")))
+
+	st := &SlowGetHandler{
+		fast: StubGetHandler{
+			c,
+			hash,
+			"abc123",
+			http.StatusOK,
+			[]byte("foo")},
+		cancelled: make(chan struct{}, 1),
+	}
+
+	ks := RunSomeFakeKeepServers(st, 2)
+	for _, k := range ks {
+		defer k.listener.Close()
+	}
+
+	arv, err := arvadosclient.MakeArvadosClient()
+	c.Check(err, IsNil)
+	kc, _ := MakeKeepClient(arv)
+	arv.ApiToken = "abc123"
+	kc.ReadConcurrency = 2
+	kc.DiskCacheSize = DiskCacheDisabled
+	kc.SetServiceRoots(map[string]string{"x": ks[0].url, "y": ks[1].url}, nil, nil)
+
+	// Make the first server in the probe sequence slow.
+	probeOrder := NewRootSorter(kc.LocalRoots(), hash).GetSortedRoots()
+	st.mtx.Lock()
+	st.slowURL = probeOrder[0]
+	st.mtx.Unlock()
+
+	t0 := time.Now()
+	r, n, _, err := kc.Get(hash)
+	c.Assert(err, IsNil)
+	c.Check(time.Since(t0) < 5*time.Second, Equals, true)
+	c.Check(n, Equals, int64(3))
+	content, err := ioutil.ReadAll(r)
+	c.Check(err, IsNil)
+	c.Check(content, DeepEquals, []byte("foo"))
+	c.Check(r.Close(), IsNil)
+
+	// The request to the slow server was cancelled.
+	select {
+	case <-st.cancelled:
+	case <-time.After(5 * time.Second):
+		c.Error("timed out waiting for slow request to be cancelled")
+	}
+}
+
+type memBlockCache struct {
+	sync.Mutex
+	data       map[string][]byte
+	gets, puts int
+}
+
+func (mc *memBlockCache) Get(hash string) ([]byte, bool) {
+	mc.Lock()
+	defer mc.Unlock()
+	mc.gets++
+	data, ok := mc.data[hash]
+	return data, ok
+}
+
+func (mc *memBlockCache) Put(hash string, data []byte) {
+	mc.Lock()
+	defer mc.Unlock()
+	mc.puts++
+	if mc.data == nil {
+		mc.data = map[string][]byte{}
+	}
+	mc.data[hash] = data
+}
+
+func (s *StandaloneSuite) TestBlockGetWithBlockCache(c *C) {
+	hash := fmt.Sprintf("%x+3", md5.Sum([]byte("foo")))
+
+	var requests int64
+	st := StubGetHandler{
+		c,
+		hash,
+		"abc123",
+		http.StatusOK,
+		[]byte("foo")}
+	ks := RunFakeKeepServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		if req.URL.Path != "/"+hash {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		st.ServeHTTP(w, req)
+	}))
+	defer ks.listener.Close()
+
+	arv, err := arvadosclient.MakeArvadosClient()
+	c.Check(err, IsNil)
+	kc, _ := MakeKeepClient(arv)
+	arv.ApiToken = "abc123"
+	kc.DiskCacheSize = DiskCacheDisabled
+	kc.SetServiceRoots(map[string]string{"x": ks.url}, nil, nil)
+
+	// Without a BlockCache, every call goes to the server.
+	for i := 0; i < 2; i++ {
+		data, err := kc.BlockGet(context.Background(), hash)
+		c.Check(err, IsNil)
+		c.Check(string(data), Equals, "foo")
+	}
+	c.Check(atomic.LoadInt64(&requests), Equals, int64(2))
+
+	// Miss populates the cache, then hits are served from it.
+	cache := &memBlockCache{}
+	kc.BlockCache = cache
+	for i := 0; i < 3; i++ {
+		data, err := kc.BlockGet(context.Background(), hash)
+		c.Check(err, IsNil)
+		c.Check(string(data), Equals, "foo")
+	}
+	c.Check(atomic.LoadInt64(&requests), Equals, int64(3))
+	c.Check(cache.gets, Equals, 3)
+	c.Check(cache.puts, Equals, 1)
+	c.Check(string(cache.data[hash[:32]]), Equals, "foo")
+
+	// Errors are not cached.
+	_, err = kc.BlockGet(context.Background(), fmt.Sprintf("%x+3", md5.Sum([]byte("bar"))))
+	c.Check(err, NotNil)
+	c.Check(cache.puts, Equals, 1)
+}
+
 func (s *StandaloneSuite) TestGet404(c *C) {
 	hash := fmt.Sprintf("%x+3", md5.Sum([]byte("foo")))
 
@@ -1197,6 +2156,50 @@ func (s *StandaloneSuite) TestPutProxy(c *C) {
 	c.Check(replicas, Equals, 2)
 }
 
+type StubProxyNoReplicasHeaderHandler struct {
+	handled chan string
+}
+
+func (h StubProxyNoReplicasHeaderHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	h.handled <- fmt.Sprintf("http://%s", req.Host)
+}
+
+func (s *StandaloneSuite) TestPutProxyNoReplicasHeader(c *C) {
+	st := StubProxyNoReplicasHeaderHandler{make(chan string, 5)}
+
+	var logbuf bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &logbuf
+
+	arv, err := arvadosclient.MakeArvadosClient()
+	c.Check(err, IsNil)
+	kc, _ := MakeKeepClient(arv)
+
+	kc.Logger = logger
+	kc.Want_replicas = 2
+	kc.Retries = 0
+	arv.ApiToken = "abc123"
+	localRoots := make(map[string]string)
+	writableLocalRoots := make(map[string]string)
+
+	ks1 := RunSomeFakeKeepServers(st, 1)
+
+	for i, k := range ks1 {
+		localRoots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i)] = k.url
+		writableLocalRoots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i)] = k.url
+		defer k.listener.Close()
+	}
+
+	kc.SetServiceRoots(localRoots, writableLocalRoots, nil)
+
+	_, replicas, err := kc.PutB([]byte("foo"))
+	<-st.handled
+
+	c.Check(err, FitsTypeOf, InsufficientReplicasError{})
+	c.Check(replicas, Equals, 1)
+	c.Check(logbuf.String(), Matches, `(?ms).*level=warning .* did not include X-Keep-Replicas-Stored header, assuming 1 replica stored.*`)
+}
+
 func (s *StandaloneSuite) TestPutProxyInsufficientReplicas(c *C) {
 	st := StubProxyHandler{make(chan string, 1)}
 
@@ -61,3 +61,26 @@ func (*RootSorterSuite) ReferenceSet(c *C) {
 		}
 	}
 }
+
+func (*RootSorterSuite) TestProbeSequence(c *C) {
+	fakeroots := FakeServiceRoots(16)
+	kc := &KeepClient{}
+	kc.SetServiceRoots(fakeroots, fakeroots, nil)
+	for h := 0; h < 8; h++ {
+		hash := Md5String(fmt.Sprintf("%064x", h))
+		seq, err := kc.ProbeSequence(hash)
+		c.Assert(err, IsNil)
+		c.Check(seq, DeepEquals, NewRootSorter(fakeroots, hash).GetSortedRoots())
+		c.Check(seq, DeepEquals, kc.getSortedRoots(hash+"+3"))
+		c.Check(seq, HasLen, 16)
+	}
+
+	seq, err := kc.ProbeSequence("acbd18db")
+	c.Check(err, IsNil)
+	c.Check(seq, DeepEquals, NewRootSorter(fakeroots, "acbd18db").GetSortedRoots())
+
+	for _, bad := range []string{"", "acbd18d", "ACBD18DB4CC2F85CEDEF654FCCC4A4D8", "acbd18db4cc2f85cedef654fccc4a4d8+3", "acbd18dbxyz"} {
+		_, err := kc.ProbeSequence(bad)
+		c.Check(err, ErrorMatches, `invalid block hash .*`, Commentf("%q", bad))
+	}
+}
@@ -15,12 +15,15 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
 	"git.arvados.org/arvados.git/sdk/go/asyncbuf"
+	"github.com/sirupsen/logrus"
 )
 
 // DebugPrintf emits debug messages. The easiest way to enable
@@ -28,12 +31,29 @@ import (
 // log.Printf to DebugPrintf.
 var DebugPrintf = func(string, ...interface{}) {}
 
+// defaultLogger is used when KeepClient.Logger is nil.
+var defaultLogger logrus.FieldLogger = func() *logrus.Logger {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	return logger
+}()
+
 func init() {
 	if arvadosclient.StringBool(os.Getenv("ARVADOS_DEBUG")) {
 		DebugPrintf = log.Printf
+		logger := logrus.New()
+		logger.Level = logrus.DebugLevel
+		defaultLogger = logger
 	}
 }
 
+func (kc *KeepClient) logger() logrus.FieldLogger {
+	if kc.Logger == nil {
+		return defaultLogger
+	}
+	return kc.Logger
+}
+
 type keepService struct {
 	Uuid     string `json:"uuid"`
 	Hostname string `json:"service_host"`
@@ -61,14 +81,14 @@ type uploadStatus struct {
 	response       string
 }
 
-func (kc *KeepClient) uploadToKeepServer(host string, hash string, classesTodo []string, body io.Reader,
+func (kc *KeepClient) uploadToKeepServer(ctx context.Context, host string, hash string, classesTodo []string, body io.Reader,
 	uploadStatusChan chan<- uploadStatus, expectedLength int, reqid string) {
 
 	var req *http.Request
 	var err error
 	var url = fmt.Sprintf("%s/%s", host, hash)
-	if req, err = http.NewRequest("PUT", url, nil); err != nil {
-		DebugPrintf("DEBUG: [%s] Error creating request PUT %v error: %v", reqid, url, err.Error())
+	if req, err = http.NewRequestWithContext(ctx, "PUT", url, nil); err != nil {
+		kc.logger().Debugf("[%s] Error creating request PUT %v error: %v", reqid, url, err.Error())
 		uploadStatusChan <- uploadStatus{err, url, 0, 0, nil, ""}
 		return
 	}
@@ -83,7 +103,7 @@ func (kc *KeepClient) uploadToKeepServer(host string, hash string, classesTodo [
 	}
 
 	req.Header.Add("X-Request-Id", reqid)
-	req.Header.Add("Authorization", "OAuth2 "+kc.Arvados.ApiToken)
+	req.Header.Add("Authorization", "OAuth2 "+kc.apiToken())
 	req.Header.Add("Content-Type", "application/octet-stream")
 	req.Header.Add(XKeepDesiredReplicas, fmt.Sprint(kc.Want_replicas))
 	if len(classesTodo) > 0 {
@@ -92,7 +112,7 @@ func (kc *KeepClient) uploadToKeepServer(host string, hash string, classesTodo [
 
 	var resp *http.Response
 	if resp, err = kc.httpClient().Do(req); err != nil {
-		DebugPrintf("DEBUG: [%s] Upload failed %v error: %v", reqid, url, err.Error())
+		kc.logger().Debugf("[%s] Upload failed %v error: %v", reqid, url, err.Error())
 		uploadStatusChan <- uploadStatus{err, url, 0, 0, nil, err.Error()}
 		return
 	}
@@ -100,11 +120,17 @@ func (kc *KeepClient) uploadToKeepServer(host string, hash string, classesTodo [
 	rep := 1
 	if xr := resp.Header.Get(XKeepReplicasStored); xr != "" {
 		fmt.Sscanf(xr, "%d", &rep)
+	} else if resp.StatusCode == http.StatusOK {
+		// Keepstore always sends this header, so the server
+		// is probably a proxy that drops it. Count one
+		// replica, which may cause us to write more replicas
+		// than necessary, rather than too few.
+		kc.logger().Warnf("[%s] response from %s did not include %s header, assuming 1 replica stored (is there a misconfigured proxy?)", reqid, host, XKeepReplicasStored)
 	}
 	scc := resp.Header.Get(XKeepStorageClassesConfirmed)
 	classesStored, err := parseStorageClassesConfirmedHeader(scc)
 	if err != nil {
-		DebugPrintf("DEBUG: [%s] Ignoring invalid %s header %q: %s", reqid, XKeepStorageClassesConfirmed, scc, err)
+		kc.logger().Debugf("[%s] Ignoring invalid %s header %q: %s", reqid, XKeepStorageClassesConfirmed, scc, err)
 	}
 
 	defer resp.Body.Close()
@@ -113,20 +139,72 @@ func (kc *KeepClient) uploadToKeepServer(host string, hash string, classesTodo [
 	respbody, err2 := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: 4096})
 	response := strings.TrimSpace(string(respbody))
 	if err2 != nil && err2 != io.EOF {
-		DebugPrintf("DEBUG: [%s] Upload %v error: %v response: %v", reqid, url, err2.Error(), response)
+		kc.logger().Debugf("[%s] Upload %v error: %v response: %v", reqid, url, err2.Error(), response)
 		uploadStatusChan <- uploadStatus{err2, url, resp.StatusCode, rep, classesStored, response}
 	} else if resp.StatusCode == http.StatusOK {
-		DebugPrintf("DEBUG: [%s] Upload %v success", reqid, url)
+		kc.logger().Debugf("[%s] Upload %v success", reqid, url)
 		uploadStatusChan <- uploadStatus{nil, url, resp.StatusCode, rep, classesStored, response}
 	} else {
 		if resp.StatusCode >= 300 && response == "" {
 			response = resp.Status
 		}
-		DebugPrintf("DEBUG: [%s] Upload %v error: %v response: %v", reqid, url, resp.StatusCode, response)
+		kc.logger().Debugf("[%s] Upload %v error: %v response: %v", reqid, url, resp.StatusCode, response)
 		uploadStatusChan <- uploadStatus{errors.New(resp.Status), url, resp.StatusCode, rep, classesStored, response}
 	}
 }
 
+// ExistingReplicas sends a HEAD request for the given block hash to
+// each writable server, and returns the servers that report having
+// it, in the order they would be tried when writing the block.
+//
+// Each server that has the block is counted as one replica, even if
+// it stores more. A server that returns an error (e.g., because it
+// requires a signed locator, or does not have the block) is assumed
+// not to have it.
+//
+// If any of the Keep services are proxies, a HEAD request does not
+// reveal how many replicas the service holds, so ExistingReplicas
+// returns nil without sending any requests.
+func (kc *KeepClient) ExistingReplicas(ctx context.Context, hash string) []string {
+	return kc.existingReplicas(ctx, hash, NewRootSorter(kc.WritableLocalRoots(), hash).GetSortedRoots(), kc.getRequestID())
+}
+
+func (kc *KeepClient) existingReplicas(ctx context.Context, hash string, roots []string, reqid string) []string {
+	if kc.foundNonDiskSvc {
+		return nil
+	}
+	found := make([]bool, len(roots))
+	var wg sync.WaitGroup
+	for i, root := range roots {
+		i, root := i, root
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequestWithContext(ctx, "HEAD", root+"/"+hash, nil)
+			if err != nil {
+				return
+			}
+			req.Header.Add("X-Request-Id", reqid)
+			req.Header.Add("Authorization", "OAuth2 "+kc.apiToken())
+			resp, err := kc.httpClient().Do(req)
+			if err != nil {
+				kc.logger().Debugf("[%s] HEAD %s/%s failed: %s", reqid, root, hash, err)
+				return
+			}
+			resp.Body.Close()
+			found[i] = resp.StatusCode == http.StatusOK
+		}()
+	}
+	wg.Wait()
+	var existing []string
+	for i, root := range roots {
+		if found[i] {
+			existing = append(existing, root)
+		}
+	}
+	return existing
+}
+
 func (kc *KeepClient) httpBlockWrite(ctx context.Context, req arvados.BlockWriteOptions) (arvados.BlockWriteResponse, error) {
 	var resp arvados.BlockWriteResponse
 	var getReader func() io.Reader
@@ -183,6 +261,8 @@ func (kc *KeepClient) httpBlockWrite(ctx context.Context, req arvados.BlockWrite
 	if req.Attempts == 0 {
 		req.Attempts = 1 + kc.Retries
 	}
+	backoff := kc.backoff()
+	req.Attempts = backoff.Attempts(req.Attempts)
 
 	// Calculate the ordering for uploading to servers
 	sv := NewRootSorter(kc.WritableLocalRoots(), req.Hash).GetSortedRoots()
@@ -222,9 +302,36 @@ func (kc *KeepClient) httpBlockWrite(ctx context.Context, req arvados.BlockWrite
 	var retryServers []string
 
 	lastError := make(map[string]string)
+	var failures []UploadError
+	// Servers we have sent PUT requests to, in the order of the
+	// first attempt, and the total number of PUT requests.
+	var triedServers []string
+	tried := make(map[string]bool)
+	attempts := 0
 	trackingClasses := len(replicasTodo) > 0
+	satisfied := false
+
+	if kc.SkipExistingReplicas {
+		sv, resp.Replicas = kc.skipExistingReplicas(ctx, req, sv)
+		if resp.Replicas > 0 {
+			// HEAD responses don't report storage
+			// classes, so we can't tell which classes
+			// the existing replicas satisfy. Rely on the
+			// total number of replicas, as we do when a
+			// server doesn't report storage classes.
+			trackingClasses = false
+		}
+	}
 
-	for retriesRemaining > 0 {
+	for retriesRemaining > 0 && !satisfied {
+		if retriesRemaining < req.Attempts && len(sv) > 0 {
+			// Wait before retrying the servers that
+			// failed in the previous round.
+			err := backoff.Sleep(ctx, req.Attempts-retriesRemaining-1)
+			if err != nil {
+				return resp, err
+			}
+		}
 		retriesRemaining--
 		nextServer = 0
 		retryServers = []string{}
@@ -247,35 +354,69 @@ func (kc *KeepClient) httpBlockWrite(ctx context.Context, req arvados.BlockWrite
 			if maxConcurrency < 1 {
 				// If there are no non-zero entries in
 				// replicasTodo, we're done.
+				satisfied = true
 				break
 			}
+			if kc.MaxConcurrentUploads > 0 && maxConcurrency > kc.MaxConcurrentUploads*replicasPerThread {
+				// Start the remaining uploads in
+				// waves, as earlier ones finish.
+				maxConcurrency = kc.MaxConcurrentUploads * replicasPerThread
+			}
 			for active*replicasPerThread < maxConcurrency {
 				// Start some upload requests
 				if nextServer < len(sv) {
-					DebugPrintf("DEBUG: [%s] Begin upload %s to %s", req.RequestID, req.Hash, sv[nextServer])
-					go kc.uploadToKeepServer(sv[nextServer], req.Hash, classesTodo, getReader(), uploadStatusChan, req.DataSize, req.RequestID)
+					kc.logger().Debugf("[%s] Begin upload %s to %s", req.RequestID, req.Hash, sv[nextServer])
+					go kc.uploadToKeepServer(ctx, sv[nextServer], req.Hash, classesTodo, getReader(), uploadStatusChan, req.DataSize, req.RequestID)
+					if !tried[sv[nextServer]] {
+						tried[sv[nextServer]] = true
+						triedServers = append(triedServers, sv[nextServer])
+					}
+					attempts++
 					nextServer++
 					active++
 				} else {
 					if active == 0 && retriesRemaining == 0 {
-						msg := "Could not write sufficient replicas: "
+						var msgs []string
 						for _, resp := range lastError {
-							msg += resp + "; "
+							msgs = append(msgs, resp)
+						}
+						if trackingClasses && len(replicasTodo) > 0 {
+							var todo []string
+							for sc, r := range replicasTodo {
+								todo = append(todo, fmt.Sprintf("%s=%d", sc, r))
+							}
+							sort.Strings(todo)
+							msgs = append(msgs, "replicas still needed in storage classes "+strings.Join(todo, ", "))
+						}
+						msgs = append(msgs, fmt.Sprintf("%d attempts on %d servers (%s)", attempts, len(triedServers), strings.Join(triedServers, ", ")))
+						msg := "Could not write sufficient replicas: " + strings.Join(msgs, "; ")
+						return resp, InsufficientReplicasError{
+							error:        errors.New(msg),
+							Replicas:     resp.Replicas,
+							Locator:      resp.Locator,
+							Attempts:     attempts,
+							TriedServers: triedServers,
+							Failures:     failures,
 						}
-						msg = msg[:len(msg)-2]
-						return resp, InsufficientReplicasError{error: errors.New(msg)}
 					}
 					break
 				}
 			}
 
-			DebugPrintf("DEBUG: [%s] Replicas remaining to write: %v active uploads: %v", req.RequestID, replicasTodo, active)
+			kc.logger().Debugf("[%s] Replicas remaining to write: %v active uploads: %v", req.RequestID, replicasTodo, active)
 			if active < 1 {
 				break
 			}
 
 			// Wait for something to happen.
-			status := <-uploadStatusChan
+			var status uploadStatus
+			select {
+			case status = <-uploadStatusChan:
+			case <-ctx.Done():
+				// The deferred func above will wait
+				// for the cancelled uploads to finish.
+				return resp, fmt.Errorf("error writing block %s: %w", req.Hash, ctx.Err())
+			}
 			active--
 
 			if status.statusCode == http.StatusOK {
@@ -297,12 +438,24 @@ func (kc *KeepClient) httpBlockWrite(ctx context.Context, req arvados.BlockWrite
 					}
 				}
 				resp.Locator = status.response
+				if req.OnReplicaStored != nil {
+					req.OnReplicaStored(strings.TrimSuffix(status.url, "/"+req.Hash), resp.Replicas)
+				}
 			} else {
 				msg := fmt.Sprintf("[%d] %s", status.statusCode, status.response)
 				if len(msg) > 100 {
 					msg = msg[:100]
 				}
 				lastError[status.url] = msg
+				failure := UploadError{
+					Server:     strings.TrimSuffix(status.url, "/"+req.Hash),
+					StatusCode: status.statusCode,
+					Err:        status.err,
+				}
+				if status.statusCode != 0 && status.response != "" {
+					failure.Err = errors.New(status.response)
+				}
+				failures = append(failures, failure)
 			}
 
 			if status.statusCode == 0 || status.statusCode == 408 || status.statusCode == 429 ||
@@ -319,6 +472,36 @@ func (kc *KeepClient) httpBlockWrite(ctx context.Context, req arvados.BlockWrite
 	return resp, nil
 }
 
+// skipExistingReplicas removes servers that already have the block
+// from sv, and returns the remaining servers along with the number
+// of replicas to count as already stored.
+//
+// If the existing replicas are enough, the first server that has
+// the block is kept: the caller still needs to send one PUT request
+// to get a signed locator, and a server that already has the block
+// doesn't need to store it again.
+func (kc *KeepClient) skipExistingReplicas(ctx context.Context, req arvados.BlockWriteOptions, sv []string) ([]string, int) {
+	existing := kc.existingReplicas(ctx, req.Hash, sv, req.RequestID)
+	if len(existing) == 0 {
+		return sv, 0
+	}
+	kc.logger().Debugf("[%s] %d servers already have %s: %v", req.RequestID, len(existing), req.Hash, existing)
+	has := make(map[string]bool, len(existing))
+	for _, root := range existing {
+		has[root] = true
+	}
+	var todo []string
+	for _, root := range sv {
+		if !has[root] {
+			todo = append(todo, root)
+		}
+	}
+	if len(existing) >= req.Replicas {
+		return append([]string{existing[0]}, todo...), req.Replicas - 1
+	}
+	return todo, len(existing)
+}
+
 func parseStorageClassesConfirmedHeader(hdr string) (map[string]int, error) {
 	if hdr == "" {
 		return nil, nil
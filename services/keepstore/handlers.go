@@ -94,6 +94,7 @@ func MakeRESTRouter(ctx context.Context, cluster *arvados.Cluster, reg *promethe
 	rtr.Handle("/_health/{check}", &health.Handler{
 		Token:  cluster.ManagementToken,
 		Prefix: "/_health/",
+		Routes: health.Routes{"volumes": rtr.checkVolumesHealth},
 	}).Methods("GET")
 
 	// Any request which does not match any of these routes gets
@@ -376,6 +377,24 @@ func (rtr *router) DebugHandler(resp http.ResponseWriter, req *http.Request) {
 	resp.Write(data)
 }
 
+// checkVolumesHealth is the health check for "/_health/volumes"
+// requests. It fails if any volume that supports health checks
+// reports that its backend is unreachable.
+func (rtr *router) checkVolumesHealth() error {
+	var errs []string
+	for _, mnt := range rtr.volmgr.Mounts() {
+		if hc, ok := mnt.Volume.(healthChecker); ok {
+			if h := hc.Health(); h.LastError != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s", mnt.UUID, h.LastError))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d volume(s) unhealthy: %s", len(errs), strings.Join(errs, "; "))
+	}
+	return nil
+}
+
 // StatusHandler addresses /status.json requests.
 func (rtr *router) StatusHandler(resp http.ResponseWriter, req *http.Request) {
 	stLock.Lock()
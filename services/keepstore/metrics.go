@@ -69,6 +69,7 @@ type volumeMetricsVecs struct {
 	ioBytes     *prometheus.CounterVec
 	errCounters *prometheus.CounterVec
 	opsCounters *prometheus.CounterVec
+	opsLatency  *prometheus.HistogramVec
 }
 
 func newVolumeMetricsVecs(reg *prometheus.Registry) *volumeMetricsVecs {
@@ -103,6 +104,17 @@ func newVolumeMetricsVecs(reg *prometheus.Registry) *volumeMetricsVecs {
 		[]string{"device_id", "direction"},
 	)
 	reg.MustRegister(m.ioBytes)
+	m.opsLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "volume_operation_seconds",
+			Help:      "Volume operation latency in seconds",
+			Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+		},
+		[]string{"device_id", "operation"},
+	)
+	reg.MustRegister(m.opsLatency)
 
 	return m
 }
@@ -113,3 +125,7 @@ func (vm *volumeMetricsVecs) getCounterVecsFor(lbls prometheus.Labels) (opsCV, e
 	ioCV = vm.ioBytes.MustCurryWith(lbls)
 	return
 }
+
+func (vm *volumeMetricsVecs) getLatencyVecFor(lbls prometheus.Labels) prometheus.ObserverVec {
+	return vm.opsLatency.MustCurryWith(lbls)
+}
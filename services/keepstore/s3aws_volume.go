@@ -7,12 +7,23 @@ package keepstore
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
 	"os"
 	"regexp"
 	"strings"
@@ -29,6 +40,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws/endpoints"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 )
@@ -48,6 +60,81 @@ var (
 	ErrS3TrashDisabled = fmt.Errorf("trash function is disabled because Collections.BlobTrashLifetime=0 and DriverParameters.UnsafeDelete=false")
 )
 
+// s3ChecksumAlgorithms maps the supported ChecksumAlgorithm values
+// to the corresponding x-amz-checksum-* header and hash function.
+var s3ChecksumAlgorithms = map[string]struct {
+	header  string
+	newHash func() hash.Hash
+}{
+	"CRC32":  {"X-Amz-Checksum-Crc32", func() hash.Hash { return crc32.NewIEEE() }},
+	"CRC32C": {"X-Amz-Checksum-Crc32c", func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) }},
+	"SHA1":   {"X-Amz-Checksum-Sha1", sha1.New},
+	"SHA256": {"X-Amz-Checksum-Sha256", sha256.New},
+}
+
+// s3CannedACLs lists the supported ACL values.
+var s3CannedACLs = map[string]bool{
+	"private":                   true,
+	"public-read":               true,
+	"public-read-write":         true,
+	"authenticated-read":        true,
+	"aws-exec-read":             true,
+	"bucket-owner-read":         true,
+	"bucket-owner-full-control": true,
+}
+
+// s3TrashedTag is the tag added to trashed objects when Tags is
+// configured, so S3 lifecycle rules can distinguish them.
+const s3TrashedTag = "arvados-trashed"
+
+// s3StorageClasses lists the supported StorageClass values. Archive
+// classes (GLACIER, DEEP_ARCHIVE) are omitted because objects
+// stored in them can't be read without being restored first.
+var s3StorageClasses = map[string]bool{
+	"STANDARD":            true,
+	"REDUCED_REDUNDANCY":  true,
+	"STANDARD_IA":         true,
+	"ONEZONE_IA":          true,
+	"INTELLIGENT_TIERING": true,
+}
+
+// S3CredentialsExpiredError is returned when an S3 request fails
+// because the volume's credentials have expired, even after
+// retrieving new credentials and retrying.
+type S3CredentialsExpiredError struct{ error }
+
+func (err S3CredentialsExpiredError) Error() string {
+	return "S3 credentials expired: " + err.error.Error()
+}
+
+// S3RequestTimeoutError is returned when an S3 request does not
+// complete within the volume's RequestTimeout. Unlike
+// context.Canceled, it indicates a problem with the S3 endpoint
+// rather than the caller giving up.
+type S3RequestTimeoutError struct {
+	Timeout time.Duration
+}
+
+func (err S3RequestTimeoutError) Error() string {
+	return fmt.Sprintf("S3 request did not complete within RequestTimeout (%s)", err.Timeout)
+}
+
+func (err S3CredentialsExpiredError) Unwrap() error {
+	return err.error
+}
+
+// s3ChecksumError is returned by Get when the data received from S3
+// does not match the checksum reported by the server.
+type s3ChecksumError struct {
+	algorithm string
+	expect    string
+	got       string
+}
+
+func (err s3ChecksumError) Error() string {
+	return fmt.Sprintf("%s checksum mismatch: server reported %s, received data has %s", err.algorithm, err.expect, err.got)
+}
+
 // S3AWSVolume implements Volume using an S3 bucket.
 type S3AWSVolume struct {
 	arvados.S3VolumeDriverParameters
@@ -61,16 +148,40 @@ type S3AWSVolume struct {
 	bucket    *s3AWSbucket
 	region    string
 	startOnce sync.Once
+
+	// stsEndpoint, if set, overrides the STS endpoint used to
+	// retrieve web identity credentials (for testing).
+	stsEndpoint string
+
+	// checksumUnsupported is set (to 1) if the endpoint rejects
+	// x-amz-checksum-* headers, in which case ChecksumAlgorithm
+	// is ignored from then on.
+	checksumUnsupported int32
+
+	healthMtx sync.Mutex
+	health    VolumeHealth
 }
 
 // s3bucket wraps s3.bucket and counts I/O and API usage stats. The
 // wrapped bucket can be replaced atomically with SetBucket in order
 // to update credentials.
 type s3AWSbucket struct {
-	bucket string
-	svc    *s3.Client
-	stats  s3awsbucketStats
-	mu     sync.Mutex
+	bucket         string
+	prefix         string
+	requestTimeout time.Duration
+	svc            *s3.Client
+	stats          s3awsbucketStats
+	mu             sync.Mutex
+
+	// readSvc is used for requests that only read data (see
+	// ReadEndpoint). It is the same as svc if ReadEndpoint is
+	// empty.
+	readSvc *s3.Client
+
+	// credentials providers (including the chain provider
+	// itself) whose cached credentials should be discarded
+	// when the server says they have expired
+	creds []aws.CredentialsProvider
 }
 
 const (
@@ -79,6 +190,20 @@ const (
 	WriteConcurrency = 5
 )
 
+// Backoff parameters for retrying throttled requests (see
+// MaxRetries). These are variables so tests can make them shorter.
+var (
+	s3RetryBaseDelay = 100 * time.Millisecond
+	s3RetryMaxDelay  = 10 * time.Second
+)
+
+// Health check parameters (see Health). These are variables so
+// tests can make them shorter.
+var (
+	s3HealthCheckInterval = 30 * time.Second
+	s3HealthCheckTimeout  = 10 * time.Second
+)
+
 var s3AWSKeepBlockRegexp = regexp.MustCompile(`^[0-9a-f]{32}$`)
 var s3AWSZeroTime time.Time
 
@@ -100,6 +225,81 @@ func (v *S3AWSVolume) key(loc string) string {
 	}
 }
 
+// objectKey returns the S3 object key for the given key, i.e., the
+// key with the volume's Prefix (if any) prepended.
+func (b *s3AWSbucket) objectKey(key string) string {
+	return b.prefix + key
+}
+
+// objectTagging returns the tag set, in the URL query format used by
+// S3, for a data object or (if trashed is true) a trash object.
+func (v *S3AWSVolume) objectTagging(trashed bool) string {
+	tags := url.Values{}
+	for k, val := range v.Tags {
+		tags.Set(k, val)
+	}
+	if trashed {
+		tags.Set(s3TrashedTag, "true")
+	}
+	return tags.Encode()
+}
+
+// withTimeout returns a context for a single S3 request. If
+// RequestTimeout is configured, the returned context is cancelled
+// when the timeout expires, as well as when ctx is done.
+func (b *s3AWSbucket) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if b.requestTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, b.requestTimeout)
+}
+
+// timeoutError returns an S3RequestTimeoutError if err resulted from
+// reqctx (obtained from withTimeout(ctx)) reaching its deadline
+// while ctx is still live. Otherwise it returns err.
+func (b *s3AWSbucket) timeoutError(ctx, reqctx context.Context, err error) error {
+	if err != nil && ctx.Err() == nil && reqctx.Err() == context.DeadlineExceeded {
+		return S3RequestTimeoutError{Timeout: b.requestTimeout}
+	}
+	return err
+}
+
+// checkLocator returns an error if loc cannot safely be used to
+// derive an S3 object key. A "/" in a locator would be interpreted
+// as a pseudo-directory separator by S3 clients, and could collide
+// with the trash/recent prefixes.
+func (v *S3AWSVolume) checkLocator(loc string) error {
+	if loc == "" || strings.Contains(loc, "/") {
+		return &KeepError{400, fmt.Sprintf("invalid locator %q", loc)}
+	}
+	return nil
+}
+
+// isDataKeyPrefix returns true if some data block key (see key())
+// starts with the given prefix.
+func (v *S3AWSVolume) isDataKeyPrefix(prefix string) bool {
+	ishex := func(s string) bool {
+		for _, c := range s {
+			if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+				return false
+			}
+		}
+		return true
+	}
+	n := v.PrefixLength
+	if n == 0 || len(prefix) <= n {
+		return len(prefix) <= 32 && ishex(prefix)
+	}
+	rest := prefix[n+1:]
+	if prefix[n] != '/' || !ishex(prefix[:n]) || len(rest) > 32 || !ishex(rest) {
+		return false
+	}
+	if len(rest) > n {
+		rest = rest[:n]
+	}
+	return rest == prefix[:len(rest)]
+}
+
 func newS3AWSVolume(cluster *arvados.Cluster, volume arvados.Volume, logger logrus.FieldLogger, metrics *volumeMetricsVecs) (Volume, error) {
 	v := &S3AWSVolume{cluster: cluster, volume: volume, metrics: metrics}
 	err := json.Unmarshal(volume.DriverParameters, v)
@@ -133,18 +333,45 @@ func (v *S3AWSVolume) safeCopy(dst, src string) error {
 	input := &s3.CopyObjectInput{
 		Bucket:      aws.String(v.bucket.bucket),
 		ContentType: aws.String("application/octet-stream"),
-		CopySource:  aws.String(v.bucket.bucket + "/" + src),
-		Key:         aws.String(dst),
+		CopySource:  aws.String(v.bucket.bucket + "/" + v.bucket.objectKey(src)),
+		Key:         aws.String(v.bucket.objectKey(dst)),
 	}
-
-	req := v.bucket.svc.CopyObjectRequest(input)
-	resp, err := req.Send(context.Background())
+	if v.ACL != "" {
+		input.ACL = s3.ObjectCannedACL(v.ACL)
+	}
+	if v.StorageClass != "" {
+		// Without this, S3 would reset the copy's storage
+		// class to STANDARD.
+		input.StorageClass = s3.StorageClass(v.StorageClass)
+	}
+	if v.SSEType != "" {
+		input.ServerSideEncryption = s3.ServerSideEncryption(v.SSEType)
+		if v.SSEKMSKeyID != "" {
+			input.SSEKMSKeyId = aws.String(v.SSEKMSKeyID)
+		}
+	}
+	if len(v.Tags) > 0 {
+		// Replace the source object's tags, so the
+		// trashed tag is added when trashing and removed
+		// when untrashing.
+		input.TaggingDirective = s3.TaggingDirectiveReplace
+		input.Tagging = aws.String(v.objectTagging(strings.HasPrefix(dst, v.TrashPrefix)))
+	}
+
+	var resp *s3.CopyObjectResponse
+	err := v.retryThrottled(context.Background(), func() error {
+		reqctx, cancel := v.bucket.withTimeout(context.Background())
+		defer cancel()
+		var err error
+		resp, err = v.bucket.svc.CopyObjectRequest(input).Send(reqctx)
+		return v.bucket.timeoutError(context.Background(), reqctx, err)
+	})
 
 	err = v.translateError(err)
 	if os.IsNotExist(err) {
 		return err
 	} else if err != nil {
-		return fmt.Errorf("PutCopy(%q ← %q): %s", dst, v.bucket.bucket+"/"+src, err)
+		return fmt.Errorf("PutCopy(%q ← %q): %s", v.bucket.objectKey(dst), v.bucket.bucket+"/"+v.bucket.objectKey(src), err)
 	}
 
 	if resp.CopyObjectResult.LastModified == nil {
@@ -162,6 +389,30 @@ func (v *S3AWSVolume) check(ec2metadataHostname string) error {
 	if v.IndexPageSize == 0 {
 		v.IndexPageSize = 1000
 	}
+	if v.UploadPartSize == 0 {
+		v.UploadPartSize = PartSize
+	} else if v.UploadPartSize < PartSize {
+		return fmt.Errorf("DriverParameters: UploadPartSize %d is too small: S3 requires parts of at least %d bytes (5 MiB)", v.UploadPartSize, PartSize)
+	}
+	if v.RequestTimeout < 0 {
+		return errors.New("DriverParameters: RequestTimeout must not be negative")
+	}
+	if v.MaxRetries < 0 {
+		return errors.New("DriverParameters: MaxRetries must not be negative")
+	}
+	if v.IndexWorkers < 0 {
+		return errors.New("DriverParameters: IndexWorkers must not be negative")
+	}
+	if v.TrashPageSize == 0 {
+		v.TrashPageSize = v.IndexPageSize
+	} else if v.TrashPageSize < 0 {
+		return errors.New("DriverParameters: TrashPageSize must not be negative")
+	}
+	if v.UploadConcurrency == 0 {
+		v.UploadConcurrency = WriteConcurrency
+	} else if v.UploadConcurrency < 0 {
+		return errors.New("DriverParameters: UploadConcurrency must not be negative")
+	}
 	if v.RaceWindow < 0 {
 		return errors.New("DriverParameters: RaceWindow must not be negative")
 	}
@@ -170,28 +421,90 @@ func (v *S3AWSVolume) check(ec2metadataHostname string) error {
 		return errors.New("DriverParameters: V2Signature is not supported")
 	}
 
+	if v.Prefix != "" && (!strings.HasSuffix(v.Prefix, "/") || strings.HasPrefix(v.Prefix, "/")) {
+		return fmt.Errorf("DriverParameters: Prefix %q must end with \"/\" and must not start with \"/\"", v.Prefix)
+	}
+	if v.TrashPrefix == "" {
+		v.TrashPrefix = "trash/"
+	}
+	if v.RecentPrefix == "" {
+		v.RecentPrefix = "recent/"
+	}
+	if strings.HasPrefix(v.TrashPrefix, v.RecentPrefix) || strings.HasPrefix(v.RecentPrefix, v.TrashPrefix) {
+		return fmt.Errorf("DriverParameters: TrashPrefix %q and RecentPrefix %q must not overlap", v.TrashPrefix, v.RecentPrefix)
+	}
+	for _, prefix := range []string{v.TrashPrefix, v.RecentPrefix} {
+		if v.isDataKeyPrefix(prefix) {
+			return fmt.Errorf("DriverParameters: prefix %q overlaps data block keys (PrefixLength=%d)", prefix, v.PrefixLength)
+		}
+	}
+
+	v.ChecksumAlgorithm = strings.ToUpper(v.ChecksumAlgorithm)
+	if _, ok := s3ChecksumAlgorithms[v.ChecksumAlgorithm]; v.ChecksumAlgorithm != "" && !ok {
+		return fmt.Errorf("DriverParameters: unsupported ChecksumAlgorithm %q", v.ChecksumAlgorithm)
+	}
+	if v.ACL != "" && !s3CannedACLs[v.ACL] {
+		return fmt.Errorf("DriverParameters: unsupported ACL %q", v.ACL)
+	}
+	v.StorageClass = strings.ToUpper(v.StorageClass)
+	if v.StorageClass != "" && !s3StorageClasses[v.StorageClass] {
+		return fmt.Errorf("DriverParameters: unsupported StorageClass %q", v.StorageClass)
+	}
+	if len(v.Tags) > 9 {
+		return fmt.Errorf("DriverParameters: too many Tags (%d): S3 allows 10 tags per object, and one is reserved for %q", len(v.Tags), s3TrashedTag)
+	}
+	for k, val := range v.Tags {
+		if k == "" || len(k) > 128 || len(val) > 256 {
+			return fmt.Errorf("DriverParameters: invalid tag %q=%q: key must be 1-128 characters and value must be at most 256 characters", k, val)
+		} else if strings.HasPrefix(k, "aws:") || k == s3TrashedTag {
+			return fmt.Errorf("DriverParameters: invalid tag %q: key is reserved", k)
+		}
+	}
+	switch v.SSEType {
+	case "", "AES256":
+		if v.SSEKMSKeyID != "" {
+			return errors.New("DriverParameters: SSEKMSKeyID requires SSEType \"aws:kms\"")
+		}
+	case "aws:kms":
+		if v.SSEKMSKeyID == "" {
+			return errors.New("DriverParameters: SSEType \"aws:kms\" requires SSEKMSKeyID")
+		}
+	default:
+		return fmt.Errorf("DriverParameters: unsupported SSEType %q (supported values are \"AES256\" and \"aws:kms\")", v.SSEType)
+	}
+
 	defaultResolver := endpoints.NewDefaultResolver()
 
 	cfg := defaults.Config()
 
 	if v.Endpoint == "" && v.Region == "" {
 		return fmt.Errorf("AWS region or endpoint must be specified")
-	} else if v.Endpoint != "" || ec2metadataHostname != "" {
-		myCustomResolver := func(service, region string) (aws.Endpoint, error) {
-			if v.Endpoint != "" && service == "s3" {
+	}
+	// resolver returns an endpoint resolver that uses the given
+	// S3 endpoint, if not empty.
+	resolver := func(s3Endpoint string) aws.EndpointResolver {
+		return aws.EndpointResolverFunc(func(service, region string) (aws.Endpoint, error) {
+			if s3Endpoint != "" && service == "s3" {
 				return aws.Endpoint{
-					URL:           v.Endpoint,
+					URL:           s3Endpoint,
 					SigningRegion: region,
 				}, nil
 			} else if service == "ec2metadata" && ec2metadataHostname != "" {
 				return aws.Endpoint{
 					URL: ec2metadataHostname,
 				}, nil
+			} else if service == "sts" && v.stsEndpoint != "" {
+				return aws.Endpoint{
+					URL:           v.stsEndpoint,
+					SigningRegion: region,
+				}, nil
 			} else {
 				return defaultResolver.ResolveEndpoint(service, region)
 			}
-		}
-		cfg.EndpointResolver = aws.EndpointResolverFunc(myCustomResolver)
+		})
+	}
+	if v.Endpoint != "" || ec2metadataHostname != "" || v.stsEndpoint != "" {
+		cfg.EndpointResolver = resolver(v.Endpoint)
 	}
 	if v.Region == "" {
 		// Endpoint is already specified (otherwise we would
@@ -202,6 +515,16 @@ func (v *S3AWSVolume) check(ec2metadataHostname string) error {
 	}
 	cfg.Region = v.Region
 
+	if v.InsecureTLS || v.CACertificates != "" {
+		tlsconf, err := v.tlsConfig()
+		if err != nil {
+			return err
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsconf
+		cfg.HTTPClient = &http.Client{Transport: transport}
+	}
+
 	// Zero timeouts mean "wait forever", which is a bad
 	// default. Default to long timeouts instead.
 	if v.ConnectTimeout == 0 {
@@ -211,42 +534,115 @@ func (v *S3AWSVolume) check(ec2metadataHostname string) error {
 		v.ReadTimeout = s3DefaultReadTimeout
 	}
 
-	creds := aws.NewChainProvider(
-		[]aws.CredentialsProvider{
+	// If keepstore is running with a web identity token (e.g., in
+	// EKS with IAM roles for service accounts), the token file
+	// and role are given in the standard AWS environment
+	// variables.
+	tokenFile, roleARN := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), os.Getenv("AWS_ROLE_ARN")
+	var providers []aws.CredentialsProvider
+	if v.WebIdentity {
+		if tokenFile == "" || roleARN == "" {
+			return errors.New("DriverParameters: WebIdentity requires AWS_WEB_IDENTITY_TOKEN_FILE and AWS_ROLE_ARN environment variables")
+		}
+		if v.AccessKeyID != "" || v.IAMRole != "" {
+			return errors.New("DriverParameters: WebIdentity cannot be combined with AccessKeyID or IAMRole")
+		}
+		providers = []aws.CredentialsProvider{newWebIdentityProvider(cfg, roleARN, tokenFile)}
+	} else {
+		providers = []aws.CredentialsProvider{
 			aws.NewStaticCredentialsProvider(v.AccessKeyID, v.SecretAccessKey, v.AuthToken),
-			ec2rolecreds.New(ec2metadata.New(cfg)),
-		})
+		}
+		if v.AccessKeyID == "" && v.IAMRole == "" && tokenFile != "" && roleARN != "" {
+			providers = append(providers, newWebIdentityProvider(cfg, roleARN, tokenFile))
+		}
+		if v.IAMMetadataEndpoint != "" {
+			providers = append(providers, newIMDSProvider(v.IAMMetadataEndpoint))
+		} else {
+			providers = append(providers, ec2rolecreds.New(ec2metadata.New(cfg)))
+		}
+	}
+	creds := aws.NewChainProvider(providers)
 
 	cfg.Credentials = creds
 
+	svc := s3.New(cfg)
+	svc.ForcePathStyle = v.UsePathStyle
+	readSvc := svc
+	if v.ReadEndpoint != "" {
+		readCfg := cfg.Copy()
+		readCfg.EndpointResolver = resolver(v.ReadEndpoint)
+		readSvc = s3.New(readCfg)
+		readSvc.ForcePathStyle = v.UsePathStyle
+	}
+
 	v.bucket = &s3AWSbucket{
-		bucket: v.Bucket,
-		svc:    s3.New(cfg),
+		bucket:         v.Bucket,
+		prefix:         v.Prefix,
+		requestTimeout: time.Duration(v.RequestTimeout),
+		svc:            svc,
+		readSvc:        readSvc,
+		creds:          append(providers, creds),
 	}
 
 	// Set up prometheus metrics
 	lbls := prometheus.Labels{"device_id": v.GetDeviceID()}
 	v.bucket.stats.opsCounters, v.bucket.stats.errCounters, v.bucket.stats.ioBytes = v.metrics.getCounterVecsFor(lbls)
+	v.bucket.stats.opsLatency = v.metrics.getLatencyVecFor(lbls)
 
 	return nil
 }
 
+// tlsConfig returns the TLS configuration for connections to the S3
+// endpoint, according to the CACertificates and InsecureTLS
+// parameters.
+func (v *S3AWSVolume) tlsConfig() (*tls.Config, error) {
+	tlsconf := &tls.Config{}
+	if v.InsecureTLS {
+		v.logger.Warnf("WARNING: DriverParameters: InsecureTLS is enabled; TLS certificates presented by S3 endpoint %q will not be verified", v.Endpoint)
+		tlsconf.InsecureSkipVerify = true
+	}
+	if v.CACertificates != "" {
+		pem, err := os.ReadFile(v.CACertificates)
+		if err != nil {
+			return nil, fmt.Errorf("DriverParameters: error reading CACertificates: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("DriverParameters: no certificates found in CACertificates file %q", v.CACertificates)
+		}
+		tlsconf.RootCAs = pool
+	}
+	return tlsconf, nil
+}
+
 // String implements fmt.Stringer.
 func (v *S3AWSVolume) String() string {
+	if v.Prefix != "" {
+		return fmt.Sprintf("s3-bucket:%+q prefix:%+q", v.Bucket, v.Prefix)
+	}
 	return fmt.Sprintf("s3-bucket:%+q", v.Bucket)
 }
 
 // GetDeviceID returns a globally unique ID for the storage bucket.
 func (v *S3AWSVolume) GetDeviceID() string {
+	if v.Prefix != "" {
+		return "s3://" + v.Endpoint + "/" + v.Bucket + "/" + v.Prefix
+	}
 	return "s3://" + v.Endpoint + "/" + v.Bucket
 }
 
 // Compare the given data with the stored data.
 func (v *S3AWSVolume) Compare(ctx context.Context, loc string, expect []byte) error {
+	if err := v.checkLocator(loc); err != nil {
+		return err
+	}
 	key := v.key(loc)
 	errChan := make(chan error, 1)
 	go func() {
-		_, err := v.head("recent/" + key)
+		_, err := v.readHeadContext(context.TODO(), v.RecentPrefix+key)
 		errChan <- err
 	}()
 	var err error
@@ -279,17 +675,42 @@ func (v *S3AWSVolume) Compare(ctx context.Context, loc string, expect []byte) er
 		return v.translateError(err)
 	}
 
+	// If expect has the hash indicated by loc, and S3 reports
+	// the same MD5 as the ETag of the stored object, the stored
+	// data matches and we don't need to download it. ETags of
+	// multipart uploads are not MD5s and never match, and
+	// neither do ETags of objects encrypted with SSE-KMS, so in
+	// those cases we fall back to a full comparison.
+	if fmt.Sprintf("%x", md5.Sum(expect)) == loc[:32] {
+		resp, err := v.readHeadContext(ctx, key)
+		if err == nil && strings.Trim(aws.StringValue(resp.ETag), `"`) == loc[:32] {
+			return nil
+		} else if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+
 	input := &s3.GetObjectInput{
 		Bucket: aws.String(v.bucket.bucket),
-		Key:    aws.String(key),
+		Key:    aws.String(v.bucket.objectKey(key)),
 	}
 
-	req := v.bucket.svc.GetObjectRequest(input)
-	result, err := req.Send(ctx)
+	reqctx, cancel := v.bucket.withTimeout(ctx)
+	defer cancel()
+	t0 := time.Now()
+	req := v.bucket.readSvc.GetObjectRequest(input)
+	result, err := req.Send(reqctx)
+	err = v.bucket.timeoutError(ctx, reqctx, err)
+	v.bucket.stats.TickLatency("get", t0)
+	v.bucket.stats.TickOps("get")
+	v.bucket.stats.Tick(&v.bucket.stats.Ops, &v.bucket.stats.GetOps)
+	v.bucket.stats.TickErr(err)
 	if err != nil {
 		return v.translateError(err)
 	}
-	return v.translateError(compareReaderWithBuf(ctx, result.Body, expect, loc[:32]))
+	defer result.Body.Close()
+	err = compareReaderWithBuf(reqctx, result.Body, expect, loc[:32])
+	return v.translateError(v.bucket.timeoutError(ctx, reqctx, err))
 }
 
 // EmptyTrash looks for trashed blocks that exceeded BlobTrashLifetime
@@ -300,8 +721,9 @@ func (v *S3AWSVolume) EmptyTrash() {
 	// Define "ready to delete" as "...when EmptyTrash started".
 	startT := time.Now()
 
+	var trashDeleter *s3awsBatchDeleter
 	emptyOneKey := func(trash *s3.Object) {
-		key := strings.TrimPrefix(*trash.Key, "trash/")
+		key := strings.TrimPrefix(*trash.Key, v.TrashPrefix)
 		loc, isblk := v.isKeepBlock(key)
 		if !isblk {
 			return
@@ -310,16 +732,16 @@ func (v *S3AWSVolume) EmptyTrash() {
 		atomic.AddInt64(&blocksInTrash, 1)
 
 		trashT := *trash.LastModified
-		recent, err := v.head("recent/" + key)
+		recent, err := v.head(v.RecentPrefix + key)
 		if err != nil && os.IsNotExist(v.translateError(err)) {
-			v.logger.Warnf("EmptyTrash: found trash marker %q but no %q (%s); calling Untrash", *trash.Key, "recent/"+key, err)
+			v.logger.Warnf("EmptyTrash: found trash marker %q but no %q (%s); calling Untrash", *trash.Key, v.RecentPrefix+key, err)
 			err = v.Untrash(loc)
 			if err != nil {
 				v.logger.WithError(err).Errorf("EmptyTrash: Untrash(%q) failed", loc)
 			}
 			return
 		} else if err != nil {
-			v.logger.WithError(err).Warnf("EmptyTrash: HEAD %q failed", "recent/"+key)
+			v.logger.WithError(err).Warnf("EmptyTrash: HEAD %q failed", v.RecentPrefix+key)
 			return
 		}
 		if trashT.Sub(*recent.LastModified) < v.cluster.Collections.BlobSigningTTL.Duration() {
@@ -350,28 +772,28 @@ func (v *S3AWSVolume) EmptyTrash() {
 		if startT.Sub(trashT) < v.cluster.Collections.BlobTrashLifetime.Duration() {
 			return
 		}
-		err = v.bucket.Del(*trash.Key)
-		if err != nil {
-			v.logger.WithError(err).Errorf("EmptyTrash: error deleting %q", *trash.Key)
-			return
-		}
-		atomic.AddInt64(&bytesDeleted, *trash.Size)
+		trashDeleter.Add(*trash.Key, *trash.Size)
+	}
+
+	// Recent markers are deleted only after the corresponding
+	// trash objects are confirmed deleted.
+	recentDeleter := v.newBatchDeleter(func(string, int64) {})
+	trashDeleter = v.newBatchDeleter(func(trashKey string, size int64) {
+		atomic.AddInt64(&bytesDeleted, size)
 		atomic.AddInt64(&blocksDeleted, 1)
 
-		_, err = v.head(*trash.Key)
+		key := strings.TrimPrefix(trashKey, v.TrashPrefix)
+		_, err := v.head(trashKey)
 		if err == nil {
-			v.logger.Warnf("EmptyTrash: HEAD %q succeeded immediately after deleting %q", loc, loc)
+			v.logger.Warnf("EmptyTrash: HEAD %q succeeded immediately after deleting %q", trashKey, trashKey)
 			return
 		}
 		if !os.IsNotExist(v.translateError(err)) {
 			v.logger.WithError(err).Warnf("EmptyTrash: HEAD %q failed", key)
 			return
 		}
-		err = v.bucket.Del("recent/" + key)
-		if err != nil {
-			v.logger.WithError(err).Warnf("EmptyTrash: error deleting %q", "recent/"+key)
-		}
-	}
+		recentDeleter.Add(v.RecentPrefix+key, 0)
+	})
 
 	var wg sync.WaitGroup
 	todo := make(chan *s3.Object, v.cluster.Collections.BlobDeleteConcurrency)
@@ -388,8 +810,8 @@ func (v *S3AWSVolume) EmptyTrash() {
 	trashL := s3awsLister{
 		Logger:   v.logger,
 		Bucket:   v.bucket,
-		Prefix:   "trash/",
-		PageSize: v.IndexPageSize,
+		Prefix:   v.TrashPrefix,
+		PageSize: v.TrashPageSize,
 		Stats:    &v.bucket.stats,
 	}
 	for trash := trashL.First(); trash != nil; trash = trashL.Next() {
@@ -397,6 +819,8 @@ func (v *S3AWSVolume) EmptyTrash() {
 	}
 	close(todo)
 	wg.Wait()
+	trashDeleter.Close()
+	recentDeleter.Close()
 
 	if err := trashL.Error(); err != nil {
 		v.logger.WithError(err).Error("EmptyTrash: lister failed")
@@ -404,22 +828,132 @@ func (v *S3AWSVolume) EmptyTrash() {
 	v.logger.Infof("EmptyTrash: stats for %v: Deleted %v bytes in %v blocks. Remaining in trash: %v bytes in %v blocks.", v.String(), bytesDeleted, blocksDeleted, bytesInTrash-bytesDeleted, blocksInTrash-blocksDeleted)
 }
 
+// s3awsBatchDeleter collects keys to delete, and deletes them in
+// batches of up to s3MaxDeleteBatch keys.
+type s3awsBatchDeleter struct {
+	volume *S3AWSVolume
+	// called (concurrently, up to BlobDeleteConcurrency at a
+	// time) for each key that is deleted successfully
+	deleted func(key string, size int64)
+
+	todo chan s3awsDeleteItem
+	done chan struct{}
+}
+
+type s3awsDeleteItem struct {
+	key  string
+	size int64
+}
+
+func (v *S3AWSVolume) newBatchDeleter(deleted func(key string, size int64)) *s3awsBatchDeleter {
+	bd := &s3awsBatchDeleter{
+		volume:  v,
+		deleted: deleted,
+		todo:    make(chan s3awsDeleteItem, s3MaxDeleteBatch),
+		done:    make(chan struct{}),
+	}
+	go bd.run()
+	return bd
+}
+
+// Add queues key for deletion. It must not be called after Close.
+func (bd *s3awsBatchDeleter) Add(key string, size int64) {
+	bd.todo <- s3awsDeleteItem{key, size}
+}
+
+// Close deletes any remaining queued keys and waits for all
+// callbacks to finish.
+func (bd *s3awsBatchDeleter) Close() {
+	close(bd.todo)
+	<-bd.done
+}
+
+func (bd *s3awsBatchDeleter) run() {
+	defer close(bd.done)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	throttle := make(chan struct{}, bd.volume.cluster.Collections.BlobDeleteConcurrency)
+	var batch []s3awsDeleteItem
+	flush := func() {
+		for _, item := range bd.deleteBatch(batch) {
+			item := item
+			throttle <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-throttle }()
+				bd.deleted(item.key, item.size)
+			}()
+		}
+		batch = nil
+	}
+	for item := range bd.todo {
+		batch = append(batch, item)
+		if len(batch) >= s3MaxDeleteBatch {
+			flush()
+		}
+	}
+	if len(batch) > 0 {
+		flush()
+	}
+}
+
+// deleteBatch deletes the given items and returns the ones that were
+// deleted successfully. If the batch request fails, it falls back to
+// deleting the items one at a time.
+func (bd *s3awsBatchDeleter) deleteBatch(batch []s3awsDeleteItem) []s3awsDeleteItem {
+	v := bd.volume
+	keys := make([]string, len(batch))
+	for i, item := range batch {
+		keys[i] = item.key
+	}
+	var ok []s3awsDeleteItem
+	if deleted, err := v.bucket.DelBatch(keys); err == nil {
+		isDeleted := make(map[string]bool, len(deleted))
+		for _, key := range deleted {
+			isDeleted[key] = true
+		}
+		for _, item := range batch {
+			if isDeleted[item.key] {
+				ok = append(ok, item)
+			} else {
+				v.logger.Errorf("EmptyTrash: error deleting %q", item.key)
+			}
+		}
+		return ok
+	} else if len(batch) > 1 {
+		v.logger.WithError(err).Warnf("EmptyTrash: batch delete of %d objects failed, deleting one at a time", len(batch))
+	}
+	for _, item := range batch {
+		err := v.bucket.Del(item.key)
+		if err != nil {
+			v.logger.WithError(err).Errorf("EmptyTrash: error deleting %q", item.key)
+			continue
+		}
+		ok = append(ok, item)
+	}
+	return ok
+}
+
 // fixRace(X) is called when "recent/X" exists but "X" doesn't
 // exist. If the timestamps on "recent/X" and "trash/X" indicate there
 // was a race between Put and Trash, fixRace recovers from the race by
-// Untrashing the block.
+// Untrashing the block. On a read-only volume, fixRace does nothing.
 func (v *S3AWSVolume) fixRace(key string) bool {
-	trash, err := v.head("trash/" + key)
+	if v.volume.ReadOnly {
+		return false
+	}
+	trash, err := v.head(v.TrashPrefix + key)
 	if err != nil {
 		if !os.IsNotExist(v.translateError(err)) {
-			v.logger.WithError(err).Errorf("fixRace: HEAD %q failed", "trash/"+key)
+			v.logger.WithError(err).Errorf("fixRace: HEAD %q failed", v.TrashPrefix+key)
 		}
 		return false
 	}
 
-	recent, err := v.head("recent/" + key)
+	recent, err := v.head(v.RecentPrefix + key)
 	if err != nil {
-		v.logger.WithError(err).Errorf("fixRace: HEAD %q failed", "recent/"+key)
+		v.logger.WithError(err).Errorf("fixRace: HEAD %q failed", v.RecentPrefix+key)
 		return false
 	}
 
@@ -433,27 +967,54 @@ func (v *S3AWSVolume) fixRace(key string) bool {
 	}
 
 	v.logger.Infof("fixRace: %q: trashed at %s but touched at %s (age when trashed = %s < %s)", key, trashTime, recentTime, ageWhenTrashed, v.cluster.Collections.BlobSigningTTL)
-	v.logger.Infof("fixRace: copying %q to %q to recover from race between Put/Touch and Trash", "recent/"+key, key)
-	err = v.safeCopy(key, "trash/"+key)
+	v.logger.Infof("fixRace: copying %q to %q to recover from race between Put/Touch and Trash", v.RecentPrefix+key, key)
+	err = v.safeCopy(key, v.TrashPrefix+key)
 	if err != nil {
 		v.logger.WithError(err).Error("fixRace: copy failed")
 		return false
 	}
+	v.bucket.stats.Tick(&v.bucket.stats.RaceRepairs)
+	v.logger.Debugf("fixRace: recovered %q from %q", key, v.TrashPrefix+key)
 	return true
 }
 
 func (v *S3AWSVolume) head(key string) (result *s3.HeadObjectOutput, err error) {
-	input := &s3.HeadObjectInput{
-		Bucket: aws.String(v.bucket.bucket),
-		Key:    aws.String(key),
-	}
+	return v.headContext(context.TODO(), key)
+}
 
-	req := v.bucket.svc.HeadObjectRequest(input)
-	res, err := req.Send(context.TODO())
+func (v *S3AWSVolume) headContext(ctx context.Context, key string) (result *s3.HeadObjectOutput, err error) {
+	return v.headWithClient(ctx, v.bucket.svc, key)
+}
 
-	v.bucket.stats.TickOps("head")
-	v.bucket.stats.Tick(&v.bucket.stats.Ops, &v.bucket.stats.HeadOps)
-	v.bucket.stats.TickErr(err)
+// readHeadContext is like headContext, but uses the ReadEndpoint (if
+// any). It must not be used where the result determines whether to
+// write, trash, or delete anything.
+func (v *S3AWSVolume) readHeadContext(ctx context.Context, key string) (result *s3.HeadObjectOutput, err error) {
+	return v.headWithClient(ctx, v.bucket.readSvc, key)
+}
+
+func (v *S3AWSVolume) headWithClient(ctx context.Context, svc *s3.Client, key string) (result *s3.HeadObjectOutput, err error) {
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(v.bucket.bucket),
+		Key:    aws.String(v.bucket.objectKey(key)),
+	}
+
+	var res *s3.HeadObjectResponse
+	err = v.withRetries(ctx, func() error {
+		reqctx, cancel := v.bucket.withTimeout(ctx)
+		defer cancel()
+		t0 := time.Now()
+		req := svc.HeadObjectRequest(input)
+		var err error
+		res, err = req.Send(reqctx)
+		err = v.bucket.timeoutError(ctx, reqctx, err)
+
+		v.bucket.stats.TickLatency("head", t0)
+		v.bucket.stats.TickOps("head")
+		v.bucket.stats.Tick(&v.bucket.stats.Ops, &v.bucket.stats.HeadOps)
+		v.bucket.stats.TickErr(err)
+		return err
+	})
 
 	if err != nil {
 		return nil, v.translateError(err)
@@ -469,6 +1030,9 @@ func (v *S3AWSVolume) Get(ctx context.Context, loc string, buf []byte) (int, err
 	// through 'buf []byte', and we don't want to allocate two buffers for each
 	// read request. Instead, use a version of ReadBlock that accepts 'buf []byte'
 	// as an input.
+	if err := v.checkLocator(loc); err != nil {
+		return 0, err
+	}
 	key := v.key(loc)
 	count, err := v.readWorker(ctx, key, buf)
 	if err == nil {
@@ -480,7 +1044,7 @@ func (v *S3AWSVolume) Get(ctx context.Context, loc string, buf []byte) (int, err
 		return 0, err
 	}
 
-	_, err = v.head("recent/" + key)
+	_, err = v.head(v.RecentPrefix + key)
 	err = v.translateError(err)
 	if err != nil {
 		// If we can't read recent/X, there's no point in
@@ -502,18 +1066,36 @@ func (v *S3AWSVolume) Get(ctx context.Context, loc string, buf []byte) (int, err
 }
 
 func (v *S3AWSVolume) readWorker(ctx context.Context, key string, buf []byte) (int, error) {
+	var n int
+	err := v.withRetries(ctx, func() error {
+		var err error
+		n, err = v.readObject(ctx, key, buf)
+		return err
+	})
+	return n, err
+}
+
+func (v *S3AWSVolume) readObject(ctx context.Context, key string, buf []byte) (int, error) {
+	if algorithm := v.checksumAlgorithm(); algorithm != "" {
+		return v.readWithChecksum(ctx, key, buf, algorithm)
+	}
 	awsBuf := aws.NewWriteAtBuffer(buf)
-	downloader := s3manager.NewDownloaderWithClient(v.bucket.svc, func(u *s3manager.Downloader) {
+	downloader := s3manager.NewDownloaderWithClient(v.bucket.readSvc, func(u *s3manager.Downloader) {
 		u.PartSize = PartSize
 		u.Concurrency = ReadConcurrency
 	})
 
 	v.logger.Debugf("Partsize: %d; Concurrency: %d\n", downloader.PartSize, downloader.Concurrency)
 
-	count, err := downloader.DownloadWithContext(ctx, awsBuf, &s3.GetObjectInput{
+	reqctx, cancel := v.bucket.withTimeout(ctx)
+	defer cancel()
+	t0 := time.Now()
+	count, err := downloader.DownloadWithContext(reqctx, awsBuf, &s3.GetObjectInput{
 		Bucket: aws.String(v.bucket.bucket),
-		Key:    aws.String(key),
+		Key:    aws.String(v.bucket.objectKey(key)),
 	})
+	err = v.bucket.timeoutError(ctx, reqctx, err)
+	v.bucket.stats.TickLatency("get", t0)
 	v.bucket.stats.TickOps("get")
 	v.bucket.stats.Tick(&v.bucket.stats.Ops, &v.bucket.stats.GetOps)
 	v.bucket.stats.TickErr(err)
@@ -521,24 +1103,429 @@ func (v *S3AWSVolume) readWorker(ctx context.Context, key string, buf []byte) (i
 	return int(count), v.translateError(err)
 }
 
-func (v *S3AWSVolume) writeObject(ctx context.Context, key string, r io.Reader) error {
-	if r == nil {
-		// r == nil leads to a memory violation in func readFillBuf in
-		// aws-sdk-go-v2@v0.23.0/service/s3/s3manager/upload.go
-		r = bytes.NewReader(nil)
+// readWithChecksum reads the object with a single (non-ranged) GET
+// request, asking S3 to report the object's checksum, and verifies
+// the received data against it. If the server doesn't report a
+// checksum, the data is returned without verification.
+func (v *S3AWSVolume) readWithChecksum(ctx context.Context, key string, buf []byte, algorithm string) (int, error) {
+	reqctx, cancel := v.bucket.withTimeout(ctx)
+	defer cancel()
+	req := v.bucket.readSvc.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(v.bucket.bucket),
+		Key:    aws.String(v.bucket.objectKey(key)),
+	})
+	req.HTTPRequest.Header.Set("X-Amz-Checksum-Mode", "ENABLED")
+	t0 := time.Now()
+	resp, err := req.Send(reqctx)
+	err = v.bucket.timeoutError(ctx, reqctx, err)
+	v.bucket.stats.TickLatency("get", t0)
+	v.bucket.stats.TickOps("get")
+	v.bucket.stats.Tick(&v.bucket.stats.Ops, &v.bucket.stats.GetOps)
+	if err != nil {
+		v.bucket.stats.TickErr(err)
+		return 0, v.translateError(err)
+	}
+	defer resp.Body.Close()
+	n, err := io.ReadFull(resp.Body, buf)
+	err = v.bucket.timeoutError(ctx, reqctx, err)
+	v.bucket.stats.TickInBytes(uint64(n))
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	} else if err == nil {
+		// buf is full; make sure there isn't more.
+		if extra, _ := resp.Body.Read(make([]byte, 1)); extra > 0 {
+			err = fmt.Errorf("object %s is larger than buffer size %d", key, len(buf))
+		}
+	}
+	if err != nil {
+		v.bucket.stats.TickErr(err)
+		return n, v.translateError(err)
 	}
+	expect := req.HTTPResponse.Header.Get(s3ChecksumAlgorithms[algorithm].header)
+	if expect == "" {
+		return n, nil
+	}
+	if got := s3Checksum(algorithm, buf[:n]); got != expect {
+		err = s3ChecksumError{algorithm: algorithm, expect: expect, got: got}
+		v.bucket.stats.Tick(&v.bucket.stats.ChecksumErrs)
+		v.bucket.stats.TickErr(err)
+		return 0, err
+	}
+	return n, nil
+}
 
+// checksumAlgorithm returns the configured ChecksumAlgorithm, or ""
+// if none is configured or the endpoint has rejected checksum
+// headers.
+func (v *S3AWSVolume) checksumAlgorithm() string {
+	if atomic.LoadInt32(&v.checksumUnsupported) != 0 {
+		return ""
+	}
+	return v.ChecksumAlgorithm
+}
+
+// s3Checksum returns the base64-encoded checksum of data, in the
+// format used in x-amz-checksum-* headers.
+func s3Checksum(algorithm string, data []byte) string {
+	h := s3ChecksumAlgorithms[algorithm].newHash()
+	h.Write(data)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// isChecksumUnsupported returns true if err indicates the endpoint
+// does not support x-amz-checksum-* headers.
+func isChecksumUnsupported(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	switch aerr.Code() {
+	case "NotImplemented", "InvalidArgument", "InvalidRequest":
+		return true
+	default:
+		return false
+	}
+}
+
+// isChecksumMismatch returns true if err indicates the endpoint
+// rejected an upload because the data did not match the supplied
+// checksum.
+func isChecksumMismatch(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && (aerr.Code() == "BadDigest" || aerr.Code() == "XAmzContentChecksumMismatch")
+}
+
+func (v *S3AWSVolume) writeObject(ctx context.Context, key string, data []byte) error {
+	err := v.withRetries(ctx, func() error {
+		algorithm := v.checksumAlgorithm()
+		err := v.uploadObject(ctx, key, data, algorithm)
+		if algorithm != "" && isChecksumUnsupported(err) {
+			v.logger.WithError(err).Warnf("endpoint rejected %s checksum header; disabling ChecksumAlgorithm and retrying", algorithm)
+			atomic.StoreInt32(&v.checksumUnsupported, 1)
+			err = v.uploadObject(ctx, key, data, "")
+		}
+		return err
+	})
+	return v.translateError(err)
+}
+
+// retryExpiredCredentials calls fn. If fn fails because the
+// credentials have expired (e.g., temporary credentials from an IAM
+// role expired during a long operation), retryExpiredCredentials
+// discards the cached credentials so new ones are retrieved, and
+// calls fn again. If that also fails because of expired
+// credentials, it returns an S3CredentialsExpiredError.
+func (v *S3AWSVolume) retryExpiredCredentials(fn func() error) error {
+	err := fn()
+	if !isCredentialsExpired(err) {
+		return err
+	}
+	v.logger.WithError(err).Info("credentials expired, refreshing and retrying")
+	v.bucket.invalidateCredentials()
+	err = fn()
+	if !isCredentialsExpired(err) {
+		return err
+	}
+	v.bucket.stats.Tick(&v.bucket.stats.CredentialsExpiredErrs)
+	return S3CredentialsExpiredError{err}
+}
+
+// isCredentialsExpired returns true if err indicates the request was
+// rejected because the credentials have expired.
+func isCredentialsExpired(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	switch aerr.Code() {
+	case "ExpiredToken", "ExpiredTokenException", "TokenRefreshRequired":
+		return true
+	default:
+		return false
+	}
+}
+
+// withRetries calls fn, retrying if the credentials have expired
+// (see retryExpiredCredentials) or S3 is throttling requests (see
+// retryThrottled).
+func (v *S3AWSVolume) withRetries(ctx context.Context, fn func() error) error {
+	return v.retryThrottled(ctx, func() error {
+		return v.retryExpiredCredentials(fn)
+	})
+}
+
+// retryThrottled calls fn. As long as fn fails because S3 is
+// throttling requests, retryThrottled waits and calls fn again, up
+// to MaxRetries times. The wait time grows exponentially with each
+// attempt, with random jitter so concurrent operations don't retry
+// in lockstep. If ctx is done while waiting, retryThrottled returns
+// ctx.Err().
+func (v *S3AWSVolume) retryThrottled(ctx context.Context, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if attempt >= v.MaxRetries || !isThrottled(err) {
+			return err
+		}
+		delay := s3RetryBaseDelay << uint(attempt)
+		if delay > s3RetryMaxDelay || delay <= 0 {
+			delay = s3RetryMaxDelay
+		}
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		v.bucket.stats.Tick(&v.bucket.stats.ThrottledRetries)
+		v.logger.WithError(err).Debugf("S3 request throttled, retrying in %v", delay)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// isThrottled returns true if err indicates S3 rejected the request
+// because the request rate is too high.
+func isThrottled(err error) bool {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return false
+	}
+	switch aerr.Code() {
+	case "SlowDown", "RequestLimitExceeded", "Throttling", "ThrottlingException", "RequestThrottled", "TooManyRequestsException", "ServiceUnavailable":
+		return true
+	}
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) {
+		switch reqErr.StatusCode() {
+		case http.StatusServiceUnavailable, http.StatusTooManyRequests:
+			return true
+		}
+	}
+	// s3manager wraps errors from multipart uploads and
+	// downloads.
+	if orig := s3OrigErr(aerr); orig != nil && orig != aerr {
+		return isThrottled(orig)
+	}
+	return false
+}
+
+// s3OrigErr returns the error wrapped by an awserr.Error, or nil if
+// there is none. Wrapped errors are available through OrigErr or
+// Unwrap, depending on the concrete error type.
+func s3OrigErr(err error) error {
+	switch err := err.(type) {
+	case interface{ OrigErr() error }:
+		return err.OrigErr()
+	case interface{ Unwrap() error }:
+		return err.Unwrap()
+	default:
+		return nil
+	}
+}
+
+// webIdentityProvider retrieves temporary credentials by exchanging
+// a web identity token (e.g., a Kubernetes projected service account
+// token) for credentials using STS AssumeRoleWithWebIdentity.
+type webIdentityProvider struct {
+	client      *sts.Client
+	roleARN     string
+	tokenFile   string
+	sessionName string
+
+	mtx   sync.Mutex
+	creds aws.Credentials
+}
+
+func newWebIdentityProvider(cfg aws.Config, roleARN, tokenFile string) *webIdentityProvider {
+	// AssumeRoleWithWebIdentity requests are authenticated by
+	// the token itself, not signed.
+	cfg.Credentials = aws.AnonymousCredentials
+	sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if sessionName == "" {
+		sessionName = fmt.Sprintf("keepstore-%d", time.Now().UnixNano())
+	}
+	return &webIdentityProvider{
+		client:      sts.New(cfg),
+		roleARN:     roleARN,
+		tokenFile:   tokenFile,
+		sessionName: sessionName,
+	}
+}
+
+// Retrieve implements aws.CredentialsProvider. The token file is
+// re-read each time new credentials are needed, because the token
+// is rotated periodically.
+func (p *webIdentityProvider) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.creds.HasKeys() && !p.creds.Expired() {
+		return p.creds, nil
+	}
+	token, err := ioutil.ReadFile(p.tokenFile)
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("error reading web identity token: %w", err)
+	}
+	resp, err := p.client.AssumeRoleWithWebIdentityRequest(&sts.AssumeRoleWithWebIdentityInput{
+		RoleArn:          aws.String(p.roleARN),
+		RoleSessionName:  aws.String(p.sessionName),
+		WebIdentityToken: aws.String(strings.TrimSpace(string(token))),
+	}).Send(ctx)
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("AssumeRoleWithWebIdentity failed: %w", err)
+	}
+	p.creds = aws.Credentials{
+		AccessKeyID:     aws.StringValue(resp.Credentials.AccessKeyId),
+		SecretAccessKey: aws.StringValue(resp.Credentials.SecretAccessKey),
+		SessionToken:    aws.StringValue(resp.Credentials.SessionToken),
+		Source:          "WebIdentityCredentials",
+		CanExpire:       true,
+		Expires:         aws.TimeValue(resp.Credentials.Expiration),
+	}
+	return p.creds, nil
+}
+
+// Invalidate discards the cached credentials, so the next call to
+// Retrieve gets new ones.
+func (p *webIdentityProvider) Invalidate() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.creds = aws.Credentials{}
+}
+
+// imdsProvider retrieves instance role credentials from an EC2
+// instance metadata service (or compatible sidecar) at a given
+// endpoint, using the IMDSv2 flow: get a session token with a PUT
+// request, then send it with each GET request.
+type imdsProvider struct {
+	client   *http.Client
+	endpoint string
+
+	mtx   sync.Mutex
+	creds aws.Credentials
+}
+
+const imdsTokenTTL = "21600" // seconds
+
+func newIMDSProvider(endpoint string) *imdsProvider {
+	return &imdsProvider{
+		client:   &http.Client{Timeout: time.Minute},
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+	}
+}
+
+// Retrieve implements aws.CredentialsProvider. It uses the first
+// role listed by the metadata service.
+func (p *imdsProvider) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.creds.HasKeys() && !p.creds.Expired() {
+		return p.creds, nil
+	}
+	token, err := p.do(ctx, "PUT", "/latest/api/token", http.Header{"X-Aws-Ec2-Metadata-Token-Ttl-Seconds": {imdsTokenTTL}})
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("error getting IMDSv2 session token: %w", err)
+	}
+	hdr := http.Header{"X-Aws-Ec2-Metadata-Token": {string(token)}}
+	roles, err := p.do(ctx, "GET", "/latest/meta-data/iam/security-credentials/", hdr)
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("error listing instance roles: %w", err)
+	}
+	role := strings.TrimSpace(strings.SplitN(string(roles), "\n", 2)[0])
+	if role == "" {
+		return aws.Credentials{}, errors.New("no instance role found in metadata service")
+	}
+	buf, err := p.do(ctx, "GET", "/latest/meta-data/iam/security-credentials/"+role, hdr)
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("error getting credentials for instance role %q: %w", role, err)
+	}
+	var resp struct {
+		Code            string
+		Message         string
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	err = json.Unmarshal(buf, &resp)
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("error decoding credentials for instance role %q: %w", role, err)
+	} else if resp.Code != "Success" {
+		return aws.Credentials{}, fmt.Errorf("error getting credentials for instance role %q: %s: %s", role, resp.Code, resp.Message)
+	}
+	p.creds = aws.Credentials{
+		AccessKeyID:     resp.AccessKeyID,
+		SecretAccessKey: resp.SecretAccessKey,
+		SessionToken:    resp.Token,
+		Source:          "IMDSv2Credentials",
+		CanExpire:       true,
+		Expires:         resp.Expiration,
+	}
+	return p.creds, nil
+}
+
+func (p *imdsProvider) do(ctx context.Context, method, path string, hdr http.Header) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, p.endpoint+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = hdr
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	return buf, nil
+}
+
+// Invalidate discards the cached credentials, so the next call to
+// Retrieve gets new ones.
+func (p *imdsProvider) Invalidate() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.creds = aws.Credentials{}
+}
+
+// invalidateCredentials discards cached credentials, so the next
+// request retrieves new ones.
+func (b *s3AWSbucket) invalidateCredentials() {
+	for _, p := range b.creds {
+		if p, ok := p.(interface{ Invalidate() }); ok {
+			p.Invalidate()
+		}
+	}
+}
+
+func (v *S3AWSVolume) uploadObject(ctx context.Context, key string, data []byte, algorithm string) error {
 	uploadInput := s3manager.UploadInput{
 		Bucket: aws.String(v.bucket.bucket),
-		Key:    aws.String(key),
-		Body:   r,
+		Key:    aws.String(v.bucket.objectKey(key)),
+		Body:   NewCountingReaderAtSeeker(bytes.NewReader(data), v.bucket.stats.TickOutBytes),
+	}
+	if v.ACL != "" {
+		uploadInput.ACL = s3.ObjectCannedACL(v.ACL)
+	}
+	if v.StorageClass != "" {
+		uploadInput.StorageClass = s3.StorageClass(v.StorageClass)
+	}
+	if v.SSEType != "" {
+		uploadInput.ServerSideEncryption = s3.ServerSideEncryption(v.SSEType)
+		if v.SSEKMSKeyID != "" {
+			uploadInput.SSEKMSKeyId = aws.String(v.SSEKMSKeyID)
+		}
 	}
 
 	if loc, ok := v.isKeepBlock(key); ok {
+		if len(v.Tags) > 0 {
+			uploadInput.Tagging = aws.String(v.objectTagging(false))
+		}
 		var contentMD5 string
 		md5, err := hex.DecodeString(loc)
 		if err != nil {
-			return v.translateError(err)
+			return err
 		}
 		contentMD5 = base64.StdEncoding.EncodeToString(md5)
 		uploadInput.ContentMD5 = &contentMD5
@@ -549,25 +1536,46 @@ func (v *S3AWSVolume) writeObject(ctx context.Context, key string, r io.Reader)
 	// Defining u.BufferProvider = s3manager.NewBufferedReadSeekerWriteToPool(64 * 1024 * 1024)
 	// is detrimental to througput (minus ~15%).
 	uploader := s3manager.NewUploaderWithClient(v.bucket.svc, func(u *s3manager.Uploader) {
-		u.PartSize = PartSize
-		u.Concurrency = WriteConcurrency
+		u.PartSize = int64(v.UploadPartSize)
+		u.Concurrency = v.UploadConcurrency
+		if algorithm != "" {
+			// Upload the whole block in a single
+			// PutObject request, so the checksum
+			// covers the entire object.
+			u.PartSize = BlockSize
+		}
 	})
 
+	var checksum string
+	if algorithm != "" {
+		checksum = s3Checksum(algorithm, data)
+	}
+
 	// Unlike the goamz S3 driver, we don't need to precompute ContentSHA256:
 	// the aws-sdk-go v2 SDK uses a ReadSeeker to avoid having to copy the
 	// block, so there is no extra memory use to be concerned about. See
 	// makeSha256Reader in aws/signer/v4/v4.go. In fact, we explicitly disable
 	// calculating the Sha-256 because we don't need it; we already use md5sum
 	// hashes that match the name of the block.
-	_, err := uploader.UploadWithContext(ctx, &uploadInput, s3manager.WithUploaderRequestOptions(func(r *aws.Request) {
+	reqctx, cancel := v.bucket.withTimeout(ctx)
+	defer cancel()
+	t0 := time.Now()
+	_, err := uploader.UploadWithContext(reqctx, &uploadInput, s3manager.WithUploaderRequestOptions(func(r *aws.Request) {
 		r.HTTPRequest.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+		if checksum != "" {
+			r.HTTPRequest.Header.Set(s3ChecksumAlgorithms[algorithm].header, checksum)
+		}
 	}))
+	err = v.bucket.timeoutError(ctx, reqctx, err)
 
+	v.bucket.stats.TickLatency("put", t0)
 	v.bucket.stats.TickOps("put")
 	v.bucket.stats.Tick(&v.bucket.stats.Ops, &v.bucket.stats.PutOps)
 	v.bucket.stats.TickErr(err)
-
-	return v.translateError(err)
+	if isChecksumMismatch(err) {
+		v.bucket.stats.Tick(&v.bucket.stats.ChecksumErrs)
+	}
+	return err
 }
 
 // Put writes a block.
@@ -577,20 +1585,71 @@ func (v *S3AWSVolume) Put(ctx context.Context, loc string, block []byte) error {
 	if v.volume.ReadOnly {
 		return MethodDisabledError
 	}
+	if err := v.checkLocator(loc); err != nil {
+		return err
+	}
 
-	rdr := bytes.NewReader(block)
-	r := NewCountingReaderAtSeeker(rdr, v.bucket.stats.TickOutBytes)
 	key := v.key(loc)
-	err := v.writeObject(ctx, key, r)
+	err := v.writeObject(ctx, key, block)
 	if err != nil {
 		return err
 	}
-	return v.writeObject(ctx, "recent/"+key, nil)
+	if v.ReadAfterWriteCheck {
+		err = v.checkWritten(ctx, key, block)
+		if err != nil {
+			return err
+		}
+	}
+	return v.writeObject(ctx, v.RecentPrefix+key, nil)
+}
+
+// Maximum number of times checkWritten re-uploads an object that is
+// not yet visible, in case RequestTimeout is not configured.
+const s3ReadAfterWriteMaxAttempts = 10
+
+// checkWritten waits for a newly written object to become visible
+// (see ReadAfterWriteCheck), uploading it again if it is still
+// missing after each backoff delay. It gives up with an error after
+// RequestTimeout (if configured) or s3ReadAfterWriteMaxAttempts
+// uploads.
+func (v *S3AWSVolume) checkWritten(ctx context.Context, key string, data []byte) error {
+	if v.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, v.RequestTimeout.Duration())
+		defer cancel()
+	}
+	delay := s3RetryBaseDelay
+	for attempt := 1; ; attempt++ {
+		_, err := v.headContext(ctx, key)
+		if err == nil {
+			return nil
+		}
+		if err = v.translateError(err); !os.IsNotExist(err) {
+			return err
+		}
+		if attempt >= s3ReadAfterWriteMaxAttempts {
+			return fmt.Errorf("object %q not visible after %d uploads", key, attempt)
+		}
+		v.logger.Infof("ReadAfterWriteCheck: %q not visible yet, uploading again after %s", key, delay)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("object %q not visible after %d uploads: %w", key, attempt, ctx.Err())
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > s3RetryMaxDelay {
+			delay = s3RetryMaxDelay
+		}
+		err = v.writeObject(ctx, key, data)
+		if err != nil {
+			return err
+		}
+	}
 }
 
 type s3awsLister struct {
 	Logger            logrus.FieldLogger
 	Bucket            *s3AWSbucket
+	UseReadEndpoint   bool
 	Prefix            string
 	PageSize          int
 	Stats             *s3awsbucketStats
@@ -630,19 +1689,28 @@ func (lister *s3awsLister) getPage() {
 		input = &s3.ListObjectsV2Input{
 			Bucket:  aws.String(lister.Bucket.bucket),
 			MaxKeys: aws.Int64(int64(lister.PageSize)),
-			Prefix:  aws.String(lister.Prefix),
+			Prefix:  aws.String(lister.Bucket.objectKey(lister.Prefix)),
 		}
 	} else {
 		input = &s3.ListObjectsV2Input{
 			Bucket:            aws.String(lister.Bucket.bucket),
 			MaxKeys:           aws.Int64(int64(lister.PageSize)),
-			Prefix:            aws.String(lister.Prefix),
+			Prefix:            aws.String(lister.Bucket.objectKey(lister.Prefix)),
 			ContinuationToken: &lister.ContinuationToken,
 		}
 	}
 
-	req := lister.Bucket.svc.ListObjectsV2Request(input)
-	resp, err := req.Send(context.Background())
+	reqctx, cancel := lister.Bucket.withTimeout(context.Background())
+	defer cancel()
+	t0 := time.Now()
+	svc := lister.Bucket.svc
+	if lister.UseReadEndpoint {
+		svc = lister.Bucket.readSvc
+	}
+	req := svc.ListObjectsV2Request(input)
+	resp, err := req.Send(reqctx)
+	err = lister.Bucket.timeoutError(context.Background(), reqctx, err)
+	lister.Stats.TickLatency("list", t0)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			lister.err = aerr
@@ -659,10 +1727,13 @@ func (lister *s3awsLister) getPage() {
 	}
 	lister.buf = make([]s3.Object, 0, len(resp.Contents))
 	for _, key := range resp.Contents {
-		if !strings.HasPrefix(*key.Key, lister.Prefix) {
-			lister.Logger.Warnf("s3awsLister: S3 Bucket.List(prefix=%q) returned key %q", lister.Prefix, *key.Key)
+		if !strings.HasPrefix(*key.Key, lister.Bucket.objectKey(lister.Prefix)) {
+			lister.Logger.Warnf("s3awsLister: S3 Bucket.List(prefix=%q) returned key %q", lister.Bucket.objectKey(lister.Prefix), *key.Key)
 			continue
 		}
+		// Report keys relative to the volume's Prefix, like
+		// the keys accepted by other s3AWSbucket methods.
+		key.Key = aws.String(strings.TrimPrefix(*key.Key, lister.Bucket.prefix))
 		lister.buf = append(lister.buf, key)
 	}
 }
@@ -677,29 +1748,109 @@ func (lister *s3awsLister) pop() (k *s3.Object) {
 
 // IndexTo writes a complete list of locators with the given prefix
 // for which Get() can retrieve data.
+//
+// If IndexWorkers > 1 and prefix is shorter than 2 characters, the
+// listing is split into one listing per 2-hex-digit prefix, which are
+// run concurrently. The output is the same as a sequential listing.
 func (v *S3AWSVolume) IndexTo(prefix string, writer io.Writer) error {
+	if v.IndexWorkers <= 1 || len(prefix) >= 2 {
+		return v.indexTo(prefix, writer)
+	}
+	var subprefixes []string
+	for i := 0; i < 256; i++ {
+		if sub := fmt.Sprintf("%02x", i); strings.HasPrefix(sub, prefix) {
+			subprefixes = append(subprefixes, sub)
+		}
+	}
+	bufs := make([]bytes.Buffer, len(subprefixes))
+	errs := make([]error, len(subprefixes))
+	done := make([]chan struct{}, len(subprefixes))
+	todo := make(chan int, len(subprefixes))
+	for i := range subprefixes {
+		done[i] = make(chan struct{})
+		todo <- i
+	}
+	close(todo)
+	// slots limits the number of listings that are in progress
+	// or finished but not yet written out, so a slow listing
+	// doesn't cause all of the others to accumulate in memory.
+	//
+	// A worker takes a slot before taking the next index from
+	// todo, so the slots are always held by the lowest indexes
+	// that haven't been written out yet. (If a worker took an
+	// index first, workers with later indexes could take all of
+	// the slots, and the next index to be written would never
+	// get one.)
+	slots := make(chan struct{}, v.IndexWorkers)
+	abort := make(chan struct{})
+	defer close(abort)
+	for w := 0; w < v.IndexWorkers; w++ {
+		go func() {
+			for {
+				select {
+				case slots <- struct{}{}:
+				case <-abort:
+					return
+				}
+				i, ok := <-todo
+				if !ok {
+					<-slots
+					return
+				}
+				select {
+				case <-abort:
+					return
+				default:
+				}
+				errs[i] = v.indexTo(subprefixes[i], &bufs[i])
+				close(done[i])
+			}
+		}()
+	}
+	for i := range subprefixes {
+		<-done[i]
+		err := errs[i]
+		if err == nil {
+			_, err = bufs[i].WriteTo(writer)
+		}
+		if err != nil {
+			// Closing abort tells the workers to skip
+			// the remaining listings.
+			return err
+		}
+		bufs[i] = bytes.Buffer{}
+		<-slots
+	}
+	return nil
+}
+
+func (v *S3AWSVolume) indexTo(prefix string, writer io.Writer) error {
 	prefix = v.key(prefix)
 	// Use a merge sort to find matching sets of X and recent/X.
 	dataL := s3awsLister{
-		Logger:   v.logger,
-		Bucket:   v.bucket,
-		Prefix:   prefix,
-		PageSize: v.IndexPageSize,
-		Stats:    &v.bucket.stats,
+		Logger:          v.logger,
+		Bucket:          v.bucket,
+		UseReadEndpoint: true,
+		Prefix:          prefix,
+		PageSize:        v.IndexPageSize,
+		Stats:           &v.bucket.stats,
 	}
 	recentL := s3awsLister{
-		Logger:   v.logger,
-		Bucket:   v.bucket,
-		Prefix:   "recent/" + prefix,
-		PageSize: v.IndexPageSize,
-		Stats:    &v.bucket.stats,
+		Logger:          v.logger,
+		Bucket:          v.bucket,
+		UseReadEndpoint: true,
+		Prefix:          v.RecentPrefix + prefix,
+		PageSize:        v.IndexPageSize,
+		Stats:           &v.bucket.stats,
 	}
 	for data, recent := dataL.First(), recentL.First(); data != nil && dataL.Error() == nil; data = dataL.Next() {
 		if *data.Key >= "g" {
-			// Conveniently, "recent/*" and "trash/*" are
-			// lexically greater than all hex-encoded data
-			// hashes, so stopping here avoids iterating
-			// over all of them needlessly with dataL.
+			// Conveniently, the default "recent/*" and
+			// "trash/*" prefixes are lexically greater
+			// than all hex-encoded data hashes, so
+			// stopping here avoids iterating over all of
+			// them needlessly with dataL. (Other prefixes
+			// are skipped by isKeepBlock below.)
 			break
 		}
 		loc, isblk := v.isKeepBlock(*data.Key)
@@ -715,7 +1866,7 @@ func (v *S3AWSVolume) IndexTo(prefix string, writer io.Writer) error {
 
 		// Advance to the corresponding recent/X marker, if any
 		for recent != nil && recentL.Error() == nil {
-			if cmp := strings.Compare((*recent.Key)[7:], *data.Key); cmp < 0 {
+			if cmp := strings.Compare((*recent.Key)[len(v.RecentPrefix):], *data.Key); cmp < 0 {
 				recent = recentL.Next()
 				continue
 			} else if cmp == 0 {
@@ -742,24 +1893,32 @@ func (v *S3AWSVolume) IndexTo(prefix string, writer io.Writer) error {
 
 // Mtime returns the stored timestamp for the given locator.
 func (v *S3AWSVolume) Mtime(loc string) (time.Time, error) {
+	if err := v.checkLocator(loc); err != nil {
+		return s3AWSZeroTime, err
+	}
 	key := v.key(loc)
-	_, err := v.head(key)
+	data, err := v.head(key)
 	if err != nil {
 		return s3AWSZeroTime, v.translateError(err)
 	}
-	resp, err := v.head("recent/" + key)
+	resp, err := v.head(v.RecentPrefix + key)
 	err = v.translateError(err)
-	if os.IsNotExist(err) {
+	if os.IsNotExist(err) && v.volume.ReadOnly {
+		// The data object X exists, but recent/X is missing,
+		// and we can't create it on a read-only volume. Use
+		// the timestamp on the data object.
+		return *data.LastModified, nil
+	} else if os.IsNotExist(err) {
 		// The data object X exists, but recent/X is missing.
-		err = v.writeObject(context.Background(), "recent/"+key, nil)
+		err = v.writeObject(context.Background(), v.RecentPrefix+key, nil)
 		if err != nil {
-			v.logger.WithError(err).Errorf("error creating %q", "recent/"+key)
+			v.logger.WithError(err).Errorf("error creating %q", v.RecentPrefix+key)
 			return s3AWSZeroTime, v.translateError(err)
 		}
-		v.logger.Infof("Mtime: created %q to migrate existing block to new storage scheme", "recent/"+key)
-		resp, err = v.head("recent/" + key)
+		v.logger.Infof("Mtime: created %q to migrate existing block to new storage scheme", v.RecentPrefix+key)
+		resp, err = v.head(v.RecentPrefix + key)
 		if err != nil {
-			v.logger.WithError(err).Errorf("HEAD failed after creating %q", "recent/"+key)
+			v.logger.WithError(err).Errorf("HEAD failed after creating %q", v.RecentPrefix+key)
 			return s3AWSZeroTime, v.translateError(err)
 		}
 	} else if err != nil {
@@ -780,6 +1939,34 @@ func (v *S3AWSVolume) Status() *VolumeStatus {
 	}
 }
 
+// Health reports whether the bucket is reachable, using a HeadBucket
+// request. To avoid sending a request each time it is called, Health
+// returns the result of the previous check if it was done less than
+// s3HealthCheckInterval ago.
+func (v *S3AWSVolume) Health() VolumeHealth {
+	v.healthMtx.Lock()
+	defer v.healthMtx.Unlock()
+	if time.Since(v.health.LastCheck) < s3HealthCheckInterval {
+		return v.health
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s3HealthCheckTimeout)
+	defer cancel()
+	_, err := v.bucket.svc.HeadBucketRequest(&s3.HeadBucketInput{
+		Bucket: aws.String(v.bucket.bucket),
+	}).Send(ctx)
+	v.bucket.stats.TickOps("head")
+	v.bucket.stats.Tick(&v.bucket.stats.Ops, &v.bucket.stats.HeadOps)
+	v.bucket.stats.TickErr(err)
+	v.health.LastCheck = time.Now()
+	v.health.LastError = err
+	if err == nil {
+		v.health.LastSuccess = v.health.LastCheck
+	} else {
+		v.logger.WithError(err).Warnf("%s: health check failed", v)
+	}
+	return v.health
+}
+
 // InternalStats returns bucket I/O and API call counters.
 func (v *S3AWSVolume) InternalStats() interface{} {
 	return &v.bucket.stats
@@ -790,6 +1977,9 @@ func (v *S3AWSVolume) Touch(loc string) error {
 	if v.volume.ReadOnly {
 		return MethodDisabledError
 	}
+	if err := v.checkLocator(loc); err != nil {
+		return err
+	}
 	key := v.key(loc)
 	_, err := v.head(key)
 	err = v.translateError(err)
@@ -799,14 +1989,14 @@ func (v *S3AWSVolume) Touch(loc string) error {
 	} else if err != nil {
 		return err
 	}
-	err = v.writeObject(context.Background(), "recent/"+key, nil)
+	err = v.writeObject(context.Background(), v.RecentPrefix+key, nil)
 	return v.translateError(err)
 }
 
 // checkRaceWindow returns a non-nil error if trash/key is, or might
 // be, in the race window (i.e., it's not safe to trash key).
 func (v *S3AWSVolume) checkRaceWindow(key string) error {
-	resp, err := v.head("trash/" + key)
+	resp, err := v.head(v.TrashPrefix + key)
 	err = v.translateError(err)
 	if os.IsNotExist(err) {
 		// OK, trash/X doesn't exist so we're not in the race
@@ -834,21 +2024,76 @@ func (v *S3AWSVolume) checkRaceWindow(key string) error {
 func (b *s3AWSbucket) Del(path string) error {
 	input := &s3.DeleteObjectInput{
 		Bucket: aws.String(b.bucket),
-		Key:    aws.String(path),
+		Key:    aws.String(b.objectKey(path)),
 	}
+	reqctx, cancel := b.withTimeout(context.Background())
+	defer cancel()
+	t0 := time.Now()
 	req := b.svc.DeleteObjectRequest(input)
-	_, err := req.Send(context.Background())
+	_, err := req.Send(reqctx)
+	err = b.timeoutError(context.Background(), reqctx, err)
+	b.stats.TickLatency("delete", t0)
 	b.stats.TickOps("delete")
 	b.stats.Tick(&b.stats.Ops, &b.stats.DelOps)
 	b.stats.TickErr(err)
 	return err
 }
 
+// Maximum number of keys in a single DeleteObjects request.
+const s3MaxDeleteBatch = 1000
+
+// DelBatch deletes the given paths using a single DeleteObjects
+// request, and returns the paths that were deleted successfully. If
+// the request itself fails (e.g., the endpoint does not support
+// DeleteObjects), DelBatch returns an error and nothing is deleted.
+func (b *s3AWSbucket) DelBatch(paths []string) ([]string, error) {
+	objs := make([]s3.ObjectIdentifier, len(paths))
+	for i, path := range paths {
+		objs[i] = s3.ObjectIdentifier{Key: aws.String(b.objectKey(path))}
+	}
+	input := &s3.DeleteObjectsInput{
+		Bucket: aws.String(b.bucket),
+		Delete: &s3.Delete{
+			Objects: objs,
+			Quiet:   aws.Bool(true),
+		},
+	}
+	reqctx, cancel := b.withTimeout(context.Background())
+	defer cancel()
+	t0 := time.Now()
+	req := b.svc.DeleteObjectsRequest(input)
+	resp, err := req.Send(reqctx)
+	err = b.timeoutError(context.Background(), reqctx, err)
+	b.stats.TickLatency("delete_batch", t0)
+	b.stats.TickOps("delete_batch")
+	b.stats.Tick(&b.stats.Ops, &b.stats.DelOps)
+	b.stats.TickErr(err)
+	if err != nil {
+		return nil, err
+	}
+	failed := map[string]bool{}
+	for _, e := range resp.Errors {
+		if e.Key != nil {
+			failed[*e.Key] = true
+		}
+	}
+	deleted := make([]string, 0, len(paths))
+	for _, path := range paths {
+		if !failed[b.objectKey(path)] {
+			deleted = append(deleted, path)
+		}
+	}
+	return deleted, nil
+}
+
 // Trash a Keep block.
 func (v *S3AWSVolume) Trash(loc string) error {
 	if v.volume.ReadOnly && !v.volume.AllowTrashWhenReadOnly {
 		return MethodDisabledError
 	}
+	if err := v.checkLocator(loc); err != nil {
+		return err
+	}
 	if t, err := v.Mtime(loc); err != nil {
 		return err
 	} else if time.Since(t) < v.cluster.Collections.BlobSigningTTL.Duration() {
@@ -859,27 +2104,37 @@ func (v *S3AWSVolume) Trash(loc string) error {
 		if !v.UnsafeDelete {
 			return ErrS3TrashDisabled
 		}
-		return v.translateError(v.bucket.Del(key))
+		return v.translateError(v.retryThrottled(context.Background(), func() error {
+			return v.bucket.Del(key)
+		}))
 	}
 	err := v.checkRaceWindow(key)
 	if err != nil {
 		return err
 	}
-	err = v.safeCopy("trash/"+key, key)
+	err = v.safeCopy(v.TrashPrefix+key, key)
 	if err != nil {
 		return err
 	}
-	return v.translateError(v.bucket.Del(key))
+	return v.translateError(v.retryThrottled(context.Background(), func() error {
+		return v.bucket.Del(key)
+	}))
 }
 
 // Untrash moves block from trash back into store
 func (v *S3AWSVolume) Untrash(loc string) error {
+	if v.volume.ReadOnly {
+		return MethodDisabledError
+	}
+	if err := v.checkLocator(loc); err != nil {
+		return err
+	}
 	key := v.key(loc)
-	err := v.safeCopy(key, "trash/"+key)
+	err := v.safeCopy(key, v.TrashPrefix+key)
 	if err != nil {
 		return err
 	}
-	err = v.writeObject(context.Background(), "recent/"+key, nil)
+	err = v.writeObject(context.Background(), v.RecentPrefix+key, nil)
 	return v.translateError(err)
 }
 
@@ -891,6 +2146,11 @@ type s3awsbucketStats struct {
 	HeadOps uint64
 	DelOps  uint64
 	ListOps uint64
+
+	ChecksumErrs           uint64
+	CredentialsExpiredErrs uint64
+	ThrottledRetries       uint64
+	RaceRepairs            uint64
 }
 
 func (s *s3awsbucketStats) TickErr(err error) {
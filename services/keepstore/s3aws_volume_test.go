@@ -9,24 +9,32 @@ import (
 	"context"
 	"crypto/md5"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/s3manager"
 
 	"github.com/johannesboyne/gofakes3"
 	"github.com/johannesboyne/gofakes3/backend/s3mem"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/sirupsen/logrus"
 	check "gopkg.in/check.v1"
 )
@@ -120,6 +128,79 @@ func (s *StubbedS3AWSSuite) TestIndex(c *check.C) {
 	}
 }
 
+func (s *StubbedS3AWSSuite) TestIndexWorkers(c *check.C) {
+	v := s.newTestableVolume(c, s.cluster, arvados.Volume{Replication: 2}, newVolumeMetricsVecs(prometheus.NewRegistry()), 0)
+	v.IndexPageSize = 3
+	for i := 0; i < 256; i++ {
+		v.PutRaw(fmt.Sprintf("%02x%030x", i, i), []byte{102, 111, 111})
+	}
+	for _, prefix := range []string{"", "c", "bc", "abc"} {
+		v.IndexWorkers = 1
+		expect := new(bytes.Buffer)
+		err := v.IndexTo(prefix, expect)
+		c.Check(err, check.IsNil)
+
+		v.IndexWorkers = 8
+		buf := new(bytes.Buffer)
+		err = v.IndexTo(prefix, buf)
+		c.Check(err, check.IsNil)
+		c.Check(buf.String(), check.Equals, expect.String(), check.Commentf("prefix %q", prefix))
+	}
+}
+
+// s3AWSSlowListHandler passes requests through to a fake S3 server,
+// except that listings of some 2-digit prefixes are delayed, so
+// concurrent listings finish out of order.
+type s3AWSSlowListHandler struct {
+	next http.Handler
+}
+
+func (h *s3AWSSlowListHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if prefix := r.URL.Query().Get("prefix"); r.Method == http.MethodGet && len(prefix) >= 2 {
+		if n, err := strconv.ParseUint(prefix[len(prefix)-2:], 16, 8); err == nil && n%3 == 0 {
+			time.Sleep(time.Duration(n%5) * time.Millisecond)
+		}
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+func (s *StubbedS3AWSSuite) TestIndexWorkersOutOfOrder(c *check.C) {
+	s.s3server = httptest.NewServer(&s3AWSSlowListHandler{
+		next: gofakes3.New(s3mem.New(), gofakes3.WithLogger(nil), gofakes3.WithTimeSkewLimit(0)).Server(),
+	})
+	defer func() {
+		s.s3server.Close()
+		s.s3server = nil
+	}()
+	v := s.newTestableVolume(c, s.cluster, arvados.Volume{Replication: 2}, newVolumeMetricsVecs(prometheus.NewRegistry()), 0)
+	for i := 0; i < 256; i++ {
+		v.PutRaw(fmt.Sprintf("%02x%030x", i, i), []byte{102, 111, 111})
+	}
+	v.IndexWorkers = 1
+	expect := new(bytes.Buffer)
+	c.Assert(v.IndexTo("", expect), check.IsNil)
+
+	v.IndexWorkers = 2
+	for trial := 0; trial < 5; trial++ {
+		buf := new(bytes.Buffer)
+		done := make(chan error, 1)
+		go func() { done <- v.IndexTo("", buf) }()
+		select {
+		case err := <-done:
+			c.Check(err, check.IsNil)
+			c.Check(buf.String(), check.Equals, expect.String())
+		case <-time.After(time.Minute):
+			c.Fatal("timed out -- IndexTo deadlocked?")
+		}
+	}
+}
+
+func (s *StubbedS3AWSSuite) TestIndexWorkersInvalid(c *check.C) {
+	v := s.newTestableVolume(c, s.cluster, arvados.Volume{Replication: 2}, newVolumeMetricsVecs(prometheus.NewRegistry()), 0)
+	v.IndexWorkers = -1
+	c.Check(v.check(""), check.ErrorMatches, `.*IndexWorkers.*`)
+}
+
 func (s *StubbedS3AWSSuite) TestSignature(c *check.C) {
 	var header http.Header
 	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -151,6 +232,719 @@ func (s *StubbedS3AWSSuite) TestSignature(c *check.C) {
 	c.Check(header.Get("Authorization"), check.Matches, `AWS4-HMAC-SHA256 .*`)
 }
 
+// newStubVolume returns a volume that sends its requests to the stub
+// S3 server at stubURL. Tests only set the driver parameters they are
+// interested in: the credentials, region, and bucket are filled in
+// here.
+func (s *StubbedS3AWSSuite) newStubVolume(c *check.C, stubURL string, params arvados.S3VolumeDriverParameters) *S3AWSVolume {
+	params.AccessKeyID = "xxx"
+	params.SecretAccessKey = "xxx"
+	params.Endpoint = stubURL
+	params.Region = "test-region-1"
+	params.Bucket = "test-bucket-name"
+	// Our test S3 server uses the older 'Path Style'
+	params.UsePathStyle = true
+	v := &S3AWSVolume{
+		S3VolumeDriverParameters: params,
+		cluster:                  s.cluster,
+		logger:                   ctxlog.TestLogger(c),
+		metrics:                  newVolumeMetricsVecs(prometheus.NewRegistry()),
+	}
+	c.Assert(v.check(""), check.IsNil)
+	return v
+}
+
+func (s *StubbedS3AWSSuite) TestUsePathStyle(c *check.C) {
+	var reqPaths, reqHosts []string
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqPaths = append(reqPaths, r.URL.Path)
+		reqHosts = append(reqHosts, r.Host)
+	}))
+	defer stub.Close()
+
+	vol := s.newStubVolume(c, stub.URL, arvados.S3VolumeDriverParameters{UsePathStyle: true})
+	c.Check(vol.bucket.svc.ForcePathStyle, check.Equals, true)
+	err := vol.Put(context.Background(), "acbd18db4cc2f85cedef654fccc4a4d8", []byte("foo"))
+	c.Check(err, check.IsNil)
+	c.Assert(reqPaths, check.Not(check.HasLen), 0)
+	c.Check(reqPaths[0], check.Equals, "/test-bucket-name/acbd18db4cc2f85cedef654fccc4a4d8")
+	for _, host := range reqHosts {
+		c.Check(host, check.Equals, strings.TrimPrefix(stub.URL, "http://"))
+	}
+
+	// Virtual-hosted style is the default.
+	vol.UsePathStyle = false
+	c.Assert(vol.check(""), check.IsNil)
+	c.Check(vol.bucket.svc.ForcePathStyle, check.Equals, false)
+}
+
+func (s *StubbedS3AWSSuite) TestReadEndpoint(c *check.C) {
+	loc := "acbd18db4cc2f85cedef654fccc4a4d8"
+	var mtx sync.Mutex
+	var readReqs, writeReqs []string
+	readStub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		readReqs = append(readReqs, r.Method+" "+r.URL.Path)
+		mtx.Unlock()
+		switch {
+		case r.URL.Query().Get("list-type") != "":
+			contents := ""
+			if !strings.HasPrefix(r.URL.Query().Get("prefix"), "recent/") {
+				contents = fmt.Sprintf(`<Contents><Key>%s</Key><LastModified>2021-01-01T00:00:00.000Z</LastModified><ETag>&quot;%s&quot;</ETag><Size>3</Size></Contents>`, loc, loc)
+			}
+			w.Header().Set("Content-Type", "application/xml")
+			fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>test-bucket-name</Name><IsTruncated>false</IsTruncated>%s</ListBucketResult>`, contents)
+		case r.Method == http.MethodHead:
+			w.Header().Set("ETag", `"`+loc+`"`)
+			w.Header().Set("Content-Length", "3")
+		default:
+			w.Header().Set("ETag", `"`+loc+`"`)
+			w.Write([]byte("foo"))
+		}
+	}))
+	defer readStub.Close()
+	writeStub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		writeReqs = append(writeReqs, r.Method+" "+r.URL.Path)
+		mtx.Unlock()
+	}))
+	defer writeStub.Close()
+
+	vol := s.newStubVolume(c, writeStub.URL, arvados.S3VolumeDriverParameters{ReadEndpoint: readStub.URL})
+
+	err := vol.Put(context.Background(), loc, []byte("foo"))
+	c.Check(err, check.IsNil)
+	c.Check(readReqs, check.HasLen, 0)
+	c.Check(writeReqs, check.Not(check.HasLen), 0)
+	for _, req := range writeReqs {
+		c.Check(req, check.Matches, `PUT /test-bucket-name/.*`)
+	}
+
+	writeReqs = nil
+	buf := make([]byte, 3)
+	n, err := vol.Get(context.Background(), loc, buf)
+	c.Check(err, check.IsNil)
+	c.Check(string(buf[:n]), check.Equals, "foo")
+	c.Check(vol.Compare(context.Background(), loc, []byte("foo")), check.IsNil)
+	var index bytes.Buffer
+	c.Check(vol.IndexTo("", &index), check.IsNil)
+	c.Check(index.String(), check.Matches, loc+`\+3 \d+\n`)
+	c.Check(writeReqs, check.HasLen, 0)
+	c.Check(readReqs, check.Not(check.HasLen), 0)
+	for _, req := range readReqs {
+		c.Check(req, check.Matches, `(GET|HEAD) /test-bucket-name(/.*)?`)
+	}
+
+	// Without ReadEndpoint, reads go to Endpoint.
+	readReqs, writeReqs = nil, nil
+	vol.ReadEndpoint = ""
+	c.Assert(vol.check(""), check.IsNil)
+	vol.Get(context.Background(), loc, buf)
+	c.Check(readReqs, check.HasLen, 0)
+	c.Check(writeReqs, check.Not(check.HasLen), 0)
+}
+
+func (s *StubbedS3AWSSuite) TestCACertificates(c *check.C) {
+	stub := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer stub.Close()
+	cafile := c.MkDir() + "/ca.pem"
+	err := os.WriteFile(cafile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: stub.Certificate().Raw}), 0600)
+	c.Assert(err, check.IsNil)
+
+	for _, trial := range []struct {
+		caCertificates string
+		insecure       bool
+		expectErr      string
+	}{
+		{"", false, `(?s).*certificate.*`},
+		{cafile, false, ``},
+		{"", true, ``},
+	} {
+		c.Logf("trial: %+v", trial)
+		vol := s.newStubVolume(c, stub.URL, arvados.S3VolumeDriverParameters{
+			CACertificates: trial.caCertificates,
+			InsecureTLS:    trial.insecure,
+		})
+		err = vol.Put(context.Background(), "acbd18db4cc2f85cedef654fccc4a4d8", []byte("foo"))
+		if trial.expectErr == "" {
+			c.Check(err, check.IsNil)
+		} else {
+			c.Check(err, check.ErrorMatches, trial.expectErr)
+		}
+	}
+
+	vol := S3AWSVolume{
+		S3VolumeDriverParameters: arvados.S3VolumeDriverParameters{
+			Endpoint:       stub.URL,
+			Bucket:         "test-bucket-name",
+			CACertificates: c.MkDir() + "/nonexistent.pem",
+		},
+		cluster: s.cluster,
+		logger:  ctxlog.TestLogger(c),
+		metrics: newVolumeMetricsVecs(prometheus.NewRegistry()),
+	}
+	c.Check(vol.check(""), check.ErrorMatches, `DriverParameters: error reading CACertificates: .*`)
+}
+
+func (s *StubbedS3AWSSuite) TestHealth(c *check.C) {
+	defer func(d time.Duration) { s3HealthCheckInterval = d }(s3HealthCheckInterval)
+	s3HealthCheckInterval = time.Hour
+
+	var headBucketReqs int32
+	var failing int32 = 1
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" && r.URL.Path == "/test-bucket-name" {
+			atomic.AddInt32(&headBucketReqs, 1)
+			if atomic.LoadInt32(&failing) == 1 {
+				w.WriteHeader(http.StatusForbidden)
+			}
+		}
+	}))
+	defer stub.Close()
+
+	vol := s.newStubVolume(c, stub.URL, arvados.S3VolumeDriverParameters{})
+
+	h := vol.Health()
+	c.Check(h.LastError, check.ErrorMatches, `(?s).*403.*`)
+	c.Check(h.LastCheck.IsZero(), check.Equals, false)
+	c.Check(h.LastSuccess.IsZero(), check.Equals, true)
+	c.Check(atomic.LoadInt32(&headBucketReqs), check.Equals, int32(1))
+
+	// The backend recovers, but the previous result is reported
+	// until s3HealthCheckInterval has passed.
+	atomic.StoreInt32(&failing, 0)
+	c.Check(vol.Health().LastError, check.NotNil)
+	c.Check(atomic.LoadInt32(&headBucketReqs), check.Equals, int32(1))
+
+	s3HealthCheckInterval = 0
+	h = vol.Health()
+	c.Check(h.LastError, check.IsNil)
+	c.Check(h.LastSuccess, check.Equals, h.LastCheck)
+	c.Check(atomic.LoadInt32(&headBucketReqs), check.Equals, int32(2))
+}
+
+func (s *StubbedS3AWSSuite) TestChecksumAlgorithm(c *check.C) {
+	var putHeaders []http.Header
+	getChecksum := "bogus"
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "PUT":
+			putHeaders = append(putHeaders, r.Header)
+		case "GET":
+			c.Check(r.Header.Get("X-Amz-Checksum-Mode"), check.Equals, "ENABLED")
+			w.Header().Set("X-Amz-Checksum-Crc32c", getChecksum)
+			w.Write([]byte("foo"))
+		}
+	}))
+	defer stub.Close()
+
+	vol := s.newStubVolume(c, stub.URL, arvados.S3VolumeDriverParameters{ChecksumAlgorithm: "crc32c"})
+
+	loc := "acbd18db4cc2f85cedef654fccc4a4d8"
+	err := vol.Put(context.Background(), loc, []byte("foo"))
+	c.Check(err, check.IsNil)
+	c.Assert(putHeaders, check.HasLen, 2)
+	c.Check(putHeaders[0].Get("X-Amz-Checksum-Crc32c"), check.Equals, "z8SuHQ==")
+
+	buf := make([]byte, 3)
+	_, err = vol.Get(context.Background(), loc, buf)
+	c.Check(err, check.FitsTypeOf, s3ChecksumError{})
+	c.Check(vol.bucket.stats.ChecksumErrs, check.Equals, uint64(1))
+
+	getChecksum = "z8SuHQ=="
+	n, err := vol.Get(context.Background(), loc, buf)
+	c.Check(err, check.IsNil)
+	c.Check(string(buf[:n]), check.Equals, "foo")
+
+	// Server doesn't report a checksum: accept the data as is.
+	getChecksum = ""
+	n, err = vol.Get(context.Background(), loc, buf)
+	c.Check(err, check.IsNil)
+	c.Check(n, check.Equals, 3)
+}
+
+func (s *StubbedS3AWSSuite) TestChecksumAlgorithmUnsupported(c *check.C) {
+	var putHeaders []http.Header
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		putHeaders = append(putHeaders, r.Header)
+		if r.Header.Get("X-Amz-Checksum-Sha256") != "" {
+			w.WriteHeader(http.StatusNotImplemented)
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>NotImplemented</Code><Message>A header you provided implies functionality that is not implemented</Message></Error>`))
+		}
+	}))
+	defer stub.Close()
+
+	vol := s.newStubVolume(c, stub.URL, arvados.S3VolumeDriverParameters{ChecksumAlgorithm: "SHA256"})
+
+	err := vol.Put(context.Background(), "acbd18db4cc2f85cedef654fccc4a4d8", []byte("foo"))
+	c.Check(err, check.IsNil)
+	// First attempt is rejected, then the block and the
+	// recent/ marker are written without checksum headers.
+	c.Assert(putHeaders, check.HasLen, 3)
+	c.Check(putHeaders[1].Get("X-Amz-Checksum-Sha256"), check.Equals, "")
+	c.Check(putHeaders[2].Get("X-Amz-Checksum-Sha256"), check.Equals, "")
+	c.Check(vol.checksumAlgorithm(), check.Equals, "")
+}
+
+func (s *StubbedS3AWSSuite) TestChecksumAlgorithmInvalid(c *check.C) {
+	vol := S3AWSVolume{
+		S3VolumeDriverParameters: arvados.S3VolumeDriverParameters{
+			Endpoint:          "http://localhost:12345",
+			Bucket:            "test-bucket-name",
+			ChecksumAlgorithm: "MD4",
+		},
+		cluster: s.cluster,
+		logger:  ctxlog.TestLogger(c),
+		metrics: newVolumeMetricsVecs(prometheus.NewRegistry()),
+	}
+	err := vol.check("")
+	c.Check(err, check.ErrorMatches, `.*unsupported ChecksumAlgorithm "MD4"`)
+}
+
+func (s *StubbedS3AWSSuite) TestACL(c *check.C) {
+	var acls []string
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			acls = append(acls, r.Header.Get("X-Amz-Acl"))
+		}
+	}))
+	defer stub.Close()
+
+	vol := s.newStubVolume(c, stub.URL, arvados.S3VolumeDriverParameters{ACL: "bucket-owner-full-control"})
+
+	err := vol.Put(context.Background(), "acbd18db4cc2f85cedef654fccc4a4d8", []byte("foo"))
+	c.Check(err, check.IsNil)
+	// One upload for the data block, one for the recent/ marker
+	c.Check(acls, check.DeepEquals, []string{"bucket-owner-full-control", "bucket-owner-full-control"})
+}
+
+func (s *StubbedS3AWSSuite) TestACLInvalid(c *check.C) {
+	vol := S3AWSVolume{
+		S3VolumeDriverParameters: arvados.S3VolumeDriverParameters{
+			Endpoint: "http://localhost:12345",
+			Bucket:   "test-bucket-name",
+			ACL:      "everyone-welcome",
+		},
+		cluster: s.cluster,
+		logger:  ctxlog.TestLogger(c),
+		metrics: newVolumeMetricsVecs(prometheus.NewRegistry()),
+	}
+	err := vol.check("")
+	c.Check(err, check.ErrorMatches, `.*unsupported ACL "everyone-welcome"`)
+}
+
+func (s *StubbedS3AWSSuite) TestStorageClass(c *check.C) {
+	var classes []string
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			classes = append(classes, r.Header.Get("X-Amz-Storage-Class"))
+		}
+	}))
+	defer stub.Close()
+
+	for _, trial := range []struct {
+		configured string
+		expect     string
+	}{
+		{"", ""},
+		{"STANDARD_IA", "STANDARD_IA"},
+		{"intelligent_tiering", "INTELLIGENT_TIERING"},
+	} {
+		c.Logf("trial: %+v", trial)
+		classes = nil
+		vol := s.newStubVolume(c, stub.URL, arvados.S3VolumeDriverParameters{StorageClass: trial.configured})
+
+		err := vol.Put(context.Background(), "acbd18db4cc2f85cedef654fccc4a4d8", []byte("foo"))
+		c.Check(err, check.IsNil)
+		c.Check(classes, check.DeepEquals, []string{trial.expect, trial.expect})
+	}
+}
+
+func (s *StubbedS3AWSSuite) TestStorageClassInvalid(c *check.C) {
+	for _, class := range []string{"GLACIER", "DEEP_ARCHIVE", "CHEAP"} {
+		vol := S3AWSVolume{
+			S3VolumeDriverParameters: arvados.S3VolumeDriverParameters{
+				Endpoint:     "http://localhost:12345",
+				Bucket:       "test-bucket-name",
+				StorageClass: class,
+			},
+			cluster: s.cluster,
+			logger:  ctxlog.TestLogger(c),
+			metrics: newVolumeMetricsVecs(prometheus.NewRegistry()),
+		}
+		err := vol.check("")
+		c.Check(err, check.ErrorMatches, `.*unsupported StorageClass "`+class+`"`)
+	}
+}
+
+func (s *StubbedS3AWSSuite) TestSSE(c *check.C) {
+	var headers []http.Header
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			headers = append(headers, r.Header)
+		}
+	}))
+	defer stub.Close()
+
+	for _, trial := range []struct {
+		sseType  string
+		keyID    string
+		expectID string
+	}{
+		{"", "", ""},
+		{"AES256", "", ""},
+		{"aws:kms", "arn:aws:kms:test-region-1:123456789012:key/test", "arn:aws:kms:test-region-1:123456789012:key/test"},
+	} {
+		c.Logf("trial: %+v", trial)
+		headers = nil
+		vol := s.newStubVolume(c, stub.URL, arvados.S3VolumeDriverParameters{
+			SSEType:     trial.sseType,
+			SSEKMSKeyID: trial.keyID,
+		})
+
+		err := vol.Put(context.Background(), "acbd18db4cc2f85cedef654fccc4a4d8", []byte("foo"))
+		c.Check(err, check.IsNil)
+		c.Assert(headers, check.HasLen, 2)
+		for _, h := range headers {
+			c.Check(h.Get("X-Amz-Server-Side-Encryption"), check.Equals, trial.sseType)
+			c.Check(h.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"), check.Equals, trial.expectID)
+		}
+	}
+}
+
+func (s *StubbedS3AWSSuite) TestSSEInvalid(c *check.C) {
+	for _, trial := range []struct {
+		sseType string
+		keyID   string
+		err     string
+	}{
+		{"aws:kms", "", `.*SSEType "aws:kms" requires SSEKMSKeyID`},
+		{"AES256", "test-key", `.*SSEKMSKeyID requires SSEType "aws:kms"`},
+		{"", "test-key", `.*SSEKMSKeyID requires SSEType "aws:kms"`},
+		{"rot13", "", `.*unsupported SSEType "rot13".*`},
+	} {
+		c.Logf("trial: %+v", trial)
+		vol := S3AWSVolume{
+			S3VolumeDriverParameters: arvados.S3VolumeDriverParameters{
+				Endpoint:    "http://localhost:12345",
+				Bucket:      "test-bucket-name",
+				SSEType:     trial.sseType,
+				SSEKMSKeyID: trial.keyID,
+			},
+			cluster: s.cluster,
+			logger:  ctxlog.TestLogger(c),
+			metrics: newVolumeMetricsVecs(prometheus.NewRegistry()),
+		}
+		err := vol.check("")
+		c.Check(err, check.ErrorMatches, trial.err)
+	}
+}
+
+// The fake S3 backend ignores SSE headers, so this only confirms
+// that sending them doesn't interfere with reading the stored
+// objects back.
+func (s *StubbedS3AWSSuite) TestSSEReadBack(c *check.C) {
+	v := s.newTestableVolume(c, s.cluster, arvados.Volume{Replication: 2}, newVolumeMetricsVecs(prometheus.NewRegistry()), 0)
+	v.SSEType = "aws:kms"
+	v.SSEKMSKeyID = "test-key"
+	ctx := context.Background()
+	loc := "acbd18db4cc2f85cedef654fccc4a4d8"
+	c.Assert(v.Put(ctx, loc, []byte("foo")), check.IsNil)
+	buf := make([]byte, 3)
+	n, err := v.Get(ctx, loc, buf)
+	c.Check(err, check.IsNil)
+	c.Check(string(buf[:n]), check.Equals, "foo")
+	c.Check(v.Compare(ctx, loc, []byte("foo")), check.IsNil)
+	_, err = v.Mtime(loc)
+	c.Check(err, check.IsNil)
+	c.Check(v.Touch(loc), check.IsNil)
+}
+
+func (s *StubbedS3AWSSuite) TestUploadTuning(c *check.C) {
+	for _, trial := range []struct {
+		partSize    arvados.ByteSize
+		concurrency int
+		expectSize  arvados.ByteSize
+		expectConc  int
+		err         string
+	}{
+		{0, 0, PartSize, WriteConcurrency, ``},
+		{8 << 20, 2, 8 << 20, 2, ``},
+		{PartSize - 1, 0, 0, 0, `.*UploadPartSize 5242879 is too small.*`},
+		{0, -1, 0, 0, `.*UploadConcurrency must not be negative`},
+	} {
+		c.Logf("trial: %+v", trial)
+		vol := S3AWSVolume{
+			S3VolumeDriverParameters: arvados.S3VolumeDriverParameters{
+				Endpoint:          "http://localhost:12345",
+				Bucket:            "test-bucket-name",
+				UploadPartSize:    trial.partSize,
+				UploadConcurrency: trial.concurrency,
+			},
+			cluster: s.cluster,
+			logger:  ctxlog.TestLogger(c),
+			metrics: newVolumeMetricsVecs(prometheus.NewRegistry()),
+		}
+		err := vol.check("")
+		if trial.err != "" {
+			c.Check(err, check.ErrorMatches, trial.err)
+			continue
+		}
+		c.Check(err, check.IsNil)
+		c.Check(vol.UploadPartSize, check.Equals, trial.expectSize)
+		c.Check(vol.UploadConcurrency, check.Equals, trial.expectConc)
+	}
+}
+
+func (s *StubbedS3AWSSuite) TestUploadMultipart(c *check.C) {
+	v := s.newTestableVolume(c, s.cluster, arvados.Volume{Replication: 2}, newVolumeMetricsVecs(prometheus.NewRegistry()), 0)
+	v.UploadPartSize = 6 << 20
+	v.UploadConcurrency = 2
+	ctx := context.Background()
+	data := make([]byte, 13<<20)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	loc := fmt.Sprintf("%x", md5.Sum(data))
+	c.Assert(v.Put(ctx, loc, data), check.IsNil)
+	buf := make([]byte, BlockSize)
+	n, err := v.Get(ctx, loc, buf)
+	c.Check(err, check.IsNil)
+	c.Check(bytes.Equal(buf[:n], data), check.Equals, true)
+}
+
+func (s *StubbedS3AWSSuite) TestPrefix(c *check.C) {
+	base := s.newTestableVolume(c, s.cluster, arvados.Volume{Replication: 2}, newVolumeMetricsVecs(prometheus.NewRegistry()), 0)
+	cluster := *s.cluster
+	cluster.Collections.BlobSigningTTL = 0
+	cluster.Collections.BlobTrashLifetime = arvados.Duration(time.Hour)
+	newVolume := func(prefix string) *S3AWSVolume {
+		v := &S3AWSVolume{
+			S3VolumeDriverParameters: base.S3VolumeDriverParameters,
+			cluster:                  &cluster,
+			logger:                   ctxlog.TestLogger(c),
+			metrics:                  newVolumeMetricsVecs(prometheus.NewRegistry()),
+		}
+		v.Prefix = prefix
+		c.Assert(v.check(""), check.IsNil)
+		v.bucket.svc.ForcePathStyle = true
+		return v
+	}
+	v1 := newVolume("cluster1/")
+	v2 := newVolume("cluster2/")
+	c.Check(v1.GetDeviceID(), check.Not(check.Equals), v2.GetDeviceID())
+
+	ctx := context.Background()
+	loc1 := "acbd18db4cc2f85cedef654fccc4a4d8" // "foo"
+	loc2 := "37b51d194a7513e45b56f6524f2d51f2" // "bar"
+	c.Assert(v1.Put(ctx, loc1, []byte("foo")), check.IsNil)
+	c.Assert(v2.Put(ctx, loc2, []byte("bar")), check.IsNil)
+
+	buf := make([]byte, 3)
+	n, err := v1.Get(ctx, loc1, buf)
+	c.Check(err, check.IsNil)
+	c.Check(string(buf[:n]), check.Equals, "foo")
+	n, err = v2.Get(ctx, loc2, buf)
+	c.Check(err, check.IsNil)
+	c.Check(string(buf[:n]), check.Equals, "bar")
+
+	// Each volume sees only its own blocks.
+	for _, trial := range []struct {
+		vol *S3AWSVolume
+		loc string
+	}{
+		{v1, loc2},
+		{v2, loc1},
+		{base.S3AWSVolume, loc1},
+		{base.S3AWSVolume, loc2},
+	} {
+		_, err = trial.vol.Get(ctx, trial.loc, buf)
+		c.Check(os.IsNotExist(err), check.Equals, true, check.Commentf("%s Get(%s): %v", trial.vol, trial.loc, err))
+		_, err = trial.vol.Mtime(trial.loc)
+		c.Check(os.IsNotExist(err), check.Equals, true, check.Commentf("%s Mtime(%s): %v", trial.vol, trial.loc, err))
+	}
+	for _, trial := range []struct {
+		vol    *S3AWSVolume
+		expect string
+	}{
+		{v1, loc1 + `\+3 \d+\n`},
+		{v2, loc2 + `\+3 \d+\n`},
+		{base.S3AWSVolume, ``},
+	} {
+		idx := &bytes.Buffer{}
+		c.Check(trial.vol.IndexTo("", idx), check.IsNil)
+		c.Check(idx.String(), check.Matches, trial.expect)
+	}
+
+	// Trash and untrash stay within the volume's prefix.
+	c.Check(v1.Trash(loc1), check.IsNil)
+	_, err = v1.Get(ctx, loc1, buf)
+	c.Check(os.IsNotExist(err), check.Equals, true)
+	_, err = v2.Get(ctx, loc2, buf)
+	c.Check(err, check.IsNil)
+	c.Check(v1.Untrash(loc1), check.IsNil)
+	_, err = v1.Get(ctx, loc1, buf)
+	c.Check(err, check.IsNil)
+}
+
+func (s *StubbedS3AWSSuite) TestPrefixInvalid(c *check.C) {
+	for _, prefix := range []string{"cluster1", "/cluster1/"} {
+		vol := S3AWSVolume{
+			S3VolumeDriverParameters: arvados.S3VolumeDriverParameters{
+				Endpoint: "http://localhost:12345",
+				Bucket:   "test-bucket-name",
+				Prefix:   prefix,
+			},
+			cluster: s.cluster,
+			logger:  ctxlog.TestLogger(c),
+			metrics: newVolumeMetricsVecs(prometheus.NewRegistry()),
+		}
+		err := vol.check("")
+		c.Check(err, check.ErrorMatches, `.*Prefix "`+prefix+`" must end with "/".*`)
+	}
+}
+
+func (s *StubbedS3AWSSuite) TestTags(c *check.C) {
+	type request struct {
+		method    string
+		path      string
+		tagging   string
+		directive string
+	}
+	var mtx sync.Mutex
+	var reqs []request
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		reqs = append(reqs, request{r.Method, r.URL.Path, r.Header.Get("X-Amz-Tagging"), r.Header.Get("X-Amz-Tagging-Directive")})
+		mtx.Unlock()
+		switch {
+		case r.Method == "HEAD" && strings.Contains(r.URL.Path, "/trash/"):
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == "HEAD":
+			w.Header().Set("Last-Modified", time.Now().Add(-time.Hour).UTC().Format(nearlyRFC1123))
+		case r.Method == "PUT" && r.Header.Get("X-Amz-Copy-Source") != "":
+			io.WriteString(w, `<CopyObjectResult><LastModified>`+time.Now().UTC().Format(time.RFC3339)+`</LastModified><ETag>"acbd18db4cc2f85cedef654fccc4a4d8"</ETag></CopyObjectResult>`)
+		case r.Method == "DELETE":
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer stub.Close()
+
+	cluster := *s.cluster
+	cluster.Collections.BlobSigningTTL = 0
+	cluster.Collections.BlobTrashLifetime = arvados.Duration(time.Hour)
+	v := s.newStubVolume(c, stub.URL, arvados.S3VolumeDriverParameters{Tags: map[string]string{"Project": "keep", "Owner": "ops team"}})
+	v.cluster = &cluster
+
+	loc := "acbd18db4cc2f85cedef654fccc4a4d8"
+	c.Assert(v.Put(context.Background(), loc, []byte("foo")), check.IsNil)
+	c.Assert(v.Trash(loc), check.IsNil)
+	c.Assert(v.Untrash(loc), check.IsNil)
+
+	var got []request
+	mtx.Lock()
+	for _, req := range reqs {
+		if req.method == "PUT" {
+			got = append(got, req)
+		}
+	}
+	mtx.Unlock()
+	c.Check(got, check.DeepEquals, []request{
+		// Put: data object is tagged, recent/ marker is not
+		{"PUT", "/test-bucket-name/" + loc, "Owner=ops+team&Project=keep", ""},
+		{"PUT", "/test-bucket-name/recent/" + loc, "", ""},
+		// Trash
+		{"PUT", "/test-bucket-name/trash/" + loc, "Owner=ops+team&Project=keep&arvados-trashed=true", "REPLACE"},
+		// Untrash
+		{"PUT", "/test-bucket-name/" + loc, "Owner=ops+team&Project=keep", "REPLACE"},
+		{"PUT", "/test-bucket-name/recent/" + loc, "", ""},
+	})
+}
+
+func (s *StubbedS3AWSSuite) TestTagsRoundTrip(c *check.C) {
+	v := s.newTestableVolume(c, s.cluster, arvados.Volume{Replication: 2}, newVolumeMetricsVecs(prometheus.NewRegistry()), 0)
+	v.Tags = map[string]string{"Project": "keep"}
+	loc := "acbd18db4cc2f85cedef654fccc4a4d8"
+	c.Assert(v.Put(context.Background(), loc, []byte("foo")), check.IsNil)
+	resp, err := v.bucket.svc.GetObjectTaggingRequest(&s3.GetObjectTaggingInput{
+		Bucket: aws.String(v.bucket.bucket),
+		Key:    aws.String(v.key(loc)),
+	}).Send(context.Background())
+	if err != nil {
+		c.Skip(fmt.Sprintf("fake S3 backend does not support object tagging: %s", err))
+	}
+	tags := map[string]string{}
+	for _, tag := range resp.TagSet {
+		tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	if len(tags) == 0 {
+		c.Skip("fake S3 backend does not store object tags")
+	}
+	c.Check(tags, check.DeepEquals, map[string]string{"Project": "keep"})
+}
+
+func (s *StubbedS3AWSSuite) TestTagsInvalid(c *check.C) {
+	for _, trial := range []struct {
+		tags map[string]string
+		err  string
+	}{
+		{map[string]string{"aws:foo": "bar"}, `.*invalid tag "aws:foo": key is reserved`},
+		{map[string]string{"arvados-trashed": "false"}, `.*invalid tag "arvados-trashed": key is reserved`},
+		{map[string]string{"": "bar"}, `.*invalid tag "".*`},
+		{map[string]string{"foo": strings.Repeat("x", 257)}, `.*invalid tag "foo".*`},
+		{map[string]string{"1": "", "2": "", "3": "", "4": "", "5": "", "6": "", "7": "", "8": "", "9": "", "10": ""}, `.*too many Tags \(10\).*`},
+	} {
+		vol := S3AWSVolume{
+			S3VolumeDriverParameters: arvados.S3VolumeDriverParameters{
+				Endpoint: "http://localhost:12345",
+				Bucket:   "test-bucket-name",
+				Tags:     trial.tags,
+			},
+			cluster: s.cluster,
+			logger:  ctxlog.TestLogger(c),
+			metrics: newVolumeMetricsVecs(prometheus.NewRegistry()),
+		}
+		c.Check(vol.check(""), check.ErrorMatches, trial.err)
+	}
+}
+
+func (s *StubbedS3AWSSuite) TestTrashRecentPrefixInvalid(c *check.C) {
+	for _, trial := range []struct {
+		prefixLength int
+		trashPrefix  string
+		recentPrefix string
+		err          string
+	}{
+		{0, "trash/", "trash/recent/", `.*must not overlap`},
+		{0, "keep/", "keep/", `.*must not overlap`},
+		{0, "abc", "recent/", `.*prefix "abc" overlaps data block keys.*`},
+		{3, "abc/", "recent/", `.*prefix "abc/" overlaps data block keys.*`},
+		{3, "trash/", "abc/ab", `.*prefix "abc/ab" overlaps data block keys.*`},
+		{0, "abc/", "recent/", ``},
+		{3, "abc/def", "recent/", ``},
+	} {
+		c.Logf("trial: %+v", trial)
+		vol := S3AWSVolume{
+			S3VolumeDriverParameters: arvados.S3VolumeDriverParameters{
+				Endpoint:     "http://localhost:12345",
+				Bucket:       "test-bucket-name",
+				PrefixLength: trial.prefixLength,
+				TrashPrefix:  trial.trashPrefix,
+				RecentPrefix: trial.recentPrefix,
+			},
+			cluster: s.cluster,
+			logger:  ctxlog.TestLogger(c),
+			metrics: newVolumeMetricsVecs(prometheus.NewRegistry()),
+		}
+		err := vol.check("")
+		if trial.err == "" {
+			c.Check(err, check.IsNil)
+		} else {
+			c.Check(err, check.ErrorMatches, trial.err)
+		}
+	}
+}
+
 func (s *StubbedS3AWSSuite) TestIAMRoleCredentials(c *check.C) {
 	s.metadata = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		upd := time.Now().UTC().Add(-time.Hour).Format(time.RFC3339)
@@ -201,6 +995,481 @@ func (s *StubbedS3AWSSuite) TestIAMRoleCredentials(c *check.C) {
 	c.Check(err, check.ErrorMatches, `(?s).*404.*`)
 }
 
+func (s *StubbedS3AWSSuite) TestIAMMetadataEndpoint(c *check.C) {
+	var mtx sync.Mutex
+	var reqs []string
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		reqs = append(reqs, r.Method+" "+r.URL.Path)
+		mtx.Unlock()
+		if r.Method == "PUT" && r.URL.Path == "/latest/api/token" {
+			c.Check(r.Header.Get("X-Aws-Ec2-Metadata-Token-Ttl-Seconds"), check.Not(check.Equals), "")
+			io.WriteString(w, "session-token")
+			return
+		}
+		if r.Method != "GET" || r.Header.Get("X-Aws-Ec2-Metadata-Token") != "session-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/latest/meta-data/iam/security-credentials/":
+			io.WriteString(w, "test-role\n")
+		case "/latest/meta-data/iam/security-credentials/test-role":
+			upd := time.Now().UTC().Add(-time.Hour).Format(time.RFC3339)
+			exp := time.Now().UTC().Add(time.Hour).Format(time.RFC3339)
+			io.WriteString(w, `{"Code":"Success","LastUpdated":"`+upd+`","Type":"AWS-HMAC","AccessKeyId":"ASIAIMDSV2EXAMPLE","SecretAccessKey":"wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY","Token":"token","Expiration":"`+exp+`"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer metadata.Close()
+
+	v := &S3AWSVolume{
+		S3VolumeDriverParameters: arvados.S3VolumeDriverParameters{
+			Endpoint:            "http://localhost:12345",
+			Region:              "test-region-1",
+			Bucket:              "test-bucket-name",
+			IAMMetadataEndpoint: metadata.URL,
+		},
+		cluster: s.cluster,
+		logger:  ctxlog.TestLogger(c),
+		metrics: newVolumeMetricsVecs(prometheus.NewRegistry()),
+	}
+	err := v.check("")
+	c.Assert(err, check.IsNil)
+	creds, err := v.bucket.svc.Client.Config.Credentials.Retrieve(context.Background())
+	c.Check(err, check.IsNil)
+	c.Check(creds.AccessKeyID, check.Equals, "ASIAIMDSV2EXAMPLE")
+	c.Check(creds.SessionToken, check.Equals, "token")
+	c.Check(reqs, check.DeepEquals, []string{
+		"PUT /latest/api/token",
+		"GET /latest/meta-data/iam/security-credentials/",
+		"GET /latest/meta-data/iam/security-credentials/test-role",
+	})
+}
+
+func (s *StubbedS3AWSSuite) TestWebIdentityCredentials(c *check.C) {
+	var mtx sync.Mutex
+	var reqs []url.Values
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		mtx.Lock()
+		reqs = append(reqs, r.Form)
+		mtx.Unlock()
+		exp := time.Now().UTC().Add(time.Hour).Format(time.RFC3339)
+		w.Header().Set("Content-Type", "text/xml")
+		io.WriteString(w, `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/"><AssumeRoleWithWebIdentityResult><Credentials><AccessKeyId>ASIAWEBIDENTITYEXAMPLE</AccessKeyId><SecretAccessKey>wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY</SecretAccessKey><SessionToken>token</SessionToken><Expiration>`+exp+`</Expiration></Credentials></AssumeRoleWithWebIdentityResult></AssumeRoleWithWebIdentityResponse>`)
+	}))
+	defer sts.Close()
+	getReqs := func() []url.Values {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return append([]url.Values(nil), reqs...)
+	}
+	resetReqs := func() {
+		mtx.Lock()
+		defer mtx.Unlock()
+		reqs = nil
+	}
+
+	tokenFile := c.MkDir() + "/token"
+	c.Assert(ioutil.WriteFile(tokenFile, []byte("test-web-identity-token\n"), 0600), check.IsNil)
+	for _, env := range []string{"AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_ROLE_ARN", "AWS_ROLE_SESSION_NAME"} {
+		defer os.Setenv(env, os.Getenv(env))
+	}
+	os.Setenv("AWS_ROLE_SESSION_NAME", "test-session")
+
+	newVolume := func(webIdentity bool) *S3AWSVolume {
+		return &S3AWSVolume{
+			S3VolumeDriverParameters: arvados.S3VolumeDriverParameters{
+				Endpoint:    "http://localhost:12345",
+				Region:      "test-region-1",
+				Bucket:      "test-bucket-name",
+				WebIdentity: webIdentity,
+			},
+			cluster:     s.cluster,
+			logger:      ctxlog.TestLogger(c),
+			metrics:     newVolumeMetricsVecs(prometheus.NewRegistry()),
+			stsEndpoint: sts.URL,
+		}
+	}
+
+	// Forced mode without the environment variables fails.
+	os.Unsetenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	os.Unsetenv("AWS_ROLE_ARN")
+	err := newVolume(true).check("")
+	c.Check(err, check.ErrorMatches, `.*WebIdentity requires AWS_WEB_IDENTITY_TOKEN_FILE and AWS_ROLE_ARN.*`)
+
+	os.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", tokenFile)
+	os.Setenv("AWS_ROLE_ARN", "arn:aws:iam::123456789012:role/keepstore")
+	for _, webIdentity := range []bool{true, false} {
+		c.Logf("WebIdentity: %v", webIdentity)
+		resetReqs()
+		v := newVolume(webIdentity)
+		c.Assert(v.check(""), check.IsNil)
+		creds, err := v.bucket.svc.Client.Config.Credentials.Retrieve(context.Background())
+		c.Check(err, check.IsNil)
+		c.Check(creds.AccessKeyID, check.Equals, "ASIAWEBIDENTITYEXAMPLE")
+		c.Check(creds.SessionToken, check.Equals, "token")
+		if reqs := getReqs(); c.Check(reqs, check.HasLen, 1) {
+			c.Check(reqs[0].Get("Action"), check.Equals, "AssumeRoleWithWebIdentity")
+			c.Check(reqs[0].Get("RoleArn"), check.Equals, "arn:aws:iam::123456789012:role/keepstore")
+			c.Check(reqs[0].Get("RoleSessionName"), check.Equals, "test-session")
+			c.Check(reqs[0].Get("WebIdentityToken"), check.Equals, "test-web-identity-token")
+		}
+
+		// Cached credentials are reused until invalidated.
+		_, err = v.bucket.svc.Client.Config.Credentials.Retrieve(context.Background())
+		c.Check(err, check.IsNil)
+		c.Check(getReqs(), check.HasLen, 1)
+		v.bucket.invalidateCredentials()
+		_, err = v.bucket.svc.Client.Config.Credentials.Retrieve(context.Background())
+		c.Check(err, check.IsNil)
+		c.Check(getReqs(), check.HasLen, 2)
+	}
+
+	// Static keys take precedence unless WebIdentity is forced.
+	resetReqs()
+	v := newVolume(false)
+	v.AccessKeyID = "AKIASTATICEXAMPLE"
+	v.SecretAccessKey = "xxx"
+	c.Assert(v.check(""), check.IsNil)
+	creds, err := v.bucket.svc.Client.Config.Credentials.Retrieve(context.Background())
+	c.Check(err, check.IsNil)
+	c.Check(creds.AccessKeyID, check.Equals, "AKIASTATICEXAMPLE")
+	c.Check(getReqs(), check.HasLen, 0)
+	v.WebIdentity = true
+	c.Check(v.check(""), check.ErrorMatches, `.*WebIdentity cannot be combined with AccessKeyID or IAMRole`)
+}
+
+func (s *StubbedS3AWSSuite) TestIAMRoleCredentialsExpired(c *check.C) {
+	// Each time the S3 stub rejects a request with ExpiredToken,
+	// the metadata server starts issuing a new access key.
+	var generation int32
+	s.metadata = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upd := time.Now().UTC().Add(-time.Hour).Format(time.RFC3339)
+		exp := time.Now().UTC().Add(time.Hour).Format(time.RFC3339)
+		key := fmt.Sprintf("ASIAIOSFODNN7EXAMPL%d", atomic.LoadInt32(&generation))
+		io.WriteString(w, `{"Code":"Success","LastUpdated":"`+upd+`","Type":"AWS-HMAC","AccessKeyId":"`+key+`","SecretAccessKey":"wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY","Token":"token","Expiration":"`+exp+`"}`)
+	}))
+	defer s.metadata.Close()
+
+	// expireKeys is the number of access key generations the S3
+	// stub considers expired.
+	var expireKeys int32
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gen := atomic.LoadInt32(&generation)
+		if gen < atomic.LoadInt32(&expireKeys) && strings.Contains(r.Header.Get("Authorization"), fmt.Sprintf("Credential=ASIAIOSFODNN7EXAMPL%d/", gen)) {
+			atomic.AddInt32(&generation, 1)
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>ExpiredToken</Code><Message>The provided token has expired.</Message></Error>`)
+			return
+		}
+		if r.Method == "HEAD" {
+			w.Header().Set("Last-Modified", time.Now().UTC().Format(nearlyRFC1123))
+		}
+	}))
+	defer stub.Close()
+
+	v := &S3AWSVolume{
+		S3VolumeDriverParameters: arvados.S3VolumeDriverParameters{
+			IAMRole:  s.metadata.URL + "/latest/api/token",
+			Endpoint: stub.URL,
+			Region:   "test-region-1",
+			Bucket:   "test-bucket-name",
+		},
+		cluster: s.cluster,
+		logger:  ctxlog.TestLogger(c),
+		metrics: newVolumeMetricsVecs(prometheus.NewRegistry()),
+	}
+	err := v.check(s.metadata.URL + "/latest")
+	c.Assert(err, check.IsNil)
+	v.bucket.svc.ForcePathStyle = true
+
+	loc := "acbd18db4cc2f85cedef654fccc4a4d8"
+
+	// First key is expired: refresh and retry succeeds.
+	atomic.StoreInt32(&expireKeys, 1)
+	err = v.Put(context.Background(), loc, []byte("foo"))
+	c.Check(err, check.IsNil)
+	c.Check(atomic.LoadInt32(&generation), check.Equals, int32(1))
+	_, err = v.Mtime(loc)
+	c.Check(err, check.IsNil)
+	c.Check(v.bucket.stats.CredentialsExpiredErrs, check.Equals, uint64(0))
+
+	// Next two keys are expired: refresh doesn't help. (This
+	// uses Put rather than Mtime because S3 can't send an error
+	// code in the response to a HEAD request.)
+	atomic.StoreInt32(&expireKeys, 3)
+	err = v.Put(context.Background(), loc, []byte("foo"))
+	c.Check(err, check.FitsTypeOf, S3CredentialsExpiredError{})
+	c.Check(err, check.ErrorMatches, `(?s)S3 credentials expired: .*ExpiredToken.*`)
+	c.Check(atomic.LoadInt32(&generation), check.Equals, int32(3))
+	c.Check(v.bucket.stats.CredentialsExpiredErrs, check.Equals, uint64(1))
+}
+
+func (s *StubbedS3AWSSuite) TestRetryThrottled(c *check.C) {
+	defer func(d time.Duration) { s3RetryBaseDelay = d }(s3RetryBaseDelay)
+	s3RetryBaseDelay = time.Millisecond
+
+	slowDown := awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate.", nil), http.StatusServiceUnavailable, "reqid")
+	v := &S3AWSVolume{
+		S3VolumeDriverParameters: arvados.S3VolumeDriverParameters{MaxRetries: 3},
+		logger:                   ctxlog.TestLogger(c),
+		bucket:                   &s3AWSbucket{},
+	}
+
+	// Throttled twice, then succeeds.
+	calls := 0
+	err := v.retryThrottled(context.Background(), func() error {
+		calls++
+		if calls <= 2 {
+			return slowDown
+		}
+		return nil
+	})
+	c.Check(err, check.IsNil)
+	c.Check(calls, check.Equals, 3)
+	c.Check(v.bucket.stats.ThrottledRetries, check.Equals, uint64(2))
+
+	// Throttled every time: give up after MaxRetries retries.
+	calls = 0
+	err = v.retryThrottled(context.Background(), func() error {
+		calls++
+		return slowDown
+	})
+	c.Check(err, check.Equals, slowDown)
+	c.Check(calls, check.Equals, 4)
+	c.Check(v.bucket.stats.ThrottledRetries, check.Equals, uint64(5))
+
+	// Other errors are not retried.
+	calls = 0
+	err = v.retryThrottled(context.Background(), func() error {
+		calls++
+		return os.ErrNotExist
+	})
+	c.Check(err, check.Equals, os.ErrNotExist)
+	c.Check(calls, check.Equals, 1)
+
+	// Context is cancelled while waiting to retry.
+	s3RetryBaseDelay = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	calls = 0
+	err = v.retryThrottled(ctx, func() error {
+		calls++
+		cancel()
+		return slowDown
+	})
+	c.Check(err, check.Equals, context.Canceled)
+	c.Check(calls, check.Equals, 1)
+
+	// MaxRetries=0 disables retries.
+	v.MaxRetries = 0
+	calls = 0
+	err = v.retryThrottled(context.Background(), func() error {
+		calls++
+		return slowDown
+	})
+	c.Check(err, check.Equals, slowDown)
+	c.Check(calls, check.Equals, 1)
+}
+
+// s3AWSEventualHandler passes requests through to a fake S3 server,
+// except that the first HEAD request for a data object (i.e., not a
+// recent/* or trash/* object) responds 404, as if a just-written
+// object were not yet visible.
+type s3AWSEventualHandler struct {
+	next  http.Handler
+	mtx   sync.Mutex
+	heads int
+	puts  int
+}
+
+func (h *s3AWSEventualHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.Contains(r.URL.Path, "/recent/") || strings.Contains(r.URL.Path, "/trash/") {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	h.mtx.Lock()
+	switch r.Method {
+	case http.MethodHead:
+		h.heads++
+		if h.heads == 1 {
+			h.mtx.Unlock()
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	case http.MethodPut:
+		h.puts++
+	}
+	h.mtx.Unlock()
+	h.next.ServeHTTP(w, r)
+}
+
+func (s *StubbedS3AWSSuite) TestReadAfterWriteCheck(c *check.C) {
+	defer func(d time.Duration) { s3RetryBaseDelay = d }(s3RetryBaseDelay)
+	s3RetryBaseDelay = time.Millisecond
+
+	handler := &s3AWSEventualHandler{
+		next: gofakes3.New(s3mem.New(), gofakes3.WithLogger(nil), gofakes3.WithTimeSkewLimit(0)).Server(),
+	}
+	s.s3server = httptest.NewServer(handler)
+	defer func() {
+		s.s3server.Close()
+		s.s3server = nil
+	}()
+	v := s.newTestableVolume(c, s.cluster, arvados.Volume{Replication: 2}, newVolumeMetricsVecs(prometheus.NewRegistry()), 5*time.Minute)
+	// Don't count the requests used to set up the volume.
+	handler.heads, handler.puts = 0, 0
+	loc := "acbd18db4cc2f85cedef654fccc4a4d8"
+
+	// Check disabled (default): no HEAD requests.
+	err := v.Put(context.Background(), loc, []byte("foo"))
+	c.Check(err, check.IsNil)
+	c.Check(handler.heads, check.Equals, 0)
+	c.Check(handler.puts, check.Equals, 1)
+
+	// Check enabled: the first HEAD says the object is missing,
+	// so it is uploaded again, and the second HEAD finds it.
+	v.ReadAfterWriteCheck = true
+	handler.puts = 0
+	err = v.Put(context.Background(), loc, []byte("foo"))
+	c.Check(err, check.IsNil)
+	c.Check(handler.heads, check.Equals, 2)
+	c.Check(handler.puts, check.Equals, 2)
+
+	buf := make([]byte, 3)
+	n, err := v.Get(context.Background(), loc, buf)
+	c.Check(err, check.IsNil)
+	c.Check(string(buf[:n]), check.Equals, "foo")
+}
+
+func (s *StubbedS3AWSSuite) TestIsThrottled(c *check.C) {
+	for _, trial := range []struct {
+		err    error
+		expect bool
+	}{
+		{nil, false},
+		{os.ErrNotExist, false},
+		{awserr.New("SlowDown", "", nil), true},
+		{awserr.New("RequestLimitExceeded", "", nil), true},
+		{awserr.New("NoSuchKey", "", nil), false},
+		{awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "", nil), http.StatusServiceUnavailable, ""), true},
+		{awserr.NewRequestFailure(awserr.New("Unknown", "", nil), http.StatusTooManyRequests, ""), true},
+		{awserr.NewRequestFailure(awserr.New("AccessDenied", "", nil), http.StatusForbidden, ""), false},
+		{awserr.New("MultipartUpload", "upload multipart failed", awserr.New("SlowDown", "", nil)), true},
+	} {
+		c.Check(isThrottled(trial.err), check.Equals, trial.expect, check.Commentf("%v", trial.err))
+	}
+}
+
+// s3AWSThrottleHandler passes requests through to a fake S3 server,
+// except that it rejects the next N multipart upload part requests
+// with a SlowDown error, where N is the value of throttle.
+type s3AWSThrottleHandler struct {
+	next     http.Handler
+	throttle int32
+}
+
+func (h *s3AWSThrottleHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut && r.URL.Query().Get("partNumber") != "" && atomic.AddInt32(&h.throttle, -1) >= 0 {
+		io.Copy(io.Discard, r.Body)
+		// S3 sends SlowDown with status 503, but then the
+		// SDK would retry the part by itself, and the
+		// error would never reach s3manager.
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message></Error>`)
+		return
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+func (s *StubbedS3AWSSuite) TestRetryThrottledMultipart(c *check.C) {
+	defer func(d time.Duration) { s3RetryBaseDelay = d }(s3RetryBaseDelay)
+	s3RetryBaseDelay = time.Millisecond
+
+	handler := &s3AWSThrottleHandler{
+		next: gofakes3.New(s3mem.New(), gofakes3.WithLogger(nil), gofakes3.WithTimeSkewLimit(0)).Server(),
+	}
+	s.s3server = httptest.NewServer(handler)
+	defer func() {
+		s.s3server.Close()
+		s.s3server = nil
+	}()
+	v := s.newTestableVolume(c, s.cluster, arvados.Volume{Replication: 2}, newVolumeMetricsVecs(prometheus.NewRegistry()), 5*time.Minute)
+	v.MaxRetries = 2
+	ctx := context.Background()
+	data := make([]byte, PartSize+1)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	loc := fmt.Sprintf("%x", md5.Sum(data))
+
+	// s3manager wraps the error from the failed part in its own
+	// awserr.Error. isThrottled must look inside it.
+	atomic.StoreInt32(&handler.throttle, 1)
+	err := v.uploadObject(ctx, loc, data, "")
+	aerr, ok := err.(awserr.Error)
+	c.Assert(ok, check.Equals, true, check.Commentf("%T %v", err, err))
+	c.Check(aerr.Code(), check.Not(check.Equals), "SlowDown")
+	orig, ok := s3OrigErr(aerr).(awserr.Error)
+	c.Assert(ok, check.Equals, true, check.Commentf("%T %v", s3OrigErr(aerr), s3OrigErr(aerr)))
+	c.Check(orig.Code(), check.Equals, "SlowDown")
+	c.Check(isThrottled(err), check.Equals, true)
+
+	// Put retries the whole upload.
+	atomic.StoreInt32(&handler.throttle, 1)
+	c.Check(v.Put(ctx, loc, data), check.IsNil)
+	c.Check(v.bucket.stats.ThrottledRetries, check.Equals, uint64(1))
+	buf := make([]byte, BlockSize)
+	n, err := v.Get(ctx, loc, buf)
+	c.Check(err, check.IsNil)
+	c.Check(bytes.Equal(buf[:n], data), check.Equals, true)
+}
+
+func (s *StubbedS3AWSSuite) TestCompareETag(c *check.C) {
+	v := s.newTestableVolume(c, s.cluster, arvados.Volume{Replication: 2}, newVolumeMetricsVecs(prometheus.NewRegistry()), 5*time.Minute)
+	ctx := context.Background()
+	getOps := func() uint64 { return atomic.LoadUint64(&v.bucket.stats.GetOps) }
+
+	// Single-part upload: ETag is the MD5, so Compare doesn't
+	// need to download the data.
+	loc := "acbd18db4cc2f85cedef654fccc4a4d8"
+	c.Assert(v.Put(ctx, loc, []byte("foo")), check.IsNil)
+	c.Check(v.Compare(ctx, loc, []byte("foo")), check.IsNil)
+	c.Check(getOps(), check.Equals, uint64(0))
+
+	// Data that doesn't match the locator is still compared
+	// byte by byte.
+	c.Check(v.Compare(ctx, loc, []byte("bar")), check.NotNil)
+	c.Check(getOps(), check.Equals, uint64(1))
+}
+
+func (s *StubbedS3AWSSuite) TestInvalidLocator(c *check.C) {
+	v := s.newTestableVolume(c, s.cluster, arvados.Volume{Replication: 2}, newVolumeMetricsVecs(prometheus.NewRegistry()), 5*time.Minute)
+	ctx := context.Background()
+	for _, loc := range []string{"", "acb/d18db4cc2f85cedef654fccc4a4d8", "../acbd18db4cc2f85cedef654fccc4a4d8"} {
+		c.Logf("loc %q", loc)
+		checkErr := func(err error) {
+			if c.Check(err, check.FitsTypeOf, &KeepError{}) {
+				c.Check(err.(*KeepError).HTTPCode, check.Equals, 400)
+			}
+			c.Check(err, check.ErrorMatches, `invalid locator .*`)
+		}
+		checkErr(v.Put(ctx, loc, []byte("foo")))
+		_, err := v.Get(ctx, loc, make([]byte, 3))
+		checkErr(err)
+		checkErr(v.Compare(ctx, loc, []byte("foo")))
+		_, err = v.Mtime(loc)
+		checkErr(err)
+		checkErr(v.Touch(loc))
+		checkErr(v.Trash(loc))
+		checkErr(v.Untrash(loc))
+	}
+	c.Check(atomic.LoadUint64(&v.bucket.stats.PutOps), check.Equals, uint64(0))
+	c.Check(atomic.LoadUint64(&v.bucket.stats.HeadOps), check.Equals, uint64(0))
+}
+
 func (s *StubbedS3AWSSuite) TestStats(c *check.C) {
 	v := s.newTestableVolume(c, s.cluster, arvados.Volume{Replication: 2}, newVolumeMetricsVecs(prometheus.NewRegistry()), 5*time.Minute)
 	stats := func() string {
@@ -230,6 +1499,132 @@ func (s *StubbedS3AWSSuite) TestStats(c *check.C) {
 	c.Check(stats(), check.Matches, `.*"InBytes":6,.*`)
 }
 
+func (s *StubbedS3AWSSuite) TestLatencyMetrics(c *check.C) {
+	metrics := newVolumeMetricsVecs(prometheus.NewRegistry())
+	v := s.newTestableVolume(c, s.cluster, arvados.Volume{Replication: 2}, metrics, 5*time.Minute)
+	ctx := context.Background()
+	loc := "acbd18db4cc2f85cedef654fccc4a4d8"
+
+	c.Assert(v.Put(ctx, loc, []byte("foo")), check.IsNil)
+	_, err := v.Get(ctx, loc, make([]byte, 3))
+	c.Check(err, check.IsNil)
+	_, err = v.Mtime(loc)
+	c.Check(err, check.IsNil)
+	c.Check(v.IndexTo("", io.Discard), check.IsNil)
+	c.Check(v.bucket.Del(v.key(loc)), check.IsNil)
+
+	latency := metrics.getLatencyVecFor(prometheus.Labels{"device_id": v.GetDeviceID()})
+	for _, op := range []string{"put", "get", "head", "list", "delete"} {
+		obs, err := latency.GetMetricWith(prometheus.Labels{"operation": op})
+		c.Assert(err, check.IsNil)
+		pb := &dto.Metric{}
+		c.Check(obs.(prometheus.Metric).Write(pb), check.IsNil)
+		c.Check(pb.GetHistogram().GetSampleCount() > 0, check.Equals, true, check.Commentf("operation %q", op))
+	}
+}
+
+func (s *StubbedS3AWSSuite) TestRequestTimeout(c *check.C) {
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Never respond (until the client gives up). The
+		// request body must be consumed first, otherwise the
+		// server doesn't notice the client disconnecting.
+		io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+	}))
+	defer stub.Close()
+
+	v := s.newStubVolume(c, stub.URL, arvados.S3VolumeDriverParameters{RequestTimeout: arvados.Duration(100 * time.Millisecond)})
+
+	ctx := context.Background()
+	loc := "acbd18db4cc2f85cedef654fccc4a4d8"
+	checkTimeout := func(err error) {
+		c.Check(err, check.FitsTypeOf, S3RequestTimeoutError{})
+		c.Check(err, check.ErrorMatches, `S3 request did not complete within RequestTimeout \(100ms\)`)
+	}
+	t0 := time.Now()
+	_, err := v.Get(ctx, loc, make([]byte, 3))
+	checkTimeout(err)
+	checkTimeout(v.Compare(ctx, loc, []byte("foo")))
+	checkTimeout(v.Put(ctx, loc, []byte("foo")))
+	_, err = v.Mtime(loc)
+	checkTimeout(err)
+	c.Check(time.Since(t0) < 10*time.Second, check.Equals, true)
+
+	// Cancelling the caller's context is still reported as
+	// context.Canceled.
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	v.bucket.requestTimeout = time.Minute
+	_, err = v.Get(ctx, loc, make([]byte, 3))
+	c.Check(err, check.Equals, context.Canceled)
+}
+
+func (s *StubbedS3AWSSuite) TestRequestTimeoutInvalid(c *check.C) {
+	vol := S3AWSVolume{
+		S3VolumeDriverParameters: arvados.S3VolumeDriverParameters{
+			Endpoint:       "http://localhost:12345",
+			Bucket:         "test-bucket-name",
+			RequestTimeout: arvados.Duration(-time.Second),
+		},
+		cluster: s.cluster,
+		logger:  ctxlog.TestLogger(c),
+		metrics: newVolumeMetricsVecs(prometheus.NewRegistry()),
+	}
+	err := vol.check("")
+	c.Check(err, check.ErrorMatches, `.*RequestTimeout must not be negative`)
+}
+
+func (s *StubbedS3AWSSuite) TestReadOnlyNoRequests(c *check.C) {
+	var requests int32
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		c.Errorf("unexpected request to read-only volume: %s %s", r.Method, r.URL)
+		<-r.Context().Done()
+	}))
+	defer stub.Close()
+
+	v := s.newStubVolume(c, stub.URL, arvados.S3VolumeDriverParameters{RequestTimeout: arvados.Duration(time.Second)})
+	v.volume = arvados.Volume{ReadOnly: true}
+
+	loc := "acbd18db4cc2f85cedef654fccc4a4d8"
+	c.Check(v.Put(context.Background(), loc, []byte("foo")), check.Equals, MethodDisabledError)
+	c.Check(v.Touch(loc), check.Equals, MethodDisabledError)
+	c.Check(v.Trash(loc), check.Equals, MethodDisabledError)
+	c.Check(v.Untrash(loc), check.Equals, MethodDisabledError)
+	c.Check(atomic.LoadInt32(&requests), check.Equals, int32(0))
+}
+
+func (s *StubbedS3AWSSuite) TestReadOnlyMtimeNoMigration(c *check.C) {
+	v := s.newTestableVolume(c, s.cluster, arvados.Volume{Replication: 2}, newVolumeMetricsVecs(prometheus.NewRegistry()), 0)
+	loc := "acbd18db4cc2f85cedef654fccc4a4d8"
+	key := v.key(loc)
+	// Store a data object without a recent/X marker, as if it
+	// had been written by an old version of keepstore.
+	_, err := s3manager.NewUploaderWithClient(v.bucket.svc).Upload(&s3manager.UploadInput{
+		Bucket: aws.String(v.bucket.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader([]byte("foo")),
+	})
+	c.Assert(err, check.IsNil)
+
+	v.volume.ReadOnly = true
+	t, err := v.Mtime(loc)
+	c.Check(err, check.IsNil)
+	c.Check(t.IsZero(), check.Equals, false)
+	_, err = v.head(v.RecentPrefix + key)
+	c.Check(os.IsNotExist(v.translateError(err)), check.Equals, true)
+
+	// A writable volume creates the marker.
+	v.volume.ReadOnly = false
+	_, err = v.Mtime(loc)
+	c.Check(err, check.IsNil)
+	_, err = v.head(v.RecentPrefix + key)
+	c.Check(err, check.IsNil)
+}
+
 type s3AWSBlockingHandler struct {
 	requested chan *http.Request
 	unblock   chan struct{}
@@ -319,6 +1714,107 @@ func (s *StubbedS3AWSSuite) testContextCancel(c *check.C, testFunc func(context.
 	}
 }
 
+func (s *StubbedS3AWSSuite) TestEmptyTrashBatch(c *check.C) {
+	s.cluster.Collections.BlobTrashLifetime.Set("1h")
+	s.cluster.Collections.BlobSigningTTL.Set("1h")
+	v := s.newTestableVolume(c, s.cluster, arvados.Volume{Replication: 2}, newVolumeMetricsVecs(prometheus.NewRegistry()), 5*time.Minute)
+
+	t0 := time.Now()
+	putS3Obj := func(t time.Time, key string, data []byte) {
+		v.serverClock.now = &t
+		uploader := s3manager.NewUploaderWithClient(v.bucket.svc)
+		_, err := uploader.UploadWithContext(context.Background(), &s3manager.UploadInput{
+			Bucket: aws.String(v.bucket.bucket),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader(data),
+		})
+		c.Assert(err, check.IsNil)
+		v.serverClock.now = nil
+	}
+
+	// Trash objects that are eligible for deletion: trashed 2h
+	// ago (> BlobTrashLifetime), long after they were last
+	// touched (no race).
+	const n = 150
+	var locs []string
+	for i := 0; i < n; i++ {
+		blk := []byte(fmt.Sprintf("TestEmptyTrashBatch %d", i))
+		loc := fmt.Sprintf("%x", md5.Sum(blk))
+		locs = append(locs, loc)
+		putS3Obj(t0.Add(-12*time.Hour), v.RecentPrefix+loc, nil)
+		putS3Obj(t0.Add(-2*time.Hour), v.TrashPrefix+loc, blk)
+	}
+
+	delOps := v.bucket.stats.DelOps
+	v.EmptyTrash()
+	// One DeleteObjects request for the trash objects, and one
+	// for the recent/* markers.
+	c.Check(v.bucket.stats.DelOps-delOps, check.Equals, uint64(2))
+	for _, loc := range locs {
+		_, err := v.head(v.TrashPrefix + loc)
+		c.Check(os.IsNotExist(v.translateError(err)), check.Equals, true, check.Commentf("%s", loc))
+		_, err = v.head(v.RecentPrefix + loc)
+		c.Check(os.IsNotExist(v.translateError(err)), check.Equals, true, check.Commentf("%s", loc))
+	}
+}
+
+func (s *StubbedS3AWSSuite) TestEmptyTrashPageSize(c *check.C) {
+	s.cluster.Collections.BlobTrashLifetime.Set("1h")
+	s.cluster.Collections.BlobSigningTTL.Set("1h")
+	v := s.newTestableVolume(c, s.cluster, arvados.Volume{Replication: 2}, newVolumeMetricsVecs(prometheus.NewRegistry()), 5*time.Minute)
+	v.TrashPageSize = 4
+
+	t0 := time.Now()
+	putS3Obj := func(t time.Time, key string, data []byte) {
+		v.serverClock.now = &t
+		uploader := s3manager.NewUploaderWithClient(v.bucket.svc)
+		_, err := uploader.UploadWithContext(context.Background(), &s3manager.UploadInput{
+			Bucket: aws.String(v.bucket.bucket),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader(data),
+		})
+		c.Assert(err, check.IsNil)
+		v.serverClock.now = nil
+	}
+
+	// 10 trash objects eligible for deletion, and 5 that were
+	// trashed too recently.
+	var expired, fresh []string
+	for i := 0; i < 15; i++ {
+		blk := []byte(fmt.Sprintf("TestEmptyTrashPageSize %d", i))
+		loc := fmt.Sprintf("%x", md5.Sum(blk))
+		trashT := t0.Add(-2 * time.Hour)
+		if i < 10 {
+			expired = append(expired, loc)
+		} else {
+			fresh = append(fresh, loc)
+			trashT = t0.Add(-10 * time.Minute)
+		}
+		putS3Obj(t0.Add(-12*time.Hour), v.RecentPrefix+loc, nil)
+		putS3Obj(trashT, v.TrashPrefix+loc, blk)
+	}
+
+	listOps := v.bucket.stats.ListOps
+	v.EmptyTrash()
+	// 15 trash objects need 4 pages of 4.
+	c.Check(v.bucket.stats.ListOps-listOps >= 4, check.Equals, true, check.Commentf("ListOps %d", v.bucket.stats.ListOps-listOps))
+	for _, loc := range expired {
+		_, err := v.head(v.TrashPrefix + loc)
+		c.Check(os.IsNotExist(v.translateError(err)), check.Equals, true, check.Commentf("%s", loc))
+	}
+	for _, loc := range fresh {
+		_, err := v.head(v.TrashPrefix + loc)
+		c.Check(err, check.IsNil, check.Commentf("%s", loc))
+	}
+}
+
+func (s *StubbedS3AWSSuite) TestTrashPageSizeDefault(c *check.C) {
+	v := s.newTestableVolume(c, s.cluster, arvados.Volume{Replication: 2}, newVolumeMetricsVecs(prometheus.NewRegistry()), 0)
+	c.Check(v.TrashPageSize, check.Equals, v.IndexPageSize)
+	v.TrashPageSize = -1
+	c.Check(v.check(""), check.ErrorMatches, `.*TrashPageSize.*`)
+}
+
 func (s *StubbedS3AWSSuite) TestBackendStates(c *check.C) {
 	s.cluster.Collections.BlobTrashLifetime.Set("1h")
 	s.cluster.Collections.BlobSigningTTL.Set("1h")
@@ -446,9 +1942,21 @@ func (s *StubbedS3AWSSuite) TestBackendStates(c *check.C) {
 			false, false, false, true, true, true,
 		},
 	} {
-		for _, prefixLength := range []int{0, 3} {
+		for _, layout := range []struct {
+			prefixLength int
+			trashPrefix  string
+			recentPrefix string
+		}{
+			{0, "trash/", "recent/"},
+			{3, "trash/", "recent/"},
+			{0, "keep-trash/", "keep-recent/"},
+			{3, "keep-trash/", "keep-recent/"},
+		} {
+			prefixLength := layout.prefixLength
 			v.PrefixLength = prefixLength
-			c.Logf("Scenario: %q (prefixLength=%d)", scenario.label, prefixLength)
+			v.TrashPrefix = layout.trashPrefix
+			v.RecentPrefix = layout.recentPrefix
+			c.Logf("Scenario: %q (prefixLength=%d, trashPrefix=%q, recentPrefix=%q)", scenario.label, prefixLength, v.TrashPrefix, v.RecentPrefix)
 
 			// We have a few tests to run for each scenario, and
 			// the tests are expected to change state. By calling
@@ -467,8 +1975,8 @@ func (s *StubbedS3AWSSuite) TestBackendStates(c *check.C) {
 				}
 				c.Log("\t", loc, "\t", key)
 				putS3Obj(scenario.dataT, key, blk)
-				putS3Obj(scenario.recentT, "recent/"+key, nil)
-				putS3Obj(scenario.trashT, "trash/"+key, blk)
+				putS3Obj(scenario.recentT, v.RecentPrefix+key, nil)
+				putS3Obj(scenario.trashT, v.TrashPrefix+key, blk)
 				v.serverClock.now = &t0
 				return loc, blk
 			}
@@ -476,11 +1984,17 @@ func (s *StubbedS3AWSSuite) TestBackendStates(c *check.C) {
 			// Check canGet
 			loc, blk := setupScenario()
 			buf := make([]byte, len(blk))
+			raceRepairs := v.bucket.stats.RaceRepairs
 			_, err := v.Get(context.Background(), loc, buf)
 			c.Check(err == nil, check.Equals, scenario.canGet)
 			if err != nil {
 				c.Check(os.IsNotExist(err), check.Equals, true)
 			}
+			if scenario.canGet && scenario.dataT == none {
+				// Get can only succeed by untrashing
+				// the block.
+				c.Check(v.bucket.stats.RaceRepairs, check.Equals, raceRepairs+1)
+			}
 
 			// Call Trash, then check canTrash and canGetAfterTrash
 			loc, _ = setupScenario()
@@ -509,7 +2023,7 @@ func (s *StubbedS3AWSSuite) TestBackendStates(c *check.C) {
 			// freshAfterEmpty
 			loc, _ = setupScenario()
 			v.EmptyTrash()
-			_, err = v.head("trash/" + v.key(loc))
+			_, err = v.head(v.TrashPrefix + v.key(loc))
 			c.Check(err == nil, check.Equals, scenario.haveTrashAfterEmpty)
 			if scenario.freshAfterEmpty {
 				t, err := v.Mtime(loc)
@@ -628,7 +2142,7 @@ func (v *TestableS3AWSVolume) PutRaw(loc string, block []byte) {
 
 	_, err := uploader.Upload(&s3manager.UploadInput{
 		Bucket: aws.String(v.bucket.bucket),
-		Key:    aws.String(key),
+		Key:    aws.String(v.bucket.objectKey(key)),
 		Body:   r,
 	})
 	if err != nil {
@@ -638,11 +2152,11 @@ func (v *TestableS3AWSVolume) PutRaw(loc string, block []byte) {
 	empty := bytes.NewReader([]byte{})
 	_, err = uploader.Upload(&s3manager.UploadInput{
 		Bucket: aws.String(v.bucket.bucket),
-		Key:    aws.String("recent/" + key),
+		Key:    aws.String(v.bucket.objectKey(v.RecentPrefix + key)),
 		Body:   empty,
 	})
 	if err != nil {
-		v.logger.Printf("PutRaw: recent/%s: %+v", key, err)
+		v.logger.Printf("PutRaw: %s%s: %+v", v.RecentPrefix, key, err)
 	}
 }
 
@@ -656,7 +2170,7 @@ func (v *TestableS3AWSVolume) TouchWithDate(loc string, lastPut time.Time) {
 	empty := bytes.NewReader([]byte{})
 	_, err := uploader.UploadWithContext(context.Background(), &s3manager.UploadInput{
 		Bucket: aws.String(v.bucket.bucket),
-		Key:    aws.String("recent/" + v.key(loc)),
+		Key:    aws.String(v.bucket.objectKey(v.RecentPrefix + v.key(loc))),
 		Body:   empty,
 	})
 	if err != nil {
@@ -7,6 +7,7 @@ package keepstore
 import (
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -22,6 +23,7 @@ type statsTicker struct {
 	opsCounters *prometheus.CounterVec
 	errCounters *prometheus.CounterVec
 	ioBytes     *prometheus.CounterVec
+	opsLatency  prometheus.ObserverVec
 }
 
 // Tick increments each of the given counters by 1 using
@@ -77,3 +79,12 @@ func (s *statsTicker) TickOps(operations ...string) {
 		s.opsCounters.With(prometheus.Labels{"operation": opType}).Inc()
 	}
 }
+
+// TickLatency records the time elapsed since t0 as the latency of
+// the given operation.
+func (s *statsTicker) TickLatency(operation string, t0 time.Time) {
+	if s.opsLatency == nil {
+		return
+	}
+	s.opsLatency.With(prometheus.Labels{"operation": operation}).Observe(time.Since(t0).Seconds())
+}
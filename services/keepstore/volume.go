@@ -420,6 +420,21 @@ func (vm *RRVolumeManager) VolumeStats(v Volume) *ioStats {
 func (vm *RRVolumeManager) Close() {
 }
 
+// VolumeHealth describes the result of a volume's most recent check
+// that its backend is reachable.
+type VolumeHealth struct {
+	LastCheck   time.Time // time of the most recent check
+	LastSuccess time.Time // time of the most recent successful check, zero if none
+	LastError   error     // error from the most recent check, nil if it succeeded
+}
+
+// A healthChecker is a Volume that can check whether its backend is
+// reachable. Health should return quickly and should not contact the
+// backend every time it is called.
+type healthChecker interface {
+	Health() VolumeHealth
+}
+
 // VolumeStatus describes the current condition of a volume
 type VolumeStatus struct {
 	MountPoint string